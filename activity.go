@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+// onchainSource prefixes the IDs of activity synced from the blockchain
+const onchainSource = "onchain"
+
+// activity represents a single change to one of a user's holdings, regardless of where it was recorded
+type activity struct {
+	ID        string // unique across sources, e.g. "onchain:<txn hash>:<address>"
+	Ref       string // what the change is part of, e.g. the txn hash shared by every address a transaction touched
+	Wallet    string // the address (or account) the change happened in
+	Asset     string
+	Time      time.Time
+	Quantity  float64 // signed, in native units (> 0 is inbound)
+	Fee       float64 // the network/exchange fee of the transaction (included in Quantity if paid from this wallet)
+	Price     float64 // per unit in Currency (0 if unknown)
+	Currency  string
+	AmountUSD float64 // the amount transfer detection matches on
+}
+
+// querier is implemented by both read-only and read-write Spanner transactions
+type querier interface {
+	Query(ctx context.Context, statement spanner.Statement) *spanner.RowIterator
+}
+
+// onchainActivityID returns the activity ID of the provided address' side of a transaction
+func onchainActivityID(txnHash, addr string) string {
+	return fmt.Sprintf("%s:%s:%s", onchainSource, txnHash, addr)
+}
+
+// parseOnchainActivityID returns the transaction hash & address of an on-chain activity ID (false if it's from another source)
+func parseOnchainActivityID(id string) (string, string, bool) {
+	parts := strings.Split(id, ":")
+	if len(parts) != 3 || parts[0] != onchainSource {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+// onchain reports whether the activity was synced from the blockchain
+func (a *activity) onchain() bool {
+	_, _, ok := parseOnchainActivityID(a.ID)
+	return ok
+}
+
+// customTxn converts the activity to the shape detectTransfers() matches on
+func (a *activity) customTxn() *CustomTxn {
+	flow := directionIn
+	if a.Quantity < 0 {
+		flow = directionOut
+	}
+
+	return &CustomTxn{
+		TxnID:        a.ID,
+		WalletID:     a.Wallet,
+		TxnTimestamp: a.Time,
+		TxnFlow:      flow,
+		AmountUSD:    a.AmountUSD,
+		Asset:        a.Asset,
+	}
+}
+
+// readUserActivity reads everything that changed the provided user's holdings (synced, imported and entered by hand), in time order
+func readUserActivity(ctx context.Context, txn querier, user *UsersRecord) ([]*activity, error) {
+	stmt := spanner.NewStatement(`
+		SELECT txn_hash, public_key, txn_timestamp, amount, COALESCE(native_fee, 0) AS native_fee, COALESCE(balance_change, 0) AS balance_change,
+			COALESCE(price, 0) AS price, COALESCE(price_currency, 'USD') AS price_currency
+		FROM transactions
+		WHERE public_key IN UNNEST(@addresses)
+		ORDER BY txn_timestamp
+	`)
+	stmt.Params["addresses"] = user.AddressList()
+
+	acts := []*activity{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec TransactionsRecord
+		if err := row.ToStructLenient(&rec); err != nil {
+			return err
+		}
+
+		acts = append(acts, &activity{
+			ID:        onchainActivityID(rec.TxnHash, rec.PublicKey),
+			Ref:       rec.TxnHash,
+			Wallet:    rec.PublicKey,
+			Asset:     btcAsset,
+			Time:      rec.TxnTimestamp,
+			Quantity:  float64(rec.BalanceChange) / satoshisPerBTC,
+			Fee:       float64(rec.NativeFee) / satoshisPerBTC,
+			Price:     rec.Price,
+			Currency:  rec.PriceCurrency,
+			AmountUSD: rec.Amount,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := readImportedActivity(ctx, txn, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	manual, err := readManualActivity(ctx, txn, user.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	acts = append(acts, imported...)
+	acts = append(acts, manual...)
+	sort.SliceStable(acts, func(i, j int) bool {
+		return acts[i].Time.Before(acts[j].Time)
+	})
+
+	return acts, nil
+}
+
+// activityPrice returns the activity's price per unit in the provided currency: as recorded if it's already in that
+// currency, otherwise from our price history (0 if we don't have one)
+func activityPrice(ctx context.Context, p prices.Provider, a *activity, currency string) (float64, error) {
+	if a.Currency == currency && a.Price > 0 {
+		return a.Price, nil
+	}
+
+	quote, err := p.Price(ctx, a.Asset, currency, a.Time)
+	if errors.Is(err, prices.ErrNoPrice) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return quote.Price, nil
+}
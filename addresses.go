@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxDeletableTransactions is the most transactions an address can have to be deleted: deleteAddress removes them all
+// in a single commit, which Spanner caps at 20,000 mutations (counting each index a row is in)
+const maxDeletableTransactions = 5000
+
+// addressColumns lists the columns read into an AddressesRecord (see decodeAddress)
+var addressColumns = []string{"public_key", "balance", "native_balance", "created_at", "updated_at", "last_txn_hash", "archived_at"}
+
+// decodeAddress decodes a row of the addressColumns into an AddressesRecord. Addresses stored before native balances
+// were tracked have none, so a null one is read as 0 until their next sync sets it.
+func decodeAddress(row *spanner.Row) (*AddressesRecord, error) {
+	var address AddressesRecord
+	var nativeBalance spanner.NullInt64
+
+	err := row.Columns(&address.PublicKey, &address.Balance, &nativeBalance, &address.CreatedAt, &address.UpdatedAt, &address.LastTxnHash, &address.ArchivedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	address.NativeBalance = nativeBalance.Int64
+	return &address, nil
+}
+
+// GetAddressHandler returns a closure responsible for reading the stored state of the address in the request path
+func GetAddressHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		address, err := readAddress(ctx, s, addr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &AddResponse{Address: address})
+	})
+}
+
+// GetAddressBalanceHandler returns a closure responsible for reading the stored balance of the address in the request path
+// note: unlike the deprecated '/balance' route, this does not sync first; callers wanting fresh data should POST to '/sync'
+func GetAddressBalanceHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		address, err := readAddress(ctx, s, addr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get balance for address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &BalanceResponse{Balance: address.Balance})
+	})
+}
+
+// ListTransactionsHandler returns a closure responsible for listing a page of the stored transactions of the address in the request path
+// (see TxnQuery for the supported query parameters)
+func ListTransactionsHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		q, err := parseTxnQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		txnsRecs, nextCursor, err := listTransactions(ctx, s, addr, q)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get transactions for address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &TransactionsResponse{Transactions: txnsRecs, NextCursor: nextCursor})
+	})
+}
+
+// DeleteAddressHandler returns a closure responsible for removing the address in the request path (and everything
+// pointing at it, see deleteAddress)
+func DeleteAddressHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		if err := deleteAddress(ctx, s, addr); err != nil {
+			http.Error(w, fmt.Sprintf("could not delete address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// readAddress reads the stored AddressesRecord for the provided address without syncing it
+func readAddress(ctx context.Context, s *spanner.Client, addr string) (*AddressesRecord, error) {
+	row, err := s.Single().ReadRow(ctx, addressesTable, spanner.Key{addr}, addressColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAddress(row)
+}
+
+// ArchiveAddressHandler returns a closure responsible for archiving the address in the request path: it's no longer
+// synced or counted in its users' portfolios, but its transactions are kept for their gains & tax reports
+func ArchiveAddressHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		address, err := setArchived(ctx, s, addr, true)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not archive address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &AddResponse{Address: address})
+	})
+}
+
+// UnarchiveAddressHandler returns a closure responsible for restoring the archived address in the request path, which
+// picks up where it left off on its next sync
+func UnarchiveAddressHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		address, err := setArchived(ctx, s, addr, false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not unarchive address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &AddResponse{Address: address})
+	})
+}
+
+// setArchived archives or restores the provided address, keeping when it was first archived if it already is
+func setArchived(ctx context.Context, s *spanner.Client, addr string, archived bool) (*AddressesRecord, error) {
+	var address *AddressesRecord
+
+	_, err := readWriteTransaction(ctx, s, "archive_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, addressColumns)
+		if err != nil {
+			return err
+		}
+
+		address, err = decodeAddress(row)
+		if err != nil {
+			return err
+		}
+
+		if address.ArchivedAt.Valid == archived {
+			return nil
+		}
+
+		address.ArchivedAt = spanner.NullTime{}
+		if archived {
+			address.ArchivedAt = spanner.NullTime{Time: time.Now().UTC(), Valid: true}
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update(addressesTable, []string{"public_key", "archived_at"}, []interface{}{addr, address.ArchivedAt}),
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return address, nil
+}
+
+// errAddressArchived is returned when syncing an archived address
+func errAddressArchived(addr string) error {
+	return status.Errorf(codes.FailedPrecondition, "address %s is archived", addr)
+}
+
+// unarchivedAddresses returns the provided addresses, leaving out the ones archived (addresses we aren't tracking yet,
+// e.g. pending their first sync, are kept)
+func unarchivedAddresses(addrs []string, records map[string]*AddressesRecord) []string {
+	unarchived := []string{}
+	for _, v := range addrs {
+		if rec, ok := records[v]; ok && rec.ArchivedAt.Valid {
+			continue
+		}
+
+		unarchived = append(unarchived, v)
+	}
+
+	return unarchived
+}
+
+// deleteAddress removes the provided address and everything that points at it in a single read-write transaction: its
+// transactions, the transfer links & lot selections made of them (including the lots other disposals picked from it),
+// its nicknames, the webhook subscriptions scoped to it, its place in its users' address lists, and the jobs still
+// pending for it. An address with more than maxDeletableTransactions is refused rather than deleted piecemeal.
+func deleteAddress(ctx context.Context, s *spanner.Client, addr string) error {
+	_, err := readWriteTransaction(ctx, s, "delete_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if _, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"public_key"}); err != nil {
+			return err
+		}
+
+		count := spanner.NewStatement(`SELECT COUNT(*) FROM transactions WHERE public_key = @address`)
+		count.Params["address"] = addr
+
+		var txnCount int64
+		err := txn.Query(ctx, count).Do(func(row *spanner.Row) error {
+			return row.Column(0, &txnCount)
+		})
+		if err != nil {
+			return err
+		}
+
+		if txnCount > maxDeletableTransactions {
+			return status.Errorf(codes.FailedPrecondition, "address %s has %d transactions, more than the %d a delete can remove at once (archive it instead)", addr, txnCount, maxDeletableTransactions)
+		}
+
+		if _, err := txn.BatchUpdate(ctx, addressActivityDeletes(addr)); err != nil {
+			return err
+		}
+
+		mutations := []*spanner.Mutation{spanner.Delete(addressesTable, spanner.Key{addr})}
+
+		pruned, err := pruneLotSelections(ctx, txn, addr)
+		if err != nil {
+			return err
+		}
+
+		nicknames := spanner.NewStatement(`SELECT user_id, public_key FROM address_nicknames WHERE public_key = @address`)
+		nicknames.Params["address"] = addr
+
+		err = queryKeys(ctx, txn, nicknames, func(key spanner.Key) {
+			mutations = append(mutations, spanner.Delete(addressNicknamesTable, key))
+		})
+		if err != nil {
+			return err
+		}
+
+		// their deliveries are interleaved in them, so they go too
+		subscriptions := spanner.NewStatement(`SELECT subscription_id FROM webhook_subscriptions WHERE address = @address`)
+		subscriptions.Params["address"] = addr
+
+		err = queryKeys(ctx, txn, subscriptions, func(key spanner.Key) {
+			mutations = append(mutations, spanner.Delete(webhookSubscriptionsTable, key))
+		})
+		if err != nil {
+			return err
+		}
+
+		detached, err := detachAddress(ctx, txn, addr)
+		if err != nil {
+			return err
+		}
+
+		cancelled, err := cancelAddressJobs(ctx, txn, addr)
+		if err != nil {
+			return err
+		}
+
+		mutations = append(mutations, pruned...)
+		mutations = append(mutations, detached...)
+		mutations = append(mutations, cancelled...)
+
+		return txn.BufferWrite(mutations)
+	})
+
+	return err
+}
+
+// addressActivityDeletes returns the DML deleting the provided address' transactions, along with the transfer links
+// with either side among them and the lot selections of their disposals. Activity is matched by ID rather than by
+// joining the transactions, so the statements don't depend on the order they run in.
+func addressActivityDeletes(addr string) []spanner.Statement {
+	params := map[string]interface{}{"address": addr, "prefix": onchainSource + ":", "suffix": ":" + addr}
+
+	stmts := []spanner.Statement{
+		// either side of a transfer going away breaks the link
+		{SQL: `DELETE FROM transfers
+			WHERE (STARTS_WITH(out_id, @prefix) AND ENDS_WITH(out_id, @suffix))
+			OR (STARTS_WITH(in_id, @prefix) AND ENDS_WITH(in_id, @suffix))`},
+		{SQL: `DELETE FROM lot_selections WHERE STARTS_WITH(disposal_id, @prefix) AND ENDS_WITH(disposal_id, @suffix)`},
+		{SQL: `DELETE FROM transactions WHERE public_key = @address`},
+	}
+
+	for i := range stmts {
+		stmts[i].Params = params
+	}
+
+	return stmts
+}
+
+// queryKeys calls f with the key made of the columns of each row the provided statement returns
+func queryKeys(ctx context.Context, txn querier, stmt spanner.Statement, f func(spanner.Key)) error {
+	iter := txn.Query(ctx, stmt)
+	return iter.Do(func(row *spanner.Row) error {
+		key := make(spanner.Key, row.Size())
+		for i := range key {
+			var v string
+			if err := row.Column(i, &v); err != nil {
+				return err
+			}
+
+			key[i] = v
+		}
+
+		f(key)
+		return nil
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+)
+
+func TestDecodeAddress(t *testing.T) {
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	row := func(nativeBalance spanner.NullInt64) *spanner.Row {
+		r, err := spanner.NewRow(addressColumns, []interface{}{"bc1qa", 123.45, nativeBalance, at, at, "abc", spanner.NullTime{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	address, err := decodeAddress(row(spanner.NullInt64{Int64: 5000, Valid: true}))
+	if err != nil {
+		t.Fatalf("decodeAddress() error = %v", err)
+	}
+
+	if address.PublicKey != "bc1qa" || address.Balance != 123.45 || address.NativeBalance != 5000 || address.LastTxnHash != "abc" || address.ArchivedAt.Valid {
+		t.Errorf("decodeAddress() = %+v", address)
+	}
+
+	// stored before native balances were tracked
+	address, err = decodeAddress(row(spanner.NullInt64{}))
+	if err != nil {
+		t.Fatalf("decodeAddress() with a null native_balance error = %v", err)
+	}
+
+	if address.NativeBalance != 0 {
+		t.Errorf("decodeAddress() with a null native_balance = %d, want 0", address.NativeBalance)
+	}
+}
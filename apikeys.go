@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// API key scopes, each including the ones before it: read only reads, write also changes a user's own data, and admin
+// reaches every user's data along with the shared kind (e.g. prices)
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// scopeLevels orders the scopes, see APIKeysRecord.HasScope
+var scopeLevels = map[string]int{scopeRead: 1, scopeWrite: 2, scopeAdmin: 3}
+
+// apiKeyPrefix starts every API key, so that they're easy to spot (e.g. by secret scanners)
+const apiKeyPrefix = "ct_"
+
+// errInvalidAPIKey is returned for API keys that are malformed, unknown or don't match their hash
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyColumns lists the columns read into an APIKeysRecord
+var apiKeyColumns = []string{"key_id", "user_id", "name", "key_hash", "scopes", "created_at"}
+
+// APIKeysRecord is the data model for a respective row in the 'api_keys' table stored in Spanner. Only the key's
+// hash is stored; the key itself is handed out once, when it's created.
+type APIKeysRecord struct {
+	KeyID     string    `spanner:"key_id"` // pk
+	UserID    string    `spanner:"user_id"`
+	Name      string    `spanner:"name"`
+	KeyHash   string    `spanner:"key_hash" json:"-"` // hex-encoded SHA-256 of the key's secret
+	Scopes    string    `spanner:"scopes"`            // comma-delimited, e.g. "read,write"
+	CreatedAt time.Time `spanner:"created_at"`
+}
+
+// HasScope reports whether the key was granted the provided scope, or one including it
+func (k *APIKeysRecord) HasScope(scope string) bool {
+	for _, v := range strings.Split(k.Scopes, ",") {
+		if scopeLevels[strings.TrimSpace(v)] >= scopeLevels[scope] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateAPIKeyRequest represents the expected request body to '/v1/users/{user}/api-keys'
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"` // defaults to read
+}
+
+// CreateAPIKeyResponse represents the expected response body to '/v1/users/{user}/api-keys'
+type CreateAPIKeyResponse struct {
+	APIKey *APIKeysRecord `json:"api_key"`
+	Key    string         `json:"key"` // the only time the key is ever returned
+}
+
+// ListAPIKeysResponse represents the expected response body to GET '/v1/users/{user}/api-keys'
+type ListAPIKeysResponse struct {
+	APIKeys []*APIKeysRecord `json:"api_keys"`
+}
+
+// CreateAPIKeyHandler returns a closure responsible for validating the incoming request
+// and invoking createAPIKey() for the user in the request path
+func CreateAPIKeyHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var keyReq CreateAPIKeyRequest
+		if err := json.Unmarshal(body, &keyReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if len(keyReq.Scopes) == 0 {
+			keyReq.Scopes = []string{scopeRead}
+		}
+
+		for _, scope := range keyReq.Scopes {
+			if _, ok := scopeLevels[scope]; !ok {
+				http.Error(w, fmt.Sprintf("unknown scope %q, must be one of: %s, %s, %s", scope, scopeRead, scopeWrite, scopeAdmin), http.StatusBadRequest)
+				return
+			}
+
+			// a key can't mint one more powerful than itself
+			if caller := apiKeyFromContext(ctx); caller != nil && !caller.HasScope(scope) {
+				http.Error(w, fmt.Sprintf("cannot grant the %s scope without it", scope), http.StatusForbidden)
+				return
+			}
+		}
+
+		if _, err := readUser(ctx, s.Single(), userID); err != nil {
+			http.Error(w, fmt.Sprintf("could not get user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		record, key, err := createAPIKey(ctx, s, userID, keyReq.Name, keyReq.Scopes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not create API key. %v", err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, &CreateAPIKeyResponse{APIKey: record, Key: key})
+	})
+}
+
+// ListAPIKeysHandler returns a closure responsible for listing the API keys of the user in the request path
+func ListAPIKeysHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		stmt := spanner.NewStatement(fmt.Sprintf(`SELECT %s FROM api_keys WHERE user_id = @user_id ORDER BY created_at`, strings.Join(apiKeyColumns, ", ")))
+		stmt.Params["user_id"] = userID
+
+		keys := []*APIKeysRecord{}
+		err := s.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var key APIKeysRecord
+			if err := row.ToStruct(&key); err != nil {
+				return err
+			}
+
+			keys = append(keys, &key)
+			return nil
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list API keys of user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ListAPIKeysResponse{APIKeys: keys})
+	})
+}
+
+// DeleteAPIKeyHandler returns a closure responsible for revoking the API key in the request path
+func DeleteAPIKeyHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, keyID := mux.Vars(r)["user"], mux.Vars(r)["key"]
+
+		_, err := readWriteTransaction(ctx, s, "delete_api_key", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			key, err := readAPIKey(ctx, txn, keyID)
+			if err != nil {
+				return err
+			}
+
+			// another user's key is as good as missing
+			if key.UserID != userID {
+				return status.Errorf(codes.NotFound, "api key %s not found", keyID)
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{spanner.Delete(apiKeysTable, spanner.Key{keyID})})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not delete API key %s. %v", keyID, err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// createAPIKey creates an API key for the provided user, returning its record along with the key itself
+func createAPIKey(ctx context.Context, s *spanner.Client, userID, name string, scopes []string) (*APIKeysRecord, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	record := &APIKeysRecord{
+		KeyID:     hex.EncodeToString(id),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	record.KeyHash = hashAPIKeySecret(encodedSecret)
+
+	mut, err := spanner.InsertStruct(apiKeysTable, record)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := s.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		return nil, "", err
+	}
+
+	return record, apiKeyPrefix + record.KeyID + "." + encodedSecret, nil
+}
+
+// authenticateAPIKey returns the record of the provided API key, or errInvalidAPIKey
+func authenticateAPIKey(ctx context.Context, s *spanner.Client, key string) (*APIKeysRecord, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), ".", 2)
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(parts) != 2 {
+		return nil, errInvalidAPIKey
+	}
+
+	record, err := readAPIKey(ctx, s.Single(), parts[0])
+	if spanner.ErrCode(err) == codes.NotFound {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(parts[1])), []byte(record.KeyHash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+
+	return record, nil
+}
+
+// readAPIKey reads the APIKeysRecord for the provided key ID
+func readAPIKey(ctx context.Context, txn rowReader, keyID string) (*APIKeysRecord, error) {
+	row, err := txn.ReadRow(ctx, apiKeysTable, spanner.Key{keyID}, apiKeyColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var key APIKeysRecord
+	if err := row.ToStruct(&key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// hashAPIKeySecret returns the hex-encoded SHA-256 of an API key's secret. The secrets are random, so unlike
+// passwords they don't need a slow, salted hash.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+// apiKeyContextKey is the context key of the API key a request was authenticated with
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the API key the request was authenticated with, or nil if authentication is disabled
+func apiKeyFromContext(ctx context.Context) *APIKeysRecord {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKeysRecord)
+	return key
+}
+
+// accessCheck reports whether the provided (non-admin) key may access the resource of the request, e.g. because it's
+// one of its user's addresses
+type accessCheck func(ctx context.Context, s *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error)
+
+// authorizer authenticates requests by their API key, and authorizes them by its scopes & user
+type authorizer struct {
+	s       *spanner.Client
+	enabled bool
+}
+
+// require wraps the provided handler, only letting through requests with an API key that was granted the provided
+// scope and passes the provided check (if any). Admin keys pass every check, as do all requests if auth is disabled.
+func (a *authorizer) require(scope string, check accessCheck, next http.Handler) http.Handler {
+	if !a.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		header := r.Header.Get("Authorization")
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if !strings.HasPrefix(header, "Bearer ") || len(token) == 0 {
+			unauthorized(w, "missing", "an API key is required, e.g. Authorization: Bearer <key>")
+			return
+		}
+
+		key, err := authenticateAPIKey(ctx, a.s, token)
+		if err == errInvalidAPIKey {
+			unauthorized(w, "invalid", err.Error())
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not authenticate API key. %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// every later log line & span of the request names the key (and its user) it was made with
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("key_id", key.KeyID, "user_id", key.UserID))
+		tracing.SpanFromContext(ctx).SetAttributes("key_id", key.KeyID, "user_id", key.UserID)
+
+		if !key.HasScope(scope) {
+			authFailures.Inc("scope")
+			http.Error(w, fmt.Sprintf("API key is missing the %s scope", scope), http.StatusForbidden)
+			return
+		}
+
+		if check != nil && !key.HasScope(scopeAdmin) {
+			ok, err := check(ctx, a.s, r, key)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not authorize API key. %v", err), statusFromErr(err))
+				return
+			}
+
+			if !ok {
+				authFailures.Inc("forbidden")
+				http.Error(w, "API key may not access this resource", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, apiKeyContextKey{}, key)))
+	})
+}
+
+// unauthorized rejects a request that didn't authenticate, recording the reason why
+func unauthorized(w http.ResponseWriter, reason, msg string) {
+	authFailures.Inc(reason)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="cointracker"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// ownUser only lets through keys of the user in the request path
+func ownUser(_ context.Context, _ *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error) {
+	return mux.Vars(r)["user"] == key.UserID, nil
+}
+
+// ownAddress only lets through keys of a user with the address in the request path
+func ownAddress(ctx context.Context, s *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error) {
+	user, err := readUser(ctx, s.Single(), key.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	return user.HasAddress(mux.Vars(r)["addr"]), nil
+}
+
+// ownUnsharedAddress only lets through keys of the one user with the address in the request path. Any user can add
+// an address we already track (the blockchain is public), so an address can be shared by several; writing to one
+// changes it for all of them, which only an admin key may do for another user.
+func ownUnsharedAddress(ctx context.Context, s *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error) {
+	userIDs, err := addressUserIDs(ctx, s.Single(), mux.Vars(r)["addr"])
+	if err != nil {
+		return false, err
+	}
+
+	return soleUser(userIDs, key.UserID), nil
+}
+
+// soleUser reports whether the provided user is the only one of the provided users
+func soleUser(userIDs []string, userID string) bool {
+	return len(userIDs) == 1 && userIDs[0] == userID
+}
+
+// ownExchangeAccount only lets through keys of the user who connected the exchange account in the request path
+func ownExchangeAccount(ctx context.Context, s *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error) {
+	account, err := readExchangeAccount(ctx, s.Single(), mux.Vars(r)["account"])
+	if err != nil {
+		return false, err
+	}
+
+	return account.UserID == key.UserID, nil
+}
+
+// ownJob only lets through keys of the user the job in the request path was created for
+func ownJob(ctx context.Context, s *spanner.Client, r *http.Request, key *APIKeysRecord) (bool, error) {
+	job, err := readJob(ctx, s.Single(), mux.Vars(r)["job"])
+	if err != nil {
+		return false, err
+	}
+
+	return job.UserID == key.UserID, nil
+}
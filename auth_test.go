@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSoleUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		userIDs []string // the users with the address on their list
+		want    bool
+	}{
+		{"only the key's user", []string{"alice"}, true},
+		{"shared with another user", []string{"alice", "bob"}, false},
+		{"shared, the key's user listed last", []string{"bob", "alice"}, false},
+		{"only another user", []string{"bob"}, false},
+		{"nobody's", []string{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := soleUser(tt.userIDs, "alice"); got != tt.want {
+			t.Errorf("%s: soleUser(%v, alice) = %v, want %v", tt.name, tt.userIDs, got, tt.want)
+		}
+	}
+}
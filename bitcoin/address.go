@@ -0,0 +1,205 @@
+// Package bitcoin validates Bitcoin (mainnet) addresses without calling out to a node or an API: legacy P2PKH & P2SH
+// addresses by their base58check checksum (starting with 1 and 3), and segwit ones by their bech32 or bech32m checksum
+// (starting with bc1, see BIP 173 & BIP 350).
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// the errors returned by ValidateAddress
+var (
+	ErrEmptyAddress    = errors.New("address is empty")
+	ErrUnknownFormat   = errors.New("not a mainnet address, which start with 1, 3 or bc1")
+	ErrInvalidChars    = errors.New("address has characters outside its encoding's alphabet")
+	ErrInvalidLength   = errors.New("address has the wrong length")
+	ErrInvalidChecksum = errors.New("address checksum doesn't match, it may have a typo")
+	ErrInvalidProgram  = errors.New("segwit address has an invalid witness version or program")
+)
+
+// base58 & bech32 alphabets
+const (
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	bech32Alphabet = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// mainnet version bytes of base58check addresses
+const (
+	p2pkhVersion = 0x00 // addresses starting with 1
+	p2shVersion  = 0x05 // addresses starting with 3
+)
+
+// the constants bech32 & bech32m checksums are xor-ed with
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+// segwitHRP is the human-readable part of mainnet segwit addresses
+const segwitHRP = "bc"
+
+// ValidateAddress returns an error describing why the provided string isn't a valid mainnet address, or nil if it is
+func ValidateAddress(addr string) error {
+	switch {
+	case len(addr) == 0:
+		return ErrEmptyAddress
+	case strings.HasPrefix(strings.ToLower(addr), segwitHRP+"1"):
+		return validateSegwit(addr)
+	case addr[0] == '1' || addr[0] == '3':
+		return validateBase58(addr)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// validateBase58 validates a legacy P2PKH or P2SH address: a version byte and a 20 byte hash, followed by the first 4
+// bytes of their double SHA-256
+func validateBase58(addr string) error {
+	if len(addr) < 26 || len(addr) > 35 {
+		return ErrInvalidLength
+	}
+
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range addr {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return ErrInvalidChars
+		}
+
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	// every leading 1 stands for a leading zero byte
+	decoded := n.Bytes()
+	for i := 0; i < len(addr) && addr[i] == '1'; i++ {
+		decoded = append([]byte{0}, decoded...)
+	}
+
+	if len(decoded) != 25 {
+		return ErrInvalidLength
+	}
+
+	payload, checksum := decoded[:21], decoded[21:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if string(second[:4]) != string(checksum) {
+		return ErrInvalidChecksum
+	}
+
+	if payload[0] != p2pkhVersion && payload[0] != p2shVersion {
+		return ErrUnknownFormat
+	}
+
+	return nil
+}
+
+// validateSegwit validates a segwit address: a witness version and program, checksummed with bech32 (version 0) or
+// bech32m (versions 1 to 16, e.g. taproot)
+func validateSegwit(addr string) error {
+	if len(addr) < 14 || len(addr) > 90 {
+		return ErrInvalidLength
+	}
+
+	// mixed case isn't allowed, but either case is
+	lower := strings.ToLower(addr)
+	if lower != addr && strings.ToUpper(addr) != addr {
+		return ErrInvalidChars
+	}
+
+	sep := strings.LastIndexByte(lower, '1')
+	hrp, data := lower[:sep], lower[sep+1:]
+	if hrp != segwitHRP || len(data) < 7 {
+		return ErrUnknownFormat
+	}
+
+	values := make([]byte, len(data))
+	for i := range data {
+		v := strings.IndexByte(bech32Alphabet, data[i])
+		if v < 0 {
+			return ErrInvalidChars
+		}
+
+		values[i] = byte(v)
+	}
+
+	version := values[0]
+	constant := bech32Const
+	if version > 0 {
+		constant = bech32mConst
+	}
+
+	if polymod(append(expandHRP(hrp), values...)) != constant {
+		return ErrInvalidChecksum
+	}
+
+	program, ok := convertBits(values[1:len(values)-6], 5, 8)
+	switch {
+	case !ok, version > 16, len(program) < 2, len(program) > 40:
+		return ErrInvalidProgram
+	case version == 0 && len(program) != 20 && len(program) != 32:
+		return ErrInvalidProgram
+	}
+
+	return nil
+}
+
+// polymod computes the bech32 checksum of the provided values
+func polymod(values []byte) int {
+	generator := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+	chk := 1
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ int(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+
+	return chk
+}
+
+// expandHRP expands the human-readable part of a bech32 string for its checksum
+func expandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+
+	return expanded
+}
+
+// convertBits regroups the provided groups of from bits into groups of to bits, reporting false if what's left over
+// isn't zero padding
+func convertBits(data []byte, from, to uint) ([]byte, bool) {
+	var acc, bits uint
+	out := []byte{}
+	maxValue := uint(1)<<to - 1
+
+	for _, v := range data {
+		acc = acc<<from | uint(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxValue))
+		}
+	}
+
+	if bits >= from || (acc<<(to-bits))&maxValue != 0 {
+		return nil, false
+	}
+
+	return out, true
+}
@@ -0,0 +1,46 @@
+package bitcoin
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	// the segwit addresses are from BIP 173 & BIP 350's test vectors
+	valid := []string{
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa",                             // p2pkh
+		"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy",                             // p2sh
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",                     // p2wpkh
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4",                     // p2wpkh, all upper case
+		"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3", // p2wsh
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", // p2tr
+	}
+
+	for _, addr := range valid {
+		if err := ValidateAddress(addr); err != nil {
+			t.Errorf("ValidateAddress(%q) = %v", addr, err)
+		}
+	}
+
+	invalid := map[string]error{
+		"": ErrEmptyAddress,
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx": ErrUnknownFormat, // testnet
+		"0x742d35Cc6634C0532925a3b844Bc454e4438f44e": ErrUnknownFormat, // ethereum
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb":         ErrInvalidChecksum,
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfN0":         ErrInvalidChars, // 0 isn't in base58
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7Div":            ErrInvalidLength,
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5": ErrInvalidChecksum,
+		"bc1QW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4": ErrInvalidChars, // mixed case
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3tb": ErrInvalidChars, // b isn't in bech32
+
+		// each witness version must use its own checksum: bech32 for v0, bech32m after it
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd": ErrInvalidChecksum,
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh":                     ErrInvalidChecksum,
+	}
+
+	for addr, want := range invalid {
+		if err := ValidateAddress(addr); !errors.Is(err, want) {
+			t.Errorf("ValidateAddress(%q) = %v, want %v", addr, err, want)
+		}
+	}
+}
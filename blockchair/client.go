@@ -5,26 +5,60 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
 )
 
 const (
 	BaseUrl          = "https://api.blockchair.com/"
+	DefaultBaseURL   = BaseUrl + "bitcoin"
 	DefaultTimeout   = 10 * time.Second
 	TransactionLimit = 50 // maximum allowed by the Blockchair API for dashborad/address endpoints
+
+	// MaxAddressesPerCall is how many addresses the Blockchair API's multi-address dashboard takes at once
+	MaxAddressesPerCall = 100
+
+	// DefaultRateLimit is how many calls per minute the Blockchair API allows (without an API key) before returning 402s
+	DefaultRateLimit = 30
+
+	// DefaultRateLimitWait is how long we wait for the Blockchair API to cool down once it starts returning 402s
+	DefaultRateLimitWait = time.Minute
 )
 
 // Config represents the Blockchair API client configuration
 type Config struct {
-	BaseURL string
+	BaseURL       string
+	APIKey        string        // optional, sent with every call
+	Timeout       time.Duration // of each call
+	RateLimit     int           // calls per minute
+	RateLimitWait time.Duration // how long we wait once rate limited
 }
 
 // Client represents a minimal http client that interacts with the Blockchair API
 type Client struct {
 	config *Config
 	client *http.Client
+	logger *logging.Logger
+
+	mu          sync.Mutex
+	calls       []time.Time // when the calls of the last minute were made, oldest first
+	rateLimited time.Time   // when we were last answered with a 402
+}
+
+// RateLimitStatus is how much of the Blockchair API's rate limit we've used up
+type RateLimitStatus struct {
+	CallsLastMinute int       `json:"calls_last_minute"`
+	Limit           int       `json:"limit"`
+	CoolingDown     bool      `json:"cooling_down"` // whether we were answered with a 402 in the last Config.RateLimitWait
+	LastRateLimited time.Time `json:"last_rate_limited,omitempty"`
 }
 
 // AddressStatsResponse represents the top-level envelope we expect from the address stats endpoint
@@ -40,9 +74,20 @@ type AddressStats struct {
 
 // Address represents a minimal BTC address object
 type Address struct {
-	AddressType string  `json:"type"`
-	Balance     int     `json:"balance"`
-	BalanceUSD  float64 `json:"balance_usd"`
+	AddressType      string  `json:"type"`
+	Balance          int     `json:"balance"`
+	BalanceUSD       float64 `json:"balance_usd"`
+	TransactionCount int     `json:"transaction_count"`
+}
+
+// AddressesStatsResponse represents the top-level envelope we expect from the multi-address stats endpoint
+type AddressesStatsResponse struct {
+	Data *AddressesStats `json:"data"`
+}
+
+// AddressesStats represents the primary payload we expect from the multi-address stats endpoint
+type AddressesStats struct {
+	Addresses map[string]*Address `json:"addresses"` // keyed by public key, including the ones never seen on chain
 }
 
 // TransactionsResponse represents the top-level envelope we expect from the transactions stats endpoint (batched)
@@ -52,15 +97,54 @@ type TransactionsResponse struct {
 
 // TransactionWrapper represents the top-level envelope from the transactions stats endpoint (single)
 type TransactionWrapper struct {
-	Txn *Transaction `json:"transaction"`
+	Txn     *Transaction `json:"transaction"`
+	Inputs  []*Output    `json:"inputs"`
+	Outputs []*Output    `json:"outputs"`
+}
+
+// Output represents a minimal BTC transaction output, either spent by this transaction (input) or created by it (output)
+type Output struct {
+	Recipient string `json:"recipient"`
+	Value     int64  `json:"value"` // in satoshis
+}
+
+// BalanceChange returns the net effect (in satoshis) this transaction had on the provided address' balance,
+// i.e. what it received through the outputs minus what it spent through the inputs
+func (t *TransactionWrapper) BalanceChange(addr string) int64 {
+	var change int64
+
+	for _, v := range t.Outputs {
+		if v.Recipient == addr {
+			change += v.Value
+		}
+	}
+
+	for _, v := range t.Inputs {
+		if v.Recipient == addr {
+			change -= v.Value
+		}
+	}
+
+	return change
 }
 
 // Transaction represents a minimal BTC transaction object
 type Transaction struct {
-	Hash      string    `json:"hash"`
-	Timestamp time.Time `json:"time"`
-	AmountUSD float64   `json:"output_total_usd"`
-	FeeUSD    float64   `json:"fee_usd"`
+	Hash        string    `json:"hash"`
+	Timestamp   time.Time `json:"time"`
+	OutputTotal int64     `json:"output_total"` // in satoshis
+	AmountUSD   float64   `json:"output_total_usd"`
+	Fee         int64     `json:"fee"` // in satoshis
+	FeeUSD      float64   `json:"fee_usd"`
+}
+
+// PriceUSD returns the BTC/USD rate Blockchair used to value this transaction (0 if it can't be derived)
+func (t *Transaction) PriceUSD() float64 {
+	if t.OutputTotal == 0 {
+		return 0
+	}
+
+	return t.AmountUSD / (float64(t.OutputTotal) / 1e8)
 }
 
 // UnmarshalJSON implements the Unmarshaler interface and overrides the default behavior in encoding/json
@@ -68,8 +152,6 @@ type Transaction struct {
 func (t *Transaction) UnmarshalJSON(data []byte) error {
 	var v map[string]interface{}
 	if err := json.Unmarshal(data, &v); err != nil {
-		fmt.Printf("error%v\n", err)
-
 		return err
 	}
 
@@ -77,6 +159,14 @@ func (t *Transaction) UnmarshalJSON(data []byte) error {
 	t.AmountUSD = v["output_total_usd"].(float64)
 	t.FeeUSD = v["fee_usd"].(float64)
 
+	if outputTotal, ok := v["output_total"].(float64); ok {
+		t.OutputTotal = int64(outputTotal)
+	}
+
+	if fee, ok := v["fee"].(float64); ok {
+		t.Fee = int64(fee)
+	}
+
 	rawTime, err := time.Parse("2006-01-02 15:04:05", v["time"].(string))
 	if err != nil {
 		return err
@@ -86,33 +176,226 @@ func (t *Transaction) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// NewClient constructs a new Blockchair client
-func NewClient(ctx context.Context) *Client {
+// NewClient constructs a new Blockchair client from the provided config, logging to the provided logger outside of
+// requests
+func NewClient(ctx context.Context, config *Config, logger *logging.Logger) *Client {
 	return &Client{
 		client: &http.Client{
-			Timeout: DefaultTimeout,
-		},
-		config: &Config{
-			BaseURL: "https://api.blockchair.com/bitcoin",
+			Timeout: config.Timeout,
 		},
+		config: config,
+		logger: logger,
 	}
 }
 
-// GetAddressStats queries the Blockchair API for a snapshot view of a given BTC address
-func (b *Client) GetAddressStats(ctx context.Context, addr string) (*AddressStatsResponse, error) {
-	path := fmt.Sprintf("%s/dashboards/address/%s?limit=%d", b.config.BaseURL, addr, TransactionLimit)
+// log returns the logger of the provided context (e.g. one carrying a request ID), falling back to the client's own
+func (b *Client) log(ctx context.Context) *logging.Logger {
+	return logging.FromContextOr(ctx, b.logger).With("component", "blockchair")
+}
 
-	resp, err := http.Get(path)
+// Ping checks that the Blockchair API can be reached, by connecting to it without making a call (which would count
+// towards the rate limit)
+func (b *Client) Ping(ctx context.Context) error {
+	u, err := url.Parse(b.config.BaseURL)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// RateLimitStatus returns how much of the rate limit the calls of the last minute used up
+func (b *Client) RateLimitStatus() *RateLimitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.pruneCalls(now)
+
+	return &RateLimitStatus{
+		CallsLastMinute: len(b.calls),
+		Limit:           b.config.RateLimit,
+		CoolingDown:     !b.rateLimited.IsZero() && now.Sub(b.rateLimited) < b.config.RateLimitWait,
+		LastRateLimited: b.rateLimited,
+	}
+}
+
+// recordCall records a call made at the provided time (and whether it was rate limited), for RateLimitStatus
+func (b *Client) recordCall(at time.Time, rateLimited bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pruneCalls(at)
+	b.calls = append(b.calls, at)
+
+	if rateLimited {
+		b.rateLimited = at
+	}
+}
+
+// pruneCalls drops the calls made over a minute before the provided time
+func (b *Client) pruneCalls(now time.Time) {
+	i := 0
+	for i < len(b.calls) && now.Sub(b.calls[i]) >= time.Minute {
+		i++
+	}
+
+	b.calls = b.calls[i:]
+}
+
+// get GETs the provided URL, recording the call's metrics under the provided endpoint name
+func (b *Client) get(ctx context.Context, endpoint, path string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(b.config.APIKey) > 0 {
+		q := req.URL.Query()
+		q.Set("key", b.config.APIKey)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	tracing.Inject(ctx, req.Header)
+
+	start := time.Now()
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// the error's URL would carry our API key into logs and spans otherwise
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = path
+		}
+
+		apiErrors.Inc(endpoint, "transport")
+		return 0, nil, err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+
+	apiCalls.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+	apiCallDuration.ObserveDuration(time.Since(start), endpoint)
+	b.recordCall(start, resp.StatusCode == http.StatusPaymentRequired)
+
+	if err != nil {
+		apiErrors.Inc(endpoint, "transport")
+		return 0, nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPaymentRequired:
+		rateLimitHits.Inc(endpoint)
+	case resp.StatusCode >= http.StatusBadRequest:
+		apiErrors.Inc(endpoint, "status")
+	}
+
+	b.log(ctx).Debug("called the Blockchair API", "endpoint", endpoint, "status", resp.StatusCode, "duration_ms", time.Since(start))
+	b.log(ctx).Debug("Blockchair API payload", "endpoint", endpoint, "payload", string(body))
+
+	return resp.StatusCode, body, nil
+}
+
+// RateLimitHooks are called around every wait for the rate limit to cool down made by a call whose context carries
+// them (see WithRateLimitHooks), e.g. to tell whoever's waiting on the call how long it'll be
+type RateLimitHooks struct {
+	Started func(until time.Time)                 // when the wait started, with when it's expected to end
+	Ended   func(waited time.Duration, err error) // when it ended, with the context's error if it was given up on
+}
+
+// rateLimitHooksContextKey is the context key of the RateLimitHooks
+type rateLimitHooksContextKey struct{}
+
+// WithRateLimitHooks returns a copy of the provided context carrying the provided hooks
+func WithRateLimitHooks(ctx context.Context, hooks *RateLimitHooks) context.Context {
+	return context.WithValue(ctx, rateLimitHooksContextKey{}, hooks)
+}
+
+// waitForCooldown waits out the Blockchair API's rate limit, returning early with the context's error if it's done
+// first (e.g. the client went away, or we're shutting down)
+func (b *Client) waitForCooldown(ctx context.Context) (err error) {
+	_, span := tracing.Start(ctx, "blockchair.rate_limit_wait", "wait_ms", b.config.RateLimitWait.Milliseconds())
+	defer span.End()
+
+	start := time.Now()
+	defer func() { rateLimitWait.Add(time.Since(start).Seconds()) }()
+
+	if hooks, ok := ctx.Value(rateLimitHooksContextKey{}).(*RateLimitHooks); ok {
+		if hooks.Started != nil {
+			hooks.Started(start.Add(b.config.RateLimitWait))
+		}
+		if hooks.Ended != nil {
+			defer func() { hooks.Ended(time.Since(start), err) }()
+		}
+	}
+
+	timer := time.NewTimer(b.config.RateLimitWait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		span.SetError(ctx.Err())
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// GetAddressStats queries the Blockchair API for a snapshot view of a given BTC address
+func (b *Client) GetAddressStats(ctx context.Context, addr string) (resp *AddressStatsResponse, err error) {
+	ctx, span := tracing.Start(ctx, "blockchair.address_stats", "address", addr)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	log := b.log(ctx).With("address", addr)
+
+	path := fmt.Sprintf("%s/dashboards/address/%s?limit=%d", b.config.BaseURL, addr, TransactionLimit)
+
+	status, body, err := b.get(ctx, addressStatsEndpoint, path)
 	if err != nil {
+		log.Error("could not fetch address stats", "error", err)
 		return nil, err
 	}
 
+	if status == http.StatusPaymentRequired {
+		log.Warn("rate limited by the Blockchair API, waiting for it to cool down", "wait_ms", b.config.RateLimitWait)
+		span.SetAttributes("rate_limited", true)
+
+		if err := b.waitForCooldown(ctx); err != nil {
+			log.Warn("gave up waiting for the Blockchair API to cool down", "error", err)
+			return nil, err
+		}
+
+		status, body, err = b.get(ctx, addressStatsEndpoint, path)
+		if err != nil {
+			log.Error("could not fetch address stats", "error", err)
+			return nil, err
+		}
+	}
+
+	span.SetAttributes("http.status_code", status)
+
+	// an error's body still parses, with no data
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("blockchair answered %d %s", status, http.StatusText(status))
+	}
+
 	addrStats := AddressStatsResponse{
 		Data: map[string]*AddressStats{
 			addr: &AddressStats{}, // payload value is keyed by its public key address
@@ -120,14 +403,72 @@ func (b *Client) GetAddressStats(ctx context.Context, addr string) (*AddressStat
 	}
 
 	if err := json.Unmarshal(body, &addrStats); err != nil {
+		apiErrors.Inc(addressStatsEndpoint, "parse")
+		log.Error("could not parse address stats", "status", status, "error", err)
 		return nil, err
 	}
 
 	return &addrStats, nil
 }
 
+// GetAddressesStats queries the Blockchair API for a snapshot view of up to MaxAddressesPerCall BTC addresses at once,
+// waiting out its rate limit if need be
+func (b *Client) GetAddressesStats(ctx context.Context, addrs []string) (resp *AddressesStatsResponse, err error) {
+	if len(addrs) > MaxAddressesPerCall {
+		return nil, fmt.Errorf("cannot process more than %d addresses at a time", MaxAddressesPerCall)
+	}
+
+	ctx, span := tracing.Start(ctx, "blockchair.addresses_stats", "addresses", len(addrs))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	log := b.log(ctx).With("addresses", len(addrs))
+
+	// we only need the stats, not the addresses' latest transactions
+	path := fmt.Sprintf("%s/dashboards/addresses/%s?limit=0", b.config.BaseURL, strings.Join(addrs, ","))
+
+	status, body, err := b.get(ctx, addressesStatsEndpoint, path)
+	if err != nil {
+		log.Error("could not fetch addresses stats", "error", err)
+		return nil, err
+	}
+
+	if status == http.StatusPaymentRequired {
+		log.Warn("rate limited by the Blockchair API, waiting for it to cool down", "wait_ms", b.config.RateLimitWait)
+		span.SetAttributes("rate_limited", true)
+
+		if err := b.waitForCooldown(ctx); err != nil {
+			log.Warn("gave up waiting for the Blockchair API to cool down", "error", err)
+			return nil, err
+		}
+
+		status, body, err = b.get(ctx, addressesStatsEndpoint, path)
+		if err != nil {
+			log.Error("could not fetch addresses stats", "error", err)
+			return nil, err
+		}
+	}
+
+	span.SetAttributes("http.status_code", status)
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("blockchair answered %d %s", status, http.StatusText(status))
+	}
+
+	addrsStats := AddressesStatsResponse{Data: &AddressesStats{}}
+	if err := json.Unmarshal(body, &addrsStats); err != nil {
+		apiErrors.Inc(addressesStatsEndpoint, "parse")
+		log.Error("could not parse addresses stats", "status", status, "error", err)
+		return nil, err
+	}
+
+	return &addrsStats, nil
+}
+
 // GetTransactionsByHashes queries the Blockchair API for transaction data by a list ids (hashes)
-func (b *Client) GetTransactionsByHashes(ctx context.Context, txnHashes []string) (*TransactionsResponse, error) {
+func (b *Client) GetTransactionsByHashes(ctx context.Context, txnHashes []string) (resp *TransactionsResponse, err error) {
 
 	// todo: parallelize me using goroutines / channels to speed up API consumption, though note maps are not goroutine-safe; see https://go.dev/blog/maps
 
@@ -136,43 +477,54 @@ func (b *Client) GetTransactionsByHashes(ctx context.Context, txnHashes []string
 		return nil, fmt.Errorf("cannot process more than 10 txn hashes at a time")
 	}
 
+	ctx, span := tracing.Start(ctx, "blockchair.transactions", "batch_size", len(txnHashes))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	log := b.log(ctx).With("batch_size", len(txnHashes))
+
 	path := fmt.Sprintf("%s/dashboards/transactions/%s", b.config.BaseURL, strings.Join(txnHashes, ","))
-	resp, err := http.Get(path)
-	if err != nil {
-		return nil, err
-	}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	status, body, err := b.get(ctx, transactionsEndpoint, path)
 	if err != nil {
+		log.Error("could not fetch transactions", "error", err)
 		return nil, err
 	}
 
 	// blockchair has a hard limit of 30 reqs/minute, returning a 402 when that limit is reached
 	// so this bootstraps some retry logic to retry on that status code
 	// todo: remove this & pay for the API if I ever need to use this in irl
-	if resp.StatusCode == 402 {
-		fmt.Printf("waiting for the Blockchair API to cool down...\n")
-
-		time.Sleep(time.Minute * 1)
+	if status == http.StatusPaymentRequired {
+		log.Warn("rate limited by the Blockchair API, waiting for it to cool down", "wait_ms", b.config.RateLimitWait)
+		span.SetAttributes("rate_limited", true)
 
-		resp, err = http.Get(path)
-		if err != nil {
+		if err := b.waitForCooldown(ctx); err != nil {
+			log.Warn("gave up waiting for the Blockchair API to cool down", "error", err)
 			return nil, err
 		}
 
-		defer resp.Body.Close()
-		body, err = ioutil.ReadAll(resp.Body)
+		status, body, err = b.get(ctx, transactionsEndpoint, path)
 		if err != nil {
+			log.Error("could not fetch transactions", "error", err)
 			return nil, err
 		}
 	}
 
+	span.SetAttributes("http.status_code", status)
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("blockchair answered %d %s", status, http.StatusText(status))
+	}
+
 	txnsResp := TransactionsResponse{
 		Data: map[string]*TransactionWrapper{},
 	}
 
 	if err := json.Unmarshal(body, &txnsResp); err != nil {
+		apiErrors.Inc(transactionsEndpoint, "parse")
+		log.Error("could not parse transactions", "status", status, "error", err)
 		return nil, err
 	}
 
@@ -0,0 +1,42 @@
+package blockchair
+
+import "github.com/jf2978/cointracker-eng-assignment/metrics"
+
+// the endpoints we call, as the "endpoint" label of our metrics
+const (
+	addressStatsEndpoint   = "address_stats"
+	addressesStatsEndpoint = "addresses_stats"
+	transactionsEndpoint   = "transactions"
+)
+
+var (
+	apiCalls = metrics.NewCounter(
+		"blockchair_requests_total",
+		"Calls to the Blockchair API that got a response, by endpoint and status code.",
+		"endpoint", "status",
+	)
+
+	apiCallDuration = metrics.NewHistogram(
+		"blockchair_request_duration_seconds",
+		"Latency of the calls to the Blockchair API that got a response, by endpoint.",
+		metrics.DefaultBuckets,
+		"endpoint",
+	)
+
+	apiErrors = metrics.NewCounter(
+		"blockchair_errors_total",
+		"Failed calls to the Blockchair API, by endpoint and reason (transport, status or parse).",
+		"endpoint", "reason",
+	)
+
+	rateLimitHits = metrics.NewCounter(
+		"blockchair_rate_limited_total",
+		"Calls to the Blockchair API rejected with a 402 for exceeding its rate limit, by endpoint.",
+		"endpoint",
+	)
+
+	rateLimitWait = metrics.NewCounter(
+		"blockchair_rate_limit_wait_seconds_total",
+		"Time spent waiting for the Blockchair API's rate limit to cool down.",
+	)
+)
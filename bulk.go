@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/jf2978/cointracker-eng-assignment/bitcoin"
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+)
+
+const (
+	// maxBulkAddresses is how many addresses a single bulk add may list
+	maxBulkAddresses = 500
+
+	// maxNicknameLength is the longest nickname an address may be given, in bytes
+	maxNicknameLength = 64
+)
+
+// the status of each address of a bulk add
+const (
+	bulkAdded    = "added"    // the address never transacted, so it was stored right away
+	bulkQueued   = "queued"   // a job was queued to import the address' transactions
+	bulkExisting = "existing" // the address was already stored, it was only attached (& nicknamed)
+	bulkArchived = "archived" // the address was already stored but archived, it was only attached (& nicknamed) & isn't synced
+	bulkInvalid  = "invalid"  // the address (or its nickname) failed validation, see its error
+	bulkSkipped  = "skipped"  // the address is valid, but another one in the request isn't, so nothing was added
+)
+
+// BulkAddRequest represents the expected request body to '/addresses/bulk'
+type BulkAddRequest struct {
+	UserID    string            `json:"user_id,omitempty"` // optionally attaches the addresses to this user's portfolio
+	Addresses []*BulkAddAddress `json:"addresses"`
+}
+
+// BulkAddAddress is an address to add in bulk
+type BulkAddAddress struct {
+	Address  string `json:"address"`
+	Nickname string `json:"nickname,omitempty"` // requires a user, who the nickname belongs to
+}
+
+// BulkAddResult is the outcome of adding one of the addresses of a bulk add
+type BulkAddResult struct {
+	Address          string `json:"address"`
+	Nickname         string `json:"nickname,omitempty"`
+	Status           string `json:"status"`
+	Error            string `json:"error,omitempty"`             // why the address is invalid
+	JobID            string `json:"job_id,omitempty"`            // the job importing the address, if queued
+	NativeBalance    int64  `json:"native_balance"`              // in satoshis, as of the add
+	TransactionCount int    `json:"transaction_count,omitempty"` // on chain, as of the add
+}
+
+// BulkAddResponse represents the expected response body to '/addresses/bulk': a result for each requested address,
+// in the order they were listed
+type BulkAddResponse struct {
+	Results []*BulkAddResult `json:"results"`
+}
+
+// AddressNicknamesRecord is the data model for a respective row in the 'address_nicknames' table stored in Spanner
+type AddressNicknamesRecord struct {
+	UserID    string    `spanner:"user_id"`    // pk
+	PublicKey string    `spanner:"public_key"` // pk
+	Nickname  string    `spanner:"nickname"`
+	UpdatedAt time.Time `spanner:"updated_at"`
+}
+
+// BulkAddHandler returns a closure responsible for validating every address of the incoming request up front, and
+// invoking bulkAdd() to add them all at once. Nothing is added if any of them is invalid.
+func BulkAddHandler(s *spanner.Client, b *blockchair.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var bulkReq BulkAddRequest
+		if err := json.Unmarshal(body, &bulkReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case len(bulkReq.Addresses) == 0:
+			http.Error(w, "addresses are required", http.StatusBadRequest)
+			return
+		case len(bulkReq.Addresses) > maxBulkAddresses:
+			http.Error(w, fmt.Sprintf("at most %d addresses can be added at once", maxBulkAddresses), http.StatusBadRequest)
+			return
+		}
+
+		userID, ok := addingUserID(ctx, bulkReq.UserID)
+		if !ok {
+			http.Error(w, "API key may only add addresses to its own user", http.StatusForbidden)
+			return
+		}
+
+		if results, ok := validateBulkAdd(userID, bulkReq.Addresses); !ok {
+			writeJSON(w, http.StatusBadRequest, &BulkAddResponse{Results: results})
+			return
+		}
+
+		results, err := bulkAdd(ctx, s, b, userID, bulkReq.Addresses)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not add addresses. %v", err), statusFromErr(err))
+			return
+		}
+
+		// the addresses' transactions are still being imported if any job was queued
+		status := http.StatusOK
+		for _, v := range results {
+			if v.Status == bulkQueued {
+				status = http.StatusAccepted
+				break
+			}
+		}
+
+		writeJSON(w, status, &BulkAddResponse{Results: results})
+	})
+}
+
+// validateBulkAdd validates each of the provided addresses (& nicknames), returning a result for each and whether they
+// are all valid
+func validateBulkAdd(userID string, addrs []*BulkAddAddress) ([]*BulkAddResult, bool) {
+	results := make([]*BulkAddResult, len(addrs))
+	seen := map[string]bool{}
+	valid := true
+
+	for i, v := range addrs {
+		if v == nil {
+			v = &BulkAddAddress{}
+		}
+
+		result := &BulkAddResult{Address: v.Address, Nickname: v.Nickname, Status: bulkSkipped}
+		results[i] = result
+
+		var problem string
+		switch err := bitcoin.ValidateAddress(v.Address); {
+		case err != nil:
+			problem = err.Error()
+		case seen[v.Address]:
+			problem = "address is listed more than once"
+		case len(v.Nickname) > 0 && len(userID) == 0:
+			problem = "a nickname requires a user_id"
+		case len(v.Nickname) > maxNicknameLength:
+			problem = fmt.Sprintf("nickname is longer than %d characters", maxNicknameLength)
+		}
+
+		seen[v.Address] = true
+
+		if len(problem) > 0 {
+			result.Status = bulkInvalid
+			result.Error = problem
+			valid = false
+		}
+	}
+
+	return results, valid
+}
+
+// bulkAdd adds the provided (valid) addresses, attaching & nicknaming them for the provided user (if any). Their
+// stats are fetched up front, a hundred at a time from Blockchair's multi-address dashboard: the ones that never
+// transacted are stored right away, and a job is queued to import the transactions of each of the others, the ones
+// with the fewest transactions first. Everything is written in a single transaction.
+func bulkAdd(ctx context.Context, s *spanner.Client, b *blockchair.Client, userID string, addrs []*BulkAddAddress) ([]*BulkAddResult, error) {
+	log := logging.FromContext(ctx).With("user_id", userID, "addresses", len(addrs))
+
+	publicKeys := make([]string, len(addrs))
+	for i, v := range addrs {
+		publicKeys[i] = v.Address
+	}
+
+	// attaching the addresses to a user that doesn't exist should fail before we call out to Blockchair
+	if len(userID) > 0 {
+		if _, err := readUser(ctx, s.Single(), userID); err != nil {
+			return nil, err
+		}
+	}
+
+	stats := map[string]*blockchair.Address{}
+	for start := 0; start < len(publicKeys); start += blockchair.MaxAddressesPerCall {
+		end := start + blockchair.MaxAddressesPerCall
+		if end > len(publicKeys) {
+			end = len(publicKeys)
+		}
+
+		resp, err := b.GetAddressesStats(ctx, publicKeys[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range resp.Data.Addresses {
+			stats[k] = v
+		}
+	}
+
+	var results []*BulkAddResult
+
+	_, err := readWriteTransaction(ctx, s, "bulk_add_addresses", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// a retried transaction starts over
+		results = make([]*BulkAddResult, len(addrs))
+		now := time.Now().UTC()
+
+		existing, err := readExistingAddresses(ctx, txn, publicKeys)
+		if err != nil {
+			return err
+		}
+
+		if len(userID) > 0 {
+			if err := attachAddresses(ctx, txn, userID, publicKeys...); err != nil {
+				return err
+			}
+		}
+
+		mutations := []*spanner.Mutation{}
+		toImport := []*BulkAddResult{}
+
+		for i, v := range addrs {
+			result := &BulkAddResult{Address: v.Address, Nickname: v.Nickname}
+			results[i] = result
+
+			if len(v.Nickname) > 0 {
+				mut, err := spanner.InsertOrUpdateStruct(addressNicknamesTable, &AddressNicknamesRecord{
+					UserID:    userID,
+					PublicKey: v.Address,
+					Nickname:  v.Nickname,
+					UpdatedAt: now,
+				})
+				if err != nil {
+					return err
+				}
+
+				mutations = append(mutations, mut)
+			}
+
+			if addr, ok := existing[v.Address]; ok {
+				result.Status = bulkExisting
+				if addr.ArchivedAt.Valid {
+					result.Status = bulkArchived
+				}
+				result.NativeBalance = addr.NativeBalance
+				continue
+			}
+
+			// Blockchair answers for addresses it has never seen too, but it's safer to import one it didn't mention
+			stat, ok := stats[v.Address]
+			if !ok {
+				toImport = append(toImport, result)
+				continue
+			}
+
+			result.NativeBalance = int64(stat.Balance)
+			result.TransactionCount = stat.TransactionCount
+
+			if stat.TransactionCount > 0 {
+				toImport = append(toImport, result)
+				continue
+			}
+
+			mut, err := spanner.InsertStruct(addressesTable, &AddressesRecord{
+				PublicKey:     v.Address,
+				Balance:       stat.BalanceUSD,
+				NativeBalance: int64(stat.Balance),
+				CreatedAt:     now,
+				UpdatedAt:     now,
+			})
+			if err != nil {
+				return err
+			}
+
+			result.Status = bulkAdded
+			mutations = append(mutations, mut)
+		}
+
+		// jobs are claimed oldest first, so queueing the smallest imports first gets the most addresses ready soonest
+		sort.SliceStable(toImport, func(i, j int) bool {
+			return toImport[i].TransactionCount < toImport[j].TransactionCount
+		})
+
+		for _, result := range toImport {
+			job, mut, err := newJob(jobAddAddress, result.Address, userID)
+			if err != nil {
+				return err
+			}
+
+			result.Status = bulkQueued
+			result.JobID = job.JobID
+			mutations = append(mutations, mut)
+		}
+
+		return txn.BufferWrite(mutations)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("bulk added addresses")
+
+	return results, nil
+}
+
+// readExistingAddresses reads the AddressesRecords of the provided addresses that are already stored, keyed by public key
+func readExistingAddresses(ctx context.Context, txn querier, addrs []string) (map[string]*AddressesRecord, error) {
+	stmt := spanner.NewStatement(fmt.Sprintf(`SELECT %s FROM addresses WHERE public_key IN UNNEST(@addresses)`, strings.Join(addressColumns, ", ")))
+	stmt.Params["addresses"] = addrs
+
+	existing := map[string]*AddressesRecord{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		addr, err := decodeAddress(row)
+		if err != nil {
+			return err
+		}
+
+		existing[addr.PublicKey] = addr
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// readAddressNicknames reads the provided user's nicknames for their addresses, keyed by public key
+func readAddressNicknames(ctx context.Context, txn querier, userID string) (map[string]string, error) {
+	stmt := spanner.NewStatement(`SELECT public_key, nickname FROM address_nicknames WHERE user_id = @user_id`)
+	stmt.Params["user_id"] = userID
+
+	nicknames := map[string]string{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var addr, nickname string
+		if err := row.Columns(&addr, &nickname); err != nil {
+			return err
+		}
+
+		nicknames[addr] = nickname
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nicknames, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxEventSize bounds the size of a single Server-Sent Event, e.g. one carrying a synced address
+const maxEventSize = 1024 * 1024
+
+// APIError is a non-2xx answer from the API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error returns the status along with the message the API answered with
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// client calls the server's v1 API
+type client struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// newClient returns a client of the server at the provided base URL, authenticating with the provided API key (if any)
+func newClient(baseURL, apiKey string, timeout time.Duration) *client {
+	return &client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: timeout},
+	}
+}
+
+// do sends a request with the provided body (JSON-encoded unless nil) and decodes the response into out (unless nil),
+// returning an *APIError for anything but a 2xx
+func (c *client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	resp, err := c.send(ctx, method, path, query, body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("could not parse the API's response: %v", err)
+	}
+
+	return nil
+}
+
+// stream sends a request like do, asking for its response as Server-Sent Events, and calls onEvent with the type &
+// data of each event until the stream ends (or onEvent returns an error)
+func (c *client) stream(ctx context.Context, method, path string, query url.Values, body interface{}, onEvent func(event string, data []byte) error) error {
+	resp, err := c.send(ctx, method, path, query, body, "text/event-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var event string
+	var data []byte
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case len(line) == 0:
+			// a blank line dispatches the event read so far
+			if len(data) > 0 {
+				if err := onEvent(event, data); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// send sends a request with the provided body (JSON-encoded unless nil), accepting the provided content type, and
+// returns its response, or an *APIError for anything but a 2xx
+func (c *client) send(ctx context.Context, method, path string, query url.Values, body interface{}, accept string) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", accept)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		raw, _ := ioutil.ReadAll(resp.Body)
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(raw))}
+	}
+
+	return resp, nil
+}
+
+// addressPath returns the v1 path of the provided address' resource, followed by the provided suffix (if any)
+func addressPath(addr, suffix string) string {
+	return "/v1/addresses/" + url.PathEscape(addr) + suffix
+}
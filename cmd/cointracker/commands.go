@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transferTimeLayout is the timestamp layout the detect-transfers endpoint expects
+const transferTimeLayout = "2006-01-02 15:04:05 UTC"
+
+// address mirrors the server's AddressesRecord
+type address struct {
+	PublicKey     string
+	Balance       float64
+	NativeBalance int64
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	LastTxnHash   string
+}
+
+// addressResponse mirrors the server's AddResponse and SyncResponse
+type addressResponse struct {
+	Address *address `json:"address"`
+}
+
+// syncEvent mirrors the server's SyncEvent
+type syncEvent struct {
+	Type    string          `json:"type"`
+	At      time.Time       `json:"at"`
+	Address string          `json:"address"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// syncEventData holds the fields of every type of sync event's data
+type syncEventData struct {
+	Transactions int
+	Batches      int
+	Batch        int
+	Reorged      int
+	Until        time.Time
+	Wait         float64 `json:"wait_ms"`
+	Waited       float64 `json:"waited_ms"`
+	OutID        string  `json:"out_id"`
+	InID         string  `json:"in_id"`
+	Error        string
+}
+
+// balanceResponse mirrors the server's BalanceResponse
+type balanceResponse struct {
+	Balance float64 `json:"balance"`
+}
+
+// transaction mirrors the server's TransactionsRecord
+type transaction struct {
+	TxnHash       string
+	PublicKey     string
+	Amount        float64
+	Fee           float64
+	NativeFee     int64
+	BalanceChange int64
+	Price         float64
+	PriceCurrency string
+	PriceSource   string
+	Tags          string
+	TxnTimestamp  time.Time
+	CreatedAt     time.Time
+}
+
+// transactionsResponse mirrors the server's TransactionsResponse
+type transactionsResponse struct {
+	Transactions []*transaction `json:"transactions"`
+	NextCursor   string         `json:"next_cursor,omitempty"`
+}
+
+// transferTxn mirrors the server's CustomTxn
+type transferTxn struct {
+	ID     string  `json:"id"`
+	Wallet string  `json:"wallet"`
+	Time   string  `json:"time"`
+	Flow   string  `json:"flow"`
+	Amount float64 `json:"amount"`
+}
+
+// parseArgs parses the provided command flags, which may come before or after the command's single positional argument
+func parseArgs(flags *flag.FlagSet, args []string) (string, error) {
+	flags.SetOutput(ioutil.Discard)
+
+	if err := flags.Parse(args); err != nil {
+		return "", fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	if flags.NArg() == 0 {
+		return "", errUsage
+	}
+
+	arg := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return "", fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	if flags.NArg() > 0 {
+		return "", fmt.Errorf("%w: unexpected arguments %s", errUsage, strings.Join(flags.Args(), " "))
+	}
+
+	return arg, nil
+}
+
+// addCommand adds an address (syncing it if it's new), optionally attaching it to a user
+func addCommand(ctx context.Context, c *client, out *printer, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	userID := flags.String("user", "", "the uuid of the user to attach the address to")
+	follow := flags.Bool("follow", false, "print the sync's progress as it runs")
+	detect := flags.Bool("detect-transfers", false, "detect the user's transfers once it's synced (implies -follow)")
+
+	addr, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{"address": addr, "user_id": *userID}
+	if *follow || *detect {
+		return followSync(ctx, c, out, "/v1/addresses", *detect, body)
+	}
+
+	var resp addressResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/addresses", nil, body, &resp); err != nil {
+		return err
+	}
+
+	return printAddress(out, &resp)
+}
+
+// balanceCommand prints an address' stored balance
+func balanceCommand(ctx context.Context, c *client, out *printer, args []string) error {
+	addr, err := parseArgs(flag.NewFlagSet("balance", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	var resp balanceResponse
+	if err := c.do(ctx, http.MethodGet, addressPath(addr, "/balance"), nil, nil, &resp); err != nil {
+		return err
+	}
+
+	return out.print(&resp, []string{"address", "balance_usd"}, [][]string{{addr, formatFloat(resp.Balance)}})
+}
+
+// syncCommand syncs an address with the blockchain, printing its updated state
+func syncCommand(ctx context.Context, c *client, out *printer, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	follow := flags.Bool("follow", false, "print the sync's progress as it runs")
+	detect := flags.Bool("detect-transfers", false, "detect the API key's user's transfers once it's synced (implies -follow)")
+
+	addr, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *follow || *detect {
+		return followSync(ctx, c, out, addressPath(addr, "/sync"), *detect, nil)
+	}
+
+	var resp addressResponse
+	if err := c.do(ctx, http.MethodPost, addressPath(addr, "/sync"), nil, nil, &resp); err != nil {
+		return err
+	}
+
+	return printAddress(out, &resp)
+}
+
+// followSync posts the provided body to the provided path of a route that syncs an address, following its progress:
+// each step is printed to stderr as it happens, and the synced address once it's done
+func followSync(ctx context.Context, c *client, out *printer, path string, detectTransfers bool, body interface{}) error {
+	query := url.Values{}
+	if detectTransfers {
+		query.Set("detect_transfers", "true")
+	}
+
+	var resp *addressResponse
+	err := c.stream(ctx, http.MethodPost, path, query, body, func(_ string, raw []byte) error {
+		var event syncEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return fmt.Errorf("could not parse the API's event: %v", err)
+		}
+
+		var data syncEventData
+		json.Unmarshal(event.Data, &data)
+
+		switch event.Type {
+		case "sync.finished":
+			resp = &addressResponse{}
+			if err := json.Unmarshal(event.Data, resp); err != nil {
+				return fmt.Errorf("could not parse the API's event: %v", err)
+			}
+		case "sync.failed":
+			return fmt.Errorf("sync failed: %s", data.Error)
+		default:
+			printProgress(os.Stderr, &event, &data)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp == nil {
+		return errors.New("the API ended the stream before the sync finished")
+	}
+
+	return printAddress(out, resp)
+}
+
+// printProgress prints a line describing the provided step of a sync
+func printProgress(w io.Writer, event *syncEvent, data *syncEventData) {
+	switch event.Type {
+	case "sync.started":
+		fmt.Fprintf(w, "syncing %s: %d new transactions in %d batches, %d reorged\n", event.Address, data.Transactions, data.Batches, data.Reorged)
+	case "batch.fetched":
+		fmt.Fprintf(w, "fetched batch %d/%d (%d transactions)\n", data.Batch, data.Batches, data.Transactions)
+	case "rate_limit.wait":
+		wait := time.Duration(data.Wait * float64(time.Millisecond)).Round(time.Second)
+		fmt.Fprintf(w, "rate limited by Blockchair, resuming in %s (at %s)\n", wait, data.Until.Local().Format("15:04:05"))
+	case "rate_limit.resumed":
+		fmt.Fprintf(w, "resumed after %s\n", time.Duration(data.Waited*float64(time.Millisecond)).Round(time.Second))
+	case "transactions.inserted":
+		fmt.Fprintf(w, "inserted %d transactions, removed %d reorged\n", data.Transactions, data.Reorged)
+	case "transfer.detected":
+		fmt.Fprintf(w, "detected transfer %s -> %s\n", data.OutID, data.InID)
+	default:
+		fmt.Fprintf(w, "%s\n", event.Type)
+	}
+}
+
+// printAddress prints an address' stored state
+func printAddress(out *printer, resp *addressResponse) error {
+	a := resp.Address
+	if a == nil {
+		a = &address{}
+	}
+
+	header := []string{"public_key", "balance_usd", "native_balance", "last_txn_hash", "updated_at"}
+	row := []string{a.PublicKey, formatFloat(a.Balance), strconv.FormatInt(a.NativeBalance, 10), a.LastTxnHash, formatTime(a.UpdatedAt)}
+
+	return out.print(resp, header, [][]string{row})
+}
+
+// transactionsCommand prints a page of an address' stored transactions (or all of them, with -all)
+func transactionsCommand(ctx context.Context, c *client, out *printer, args []string) error {
+	flags := flag.NewFlagSet("transactions", flag.ContinueOnError)
+	all := flags.Bool("all", false, "follow the cursor until every matching transaction is printed")
+
+	query := url.Values{}
+	for _, param := range []string{"limit", "cursor", "from", "to", "direction", "tag", "sort", "order", "min_amount", "max_amount"} {
+		param := param
+		flags.Func(strings.ReplaceAll(param, "_", "-"), "the "+param+" query parameter", func(v string) error {
+			query.Set(param, v)
+			return nil
+		})
+	}
+
+	addr, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	resp := &transactionsResponse{Transactions: []*transaction{}}
+	for {
+		var page transactionsResponse
+		if err := c.do(ctx, http.MethodGet, addressPath(addr, "/transactions"), query, nil, &page); err != nil {
+			return err
+		}
+
+		resp.Transactions = append(resp.Transactions, page.Transactions...)
+		resp.NextCursor = page.NextCursor
+
+		if !*all || len(page.NextCursor) == 0 {
+			break
+		}
+
+		query.Set("cursor", page.NextCursor)
+	}
+
+	header := []string{"txn_hash", "time", "balance_change", "amount_usd", "fee_usd", "price", "currency", "tags"}
+	rows := [][]string{}
+	for _, t := range resp.Transactions {
+		rows = append(rows, []string{
+			t.TxnHash,
+			formatTime(t.TxnTimestamp),
+			strconv.FormatInt(t.BalanceChange, 10),
+			formatFloat(t.Amount),
+			formatFloat(t.Fee),
+			formatFloat(t.Price),
+			t.PriceCurrency,
+			t.Tags,
+		})
+	}
+
+	if err := out.print(resp, header, rows); err != nil {
+		return err
+	}
+
+	// the cursor isn't part of a table or CSV, so point at it on stderr rather than lose it
+	if out.format != formatJSON && len(resp.NextCursor) > 0 {
+		fmt.Fprintf(os.Stderr, "more transactions: -cursor %s (or -all)\n", resp.NextCursor)
+	}
+
+	return nil
+}
+
+// detectTransfersCommand detects likely transfers among the transactions of a CSV or JSON file
+func detectTransfersCommand(ctx context.Context, c *client, out *printer, args []string) error {
+	flags := flag.NewFlagSet("detect-transfers", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	path := flags.String("file", "", "the transactions to look through, or - for stdin")
+	format := flags.String("format", "", "the file's format, json or csv (default: from its extension)")
+
+	if err := flags.Parse(args); err != nil || len(*path) == 0 || flags.NArg() > 0 {
+		return errUsage
+	}
+
+	if len(*format) == 0 {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*path)), ".")
+	}
+
+	var r io.Reader = os.Stdin
+	if *path != "-" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var txns []*transferTxn
+	var err error
+	switch *format {
+	case formatJSON:
+		txns, err = readTransferJSON(r)
+	case formatCSV:
+		txns, err = readTransferCSV(r)
+	default:
+		return fmt.Errorf("%w: -format must be json or csv", errUsage)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", *path, err)
+	}
+
+	resp := map[string]string{}
+	if err := c.do(ctx, http.MethodPost, "/v1/detect-transfers", nil, map[string]interface{}{"transactions": txns}, &resp); err != nil {
+		return err
+	}
+
+	outIDs := []string{}
+	for k := range resp {
+		outIDs = append(outIDs, k)
+	}
+	sort.Strings(outIDs)
+
+	rows := [][]string{}
+	for _, id := range outIDs {
+		rows = append(rows, []string{id, resp[id]})
+	}
+
+	return out.print(resp, []string{"out_id", "in_id"}, rows)
+}
+
+// readTransferJSON reads transactions in the shape of test_json/detect_transfers.json, i.e. {"transactions": [...]}
+func readTransferJSON(r io.Reader) ([]*transferTxn, error) {
+	var body struct {
+		Transactions []*transferTxn `json:"transactions"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	for i, t := range body.Transactions {
+		if err := t.normalizeTime(); err != nil {
+			return nil, fmt.Errorf("transaction %d: %v", i, err)
+		}
+	}
+
+	return body.Transactions, nil
+}
+
+// readTransferCSV reads transactions from a CSV with an id, wallet, time, flow and amount column (in any order)
+func readTransferCSV(r io.Reader) ([]*transferTxn, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"id", "wallet", "time", "flow", "amount"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing %q column", name)
+		}
+	}
+
+	txns := []*transferTxn{}
+	for i, record := range records[1:] {
+		amount, err := strconv.ParseFloat(strings.TrimSpace(record[columns["amount"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: amount must be a number", i+2)
+		}
+
+		t := &transferTxn{
+			ID:     record[columns["id"]],
+			Wallet: record[columns["wallet"]],
+			Time:   record[columns["time"]],
+			Flow:   strings.ToLower(strings.TrimSpace(record[columns["flow"]])),
+			Amount: amount,
+		}
+
+		if err := t.normalizeTime(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+
+		txns = append(txns, t)
+	}
+
+	return txns, nil
+}
+
+// normalizeTime rewrites the transaction's time in the layout the API expects, also accepting RFC 3339 timestamps
+func (t *transferTxn) normalizeTime() error {
+	v := strings.TrimSpace(t.Time)
+
+	parsed, err := time.Parse(transferTimeLayout, v)
+	if err != nil {
+		if parsed, err = time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("time %q must look like %q or be an RFC 3339 timestamp", t.Time, transferTimeLayout)
+		}
+	}
+
+	t.Time = parsed.UTC().Format(transferTimeLayout)
+	return nil
+}
+
+// formatFloat formats a float without trailing zeros
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatTime formats a time as RFC 3339, or as nothing if it's zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
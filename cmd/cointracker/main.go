@@ -0,0 +1,144 @@
+// Command cointracker is a command-line client for the server's v1 API, e.g.
+//
+//	cointracker add 3E8ociqZa9mZUSwGdSmAEMAoAxBK3FNDcd
+//	cointracker -o csv transactions -all 3E8ociqZa9mZUSwGdSmAEMAoAxBK3FNDcd > txns.csv
+//	cointracker detect-transfers -file test_json/detect_transfers.json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exit codes, so that scripts can tell a bad invocation from a request the API rejected or failed
+const (
+	exitOK          = 0
+	exitError       = 1 // anything local, e.g. an unreadable input file or an unreachable server
+	exitUsage       = 2
+	exitClientError = 3 // the API answered with a 4xx, e.g. an unknown address
+	exitServerError = 4 // the API answered with a 5xx
+)
+
+const (
+	defaultServerURL = "http://localhost:8080"
+	defaultTimeout   = 5 * time.Minute // a sync can wait out the Blockchair API's rate limit before it responds
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *client, out *printer, args []string) error
+}
+
+// commands are the CLI's subcommands, keyed by name
+var commands = map[string]*command{
+	"add":              {"add [-user <uuid>] [-follow] [-detect-transfers] <address>", addCommand},
+	"balance":          {"balance <address>", balanceCommand},
+	"transactions":     {"transactions [-limit n] [-cursor c] [-all] [-from t] [-to t] [-direction in|out] [-tag t] [-sort timestamp|amount] [-order asc|desc] <address>", transactionsCommand},
+	"sync":             {"sync [-follow] [-detect-transfers] <address>", syncCommand},
+	"detect-transfers": {"detect-transfers -file <path|-> [-format json|csv]", detectTransfersCommand},
+}
+
+// errUsage is returned by commands invoked with the wrong arguments
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the CLI with the provided arguments, returning its exit code
+func run(args []string) int {
+	flags := flag.NewFlagSet("cointracker", flag.ContinueOnError)
+	serverURL := flags.String("server", envOr("COINTRACKER_URL", defaultServerURL), "the server's base URL (env: COINTRACKER_URL)")
+	apiKey := flags.String("api-key", os.Getenv("COINTRACKER_API_KEY"), "the API key to authenticate with (env: COINTRACKER_API_KEY)")
+	output := flags.String("o", formatTable, "the output format: table, json or csv")
+	timeout := flags.Duration("timeout", defaultTimeout, "how long to wait for each request")
+	flags.Usage = func() { usage(flags) }
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if flags.NArg() == 0 {
+		usage(flags)
+		return exitUsage
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		usage(flags)
+		return exitUsage
+	}
+
+	out, err := newPrinter(os.Stdout, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	c := newClient(*serverURL, *apiKey, *timeout)
+
+	err = cmd.run(context.Background(), c, out, flags.Args()[1:])
+
+	var apiErr *APIError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintf(os.Stderr, "usage: cointracker [flags] %s\n", cmd.usage)
+		return exitUsage
+	case errors.As(err, &apiErr):
+		fmt.Fprintln(os.Stderr, apiErr)
+		if apiErr.StatusCode >= 500 {
+			return exitServerError
+		}
+		return exitClientError
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+}
+
+// usage prints the CLI's usage to stderr
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "usage: cointracker [flags] <command> [command flags] [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flags.PrintDefaults()
+
+	fmt.Fprintln(os.Stderr, "\nexit codes: 0 ok, 1 error, 2 usage, 3 rejected by the API (4xx), 4 failed by the API (5xx)")
+}
+
+// envOr returns the named environment variable, or the provided fallback if it's unset
+func envOr(name, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); len(v) > 0 {
+		return v
+	}
+
+	return fallback
+}
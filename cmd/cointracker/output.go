@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+// printer writes a command's result in the chosen format: JSON prints the API's response as is, while tables and
+// CSVs print the rows the command picked out of it
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+// newPrinter returns a printer writing to the provided writer in the named format
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case formatTable, formatJSON, formatCSV:
+		return &printer{w: w, format: format}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, must be one of: %s, %s, %s", format, formatTable, formatJSON, formatCSV)
+	}
+}
+
+// print writes the provided response (for JSON) or header and rows (for tables and CSVs)
+func (p *printer) print(resp interface{}, header []string, rows [][]string) error {
+	switch p.format {
+	case formatJSON:
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	case formatCSV:
+		w := csv.NewWriter(p.w)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	}
+}
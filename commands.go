@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/config"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges/fakeexchange"
+	"github.com/jf2978/cointracker-eng-assignment/importer"
+	"github.com/jf2978/cointracker-eng-assignment/journal"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/webhooks"
+)
+
+// commands are the administrative subcommands of this binary, e.g. `go run . tax-report -user <uuid> -year 2021`
+var commands = map[string]func(ctx context.Context, cfg *config.Config, args []string) error{
+	"tax-report":       taxReportCommand,
+	"journal":          journalCommand,
+	"import":           importCommand,
+	"fake-exchange":    fakeExchangeCommand,
+	"migrate":          migrateCommand,
+	"create-api-key":   createAPIKeyCommand,
+	"webhook-receiver": webhookReceiverCommand,
+}
+
+// runCommand runs the named command with the provided config and arguments
+func runCommand(ctx context.Context, cfg *config.Config, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := []string{}
+		for k := range commands {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		return fmt.Errorf("unknown command %q, must be one of: %s", name, strings.Join(names, ", "))
+	}
+
+	return cmd(ctx, cfg, args)
+}
+
+// taxReportCommand writes the Form 8949-style CSV of a user's tax year, and prints its summary to stderr
+func taxReportCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("tax-report", flag.ExitOnError)
+	userID := flags.String("user", "", "the uuid of the user to report on (required)")
+	year := flags.Int("year", time.Now().Year()-1, "the tax year to report on")
+	currency := flags.String("currency", defaultCurrency, "the fiat currency to report in")
+	out := flags.String("out", "", "the file to write the CSV to (default: stdout)")
+	flags.Parse(args)
+
+	if len(*userID) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-user is required")
+	}
+
+	s, err := newSpannerClient(ctx, cfg.Storage.Spanner)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	priceStore, err := newPriceStore(ctx, cfg.Prices.HistoryDir)
+	if err != nil {
+		return err
+	}
+
+	report, err := taxReport(ctx, s, priceStore, *userID, *year, strings.ToUpper(*currency))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	if err := report.WriteCSV(w); err != nil {
+		return err
+	}
+
+	return report.WriteSummary(os.Stderr)
+}
+
+// journalCommand writes a user's beancount or ledger-cli journal
+func journalCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	userID := flags.String("user", "", "the uuid of the user to export (required)")
+	format := flags.String("format", string(journal.Beancount), "the journal format, beancount or ledger")
+	currency := flags.String("currency", defaultCurrency, "the fiat currency of the journal's prices")
+	out := flags.String("out", "", "the file to write the journal to (default: stdout)")
+	flags.Parse(args)
+
+	if len(*userID) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-user is required")
+	}
+
+	f, err := journal.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	s, err := newSpannerClient(ctx, cfg.Storage.Spanner)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	priceStore, err := newPriceStore(ctx, cfg.Prices.HistoryDir)
+	if err != nil {
+		return err
+	}
+
+	j, err := userJournal(ctx, s, priceStore, *userID, strings.ToUpper(*currency))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		w = file
+	}
+
+	return j.Write(w, f)
+}
+
+// importCommand imports an exchange CSV export for a user, printing what was (or would be) imported
+func importCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	userID := flags.String("user", "", "the uuid of the user to import for (required)")
+	format := flags.String("format", string(importer.Generic), "the export's format: coinbase, kraken or generic")
+	path := flags.String("file", "", "the CSV export to import (required)")
+	dryRun := flags.Bool("dry-run", false, "only print what would be imported")
+	flags.Parse(args)
+
+	if len(*userID) == 0 || len(*path) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-user and -file are required")
+	}
+
+	f, err := importer.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	txns, err := importer.Parse(file, f)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", *path, err)
+	}
+
+	s, err := newSpannerClient(ctx, cfg.Storage.Spanner)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	resp, err := importTransactions(ctx, s, *userID, txns, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+
+	for _, v := range resp.Imported {
+		fmt.Printf("%s %s: %s %s %s on %s\n", verb, v.ImportID, v.Type, strconv.FormatFloat(v.Quantity, 'f', -1, 64), v.Asset, v.TxnTimestamp.Format(time.RFC3339))
+	}
+
+	fmt.Printf("%s %d transactions, skipped %d already imported\n", verb, len(resp.Imported), len(resp.Duplicates))
+	return nil
+}
+
+// fakeExchangeCommand serves a stand-in for Kraken's API with a seeded ledger, for connecting exchange accounts locally
+func fakeExchangeCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("fake-exchange", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8081", "the address to listen on")
+	key := flags.String("key", "fake-key", "the API key to accept")
+	secret := flags.String("secret", "ZmFrZS1zZWNyZXQ=", "the (base64-encoded) API secret to accept")
+	flags.Parse(args)
+
+	server := fakeexchange.NewServer(exchanges.Credentials{Key: *key, Secret: *secret})
+	server.Seed(time.Now().AddDate(0, 0, -7))
+
+	logging.FromContext(ctx).Info("serving a fake exchange", "addr", *addr, "hint", fmt.Sprintf("set KRAKEN_API_URL=http://%s to sync against it", *addr))
+	return http.ListenAndServe(*addr, server)
+}
+
+// webhookReceiverCommand serves a local webhook subscriber that verifies & logs the deliveries it's sent, for testing
+// subscriptions
+func webhookReceiverCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("webhook-receiver", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8082", "the address to listen on")
+	secret := flags.String("secret", "", "the subscription's signing secret (required)")
+	failRate := flags.Float64("fail-rate", 0, "the share of deliveries (between 0 and 1) to fail with a 503, to exercise retries")
+	flags.Parse(args)
+
+	if len(*secret) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-secret is required")
+	}
+
+	log := logging.FromContext(ctx)
+	receiver := webhooks.NewReceiver(*secret, *failRate, func(d *webhooks.Delivery) {
+		log.Info("received webhook", "delivery_id", d.ID, "event", d.Event.Type, "event_id", d.Event.ID, "user_id", d.Event.UserID, "address", d.Event.Address)
+	})
+
+	log.Info("serving a webhook receiver", "addr", *addr, "hint", fmt.Sprintf("subscribe http://%s with the secret it was created with; GET it to list what it received", *addr))
+	return http.ListenAndServe(*addr, receiver)
+}
+
+// migrateCommand applies (up), reverts (down) or lists (status) the schema migrations of the configured storage backend
+func migrateCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status [-steps n]")
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := flags.Int("steps", 0, "how many migrations to apply or revert (default: every pending one for up, 1 for down)")
+	flags.Parse(args[1:])
+
+	migrator, closeMigrator, err := newMigrator(ctx, cfg.Storage, true)
+	if err != nil {
+		return err
+	}
+	defer closeMigrator()
+
+	log := logging.FromContext(ctx)
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx, *steps)
+		for _, m := range applied {
+			log.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			log.Info("schema is up to date")
+		}
+		return nil
+	case "down":
+		reverted, err := migrator.Down(ctx, *steps)
+		for _, m := range reverted {
+			log.Info("reverted migration", "version", m.Version, "name", m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, v := range statuses {
+			appliedAt := "pending"
+			if v.AppliedAt != nil {
+				appliedAt = v.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", v.Version, v.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate subcommand %q, must be one of: up, down, status", args[0])
+	}
+}
+
+// createAPIKeyCommand creates an API key for a user (or for a new one, with -username) and prints it (the only time
+// it's shown), e.g. to bootstrap the first admin key
+func createAPIKeyCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	userID := flags.String("user", "", "the uuid of the user the key belongs to")
+	username := flags.String("username", "", "creates a user with this username for the key to belong to instead")
+	scopes := flags.String("scopes", scopeRead, "the comma-delimited scopes to grant: read, write and/or admin")
+	name := flags.String("name", "", "a name to tell the key apart by")
+	flags.Parse(args)
+
+	if (len(*userID) == 0) == (len(*username) == 0) {
+		flags.Usage()
+		return fmt.Errorf("either -user or -username is required")
+	}
+
+	granted := []string{}
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if _, ok := scopeLevels[scope]; !ok {
+			return fmt.Errorf("unknown scope %q, must be one of: %s, %s, %s", scope, scopeRead, scopeWrite, scopeAdmin)
+		}
+
+		granted = append(granted, scope)
+	}
+
+	s, err := newSpannerClient(ctx, cfg.Storage.Spanner)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if len(*username) > 0 {
+		user, err := createUser(ctx, s, *username)
+		if err != nil {
+			return err
+		}
+
+		*userID = user.UUID
+		logging.FromContext(ctx).Info("created user", "user_id", user.UUID, "username", user.Username)
+	} else if _, err := readUser(ctx, s.Single(), *userID); err != nil {
+		return fmt.Errorf("could not get user %s: %v", *userID, err)
+	}
+
+	record, key, err := createAPIKey(ctx, s, *userID, *name, granted)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("created API key", "key_id", record.KeyID, "user_id", record.UserID, "scopes", record.Scopes)
+	fmt.Println(key)
+	return nil
+}
@@ -0,0 +1,447 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// the supported storage backends, providers and trace exporters
+var (
+	StorageBackends = []string{"spanner"}
+	Providers       = []string{"blockchair"}
+	TraceExporters  = []string{"none", "stdout", "stderr"}
+)
+
+// Config is everything the server (and its commands) can be configured with. It's layered: Default() values, then a
+// YAML or JSON file, then environment variables, then flags, each overriding the last (see Load).
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Provider  ProviderConfig  `yaml:"provider"`
+	Exchanges ExchangesConfig `yaml:"exchanges"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Prices    PricesConfig    `yaml:"prices"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+}
+
+// ServerConfig is where the server listens
+type ServerConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+// Addr returns the host:port the server listens on
+func (c ServerConfig) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// StorageConfig picks the storage backend and configures it
+type StorageConfig struct {
+	Backend string        `yaml:"backend"`
+	Spanner SpannerConfig `yaml:"spanner"`
+}
+
+// SpannerConfig locates our Spanner database, and how to authenticate against it
+type SpannerConfig struct {
+	Project         string `yaml:"project"`
+	Instance        string `yaml:"instance"`
+	Database        string `yaml:"database"`
+	CredentialsFile string `yaml:"credentials_file"` // a service account key, unused against the emulator
+	EmulatorHost    string `yaml:"emulator_host"`    // host:port of a Spanner emulator to use instead of Spanner itself
+}
+
+// DatabasePath returns the fully qualified name of the database
+func (c SpannerConfig) DatabasePath() string {
+	return fmt.Sprintf("projects/%s/instances/%s/databases/%s", c.Project, c.Instance, c.Database)
+}
+
+// ProviderConfig picks the blockchain data provider and configures it
+type ProviderConfig struct {
+	Name       string           `yaml:"name"`
+	Blockchair BlockchairConfig `yaml:"blockchair"`
+}
+
+// BlockchairConfig configures the Blockchair API client
+type BlockchairConfig struct {
+	BaseURL       string        `yaml:"base_url"`
+	APIKey        string        `yaml:"api_key"` // optional, lifts the free tier's rate limit
+	Timeout       time.Duration `yaml:"timeout"`
+	RateLimit     int           `yaml:"rate_limit"` // calls per minute
+	RateLimitWait time.Duration `yaml:"rate_limit_wait"`
+}
+
+// ExchangesConfig configures the exchange connectors
+type ExchangesConfig struct {
+	Kraken KrakenConfig `yaml:"kraken"`
+
+	// the base64-encoded 32 byte key exchange account credentials are encrypted at rest with (see secrets.Box), without
+	// which accounts can't be connected
+	CredentialsKey string `yaml:"credentials_key"`
+}
+
+// KrakenConfig configures the Kraken connector
+type KrakenConfig struct {
+	BaseURL string `yaml:"base_url"`
+}
+
+// SchedulerConfig configures the background jobs
+type SchedulerConfig struct {
+	ExchangeSync    JobConfig `yaml:"exchange_sync"`
+	WebhookDelivery JobConfig `yaml:"webhook_delivery"`
+	Jobs            JobConfig `yaml:"jobs"` // runs the adds & syncs requested asynchronously
+}
+
+// JobConfig configures a background job
+type JobConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// PricesConfig configures the price store
+type PricesConfig struct {
+	HistoryDir string `yaml:"history_dir"` // every .csv file in here is loaded into the price store at startup
+}
+
+// LoggingConfig configures the logger
+type LoggingConfig struct {
+	Level string `yaml:"level"`
+}
+
+// TracingConfig configures where spans are exported to
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"`
+}
+
+// AuthConfig configures API key authentication
+type AuthConfig struct {
+	Enabled bool `yaml:"enabled"` // when disabled, every request is let through as if it were made with an admin key
+}
+
+// WebhooksConfig configures webhook deliveries
+type WebhooksConfig struct {
+	// lets subscriptions deliver to loopback & private network addresses, e.g. a local webhooks.Receiver. Only meant
+	// for testing, since any write-scoped key could then have the server post to internal services.
+	AllowPrivateURLs bool `yaml:"allow_private_urls"`
+}
+
+// Default returns the config used for anything that isn't overridden
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host: "localhost",
+			Port: 8080,
+		},
+		Storage: StorageConfig{
+			Backend: "spanner",
+			Spanner: SpannerConfig{
+				Project:         "cointracker-test-1234",
+				Instance:        "test-instance",
+				Database:        "test-db",
+				CredentialsFile: "./service-account.json",
+			},
+		},
+		Provider: ProviderConfig{
+			Name: "blockchair",
+			Blockchair: BlockchairConfig{
+				BaseURL:       blockchair.DefaultBaseURL,
+				Timeout:       blockchair.DefaultTimeout,
+				RateLimit:     blockchair.DefaultRateLimit,
+				RateLimitWait: blockchair.DefaultRateLimitWait,
+			},
+		},
+		Exchanges: ExchangesConfig{
+			Kraken: KrakenConfig{BaseURL: exchanges.KrakenURL},
+		},
+		Scheduler: SchedulerConfig{
+			ExchangeSync:    JobConfig{Enabled: true, Interval: 15 * time.Minute},
+			WebhookDelivery: JobConfig{Enabled: true, Interval: 5 * time.Second},
+			Jobs:            JobConfig{Enabled: true, Interval: time.Second},
+		},
+		Prices: PricesConfig{
+			HistoryDir: "./price_history",
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+		Auth: AuthConfig{
+			Enabled: true,
+		},
+	}
+}
+
+// setting is a single config value that can be overridden by an environment variable and a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) interface{} // returns a pointer to the value, i.e. a *string, *int, *bool or *time.Duration
+}
+
+// settings lists everything that can be overridden by environment variables and flags, everything else is only set
+// by the config file
+var settings = []*setting{
+	{"host", "LISTEN_HOST", "the host to listen on", func(c *Config) interface{} { return &c.Server.Host }},
+	{"port", "PORT", "the port to listen on", func(c *Config) interface{} { return &c.Server.Port }},
+	{"storage", "STORAGE_BACKEND", "the storage backend, one of: " + strings.Join(StorageBackends, ", "), func(c *Config) interface{} { return &c.Storage.Backend }},
+	{"spanner-project", "SPANNER_PROJECT", "the GCP project of the Spanner instance", func(c *Config) interface{} { return &c.Storage.Spanner.Project }},
+	{"spanner-instance", "SPANNER_INSTANCE", "the Spanner instance", func(c *Config) interface{} { return &c.Storage.Spanner.Instance }},
+	{"spanner-database", "SPANNER_DATABASE", "the Spanner database", func(c *Config) interface{} { return &c.Storage.Spanner.Database }},
+	{"credentials", "GOOGLE_APPLICATION_CREDENTIALS", "the service account key file to authenticate with", func(c *Config) interface{} { return &c.Storage.Spanner.CredentialsFile }},
+	{"spanner-emulator", "SPANNER_EMULATOR_HOST", "the host:port of a Spanner emulator to use instead of Spanner", func(c *Config) interface{} { return &c.Storage.Spanner.EmulatorHost }},
+	{"provider", "PROVIDER", "the blockchain data provider, one of: " + strings.Join(Providers, ", "), func(c *Config) interface{} { return &c.Provider.Name }},
+	{"blockchair-url", "BLOCKCHAIR_API_URL", "the base URL of the Blockchair API", func(c *Config) interface{} { return &c.Provider.Blockchair.BaseURL }},
+	{"blockchair-key", "BLOCKCHAIR_API_KEY", "the Blockchair API key (optional)", func(c *Config) interface{} { return &c.Provider.Blockchair.APIKey }},
+	{"blockchair-rate-limit", "BLOCKCHAIR_RATE_LIMIT", "how many Blockchair API calls per minute are allowed", func(c *Config) interface{} { return &c.Provider.Blockchair.RateLimit }},
+	{"blockchair-rate-limit-wait", "BLOCKCHAIR_RATE_LIMIT_WAIT", "how long to wait once rate limited by the Blockchair API", func(c *Config) interface{} { return &c.Provider.Blockchair.RateLimitWait }},
+	{"kraken-url", "KRAKEN_API_URL", "the base URL of the Kraken API", func(c *Config) interface{} { return &c.Exchanges.Kraken.BaseURL }},
+	{"exchange-credentials-key", "EXCHANGE_CREDENTIALS_KEY", "the base64-encoded 32 byte key exchange credentials are encrypted with", func(c *Config) interface{} { return &c.Exchanges.CredentialsKey }},
+	{"exchange-sync", "EXCHANGE_SYNC_ENABLED", "whether exchange accounts are synced in the background", func(c *Config) interface{} { return &c.Scheduler.ExchangeSync.Enabled }},
+	{"exchange-sync-interval", "EXCHANGE_SYNC_INTERVAL", "how often exchange accounts are synced in the background", func(c *Config) interface{} { return &c.Scheduler.ExchangeSync.Interval }},
+	{"webhook-delivery", "WEBHOOK_DELIVERY_ENABLED", "whether webhook deliveries are sent in the background", func(c *Config) interface{} { return &c.Scheduler.WebhookDelivery.Enabled }},
+	{"webhook-delivery-interval", "WEBHOOK_DELIVERY_INTERVAL", "how often deliveries due to be sent are looked for", func(c *Config) interface{} { return &c.Scheduler.WebhookDelivery.Interval }},
+	{"jobs", "JOBS_ENABLED", "whether asynchronous jobs are run by this instance", func(c *Config) interface{} { return &c.Scheduler.Jobs.Enabled }},
+	{"jobs-interval", "JOBS_INTERVAL", "how often queued jobs are looked for", func(c *Config) interface{} { return &c.Scheduler.Jobs.Interval }},
+	{"price-history", "PRICE_HISTORY_DIR", "the directory of price history CSVs loaded at startup", func(c *Config) interface{} { return &c.Prices.HistoryDir }},
+	{"log-level", "LOG_LEVEL", "the minimum level logged, one of: debug, info, warn, error", func(c *Config) interface{} { return &c.Logging.Level }},
+	{"trace-exporter", "TRACE_EXPORTER", "where spans are exported, one of: " + strings.Join(TraceExporters, ", "), func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"webhooks-allow-private-urls", "WEBHOOKS_ALLOW_PRIVATE_URLS", "whether webhooks may deliver to loopback & private network addresses (for testing)", func(c *Config) interface{} { return &c.Webhooks.AllowPrivateURLs }},
+	{"auth", "AUTH_ENABLED", "whether requests must authenticate with an API key", func(c *Config) interface{} { return &c.Auth.Enabled }},
+}
+
+// Load returns the config layered from its defaults, the config file (the -config flag, or the CONFIG_FILE
+// environment variable), the environment and the flags in the provided arguments, along with the arguments left after
+// the flags. The config is validated, with every problem reported at once.
+func Load(name string, args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "a YAML or JSON config file (env: CONFIG_FILE)")
+
+	values := map[*setting]*string{}
+	for _, s := range settings {
+		values[s] = flags.String(s.flag, "", fmt.Sprintf("%s (env: %s)", s.usage, s.env))
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Default()
+
+	if len(*file) > 0 {
+		if err := cfg.loadFile(*file); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && len(v) > 0 {
+			if err := set(s.field(cfg), v); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s environment variable: %v", s.env, err)
+			}
+		}
+	}
+
+	passed := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+
+	for _, s := range settings {
+		if passed[s.flag] {
+			if err := set(s.field(cfg), *values[s]); err != nil {
+				return nil, nil, fmt.Errorf("invalid -%s flag: %v", s.flag, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, flags.Args(), nil
+}
+
+// loadFile overrides the config with whatever the provided file sets. JSON being valid YAML, both are decoded the
+// same way; unknown keys are an error, so that typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+	default:
+		return fmt.Errorf("unsupported config file extension %q, must be one of: .yaml, .yml, .json", ext)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// set parses the provided string into the value the provided pointer points to
+func set(field interface{}, v string) error {
+	switch p := field.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, e.g. 90s or 15m", v)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+
+	return nil
+}
+
+// Validate checks the config for anything the server couldn't start (or would misbehave) with, returning an error
+// listing every problem found
+func (c *Config) Validate() error {
+	problems := []string{}
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		addProblem("server.port must be between 1 and 65535, got %d", c.Server.Port)
+	}
+
+	if !oneOf(c.Storage.Backend, StorageBackends) {
+		addProblem("storage.backend %q is not supported, must be one of: %s", c.Storage.Backend, strings.Join(StorageBackends, ", "))
+	}
+
+	if c.Storage.Backend == "spanner" {
+		spanner := c.Storage.Spanner
+		if len(spanner.Project) == 0 {
+			addProblem("storage.spanner.project is required")
+		}
+		if len(spanner.Instance) == 0 {
+			addProblem("storage.spanner.instance is required")
+		}
+		if len(spanner.Database) == 0 {
+			addProblem("storage.spanner.database is required")
+		}
+
+		if len(spanner.EmulatorHost) == 0 && len(spanner.CredentialsFile) == 0 {
+			addProblem("storage.spanner.credentials_file is required unless storage.spanner.emulator_host is set")
+		}
+
+		if len(spanner.EmulatorHost) > 0 {
+			if _, _, err := net.SplitHostPort(spanner.EmulatorHost); err != nil {
+				addProblem("storage.spanner.emulator_host must be a host:port, got %q", spanner.EmulatorHost)
+			}
+		}
+	}
+
+	if !oneOf(c.Provider.Name, Providers) {
+		addProblem("provider.name %q is not supported, must be one of: %s", c.Provider.Name, strings.Join(Providers, ", "))
+	}
+
+	if c.Provider.Name == "blockchair" {
+		bc := c.Provider.Blockchair
+		if !isURL(bc.BaseURL) {
+			addProblem("provider.blockchair.base_url must be an http(s) URL, got %q", bc.BaseURL)
+		}
+		if bc.Timeout <= 0 {
+			addProblem("provider.blockchair.timeout must be positive, got %s", bc.Timeout)
+		}
+		if bc.RateLimit < 1 {
+			addProblem("provider.blockchair.rate_limit must be at least 1 call per minute, got %d", bc.RateLimit)
+		}
+		if bc.RateLimitWait <= 0 {
+			addProblem("provider.blockchair.rate_limit_wait must be positive, got %s", bc.RateLimitWait)
+		}
+	}
+
+	if !isURL(c.Exchanges.Kraken.BaseURL) {
+		addProblem("exchanges.kraken.base_url must be an http(s) URL, got %q", c.Exchanges.Kraken.BaseURL)
+	}
+
+	if len(c.Exchanges.CredentialsKey) > 0 {
+		if _, err := secrets.ParseKey(c.Exchanges.CredentialsKey); err != nil {
+			addProblem("exchanges.credentials_key is invalid: %v", err)
+		}
+	}
+
+	if c.Scheduler.ExchangeSync.Enabled && c.Scheduler.ExchangeSync.Interval < time.Minute {
+		addProblem("scheduler.exchange_sync.interval must be at least 1m, got %s", c.Scheduler.ExchangeSync.Interval)
+	}
+
+	if c.Scheduler.WebhookDelivery.Enabled && c.Scheduler.WebhookDelivery.Interval < time.Second {
+		addProblem("scheduler.webhook_delivery.interval must be at least 1s, got %s", c.Scheduler.WebhookDelivery.Interval)
+	}
+
+	if c.Scheduler.Jobs.Enabled && c.Scheduler.Jobs.Interval < 100*time.Millisecond {
+		addProblem("scheduler.jobs.interval must be at least 100ms, got %s", c.Scheduler.Jobs.Interval)
+	}
+
+	if len(c.Prices.HistoryDir) == 0 {
+		addProblem("prices.history_dir is required")
+	}
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		addProblem("logging.level: %v", err)
+	}
+
+	if !oneOf(c.Tracing.Exporter, TraceExporters) {
+		addProblem("tracing.exporter %q is not supported, must be one of: %s", c.Tracing.Exporter, strings.Join(TraceExporters, ", "))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// oneOf reports whether the provided string is one of the provided options
+func oneOf(v string, options []string) bool {
+	for _, o := range options {
+		if v == o {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isURL reports whether the provided string is an absolute http(s) URL
+func isURL(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/gains"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+// LotSelectionsRecord is the data model for a respective row in the 'lot_selections' table stored in Spanner,
+// recording the lots a user picked for a disposal under specific identification
+type LotSelectionsRecord struct {
+	UserID     string `spanner:"user_id"`     // pk
+	DisposalID string `spanner:"disposal_id"` // pk, the activity ID of the disposal
+	LotIDs     string `spanner:"lot_ids"`     // comma-delimited list of the acquiring activity IDs, in the order they're consumed
+}
+
+// CostBasisMethodRequest represents the expected request body to '/v1/users/{user}/cost-basis-method'
+type CostBasisMethodRequest struct {
+	Method string `json:"method"`
+}
+
+// LotSelectionRequest represents the expected request body to '/v1/users/{user}/lot-selections/{disposal}'
+type LotSelectionRequest struct {
+	LotIDs []string `json:"lots"`
+}
+
+// GainsResponse represents the expected response body to '/v1/users/{user}/gains'
+type GainsResponse struct {
+	UserID        string               `json:"user_id"`
+	Method        gains.Method         `json:"method"`
+	Currency      string               `json:"currency"`
+	Year          int                  `json:"year,omitempty"` // if set, realized gains are limited to disposals in this year
+	Realized      []*gains.Realization `json:"realized"`
+	ByTransaction []*gains.Summary     `json:"by_transaction"`
+	ByAsset       []*gains.Summary     `json:"by_asset"`
+	ByYear        []*gains.Summary     `json:"by_year"`    // always across all years
+	Unrealized    []*gains.Holding     `json:"unrealized"` // as of now
+}
+
+// SetCostBasisMethodHandler returns a closure responsible for updating the cost basis method of the user in the request path
+func SetCostBasisMethodHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var methodReq CostBasisMethodRequest
+		if err := json.Unmarshal(body, &methodReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		method, err := gains.ParseMethod(methodReq.Method)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var user *UsersRecord
+		_, err = readWriteTransaction(ctx, s, "set_cost_basis_method", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			var readErr error
+			if user, readErr = readUser(ctx, txn, userID); readErr != nil {
+				return readErr
+			}
+
+			user.CostBasisMethod = string(method)
+
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.Update(usersTable, []string{"uuid", "cost_basis_method"}, []interface{}{userID, user.CostBasisMethod}),
+			})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not update user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &UserResponse{User: user})
+	})
+}
+
+// SetLotSelectionHandler returns a closure responsible for recording which lots the disposal in the request path consumes
+// (only used by users on specific identification)
+func SetLotSelectionHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		vars := mux.Vars(r)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var selectionReq LotSelectionRequest
+		if err := json.Unmarshal(body, &selectionReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		selection := &LotSelectionsRecord{
+			UserID:     vars["user"],
+			DisposalID: vars["disposal"],
+			LotIDs:     strings.Join(selectionReq.LotIDs, ","),
+		}
+
+		_, err = readWriteTransaction(ctx, s, "set_lot_selection", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if _, err := readUser(ctx, txn, selection.UserID); err != nil {
+				return err
+			}
+
+			mut, err := spanner.InsertOrUpdateStruct(lotSelectionsTable, selection)
+			if err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{mut})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not select lots for user %s. %v", selection.UserID, err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// GetGainsHandler returns a closure responsible for invoking computeGains() for the user in the request path
+func GetGainsHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		currency := defaultCurrency
+		if v := r.URL.Query().Get("currency"); v != "" {
+			currency = strings.ToUpper(v)
+		}
+
+		year := 0
+		if v := r.URL.Query().Get("year"); v != "" {
+			var err error
+			if year, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "year must be an integer", http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, result, err := computeGains(ctx, s, p, userID, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not compute gains for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		realized := result.Realized
+		if year != 0 {
+			realized = realizedIn(realized, year)
+		}
+
+		holdings, err := currentHoldings(ctx, p, result, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not value holdings for user %s. %v", userID, err), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &GainsResponse{
+			UserID:        userID,
+			Method:        gains.Method(user.CostBasisMethod),
+			Currency:      currency,
+			Year:          year,
+			Realized:      realized,
+			ByTransaction: gains.Summarize(realized, gains.ByEvent),
+			ByAsset:       gains.Summarize(realized, gains.ByAsset),
+			ByYear:        gains.Summarize(result.Realized, gains.ByYear),
+			Unrealized:    holdings,
+		})
+	})
+}
+
+// computeGains runs the provided user's activity through the cost basis engine with their cost basis method, valued in the
+// provided currency. transfers between the user's own wallets (see userTransfers()) only dispose of the fee paid for them.
+func computeGains(ctx context.Context, s *spanner.Client, p prices.Provider, userID, currency string) (*UsersRecord, *gains.Result, error) {
+	txn := s.ReadOnlyTransaction()
+	defer txn.Close()
+
+	user, err := readUser(ctx, txn, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// users who never picked a method (or were created before they could) get the default
+	if len(user.CostBasisMethod) == 0 {
+		user.CostBasisMethod = string(gains.FIFO)
+	}
+
+	method, err := gains.ParseMethod(user.CostBasisMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acts, err := readUserActivity(ctx, txn, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transfers, err := userTransfers(acts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selections, err := readLotSelections(ctx, txn, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events, err := gainEvents(ctx, p, acts, transfers, currency)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := gains.Compute(events, method, selections)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, result, nil
+}
+
+// gainEvents converts the provided activity into cost basis engine events, folding both sides of each transfer into one
+func gainEvents(ctx context.Context, p prices.Provider, acts []*activity, transfers map[string]string, currency string) ([]*gains.Event, error) {
+	byID := map[string]*activity{}
+	for _, v := range acts {
+		byID[v.ID] = v
+	}
+
+	depositIDs := map[string]bool{}
+	for _, inID := range transfers {
+		depositIDs[inID] = true
+	}
+
+	events := []*gains.Event{}
+	for _, v := range acts {
+		// the deposit side is folded into its withdrawal below
+		if depositIDs[v.ID] {
+			continue
+		}
+
+		price, err := activityPrice(ctx, p, v, currency)
+		if err != nil {
+			return nil, err
+		}
+
+		event := &gains.Event{
+			ID:       v.ID,
+			Asset:    v.Asset,
+			Time:     v.Time,
+			Quantity: v.Quantity,
+			Price:    price,
+		}
+
+		if inID, ok := transfers[v.ID]; ok {
+			event.Transfer = true
+			event.Quantity += byID[inID].Quantity
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// readLotSelections reads the lots the provided user picked per disposal, keyed by disposal ID
+func readLotSelections(ctx context.Context, txn querier, userID string) (map[string][]string, error) {
+	stmt := spanner.NewStatement(`SELECT user_id, disposal_id, lot_ids FROM lot_selections WHERE user_id = @user_id`)
+	stmt.Params["user_id"] = userID
+
+	selections := map[string][]string{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec LotSelectionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		selections[rec.DisposalID] = strings.Split(rec.LotIDs, ",")
+		return nil
+	})
+
+	return selections, err
+}
+
+// pruneLotSelections returns the mutations taking the lots acquired by the provided address off every selection that
+// picked them, deleting the selections left without any (gains.Compute would otherwise skip lots it can't find,
+// consuming the disposal's remaining lots in their place)
+func pruneLotSelections(ctx context.Context, txn querier, addr string) ([]*spanner.Mutation, error) {
+	stmt := spanner.NewStatement(`
+		SELECT user_id, disposal_id, lot_ids FROM lot_selections
+		WHERE EXISTS (SELECT 1 FROM UNNEST(SPLIT(lot_ids, ',')) AS l WHERE STARTS_WITH(l, @prefix) AND ENDS_WITH(l, @suffix))`)
+	stmt.Params["prefix"] = onchainSource + ":"
+	stmt.Params["suffix"] = ":" + addr
+
+	mutations := []*spanner.Mutation{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec LotSelectionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		lots := []string{}
+		for _, v := range strings.Split(rec.LotIDs, ",") {
+			if _, lotAddr, ok := parseOnchainActivityID(v); !ok || lotAddr != addr {
+				lots = append(lots, v)
+			}
+		}
+
+		if len(lots) == 0 {
+			mutations = append(mutations, spanner.Delete(lotSelectionsTable, spanner.Key{rec.UserID, rec.DisposalID}))
+			return nil
+		}
+
+		rec.LotIDs = strings.Join(lots, ",")
+
+		mut, err := spanner.UpdateStruct(lotSelectionsTable, &rec)
+		if err != nil {
+			return err
+		}
+
+		mutations = append(mutations, mut)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mutations, nil
+}
+
+// realizedIn filters the provided realizations down to the disposals made in the provided year
+func realizedIn(realized []*gains.Realization, year int) []*gains.Realization {
+	filtered := []*gains.Realization{}
+	for _, v := range realized {
+		if v.Disposed.Year() == year {
+			filtered = append(filtered, v)
+		}
+	}
+
+	return filtered
+}
+
+// currentHoldings values the open lots of the provided result at the current price in the provided currency
+func currentHoldings(ctx context.Context, p prices.Provider, result *gains.Result, currency string) ([]*gains.Holding, error) {
+	now := time.Now()
+
+	current := map[string]float64{}
+	for _, v := range result.Lots {
+		if _, ok := current[v.Asset]; ok {
+			continue
+		}
+
+		price, err := activityPrice(ctx, p, &activity{Asset: v.Asset, Time: now}, currency)
+		if err != nil {
+			return nil, err
+		}
+
+		current[v.Asset] = price
+	}
+
+	return result.Holdings(func(asset string) (float64, bool) {
+		return current[asset], current[asset] > 0
+	}), nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/config"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/secrets"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+// exchangeSyncOverlap is how far before the last sync each sync starts from, in case the exchange records activity late
+// (anything fetched twice is deduplicated on import)
+const exchangeSyncOverlap = time.Hour
+
+// exchangeAccountColumns lists the columns read into an ExchangeAccountsRecord
+var exchangeAccountColumns = []string{"account_id", "user_id", "exchange", "api_key", "api_secret", "created_at", "last_synced_at"}
+
+// errNoCredentialsKey is returned when connecting an exchange account without exchanges.credentials_key configured
+var errNoCredentialsKey = errors.New("exchange credentials can't be stored, exchanges.credentials_key isn't configured")
+
+// ExchangeAccountsRecord is the data model for a respective row in the 'exchange_accounts' table stored in Spanner,
+// holding the API credentials of an exchange account connected by a user. They're stored sealed (see sealCredentials),
+// except for accounts connected before they were, which are sealed on their next sync.
+type ExchangeAccountsRecord struct {
+	AccountID    string           `spanner:"account_id"` // pk
+	UserID       string           `spanner:"user_id"`
+	Exchange     string           `spanner:"exchange"` // the connector it syncs through, e.g. "kraken"
+	APIKey       string           `spanner:"api_key" json:"-"`
+	APISecret    string           `spanner:"api_secret" json:"-"`
+	CreatedAt    time.Time        `spanner:"created_at"`
+	LastSyncedAt spanner.NullTime `spanner:"last_synced_at"`
+}
+
+// ExchangeAccountRequest represents the expected request body to '/v1/users/{user}/exchanges'
+type ExchangeAccountRequest struct {
+	Exchange  string `json:"exchange"`
+	APIKey    string `json:"api_key"`
+	APISecret string `json:"api_secret"`
+}
+
+// ExchangeAccountResponse represents the expected response body to '/v1/users/{user}/exchanges'
+type ExchangeAccountResponse struct {
+	Account *ExchangeAccountsRecord `json:"account"`
+}
+
+// newConnectors returns the connector of every supported exchange, keyed by name
+// note: exchanges.kraken.base_url (or KRAKEN_API_URL) can point the Kraken connector at a stand-in server (see
+// `go run . fake-exchange`)
+func newConnectors(cfg config.ExchangesConfig) map[string]exchanges.Connector {
+	return map[string]exchanges.Connector{
+		"kraken": exchanges.NewKraken(cfg.Kraken.BaseURL),
+	}
+}
+
+// newCredentialsBox returns the box exchange account credentials are sealed with, or nil if no key is configured (in
+// which case accounts can't be connected)
+func newCredentialsBox(cfg config.ExchangesConfig) (*secrets.Box, error) {
+	if len(cfg.CredentialsKey) == 0 {
+		return nil, nil
+	}
+
+	key, err := secrets.ParseKey(cfg.CredentialsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets.New(key)
+}
+
+// AddExchangeAccountHandler returns a closure responsible for validating the incoming request
+// and connecting an exchange account to the user in the request path
+func AddExchangeAccountHandler(s *spanner.Client, connectors map[string]exchanges.Connector, box *secrets.Box) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var accountReq ExchangeAccountRequest
+		if err := json.Unmarshal(body, &accountReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		accountReq.Exchange = strings.ToLower(accountReq.Exchange)
+		if _, ok := connectors[accountReq.Exchange]; !ok {
+			http.Error(w, fmt.Sprintf("unsupported exchange %q", accountReq.Exchange), http.StatusBadRequest)
+			return
+		}
+
+		if len(accountReq.APIKey) == 0 || len(accountReq.APISecret) == 0 {
+			http.Error(w, "api_key and api_secret are required", http.StatusBadRequest)
+			return
+		}
+
+		if box == nil {
+			http.Error(w, errNoCredentialsKey.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		account, err := addExchangeAccount(ctx, s, box, userID, &accountReq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not connect %s account for user %s. %v", accountReq.Exchange, userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, &ExchangeAccountResponse{Account: account})
+	})
+}
+
+// SyncExchangeAccountHandler returns a closure responsible for invoking syncExchangeAccount() for the account in the request path
+func SyncExchangeAccountHandler(s *spanner.Client, connectors map[string]exchanges.Connector, box *secrets.Box) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		accountID := mux.Vars(r)["account"]
+
+		resp, err := syncExchangeAccount(ctx, s, connectors, box, accountID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not sync exchange account %s. %v", accountID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+// DeleteExchangeAccountHandler returns a closure responsible for disconnecting the exchange account in the request path
+// (what was already synced from it is kept, like any other import)
+func DeleteExchangeAccountHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		accountID := mux.Vars(r)["account"]
+
+		_, err := readWriteTransaction(ctx, s, "delete_exchange_account", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if _, err := readExchangeAccount(ctx, txn, accountID); err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.Delete(exchangeAccountsTable, spanner.Key{accountID}),
+			})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not delete exchange account %s. %v", accountID, err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// addExchangeAccount stores the provided exchange account credentials for the provided user, sealed with the provided box
+func addExchangeAccount(ctx context.Context, s *spanner.Client, box *secrets.Box, userID string, accountReq *ExchangeAccountRequest) (*ExchangeAccountsRecord, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	account := &ExchangeAccountsRecord{
+		AccountID: id,
+		UserID:    userID,
+		Exchange:  accountReq.Exchange,
+		CreatedAt: time.Now(),
+	}
+
+	account.APIKey, account.APISecret, err = sealCredentials(box, id, exchanges.Credentials{Key: accountReq.APIKey, Secret: accountReq.APISecret})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = readWriteTransaction(ctx, s, "add_exchange_account", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if _, err := readUser(ctx, txn, userID); err != nil {
+			return err
+		}
+
+		mut, err := spanner.InsertStruct(exchangeAccountsTable, account)
+		if err != nil {
+			return err
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{mut})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// readExchangeAccount reads the ExchangeAccountsRecord for the provided account ID
+func readExchangeAccount(ctx context.Context, txn rowReader, accountID string) (*ExchangeAccountsRecord, error) {
+	row, err := txn.ReadRow(ctx, exchangeAccountsTable, spanner.Key{accountID}, exchangeAccountColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var account ExchangeAccountsRecord
+	if err := row.ToStruct(&account); err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// syncExchangeAccount fetches the account's activity since its last sync through its exchange's connector
+// and imports it for the account's user (see importTransactions())
+func syncExchangeAccount(ctx context.Context, s *spanner.Client, connectors map[string]exchanges.Connector, box *secrets.Box, accountID string) (resp *ImportResponse, err error) {
+	ctx, span := tracing.Start(ctx, "sync.exchange_account", "account_id", accountID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	account, err := readExchangeAccount(ctx, s.Single(), accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes("exchange", account.Exchange)
+
+	connector, ok := connectors[account.Exchange]
+	if !ok {
+		return nil, fmt.Errorf("unsupported exchange %q", account.Exchange)
+	}
+
+	var since time.Time
+	if account.LastSyncedAt.Valid {
+		since = account.LastSyncedAt.Time.Add(-exchangeSyncOverlap)
+	}
+
+	creds, err := openCredentials(box, account)
+	if err != nil {
+		return nil, err
+	}
+
+	syncedAt := time.Now()
+
+	txns, err := connector.Transactions(ctx, creds, since)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logging.FromContext(ctx).With("account_id", accountID, "exchange", account.Exchange)
+	log.Debug("fetched exchange transactions", "txns", len(txns), "since", since, "duration_ms", time.Since(syncedAt))
+
+	resp, err = importTransactions(ctx, s, account.UserID, txns, false)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := []string{"account_id", "last_synced_at"}
+	vals := []interface{}{accountID, syncedAt}
+
+	// credentials stored before they were sealed are sealed now, if we can
+	if box != nil && !secrets.IsSealed(account.APISecret) {
+		key, secret, err := sealCredentials(box, accountID, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		cols = append(cols, "api_key", "api_secret")
+		vals = append(vals, key, secret)
+		log.Info("sealed exchange account credentials")
+	}
+
+	if _, err := s.Apply(ctx, []*spanner.Mutation{spanner.Update(exchangeAccountsTable, cols, vals)}); err != nil {
+		return nil, err
+	}
+
+	exchangeSyncDuration.ObserveDuration(time.Since(syncedAt), account.Exchange)
+	exchangeSyncNewTxns.Add(float64(len(resp.Imported)), account.Exchange)
+
+	log.Info("synced exchange account", "new_txns", len(resp.Imported), "duplicates", len(resp.Duplicates), "duration_ms", time.Since(syncedAt))
+
+	return resp, nil
+}
+
+// sealCredentials seals the provided credentials of the exchange account with the provided ID, each bound to the account
+// & the column it's stored in
+func sealCredentials(box *secrets.Box, accountID string, creds exchanges.Credentials) (key, secret string, err error) {
+	if box == nil {
+		return "", "", errNoCredentialsKey
+	}
+
+	if key, err = box.Seal(creds.Key, accountID+":api_key"); err != nil {
+		return "", "", err
+	}
+
+	if secret, err = box.Seal(creds.Secret, accountID+":api_secret"); err != nil {
+		return "", "", err
+	}
+
+	return key, secret, nil
+}
+
+// openCredentials returns the credentials of the provided exchange account, opening them with the provided box unless
+// they were stored before they were sealed
+func openCredentials(box *secrets.Box, account *ExchangeAccountsRecord) (exchanges.Credentials, error) {
+	if !secrets.IsSealed(account.APIKey) && !secrets.IsSealed(account.APISecret) {
+		return exchanges.Credentials{Key: account.APIKey, Secret: account.APISecret}, nil
+	}
+
+	if box == nil {
+		return exchanges.Credentials{}, errNoCredentialsKey
+	}
+
+	key, err := box.Open(account.APIKey, account.AccountID+":api_key")
+	if err != nil {
+		return exchanges.Credentials{}, fmt.Errorf("could not open api_key: %w", err)
+	}
+
+	secret, err := box.Open(account.APISecret, account.AccountID+":api_secret")
+	if err != nil {
+		return exchanges.Credentials{}, fmt.Errorf("could not open api_secret: %w", err)
+	}
+
+	return exchanges.Credentials{Key: key, Secret: secret}, nil
+}
+
+// syncExchangeAccountsEvery syncs every connected exchange account each interval of the provided job, recording each
+// run in the job's status. It returns once the stop channel is closed, finishing the account it's syncing (if any)
+// first, unless the provided context is done.
+func syncExchangeAccountsEvery(ctx context.Context, stop <-chan struct{}, s *spanner.Client, connectors map[string]exchanges.Connector, box *secrets.Box, job *health.JobStatus) {
+	log := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(job.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids := []string{}
+
+		iter := s.Single().Query(ctx, spanner.NewStatement(`SELECT account_id FROM exchange_accounts`))
+		err := iter.Do(func(row *spanner.Row) error {
+			var id string
+			if err := row.Column(0, &id); err != nil {
+				return err
+			}
+
+			ids = append(ids, id)
+			return nil
+		})
+
+		if err != nil {
+			log.Error("could not list exchange accounts to sync", "error", err)
+			continue
+		}
+
+		for i, id := range ids {
+			select {
+			case <-stop:
+				log.Info("stopped syncing exchange accounts", "remaining", len(ids)-i)
+				return
+			default:
+			}
+
+			if _, err := syncExchangeAccount(ctx, s, connectors, box, id); err != nil {
+				log.Error("could not sync exchange account", "account_id", id, "error", err)
+			}
+		}
+
+		job.Ran(time.Now())
+	}
+}
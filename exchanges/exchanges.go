@@ -0,0 +1,21 @@
+package exchanges
+
+import (
+	"context"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/importer"
+)
+
+// Credentials are the API credentials of a single exchange account (read-only keys are all a connector needs)
+type Credentials struct {
+	Key    string
+	Secret string
+}
+
+// Connector fetches the activity of an exchange account through the exchange's API
+type Connector interface {
+	// Transactions returns the account's trades, deposits & withdrawals since the provided time (all of them if it's zero),
+	// identified the same way as the exchange's CSV export so either can be imported without duplicates
+	Transactions(ctx context.Context, creds Credentials, since time.Time) ([]*importer.Transaction, error)
+}
@@ -0,0 +1,157 @@
+package fakeexchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+)
+
+// pageSize is how many ledger entries Kraken returns per page
+const pageSize = 50
+
+// Server is a local stand-in for Kraken's private API, serving the ledger entries added to it to requests signed with
+// its credentials. It's safe for concurrent use.
+type Server struct {
+	creds exchanges.Credentials
+
+	mu     sync.RWMutex
+	ledger map[string]*exchanges.KrakenLedgerEntry // keyed by ledger ID
+	nonce  int64                                   // the last nonce seen, which Kraken requires to increase
+}
+
+// NewServer returns a new, empty stand-in server accepting the provided credentials
+func NewServer(creds exchanges.Credentials) *Server {
+	return &Server{
+		creds:  creds,
+		ledger: map[string]*exchanges.KrakenLedgerEntry{},
+	}
+}
+
+// Add adds (or replaces) the ledger entry with the provided ID
+func (s *Server) Add(id string, entry *exchanges.KrakenLedgerEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ledger[id] = entry
+}
+
+// Seed adds a short history to the server's ledger: a BTC purchase, a withdrawal to a wallet and a staking reward
+func (s *Server) Seed(start time.Time) {
+	at := func(d time.Duration) float64 {
+		return float64(start.Add(d).Unix())
+	}
+
+	s.Add("LSEED1-BUY-USD", &exchanges.KrakenLedgerEntry{RefID: "TSEED1", Time: at(0), Type: "trade", Aclass: "currency", Asset: "ZUSD", Amount: "-3000.0000", Fee: "7.8000"})
+	s.Add("LSEED1-BUY-XBT", &exchanges.KrakenLedgerEntry{RefID: "TSEED1", Time: at(0), Type: "trade", Aclass: "currency", Asset: "XXBT", Amount: "0.1000000000", Fee: "0.0000000000"})
+	s.Add("LSEED2-WITHDRAW", &exchanges.KrakenLedgerEntry{RefID: "WSEED2", Time: at(24 * time.Hour), Type: "withdrawal", Aclass: "currency", Asset: "XXBT", Amount: "-0.0500000000", Fee: "0.0001500000"})
+	s.Add("LSEED3-STAKING", &exchanges.KrakenLedgerEntry{RefID: "RSEED3", Time: at(48 * time.Hour), Type: "staking", Aclass: "currency", Asset: "XBT.M", Amount: "0.0000100000", Fee: "0.0000000000"})
+}
+
+// ServeHTTP serves Kraken's ledgers endpoint (and nothing else), answering errors the way Kraken does
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != exchanges.KrakenLedgersPath {
+		writeError(w, http.StatusNotFound, "EGeneral:Unknown method")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "EGeneral:Invalid arguments")
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "EGeneral:Invalid arguments")
+		return
+	}
+
+	if err := s.authenticate(r, form, string(body)); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	offset, _ := strconv.Atoi(form.Get("ofs"))
+	start, _ := strconv.ParseFloat(form.Get("start"), 64)
+
+	var resp exchanges.KrakenLedgersResponse
+	resp.Error = []string{}
+	resp.Result.Ledger = map[string]*exchanges.KrakenLedgerEntry{}
+
+	ids := s.ledgerIDs(start)
+	resp.Result.Count = len(ids)
+
+	s.mu.RLock()
+	for i := offset; i < len(ids) && i < offset+pageSize; i++ {
+		resp.Result.Ledger[ids[i]] = s.ledger[ids[i]]
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// authenticate checks the request's API key, signature and nonce like Kraken does
+func (s *Server) authenticate(r *http.Request, form url.Values, body string) error {
+	if r.Header.Get("API-Key") != s.creds.Key {
+		return fmt.Errorf("EAPI:Invalid key")
+	}
+
+	sign, err := exchanges.KrakenSign(r.URL.Path, form.Get("nonce"), body, s.creds.Secret)
+	if err != nil || sign != r.Header.Get("API-Sign") {
+		return fmt.Errorf("EAPI:Invalid signature")
+	}
+
+	nonce, err := strconv.ParseInt(form.Get("nonce"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("EAPI:Invalid nonce")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nonce <= s.nonce {
+		return fmt.Errorf("EAPI:Invalid nonce")
+	}
+
+	s.nonce = nonce
+	return nil
+}
+
+// ledgerIDs returns the IDs of the entries after the provided unix timestamp, newest first (as Kraken pages them)
+func (s *Server) ledgerIDs(start float64) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []string{}
+	for id, v := range s.ledger {
+		if v.Time > start {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if s.ledger[ids[i]].Time != s.ledger[ids[j]].Time {
+			return s.ledger[ids[i]].Time > s.ledger[ids[j]].Time
+		}
+
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// writeError writes an error response in Kraken's format
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": []string{msg}})
+}
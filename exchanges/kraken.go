@@ -0,0 +1,189 @@
+package exchanges
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/importer"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+const (
+	// KrakenURL is the base URL of Kraken's REST API
+	KrakenURL = "https://api.kraken.com"
+
+	// KrakenLedgersPath is the private endpoint listing an account's ledger entries, 50 per page
+	KrakenLedgersPath = "/0/private/Ledgers"
+
+	// krakenTimeLayout is how Kraken's ledgers export formats times (see importer.Mappings)
+	krakenTimeLayout = "2006-01-02 15:04:05.0000"
+)
+
+// krakenHeader is the header of Kraken's ledgers export, which each ledger entry is laid out as for the importer
+var krakenHeader = []string{"txid", "refid", "time", "type", "subtype", "aclass", "asset", "amount", "fee", "balance"}
+
+// KrakenLedgerEntry represents a single entry of a Kraken account's ledger, as returned by its API
+type KrakenLedgerEntry struct {
+	RefID   string  `json:"refid"`
+	Time    float64 `json:"time"` // unix timestamp
+	Type    string  `json:"type"`
+	Subtype string  `json:"subtype"`
+	Aclass  string  `json:"aclass"`
+	Asset   string  `json:"asset"`
+	Amount  string  `json:"amount"`
+	Fee     string  `json:"fee"`
+	Balance string  `json:"balance"`
+}
+
+// KrakenLedgersResponse represents the response body of Kraken's ledgers endpoint
+type KrakenLedgersResponse struct {
+	Error  []string `json:"error"`
+	Result struct {
+		Ledger map[string]*KrakenLedgerEntry `json:"ledger"` // keyed by ledger ID
+		Count  int                           `json:"count"`  // across all pages
+	} `json:"result"`
+}
+
+// Kraken is the Connector for Kraken accounts
+type Kraken struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewKraken returns a new Kraken connector against the provided base URL (KrakenURL, or a stand-in server)
+func NewKraken(baseURL string) *Kraken {
+	return &Kraken{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Transactions pages through the account's ledger, converting it the same way as Kraken's ledgers export
+func (k *Kraken) Transactions(ctx context.Context, creds Credentials, since time.Time) ([]*importer.Transaction, error) {
+	ids := []string{}
+	entries := map[string]*KrakenLedgerEntry{}
+
+	for {
+		resp, err := k.ledgers(ctx, creds, since, len(entries))
+		if err != nil {
+			return nil, err
+		}
+
+		for id, v := range resp.Result.Ledger {
+			if _, ok := entries[id]; !ok {
+				ids = append(ids, id)
+			}
+
+			entries[id] = v
+		}
+
+		if len(resp.Result.Ledger) == 0 || len(entries) >= resp.Result.Count {
+			break
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if entries[ids[i]].Time != entries[ids[j]].Time {
+			return entries[ids[i]].Time < entries[ids[j]].Time
+		}
+
+		return ids[i] < ids[j]
+	})
+
+	records := [][]string{}
+	for _, id := range ids {
+		v := entries[id]
+		records = append(records, []string{
+			id, v.RefID, unixTime(v.Time).Format(krakenTimeLayout), v.Type, v.Subtype, v.Aclass, v.Asset, v.Amount, v.Fee, v.Balance,
+		})
+	}
+
+	return importer.ParseRecords(krakenHeader, records, importer.Kraken)
+}
+
+// ledgers requests a single page of the account's ledger, starting at the provided offset
+func (k *Kraken) ledgers(ctx context.Context, creds Credentials, since time.Time, offset int) (resp *KrakenLedgersResponse, err error) {
+	ctx, span := tracing.Start(ctx, "kraken.ledgers", "offset", offset)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	form := url.Values{}
+	form.Set("nonce", strconv.FormatInt(time.Now().UnixNano(), 10))
+	form.Set("ofs", strconv.Itoa(offset))
+	if !since.IsZero() {
+		form.Set("start", strconv.FormatInt(since.Unix(), 10))
+	}
+
+	body := form.Encode()
+
+	sign, err := KrakenSign(KrakenLedgersPath, form.Get("nonce"), body, creds.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.baseURL+KrakenLedgersPath, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("API-Key", creds.Key)
+	req.Header.Set("API-Sign", sign)
+	tracing.Inject(ctx, req.Header)
+
+	httpResp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	span.SetAttributes("http.status_code", httpResp.StatusCode)
+
+	var ledgersResp KrakenLedgersResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&ledgersResp); err != nil {
+		return nil, fmt.Errorf("could not decode kraken response (%s): %w", httpResp.Status, err)
+	}
+
+	if len(ledgersResp.Error) > 0 {
+		return nil, fmt.Errorf("kraken: %s", strings.Join(ledgersResp.Error, ", "))
+	}
+
+	span.SetAttributes("entries", len(ledgersResp.Result.Ledger))
+
+	return &ledgersResp, nil
+}
+
+// KrakenSign returns the API-Sign header of a private request to Kraken: the HMAC-SHA512 (keyed with the base64-decoded
+// secret) of the path followed by the SHA256 of the nonce & the request body, base64-encoded
+func KrakenSign(path, nonce, body, secret string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("the API secret must be base64-encoded: %w", err)
+	}
+
+	digest := sha256.Sum256([]byte(nonce + body))
+
+	mac := hmac.New(sha512.New, key)
+	mac.Write(append([]byte(path), digest[:]...))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// unixTime converts a fractional unix timestamp to a time
+func unixTime(v float64) time.Time {
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)).UTC()
+}
@@ -0,0 +1,143 @@
+package exchanges_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges/fakeexchange"
+)
+
+var (
+	testCreds = exchanges.Credentials{Key: "test-key", Secret: "c2VjcmV0LXRlc3Qtc2VjcmV0"}
+	testStart = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// newFakeKraken returns a Kraken connector against a stand-in server seeded with its short history
+func newFakeKraken(t *testing.T) (*exchanges.Kraken, *fakeexchange.Server) {
+	t.Helper()
+
+	fake := fakeexchange.NewServer(testCreds)
+	fake.Seed(testStart)
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return exchanges.NewKraken(srv.URL), fake
+}
+
+func TestKrakenTransactions(t *testing.T) {
+	tests := []struct {
+		name  string
+		since time.Time
+		want  []string // "<external id> <type> <asset> <quantity>", oldest first
+	}{
+		{
+			name:  "everything",
+			since: time.Time{},
+			want: []string{
+				"LSEED1-BUY-XBT buy BTC 0.1",
+				"LSEED2-WITHDRAW withdrawal BTC -0.05015",
+				"LSEED3-STAKING income BTC 1e-05",
+			},
+		},
+		{
+			name:  "since the purchase",
+			since: testStart.Add(12 * time.Hour),
+			want: []string{
+				"LSEED2-WITHDRAW withdrawal BTC -0.05015",
+				"LSEED3-STAKING income BTC 1e-05",
+			},
+		},
+		{
+			name:  "nothing new",
+			since: testStart.Add(72 * time.Hour),
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kraken, _ := newFakeKraken(t)
+
+			txns, err := kraken.Transactions(context.Background(), testCreds, tt.since)
+			if err != nil {
+				t.Fatalf("Transactions() error = %v", err)
+			}
+
+			got := []string{}
+			for _, v := range txns {
+				got = append(got, fmt.Sprintf("%s %s %s %v", v.ExternalID, v.Type, v.Asset, v.Quantity))
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Transactions() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestKrakenTransactionsPages(t *testing.T) {
+	kraken, fake := newFakeKraken(t)
+
+	// more than two of the server's pages of 50
+	for i := 0; i < 120; i++ {
+		fake.Add(fmt.Sprintf("LPAGE%03d", i), &exchanges.KrakenLedgerEntry{
+			RefID:  fmt.Sprintf("RPAGE%03d", i),
+			Time:   float64(testStart.Add(time.Duration(i+100) * time.Hour).Unix()),
+			Type:   "staking",
+			Aclass: "currency",
+			Asset:  "XBT.M",
+			Amount: "0.0000100000",
+			Fee:    "0.0000000000",
+		})
+	}
+
+	txns, err := kraken.Transactions(context.Background(), testCreds, time.Time{})
+	if err != nil {
+		t.Fatalf("Transactions() error = %v", err)
+	}
+
+	if len(txns) != 123 {
+		t.Fatalf("Transactions() returned %d transactions, want 123", len(txns))
+	}
+
+	seen := map[string]bool{}
+	for i, v := range txns {
+		if seen[v.ID] {
+			t.Errorf("transaction %s returned twice", v.ID)
+		}
+		seen[v.ID] = true
+
+		if i > 0 && v.Time.Before(txns[i-1].Time) {
+			t.Errorf("transaction %s is out of order", v.ID)
+		}
+	}
+}
+
+func TestKrakenTransactionsRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		creds   exchanges.Credentials
+		wantErr string
+	}{
+		{"unknown key", exchanges.Credentials{Key: "other-key", Secret: testCreds.Secret}, "EAPI:Invalid key"},
+		{"wrong secret", exchanges.Credentials{Key: testCreds.Key, Secret: "b3RoZXItc2VjcmV0"}, "EAPI:Invalid signature"},
+		{"secret not base64", exchanges.Credentials{Key: testCreds.Key, Secret: "not base64!"}, "must be base64-encoded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kraken, _ := newFakeKraken(t)
+
+			_, err := kraken.Transactions(context.Background(), tt.creds, time.Time{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Transactions() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
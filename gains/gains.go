@@ -0,0 +1,329 @@
+package gains
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Method represents how lots are picked to be consumed by a disposal
+type Method string
+
+const (
+	FIFO       Method = "fifo"        // first in, first out
+	LIFO       Method = "lifo"        // last in, first out
+	HIFO       Method = "hifo"        // highest cost in, first out
+	SpecificID Method = "specific_id" // lots picked per disposal (falling back to FIFO for anything not picked)
+
+	// epsilon is how close to zero a quantity has to be to be considered zero (i.e. float rounding noise)
+	epsilon = 1e-9
+)
+
+// ParseMethod validates the provided cost basis method
+func ParseMethod(v string) (Method, error) {
+	switch m := Method(v); m {
+	case FIFO, LIFO, HIFO, SpecificID:
+		return m, nil
+	}
+
+	return "", fmt.Errorf("cost basis method must be one of: %s, %s, %s, %s", FIFO, LIFO, HIFO, SpecificID)
+}
+
+// Event represents a single change in holdings: an acquisition (positive quantity) or a disposal (negative quantity)
+type Event struct {
+	ID       string
+	Asset    string
+	Time     time.Time
+	Quantity float64
+	Price    float64 // fiat per unit at the time (0 if unknown)
+
+	// Transfer marks a move between the user's own wallets, which neither acquires nor disposes of anything.
+	// its Quantity is the net effect of the move, i.e. the fee paid for it (which is disposed of)
+	Transfer bool
+}
+
+// Lot represents an acquisition that's (partly) still held
+type Lot struct {
+	ID           string    `json:"id"` // the ID of the acquiring event
+	Asset        string    `json:"asset"`
+	Acquired     time.Time `json:"acquired"`
+	Quantity     float64   `json:"quantity"`
+	Remaining    float64   `json:"remaining"`
+	Price        float64   `json:"price"` // cost basis per unit
+	MissingPrice bool      `json:"missing_price"`
+}
+
+// Realization represents (part of) a disposal matched against a single lot
+type Realization struct {
+	EventID   string    `json:"event_id"`
+	LotID     string    `json:"lot_id"` // empty if there was no lot left to match against
+	Asset     string    `json:"asset"`
+	Acquired  time.Time `json:"acquired"`
+	Disposed  time.Time `json:"disposed"`
+	Quantity  float64   `json:"quantity"`
+	Proceeds  float64   `json:"proceeds"`
+	CostBasis float64   `json:"cost_basis"`
+	Gain      float64   `json:"gain"`
+	LongTerm  bool      `json:"long_term"` // held for more than a year
+	Fee       bool      `json:"fee"`       // the fee paid to transfer between the user's own wallets
+
+	// data quality flags: the basis is treated as 0 when there's no lot, and prices as 0 when unknown
+	MissingBasis bool `json:"missing_basis"`
+	MissingPrice bool `json:"missing_price"`
+}
+
+// Summary represents the totals of a group of realizations (e.g. per year, asset or transaction)
+type Summary struct {
+	Key           string  `json:"key"`
+	Proceeds      float64 `json:"proceeds"`
+	CostBasis     float64 `json:"cost_basis"`
+	Gain          float64 `json:"gain"`
+	ShortTermGain float64 `json:"short_term_gain"`
+	LongTermGain  float64 `json:"long_term_gain"`
+}
+
+// Holding represents the open lots of a single asset, valued at a current price
+type Holding struct {
+	Asset          string  `json:"asset"`
+	Quantity       float64 `json:"quantity"`
+	CostBasis      float64 `json:"cost_basis"`
+	Price          float64 `json:"price"`
+	Value          float64 `json:"value"`
+	UnrealizedGain float64 `json:"unrealized_gain"`
+	MissingPrice   bool    `json:"missing_price"`
+}
+
+// Result represents the outcome of running events through the engine
+type Result struct {
+	Realized []*Realization
+	Lots     []*Lot // lots with a remaining quantity, in the order they were acquired
+}
+
+// Compute builds lots from the acquisitions in the provided events and consumes them with each disposal (in time order)
+// using the provided method. selections lists the lot IDs picked for each disposal ID when using SpecificID.
+func Compute(events []*Event, method Method, selections map[string][]string) (*Result, error) {
+	if _, err := ParseMethod(string(method)); err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*Event, len(events))
+	copy(sorted, events)
+
+	// acquisitions go before disposals at the same instant, so something received & spent within a block can be matched
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].Time.Before(sorted[j].Time)
+		}
+
+		return sorted[i].Quantity > sorted[j].Quantity
+	})
+
+	result := &Result{Realized: []*Realization{}, Lots: []*Lot{}}
+	acquired := []*Lot{}
+	lots := map[string][]*Lot{} // per asset, in the order they were acquired
+
+	for _, v := range sorted {
+		if v.Quantity > epsilon && !v.Transfer {
+			lot := &Lot{
+				ID:           v.ID,
+				Asset:        v.Asset,
+				Acquired:     v.Time,
+				Quantity:     v.Quantity,
+				Remaining:    v.Quantity,
+				Price:        v.Price,
+				MissingPrice: v.Price == 0,
+			}
+
+			acquired = append(acquired, lot)
+			lots[v.Asset] = append(lots[v.Asset], lot)
+			continue
+		}
+
+		if v.Quantity < -epsilon {
+			result.Realized = append(result.Realized, dispose(v, pick(lots[v.Asset], method, selections[v.ID]))...)
+		}
+	}
+
+	for _, v := range acquired {
+		if v.Remaining > epsilon {
+			result.Lots = append(result.Lots, v)
+		}
+	}
+
+	return result, nil
+}
+
+// pick returns the provided lots in the order the method consumes them
+func pick(lots []*Lot, method Method, selected []string) []*Lot {
+	ordered := make([]*Lot, len(lots))
+	copy(ordered, lots)
+
+	switch method {
+	case LIFO:
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	case HIFO:
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Price > ordered[j].Price })
+	case SpecificID:
+		rank := map[string]int{}
+		for i, v := range selected {
+			rank[v] = i + 1
+		}
+
+		// selected lots first (in the order they were selected), then everything else FIFO
+		sort.SliceStable(ordered, func(i, j int) bool {
+			ri, rj := rank[ordered[i].ID], rank[ordered[j].ID]
+			if ri == 0 || rj == 0 {
+				return ri != 0
+			}
+			return ri < rj
+		})
+	}
+
+	return ordered
+}
+
+// dispose consumes the disposal's quantity from the provided (ordered) lots, returning a realization per lot it touched
+func dispose(event *Event, lots []*Lot) []*Realization {
+	realized := []*Realization{}
+	remaining := -event.Quantity
+
+	for _, lot := range lots {
+		if remaining <= epsilon {
+			break
+		}
+
+		if lot.Remaining <= epsilon {
+			continue
+		}
+
+		qty := lot.Remaining
+		if remaining < qty {
+			qty = remaining
+		}
+
+		lot.Remaining -= qty
+		remaining -= qty
+
+		realized = append(realized, newRealization(event, lot, qty))
+	}
+
+	// whatever is left wasn't covered by anything we know was acquired
+	if remaining > epsilon {
+		realized = append(realized, newRealization(event, nil, remaining))
+	}
+
+	return realized
+}
+
+// newRealization matches the provided quantity of the disposal against the provided lot (nil if there's none)
+func newRealization(event *Event, lot *Lot, qty float64) *Realization {
+	r := &Realization{
+		EventID:      event.ID,
+		Asset:        event.Asset,
+		Acquired:     event.Time,
+		Disposed:     event.Time,
+		Quantity:     qty,
+		Proceeds:     qty * event.Price,
+		Fee:          event.Transfer,
+		MissingBasis: lot == nil,
+		MissingPrice: event.Price == 0,
+	}
+
+	if lot != nil {
+		r.LotID = lot.ID
+		r.Acquired = lot.Acquired
+		r.CostBasis = qty * lot.Price
+		r.MissingPrice = r.MissingPrice || lot.MissingPrice
+	}
+
+	r.Gain = r.Proceeds - r.CostBasis
+
+	r.LongTerm = longTerm(r.Acquired, r.Disposed)
+
+	return r
+}
+
+// longTerm reports whether something acquired & disposed of at the provided times was held for more than a year. The
+// holding period counts calendar days (in UTC), not instants: it's long term if it was disposed of after the anniversary
+// of its acquisition, whatever the time of day either happened at.
+func longTerm(acquired, disposed time.Time) bool {
+	date := func(t time.Time) time.Time {
+		y, m, d := t.UTC().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	return date(disposed).After(date(acquired).AddDate(1, 0, 0))
+}
+
+// Summarize totals the provided realizations, grouped by the key the provided function returns for each
+func Summarize(realized []*Realization, key func(*Realization) string) []*Summary {
+	byKey := map[string]*Summary{}
+	summaries := []*Summary{}
+
+	for _, v := range realized {
+		k := key(v)
+
+		summary, ok := byKey[k]
+		if !ok {
+			summary = &Summary{Key: k}
+			byKey[k] = summary
+			summaries = append(summaries, summary)
+		}
+
+		summary.Proceeds += v.Proceeds
+		summary.CostBasis += v.CostBasis
+		summary.Gain += v.Gain
+
+		if v.LongTerm {
+			summary.LongTermGain += v.Gain
+		} else {
+			summary.ShortTermGain += v.Gain
+		}
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+
+	return summaries
+}
+
+// ByYear groups realizations by the year they were disposed of in
+func ByYear(r *Realization) string { return strconv.Itoa(r.Disposed.Year()) }
+
+// ByAsset groups realizations by their asset
+func ByAsset(r *Realization) string { return r.Asset }
+
+// ByEvent groups realizations by the disposal (i.e. transaction) they're part of
+func ByEvent(r *Realization) string { return r.EventID }
+
+// Holdings values the open lots per asset at the current price the provided function returns (false if it's unknown)
+func (r *Result) Holdings(price func(asset string) (float64, bool)) []*Holding {
+	byAsset := map[string]*Holding{}
+	holdings := []*Holding{}
+
+	for _, lot := range r.Lots {
+		holding, ok := byAsset[lot.Asset]
+		if !ok {
+			holding = &Holding{Asset: lot.Asset}
+			holding.Price, ok = price(lot.Asset)
+			holding.MissingPrice = !ok
+
+			byAsset[lot.Asset] = holding
+			holdings = append(holdings, holding)
+		}
+
+		holding.Quantity += lot.Remaining
+		holding.CostBasis += lot.Remaining * lot.Price
+	}
+
+	for _, v := range holdings {
+		v.Value = v.Quantity * v.Price
+		v.UnrealizedGain = v.Value - v.CostBasis
+	}
+
+	sort.SliceStable(holdings, func(i, j int) bool { return holdings[i].Asset < holdings[j].Asset })
+
+	return holdings
+}
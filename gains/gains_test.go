@@ -0,0 +1,282 @@
+package gains
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// day returns the time the provided number of days after t0
+func day(n int) time.Time { return t0.AddDate(0, 0, n) }
+
+// split is the part of a disposal matched against a single lot
+type split struct {
+	lot      string
+	quantity float64
+	basis    float64
+	gain     float64
+}
+
+// threeLots returns three lots of 1 BTC, bought at 100, 300 & 200, then 1.5 BTC sold at 400
+func threeLots() []*Event {
+	return []*Event{
+		{ID: "buy1", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+		{ID: "buy2", Asset: "BTC", Time: day(1), Quantity: 1, Price: 300},
+		{ID: "buy3", Asset: "BTC", Time: day(2), Quantity: 1, Price: 200},
+		{ID: "sell", Asset: "BTC", Time: day(10), Quantity: -1.5, Price: 400},
+	}
+}
+
+func compute(t *testing.T, events []*Event, method Method, selections map[string][]string) *Result {
+	t.Helper()
+
+	result, err := Compute(events, method, selections)
+	if err != nil {
+		t.Fatalf("Compute() error = %v", err)
+	}
+
+	return result
+}
+
+// checkSplits checks the lots the provided realizations consumed, in order
+func checkSplits(t *testing.T, realized []*Realization, want ...split) {
+	t.Helper()
+
+	if len(realized) != len(want) {
+		t.Fatalf("Compute() realized %d splits, want %d: %+v", len(realized), len(want), realized)
+	}
+
+	for i, r := range realized {
+		got := split{lot: r.LotID, quantity: round(r.Quantity), basis: round(r.CostBasis), gain: round(r.Gain)}
+		if got != want[i] {
+			t.Errorf("split %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// checkRemaining checks what's left of the open lots, by lot ID
+func checkRemaining(t *testing.T, lots []*Lot, want map[string]float64) {
+	t.Helper()
+
+	got := map[string]float64{}
+	for _, v := range lots {
+		got[v.ID] = round(v.Remaining)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("open lots = %v, want %v", got, want)
+		return
+	}
+
+	for id, remaining := range want {
+		if got[id] != remaining {
+			t.Errorf("open lots = %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+// round rounds away float noise, e.g. 0.30000000000000004
+func round(v float64) float64 { return math.Round(v*1e8) / 1e8 }
+
+func TestComputeMethods(t *testing.T) {
+	t.Run("fifo", func(t *testing.T) {
+		result := compute(t, threeLots(), FIFO, nil)
+		checkSplits(t, result.Realized, split{"buy1", 1, 100, 300}, split{"buy2", 0.5, 150, 50})
+		checkRemaining(t, result.Lots, map[string]float64{"buy2": 0.5, "buy3": 1})
+	})
+
+	t.Run("lifo", func(t *testing.T) {
+		result := compute(t, threeLots(), LIFO, nil)
+		checkSplits(t, result.Realized, split{"buy3", 1, 200, 200}, split{"buy2", 0.5, 150, 50})
+		checkRemaining(t, result.Lots, map[string]float64{"buy1": 1, "buy2": 0.5})
+	})
+
+	t.Run("hifo", func(t *testing.T) {
+		result := compute(t, threeLots(), HIFO, nil)
+		checkSplits(t, result.Realized, split{"buy2", 1, 300, 100}, split{"buy3", 0.5, 100, 100})
+		checkRemaining(t, result.Lots, map[string]float64{"buy1": 1, "buy3": 0.5})
+	})
+
+	t.Run("specific id", func(t *testing.T) {
+		// the picked lot first, then FIFO for the rest
+		result := compute(t, threeLots(), SpecificID, map[string][]string{"sell": {"buy3"}})
+		checkSplits(t, result.Realized, split{"buy3", 1, 200, 200}, split{"buy1", 0.5, 50, 150})
+		checkRemaining(t, result.Lots, map[string]float64{"buy1": 0.5, "buy2": 1})
+	})
+
+	t.Run("specific id without a selection", func(t *testing.T) {
+		result := compute(t, threeLots(), SpecificID, map[string][]string{"another-sale": {"buy3"}})
+		checkSplits(t, result.Realized, split{"buy1", 1, 100, 300}, split{"buy2", 0.5, 150, 50})
+	})
+
+	t.Run("specific id picking a lot that doesn't exist", func(t *testing.T) {
+		result := compute(t, threeLots(), SpecificID, map[string][]string{"sell": {"deleted", "buy2"}})
+		checkSplits(t, result.Realized, split{"buy2", 1, 300, 100}, split{"buy1", 0.5, 50, 150})
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		if _, err := Compute(threeLots(), Method("average"), nil); err == nil {
+			t.Error("Compute() with an unknown method returned no error")
+		}
+	})
+}
+
+func TestComputeConsumesLotsAcrossDisposals(t *testing.T) {
+	result := compute(t, []*Event{
+		{ID: "buy", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+		{ID: "sell1", Asset: "BTC", Time: day(1), Quantity: -0.25, Price: 200},
+		{ID: "sell2", Asset: "BTC", Time: day(2), Quantity: -0.25, Price: 300},
+	}, FIFO, nil)
+
+	if result.Realized[0].EventID != "sell1" || result.Realized[1].EventID != "sell2" {
+		t.Errorf("Compute() realized %s then %s, want sell1 then sell2", result.Realized[0].EventID, result.Realized[1].EventID)
+	}
+
+	checkSplits(t, result.Realized, split{"buy", 0.25, 25, 25}, split{"buy", 0.25, 25, 50})
+	checkRemaining(t, result.Lots, map[string]float64{"buy": 0.5})
+}
+
+func TestComputeTransfersOnlyDisposeOfTheirFee(t *testing.T) {
+	result := compute(t, []*Event{
+		{ID: "buy", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+		{ID: "move-out", Asset: "BTC", Time: day(1), Quantity: -0.01, Price: 200, Transfer: true},
+		{ID: "move-in", Asset: "BTC", Time: day(1), Quantity: 0.5, Price: 200, Transfer: true},
+	}, FIFO, nil)
+
+	checkSplits(t, result.Realized, split{"buy", 0.01, 1, 1})
+	if !result.Realized[0].Fee {
+		t.Error("the transfer's realization isn't flagged as a fee")
+	}
+
+	// the deposit side doesn't open a lot of its own
+	checkRemaining(t, result.Lots, map[string]float64{"buy": 0.99})
+}
+
+func TestComputeFlagsMissingData(t *testing.T) {
+	t.Run("disposing of more than was acquired", func(t *testing.T) {
+		result := compute(t, []*Event{
+			{ID: "buy", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+			{ID: "sell", Asset: "BTC", Time: day(1), Quantity: -1.5, Price: 200},
+		}, FIFO, nil)
+
+		checkSplits(t, result.Realized, split{"buy", 1, 100, 100}, split{"", 0.5, 0, 100})
+		if result.Realized[0].MissingBasis || !result.Realized[1].MissingBasis {
+			t.Errorf("only the unmatched split should miss its basis: %+v", result.Realized)
+		}
+	})
+
+	t.Run("acquired without a price", func(t *testing.T) {
+		result := compute(t, []*Event{
+			{ID: "gift", Asset: "BTC", Time: day(0), Quantity: 1},
+			{ID: "sell", Asset: "BTC", Time: day(1), Quantity: -1, Price: 200},
+		}, FIFO, nil)
+
+		checkSplits(t, result.Realized, split{"gift", 1, 0, 200})
+		if r := result.Realized[0]; !r.MissingPrice || r.MissingBasis {
+			t.Errorf("the gift's split should miss its price (not its basis): %+v", r)
+		}
+	})
+}
+
+func TestComputeMatchesReceiptsSpentAtTheSameInstant(t *testing.T) {
+	// listed spend first, e.g. both sides of a block in the order Blockchair returned them
+	result := compute(t, []*Event{
+		{ID: "spend", Asset: "BTC", Time: day(0), Quantity: -1, Price: 100},
+		{ID: "receive", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+	}, FIFO, nil)
+
+	checkSplits(t, result.Realized, split{"receive", 1, 100, 0})
+}
+
+func TestComputeKeepsAssetsApart(t *testing.T) {
+	result := compute(t, []*Event{
+		{ID: "buy-btc", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+		{ID: "buy-eth", Asset: "ETH", Time: day(1), Quantity: 1, Price: 10},
+		{ID: "sell-eth", Asset: "ETH", Time: day(2), Quantity: -1, Price: 20},
+	}, FIFO, nil)
+
+	checkSplits(t, result.Realized, split{"buy-eth", 1, 10, 10})
+	checkRemaining(t, result.Lots, map[string]float64{"buy-btc": 1})
+}
+
+func TestComputeHoldingPeriod(t *testing.T) {
+	result := compute(t, []*Event{
+		{ID: "buy1", Asset: "BTC", Time: day(0), Quantity: 1, Price: 100},
+		{ID: "buy2", Asset: "BTC", Time: day(200), Quantity: 1, Price: 100},
+		{ID: "sell", Asset: "BTC", Time: t0.AddDate(1, 0, 1), Quantity: -2, Price: 100},
+	}, FIFO, nil)
+
+	if !result.Realized[0].LongTerm || result.Realized[1].LongTerm {
+		t.Errorf("only buy1 was held for more than a year: %+v", result.Realized)
+	}
+}
+
+func TestLongTerm(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		acquired, disposed string
+		want               bool
+	}{
+		{"2020-01-01T10:00:00Z", "2020-12-31T23:59:59Z", false},
+		// later in the day of the anniversary is still within the year
+		{"2020-01-01T10:00:00Z", "2021-01-01T11:00:00Z", false},
+		{"2020-01-01T10:00:00Z", "2021-01-01T09:00:00Z", false},
+		{"2020-01-01T10:00:00Z", "2021-01-02T00:00:00Z", true},
+		{"2020-01-01T23:59:59Z", "2021-01-02T00:00:00Z", true},
+		// dates are taken in UTC: the 1st at 23:00 in New York is the 2nd in UTC
+		{"2020-01-01T23:00:00-05:00", "2021-01-02T12:00:00Z", false},
+		{"2020-01-01T23:00:00-05:00", "2021-01-03T00:00:00Z", true},
+	}
+
+	for _, tt := range tests {
+		if got := longTerm(at(tt.acquired), at(tt.disposed)); got != tt.want {
+			t.Errorf("longTerm(%s, %s) = %v, want %v", tt.acquired, tt.disposed, got, tt.want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	realized := []*Realization{
+		{EventID: "a", Asset: "BTC", Disposed: day(0), Proceeds: 10, CostBasis: 4, Gain: 6},
+		{EventID: "b", Asset: "ETH", Disposed: day(400), Proceeds: 5, CostBasis: 8, Gain: -3, LongTerm: true},
+		{EventID: "b", Asset: "BTC", Disposed: day(400), Proceeds: 2, CostBasis: 1, Gain: 1},
+	}
+
+	byYear := Summarize(realized, ByYear)
+	want := []Summary{
+		{Key: "2020", Proceeds: 10, CostBasis: 4, Gain: 6, ShortTermGain: 6},
+		{Key: "2021", Proceeds: 7, CostBasis: 9, Gain: -2, ShortTermGain: 1, LongTermGain: -3},
+	}
+
+	if len(byYear) != len(want) {
+		t.Fatalf("Summarize(ByYear) = %d summaries, want %d", len(byYear), len(want))
+	}
+	for i, v := range byYear {
+		if *v != want[i] {
+			t.Errorf("Summarize(ByYear)[%d] = %+v, want %+v", i, *v, want[i])
+		}
+	}
+
+	// the other groupings only change the keys, in order
+	for name, key := range map[string]func(*Realization) string{"ByAsset": ByAsset, "ByEvent": ByEvent} {
+		keys := []string{}
+		for _, v := range Summarize(realized, key) {
+			keys = append(keys, v.Key)
+		}
+
+		wantKeys := map[string][]string{"ByAsset": {"BTC", "ETH"}, "ByEvent": {"a", "b"}}[name]
+		if len(keys) != 2 || keys[0] != wantKeys[0] || keys[1] != wantKeys[1] {
+			t.Errorf("Summarize(%s) keys = %v, want %v", name, keys, wantKeys)
+		}
+	}
+}
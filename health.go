@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+)
+
+// rateLimitHeadroom is the share of the Blockchair rate limit left below which we report it as degraded
+const rateLimitHeadroom = 0.2
+
+// the errors reported by dependency checks that aren't failing outright
+var (
+	errRateLimited  = errors.New("rate limited by the Blockchair API, cooling down")
+	errLowHeadroom  = errors.New("close to the Blockchair API's rate limit")
+	errSchedulerLag = errors.New("the scheduler missed a run")
+)
+
+// newReadinessChecker returns the checker behind /readyz: Spanner must be reachable for us to be ready, while an
+// unreachable (or rate limited) Blockchair API or a lagging background job (the exchange sync scheduler, the webhook
+// dispatcher or the job runner, nil when they're disabled) only degrade the service
+func newReadinessChecker(s *spanner.Client, b *blockchair.Client, exchangeSync, webhookDelivery, asyncJobs *health.JobStatus) *health.Checker {
+	checker := health.NewChecker(health.DefaultTimeout)
+
+	checker.Add("spanner", &health.Check{
+		Critical: true,
+		Run: func(ctx context.Context) (string, interface{}, error) {
+			iter := s.Single().Query(ctx, spanner.NewStatement("SELECT 1"))
+			if err := iter.Do(func(row *spanner.Row) error { return nil }); err != nil {
+				return health.StatusUnavailable, nil, err
+			}
+
+			return health.StatusOK, nil, nil
+		},
+	})
+
+	checker.Add("blockchair", &health.Check{
+		Run: func(ctx context.Context) (string, interface{}, error) {
+			if err := b.Ping(ctx); err != nil {
+				return health.StatusUnavailable, nil, err
+			}
+
+			return health.StatusOK, nil, nil
+		},
+	})
+
+	checker.Add("blockchair_rate_limit", &health.Check{
+		Run: func(ctx context.Context) (string, interface{}, error) {
+			limit := b.RateLimitStatus()
+
+			headroom := float64(limit.Limit-limit.CallsLastMinute) / float64(limit.Limit)
+			switch {
+			case limit.CoolingDown:
+				return health.StatusDegraded, limit, errRateLimited
+			case headroom < rateLimitHeadroom:
+				return health.StatusDegraded, limit, errLowHeadroom
+			}
+
+			return health.StatusOK, limit, nil
+		},
+	})
+
+	// there's nothing to check for a job that's disabled
+	if exchangeSync != nil {
+		checker.Add("exchange_sync_scheduler", jobCheck(exchangeSync))
+	}
+
+	if webhookDelivery != nil {
+		checker.Add("webhook_dispatcher", jobCheck(webhookDelivery))
+	}
+
+	if asyncJobs != nil {
+		checker.Add("job_runner", jobCheck(asyncJobs))
+	}
+
+	return checker
+}
+
+// jobCheck returns the check of a background job, which is degraded once it's missed a run
+func jobCheck(job *health.JobStatus) *health.Check {
+	return &health.Check{
+		Run: func(ctx context.Context) (string, interface{}, error) {
+			lag, lastRun := job.Lag(time.Now())
+
+			details := map[string]interface{}{
+				"interval_ms": float64(job.Interval()) / float64(time.Millisecond),
+				"lag_ms":      float64(lag) / float64(time.Millisecond),
+			}
+
+			if !lastRun.IsZero() {
+				details["last_run"] = lastRun
+			}
+
+			// a run taking a while is expected, missing a whole one isn't
+			if lag > job.Interval() {
+				return health.StatusDegraded, details, errSchedulerLag
+			}
+
+			return health.StatusOK, details, nil
+		},
+	}
+}
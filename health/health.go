@@ -0,0 +1,203 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dependency statuses, from best to worst
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+// DefaultTimeout bounds each check, so that a hanging dependency fails its check rather than the load balancer's probe
+const DefaultTimeout = 2 * time.Second
+
+// Check checks a single dependency, returning its status, some details about it (if any) and the error behind
+// anything but StatusOK
+type Check struct {
+	Critical bool // whether the service is unready while this dependency is unavailable
+	Run      func(ctx context.Context) (string, interface{}, error)
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Status    string      `json:"status"`
+	Critical  bool        `json:"critical"`
+	LatencyMS float64     `json:"latency_ms"`
+	Error     string      `json:"error,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// Report is the outcome of every check: unavailable if a critical dependency is (or the service is shutting down),
+// degraded if any other is anything but ok
+type Report struct {
+	Status       string             `json:"status"`
+	ShuttingDown bool               `json:"shutting_down,omitempty"`
+	Checks       map[string]*Result `json:"checks"`
+}
+
+// Checker runs the checks deciding whether the service is ready to be sent requests
+type Checker struct {
+	timeout      time.Duration
+	checks       map[string]*Check
+	shuttingDown int32 // set (atomically) to 1 once a graceful shutdown starts
+}
+
+// NewChecker returns a checker without any checks, bounding each by the provided timeout
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: map[string]*Check{}}
+}
+
+// Add adds a check of the named dependency. Checks must all be added before the checker is used.
+func (c *Checker) Add(name string, check *Check) {
+	c.checks[name] = check
+}
+
+// MarkShuttingDown makes the service unready from now on, so that load balancers stop routing requests to it
+func (c *Checker) MarkShuttingDown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether MarkShuttingDown was called
+func (c *Checker) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+// Check runs every check concurrently
+func (c *Checker) Check(ctx context.Context) *Report {
+	report := &Report{
+		Status:       StatusOK,
+		ShuttingDown: c.ShuttingDown(),
+		Checks:       map[string]*Result{},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range c.checks {
+		wg.Add(1)
+
+		go func(name string, check *Check) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			status, details, err := check.Run(ctx)
+
+			result := &Result{
+				Status:    status,
+				Critical:  check.Critical,
+				LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+				Details:   details,
+			}
+
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			report.Checks[name] = result
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	for _, v := range report.Checks {
+		switch {
+		case v.Status == StatusOK:
+		case v.Critical && v.Status == StatusUnavailable:
+			report.Status = StatusUnavailable
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+
+	if report.ShuttingDown {
+		report.Status = StatusUnavailable
+	}
+
+	return report
+}
+
+// ReadinessHandler returns a handler serving the checker's report, with a 503 whenever the service is unavailable
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+
+		status := http.StatusOK
+		if report.Status == StatusUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// LivenessHandler returns a handler reporting that the process is alive (and able to serve requests at all)
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+	})
+}
+
+// writeJSON writes the provided value as a JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// JobStatus tracks the runs of a background job, so that a check can report it falling behind its schedule
+type JobStatus struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	started time.Time
+	lastRun time.Time
+}
+
+// NewJobStatus returns the status of a job starting now, and running every interval
+func NewJobStatus(interval time.Duration) *JobStatus {
+	return &JobStatus{interval: interval, started: time.Now()}
+}
+
+// Interval returns how often the job runs
+func (j *JobStatus) Interval() time.Duration {
+	return j.interval
+}
+
+// Ran records a run of the job completing at the provided time
+func (j *JobStatus) Ran(at time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.lastRun = at
+}
+
+// Lag returns how long the job's next run is overdue at the provided time (0 if it isn't), and when it last ran
+func (j *JobStatus) Lag(now time.Time) (time.Duration, time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	due := j.started.Add(j.interval)
+	if !j.lastRun.IsZero() {
+		due = j.lastRun.Add(j.interval)
+	}
+
+	if now.Before(due) {
+		return 0, j.lastRun
+	}
+
+	return now.Sub(due), j.lastRun
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+const (
+	// history bucket intervals
+	intervalDaily   = "daily"
+	intervalWeekly  = "weekly"
+	intervalMonthly = "monthly"
+
+	// maxHistoryPoints caps the size of a time series (a little over 10 years of daily buckets)
+	maxHistoryPoints = 4000
+)
+
+// HistoryQuery represents the options for reconstructing balance history, parsed from the query parameters:
+// either a single point in time (at), or a series of buckets (interval, from & to), valued in currency
+type HistoryQuery struct {
+	At       time.Time
+	Interval string
+	From     time.Time // defaults to the first transaction
+	To       time.Time // defaults to now
+	Currency string    // defaults to USD
+}
+
+// HistoryResponse represents the expected response body to the '/history' endpoints
+type HistoryResponse struct {
+	Interval string          `json:"interval,omitempty"`
+	Currency string          `json:"currency"`
+	Points   []*HistoryPoint `json:"points"`
+}
+
+// HistoryPoint represents the reconstructed balance at a point in time
+// note: for a series, Time is the start of the bucket and the balance is the one held at its close
+type HistoryPoint struct {
+	Time          time.Time `json:"time"`
+	NativeBalance float64   `json:"native_balance"` // in BTC
+	FiatBalance   float64   `json:"fiat_balance"`   // in the requested currency, valued at Price
+	Price         float64   `json:"price"`          // the BTC rate in effect at the time (0 if unknown)
+}
+
+// balanceEvent represents a single stored change to an address' balance being replayed
+type balanceEvent struct {
+	TxnTimestamp  time.Time `spanner:"txn_timestamp"`
+	BalanceChange int64     `spanner:"balance_change"`
+	Price         float64   `spanner:"price"`
+	PriceCurrency string    `spanner:"price_currency"`
+}
+
+// parseHistoryQuery parses and validates the HistoryQuery options from the provided query parameters
+func parseHistoryQuery(values url.Values) (*HistoryQuery, error) {
+	q := &HistoryQuery{Interval: values.Get("interval"), Currency: defaultCurrency}
+
+	if v := values.Get("currency"); v != "" {
+		q.Currency = strings.ToUpper(v)
+	}
+
+	for param, dst := range map[string]*time.Time{"at": &q.At, "from": &q.From, "to": &q.To} {
+		if v := values.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+			}
+			*dst = t
+		}
+	}
+
+	if !q.At.IsZero() {
+		if q.Interval != "" || !q.From.IsZero() || !q.To.IsZero() {
+			return nil, fmt.Errorf("at cannot be combined with interval, from or to")
+		}
+
+		return q, nil
+	}
+
+	switch q.Interval {
+	case intervalDaily, intervalWeekly, intervalMonthly:
+	case "":
+		q.Interval = intervalDaily
+	default:
+		return nil, fmt.Errorf("interval must be one of: %s, %s, %s", intervalDaily, intervalWeekly, intervalMonthly)
+	}
+
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	return q, nil
+}
+
+// GetAddressHistoryHandler returns a closure responsible for invoking balanceHistory() for the address in the request path
+func GetAddressHistoryHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		q, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		txn := s.ReadOnlyTransaction()
+		defer txn.Close()
+
+		// make sure we 404 on addresses we aren't tracking rather than replaying nothing
+		if _, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"public_key"}); err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		historyResp, err := balanceHistory(ctx, txn, p, []string{addr}, nil, q)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, historyResp)
+	})
+}
+
+// GetPortfolioHistoryHandler returns a closure responsible for invoking balanceHistory() across all (unarchived) addresses
+// (and manual BTC transactions) of the user in the request path
+func GetPortfolioHistoryHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		q, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		txn := s.ReadOnlyTransaction()
+		defer txn.Close()
+
+		user, err := readUser(ctx, txn, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		manual, err := readManualTransactions(ctx, txn, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		addresses, err := readAddresses(ctx, txn, user.AddressList())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		// like the portfolio, its history leaves archived addresses out
+		historyResp, err := balanceHistory(ctx, txn, p, unarchivedAddresses(user.AddressList(), addresses), manualBalanceEvents(manual), q)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get history for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, historyResp)
+	})
+}
+
+// balanceHistory reconstructs the combined balance of the provided addresses (plus the provided off-chain events), either at a
+// single point in time or as a series of buckets, by replaying their stored balance changes in order. transfers between the
+// addresses cancel out along the way. each point is valued at the historical price in effect at the time it represents
+func balanceHistory(ctx context.Context, txn *spanner.ReadOnlyTransaction, p prices.Provider, addrs []string, offChain []*balanceEvent, q *HistoryQuery) (*HistoryResponse, error) {
+	events, err := readBalanceEvents(ctx, txn, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := readAddresses(ctx, txn, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// we only import an address' most recent transactions, so rather than assuming every address started out empty we
+	// work out the balance held before the first stored transaction from the latest synced balance (0 for a full history)
+	var opening int64
+	for _, v := range addresses {
+		opening += v.NativeBalance
+	}
+
+	for _, v := range events {
+		opening -= v.BalanceChange
+	}
+
+	// off-chain holdings are entered in full, so they start out empty
+	if len(offChain) > 0 {
+		events = append(events, offChain...)
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].TxnTimestamp.Before(events[j].TxnTimestamp)
+		})
+	}
+
+	if !q.At.IsZero() {
+		point, err := balanceAt(ctx, p, events, opening, q.At, q.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		return &HistoryResponse{Currency: q.Currency, Points: []*HistoryPoint{point}}, nil
+	}
+
+	to := q.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	from := q.From
+	if from.IsZero() {
+		from = to
+		if len(events) > 0 && events[0].TxnTimestamp.Before(to) {
+			from = events[0].TxnTimestamp
+		}
+	}
+
+	points := []*HistoryPoint{}
+
+	// walk the buckets and the (sorted) events together, carrying the running balance and latest transaction price forward
+	balance := opening
+	var txnPrice float64
+	i := 0
+
+	for start := bucketStart(from, q.Interval); start.Before(to); start = nextBucket(start, q.Interval) {
+		if len(points) == maxHistoryPoints {
+			return nil, fmt.Errorf("too many points, narrow the range or use a coarser interval")
+		}
+
+		end := nextBucket(start, q.Interval)
+		for ; i < len(events) && events[i].TxnTimestamp.Before(end); i++ {
+			balance += events[i].BalanceChange
+			if events[i].Price > 0 && events[i].PriceCurrency == q.Currency {
+				txnPrice = events[i].Price
+			}
+		}
+
+		// the balance is the one at the bucket's close, so that's also when we price it
+		closedAt := end.Add(-time.Nanosecond)
+		if closedAt.After(to) {
+			closedAt = to
+		}
+
+		price, err := pointPrice(ctx, p, q.Currency, closedAt, txnPrice)
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, newHistoryPoint(start, balance, price))
+	}
+
+	return &HistoryResponse{Interval: q.Interval, Currency: q.Currency, Points: points}, nil
+}
+
+// balanceAt replays the provided (sorted) events on top of the opening balance up to and including the provided time
+func balanceAt(ctx context.Context, p prices.Provider, events []*balanceEvent, opening int64, at time.Time, currency string) (*HistoryPoint, error) {
+	balance := opening
+	var txnPrice float64
+
+	for _, v := range events {
+		if v.TxnTimestamp.After(at) {
+			break
+		}
+
+		balance += v.BalanceChange
+		if v.Price > 0 && v.PriceCurrency == currency {
+			txnPrice = v.Price
+		}
+	}
+
+	price, err := pointPrice(ctx, p, currency, at, txnPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHistoryPoint(at, balance, price), nil
+}
+
+// pointPrice returns the BTC rate in the provided currency at the provided time: from our price history if it covers the time,
+// otherwise the rate the latest transaction replayed so far was valued at (0 if there's none)
+func pointPrice(ctx context.Context, p prices.Provider, currency string, at time.Time, txnPrice float64) (float64, error) {
+	quote, err := p.Price(ctx, btcAsset, currency, at)
+	if err == nil {
+		return quote.Price, nil
+	}
+
+	if errors.Is(err, prices.ErrNoPrice) {
+		return txnPrice, nil
+	}
+
+	return 0, err
+}
+
+// newHistoryPoint values the provided balance (in satoshis) at the provided BTC rate
+func newHistoryPoint(t time.Time, balance int64, price float64) *HistoryPoint {
+	native := float64(balance) / satoshisPerBTC
+
+	return &HistoryPoint{
+		Time:          t,
+		NativeBalance: native,
+		FiatBalance:   native * price,
+		Price:         price,
+	}
+}
+
+// readBalanceEvents reads the stored balance changes of the provided addresses (and the price they were valued at), sorted by time
+func readBalanceEvents(ctx context.Context, txn *spanner.ReadOnlyTransaction, addrs []string) ([]*balanceEvent, error) {
+	stmt := spanner.NewStatement(`
+		SELECT txn_timestamp, COALESCE(balance_change, 0) AS balance_change, COALESCE(price, 0) AS price,
+			COALESCE(price_currency, 'USD') AS price_currency
+		FROM transactions
+		WHERE public_key IN UNNEST(@addresses)
+		ORDER BY txn_timestamp
+	`)
+	stmt.Params["addresses"] = addrs
+
+	events := []*balanceEvent{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var event balanceEvent
+		if err := row.ToStruct(&event); err != nil {
+			return err
+		}
+
+		events = append(events, &event)
+		return nil
+	})
+
+	return events, err
+}
+
+// manualBalanceEvents converts the provided manual transactions of BTC into balance events (history is in BTC)
+func manualBalanceEvents(recs []*ManualTransactionsRecord) []*balanceEvent {
+	events := []*balanceEvent{}
+	for _, v := range recs {
+		if v.Asset != btcAsset {
+			continue
+		}
+
+		events = append(events, &balanceEvent{
+			TxnTimestamp:  v.TxnTimestamp,
+			BalanceChange: int64(math.Round(v.Quantity * satoshisPerBTC)),
+			Price:         v.FiatValue / math.Abs(v.Quantity),
+			PriceCurrency: v.FiatCurrency,
+		})
+	}
+
+	return events
+}
+
+// bucketStart returns the start (in UTC) of the bucket the provided time falls in; weeks start on Monday
+func bucketStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch interval {
+	case intervalWeekly:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case intervalMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// nextBucket returns the start of the bucket following the one starting at the provided time
+func nextBucket(start time.Time, interval string) time.Time {
+	switch interval {
+	case intervalWeekly:
+		return start.AddDate(0, 0, 7)
+	case intervalMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
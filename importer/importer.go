@@ -0,0 +1,410 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the layout of an exchange's CSV export
+type Format string
+
+const (
+	Coinbase Format = "coinbase" // the "transaction history" report
+	Kraken   Format = "kraken"   // the "ledgers" export
+	Generic  Format = "generic"  // our own layout, for anything else (see Mappings)
+)
+
+// types of imported transactions
+const (
+	Buy        = "buy"
+	Sell       = "sell"
+	Deposit    = "deposit"
+	Withdrawal = "withdrawal"
+	Income     = "income" // e.g. staking or learning rewards
+)
+
+// outbound reports whether a transaction of the provided type decreases the account's balance
+func outbound(typ string) bool {
+	return typ == Sell || typ == Withdrawal
+}
+
+// Transaction represents a single change to an exchange account's balance of a (non-fiat) asset, whatever it was exported from
+type Transaction struct {
+	ID         string    `json:"id"` // stable across re-imports of the same row
+	Format     Format    `json:"format"`
+	ExternalID string    `json:"external_id,omitempty"` // the exchange's own identifier (if it exports one)
+	Type       string    `json:"type"`
+	Asset      string    `json:"asset"`
+	Quantity   float64   `json:"quantity"` // signed change in the account's balance of Asset (> 0 is inbound), net of Fee
+	Fee        float64   `json:"fee"`      // in Asset
+	Price      float64   `json:"price"`    // per unit in Currency (0 if unknown)
+	Currency   string    `json:"currency"`
+	Time       time.Time `json:"time"`
+	Notes      string    `json:"notes,omitempty"`
+}
+
+// Mapping describes where a format keeps each field of a Transaction (column names are matched case-insensitively,
+// and empty if the format doesn't have that field)
+type Mapping struct {
+	ID, Ref, Time, Type, Asset, Quantity, Fee, Price, Currency, Notes string
+
+	TimeLayouts    []string
+	Types          map[string]string // the format's (lower-cased) transaction types to ours, "" to go by the quantity's sign
+	SignedQuantity bool              // whether quantities are already signed, rather than by type
+}
+
+// Mappings are the column mappings of every supported format
+var Mappings = map[Format]*Mapping{
+	Coinbase: {
+		ID:          "ID",
+		Time:        "Timestamp",
+		Type:        "Transaction Type",
+		Asset:       "Asset",
+		Quantity:    "Quantity Transacted",
+		Price:       "Spot Price at Transaction",
+		Currency:    "Spot Price Currency",
+		Notes:       "Notes",
+		TimeLayouts: []string{time.RFC3339, "2006-01-02 15:04:05 MST"},
+		Types: map[string]string{
+			"buy":                 Buy,
+			"advanced trade buy":  Buy,
+			"sell":                Sell,
+			"advanced trade sell": Sell,
+			"convert":             Sell,
+			"send":                Withdrawal,
+			"withdrawal":          Withdrawal,
+			"receive":             Deposit,
+			"deposit":             Deposit,
+			"rewards income":      Income,
+			"staking income":      Income,
+			"coinbase earn":       Income,
+			"learning reward":     Income,
+		},
+	},
+	Kraken: {
+		ID:          "txid",
+		Ref:         "refid",
+		Time:        "time",
+		Type:        "type",
+		Asset:       "asset",
+		Quantity:    "amount",
+		Fee:         "fee",
+		TimeLayouts: []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.0000"},
+		Types: map[string]string{
+			"trade":      "",
+			"spend":      "",
+			"receive":    "",
+			"deposit":    Deposit,
+			"withdrawal": Withdrawal,
+			"staking":    Income,
+			"earn":       Income,
+		},
+		SignedQuantity: true,
+	},
+	Generic: {
+		ID:          "id",
+		Time:        "time",
+		Type:        "type",
+		Asset:       "asset",
+		Quantity:    "quantity",
+		Fee:         "fee",
+		Price:       "price",
+		Currency:    "currency",
+		Notes:       "notes",
+		TimeLayouts: []string{time.RFC3339, "2006-01-02"},
+		Types: map[string]string{
+			Buy:        Buy,
+			Sell:       Sell,
+			Deposit:    Deposit,
+			Withdrawal: Withdrawal,
+			Income:     Income,
+		},
+	},
+}
+
+// fiat lists the currencies that are never imported as assets (exchanges export fiat balances as rows too)
+var fiat = map[string]bool{"USD": true, "EUR": true, "GBP": true, "CAD": true, "AUD": true, "JPY": true, "CHF": true}
+
+// krakenAssets maps Kraken's legacy asset codes to the usual tickers
+var krakenAssets = map[string]string{"XXBT": "BTC", "XBT": "BTC", "XXDG": "DOGE", "XDG": "DOGE"}
+
+// ParseFormat validates the provided format name
+func ParseFormat(s string) (Format, error) {
+	f := Format(strings.ToLower(s))
+	if _, ok := Mappings[f]; !ok {
+		return "", fmt.Errorf("unknown import format %q, must be one of: %s, %s, %s", s, Coinbase, Kraken, Generic)
+	}
+
+	return f, nil
+}
+
+// row is a parsed CSV row before fiat rows are dropped (they price the trades that share their ref)
+type row struct {
+	txn *Transaction
+	ref string
+}
+
+// Parse reads every transaction out of the provided CSV export, skipping anything before the header (e.g. Coinbase's
+// preamble) and fiat rows, in the order they appear
+func Parse(r io.Reader, f Format) ([]*Transaction, error) {
+	mapping, ok := Mappings[f]
+	if !ok {
+		return nil, fmt.Errorf("unknown import format %q", f)
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var columns map[string]int
+	rows := []*row{}
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if columns == nil {
+			columns = header(record, mapping)
+			continue
+		}
+
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		v, err := parseRow(record, columns, mapping, f)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		rows = append(rows, v)
+	}
+
+	if columns == nil {
+		return nil, fmt.Errorf("could not find a %s header in the CSV (it needs a %q column)", f, mapping.Time)
+	}
+
+	return pricedTransactions(rows), nil
+}
+
+// ParseRecords converts records laid out like the provided format's export (e.g. a Kraken ledger fetched from its API)
+// into transactions, the same way Parse() does
+func ParseRecords(head []string, records [][]string, f Format) ([]*Transaction, error) {
+	mapping, ok := Mappings[f]
+	if !ok {
+		return nil, fmt.Errorf("unknown import format %q", f)
+	}
+
+	columns := header(head, mapping)
+	if columns == nil {
+		return nil, fmt.Errorf("the %s records need a %q column", f, mapping.Time)
+	}
+
+	rows := []*row{}
+	for i, record := range records {
+		v, err := parseRow(record, columns, mapping, f)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+
+		rows = append(rows, v)
+	}
+
+	return pricedTransactions(rows), nil
+}
+
+// pricedTransactions drops the fiat rows, having used them to price the trades they're the other side of
+func pricedTransactions(rows []*row) []*Transaction {
+	// fiat legs price the other side of their trade, e.g. Kraken exports a buy as one BTC row & one USD row
+	fiatByRef := map[string]*Transaction{}
+	for _, v := range rows {
+		if len(v.ref) > 0 && fiat[v.txn.Asset] {
+			fiatByRef[v.ref] = v.txn
+		}
+	}
+
+	txns := []*Transaction{}
+	for _, v := range rows {
+		if fiat[v.txn.Asset] {
+			continue
+		}
+
+		if leg, ok := fiatByRef[v.ref]; ok && v.txn.Price == 0 && v.txn.Quantity != 0 {
+			v.txn.Price = math.Abs(leg.Quantity+leg.Fee) / math.Abs(v.txn.Quantity+v.txn.Fee)
+			v.txn.Currency = leg.Asset
+		}
+
+		txns = append(txns, v.txn)
+	}
+
+	return txns
+}
+
+// header maps the provided record's columns to their index, or returns nil if it isn't the header of the mapping
+func header(record []string, mapping *Mapping) map[string]int {
+	columns := map[string]int{}
+	for i, v := range record {
+		columns[strings.ToLower(strings.TrimSpace(v))] = i
+	}
+
+	if _, ok := columns[strings.ToLower(mapping.Time)]; !ok {
+		return nil
+	}
+
+	return columns
+}
+
+// parseRow converts a single CSV record into a transaction using the provided column mapping
+func parseRow(record []string, columns map[string]int, mapping *Mapping, f Format) (*row, error) {
+	field := func(name string) string {
+		i, ok := columns[strings.ToLower(name)]
+		if len(name) == 0 || !ok || i >= len(record) {
+			return ""
+		}
+
+		return strings.TrimSpace(record[i])
+	}
+
+	at, err := parseTime(field(mapping.Time), mapping.TimeLayouts)
+	if err != nil {
+		return nil, err
+	}
+
+	quantity, err := parseNumber(field(mapping.Quantity))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quantity %q", field(mapping.Quantity))
+	}
+
+	fee, err := parseNumber(field(mapping.Fee))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fee %q", field(mapping.Fee))
+	}
+
+	price, err := parseNumber(field(mapping.Price))
+	if err != nil {
+		return nil, fmt.Errorf("invalid price %q", field(mapping.Price))
+	}
+
+	rawType := strings.ToLower(field(mapping.Type))
+	typ, ok := mapping.Types[rawType]
+	if !ok {
+		return nil, fmt.Errorf("unknown transaction type %q", field(mapping.Type))
+	}
+
+	if !mapping.SignedQuantity {
+		quantity = math.Abs(quantity)
+		if outbound(typ) {
+			quantity = -quantity
+		}
+	}
+
+	if len(typ) == 0 {
+		typ = Buy
+		if quantity < 0 {
+			typ = Sell
+		}
+	}
+
+	txn := &Transaction{
+		Format:     f,
+		ExternalID: field(mapping.ID),
+		Type:       typ,
+		Asset:      normalizeAsset(field(mapping.Asset), f),
+		Quantity:   round(quantity - fee),
+		Fee:        fee,
+		Price:      price,
+		Currency:   strings.ToUpper(field(mapping.Currency)),
+		Time:       at,
+		Notes:      field(mapping.Notes),
+	}
+
+	if len(txn.Asset) == 0 {
+		return nil, fmt.Errorf("missing asset")
+	}
+
+	txn.ID = transactionID(txn)
+
+	return &row{txn: txn, ref: field(mapping.Ref)}, nil
+}
+
+// transactionID identifies the provided transaction by the exchange's own ID if it has one, otherwise by its contents,
+// so re-importing the same export yields the same IDs
+func transactionID(t *Transaction) string {
+	if len(t.ExternalID) > 0 {
+		return fmt.Sprintf("%s:%s", t.Format, t.ExternalID)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		t.Time.UTC().Format(time.RFC3339Nano),
+		t.Type,
+		t.Asset,
+		strconv.FormatFloat(t.Quantity, 'f', -1, 64),
+		strconv.FormatFloat(t.Fee, 'f', -1, 64),
+		strconv.FormatFloat(t.Price, 'f', -1, 64),
+	}, "|")))
+
+	return fmt.Sprintf("%s:%s", t.Format, hex.EncodeToString(sum[:16]))
+}
+
+// normalizeAsset maps the provided format's asset code to the usual ticker, e.g. Kraken's "XXBT" or "XBT.M" to "BTC"
+func normalizeAsset(asset string, f Format) string {
+	asset = strings.ToUpper(asset)
+	if f != Kraken {
+		return asset
+	}
+
+	// staked, opt-in rewards & futures balances share their asset's code
+	if i := strings.Index(asset, "."); i > 0 {
+		asset = asset[:i]
+	}
+
+	if v, ok := krakenAssets[asset]; ok {
+		return v
+	}
+
+	// legacy codes are the ticker prefixed with X (crypto) or Z (fiat), e.g. "XETH" or "ZUSD"
+	if len(asset) == 4 && (asset[0] == 'X' || asset[0] == 'Z') {
+		return asset[1:]
+	}
+
+	return asset
+}
+
+// round drops the float noise past the smallest unit any asset we import is divided into
+func round(v float64) float64 {
+	return math.Round(v*1e10) / 1e10
+}
+
+// parseTime parses the provided time with the first layout that matches
+func parseTime(v string, layouts []string) (time.Time, error) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+// parseNumber parses the provided amount, ignoring currency symbols & thousands separators (an empty amount is 0)
+func parseNumber(v string) (float64, error) {
+	v = strings.NewReplacer("$", "", "€", "", "£", "", ",", "").Replace(v)
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	return strconv.ParseFloat(v, 64)
+}
@@ -0,0 +1,146 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseFile parses the export in testdata with the provided name
+func parseFile(t *testing.T, name string, f Format) []*Transaction {
+	t.Helper()
+
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	txns, err := Parse(file, f)
+	if err != nil {
+		t.Fatalf("Parse(%s) error = %v", name, err)
+	}
+
+	return txns
+}
+
+func TestParseCoinbase(t *testing.T) {
+	txns := parseFile(t, "coinbase.csv", Coinbase)
+	if len(txns) != 3 {
+		t.Fatalf("Parse() returned %d transactions, want 3 (after the report's preamble)", len(txns))
+	}
+
+	buy, send, staking := txns[0], txns[1], txns[2]
+
+	if buy.ID != "coinbase:cb1" || buy.Type != Buy || buy.Quantity != 0.5 || buy.Price != 30000 || buy.Currency != "USD" || buy.Notes != "Bought 0.5 BTC" {
+		t.Errorf("buy = %+v", buy)
+	}
+
+	if send.Type != Withdrawal || send.Quantity != -0.1 {
+		t.Errorf("send = %+v, want a withdrawal of -0.1", send)
+	}
+
+	// Coinbase writes older timestamps without the "T"
+	if want := time.Date(2021, 3, 2, 3, 4, 5, 0, time.UTC); staking.Type != Income || staking.Asset != "ETH" || !staking.Time.Equal(want) {
+		t.Errorf("staking = %+v, want ETH income at %s", staking, want)
+	}
+}
+
+func TestParseKraken(t *testing.T) {
+	txns := parseFile(t, "kraken.csv", Kraken)
+	if len(txns) != 3 {
+		t.Fatalf("Parse() returned %d transactions, want 3 (without the trade's USD leg)", len(txns))
+	}
+
+	// a trade's asset leg is priced by its fiat leg
+	if buy := txns[0]; buy.ID != "kraken:L2" || buy.Type != Buy || buy.Asset != "BTC" || buy.Quantity != 0.5 || buy.Price != 30000 || buy.Currency != "USD" {
+		t.Errorf("trade = %+v, want a buy of 0.5 BTC at 30000 USD", buy)
+	}
+
+	// the fee comes out of the balance on top of the amount, and nothing prices it
+	if withdrawal := txns[1]; withdrawal.Type != Withdrawal || withdrawal.Quantity != -0.1005 || withdrawal.Fee != 0.0005 || withdrawal.Price != 0 || withdrawal.Currency != "" {
+		t.Errorf("withdrawal = %+v, want -0.1005 BTC with a 0.0005 fee & no price", withdrawal)
+	}
+
+	if staking := txns[2]; staking.Type != Income || staking.Asset != "BTC" || staking.Quantity != 0.001 {
+		t.Errorf("staking = %+v, want 0.001 BTC of income", staking)
+	}
+}
+
+func TestParseGeneric(t *testing.T) {
+	txns := parseFile(t, "generic.csv", Generic)
+	if len(txns) != 3 {
+		t.Fatalf("Parse() returned %d transactions, want 3 (skipping the blank line)", len(txns))
+	}
+
+	if buy := txns[0]; buy.ID != "generic:g1" || buy.Asset != "BTC" || buy.Currency != "USD" {
+		t.Errorf("buy = %+v, want generic:g1 with its asset & currency upper-cased", buy)
+	}
+
+	if sell := txns[1]; sell.Type != Sell || sell.Quantity != -0.201 || sell.Fee != 0.001 || !sell.Time.Equal(time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("sell = %+v, want -0.201 BTC including its fee on 2021-01-03", sell)
+	}
+
+	if deposit := txns[2]; deposit.Type != Deposit || deposit.Quantity != 1 || deposit.Price != 0 || deposit.Notes != "from a friend" {
+		t.Errorf("deposit = %+v", deposit)
+	}
+}
+
+func TestParseIsIdempotent(t *testing.T) {
+	first := parseFile(t, "generic.csv", Generic)
+	second := parseFile(t, "generic.csv", Generic)
+
+	// the rows without an id are identified by their contents
+	for i := 1; i < 3; i++ {
+		if len(first[i].ExternalID) != 0 || !strings.HasPrefix(first[i].ID, "generic:") {
+			t.Errorf("row %d ID = %q, want one derived for the generic format", i, first[i].ID)
+		}
+
+		if first[i].ID != second[i].ID {
+			t.Errorf("re-parsing row %d changed its ID from %s to %s", i, first[i].ID, second[i].ID)
+		}
+	}
+
+	if first[1].ID == first[2].ID {
+		t.Errorf("different rows share the ID %s", first[1].ID)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	errs := map[string]string{
+		"a,b,c\n1,2,3\n": `needs a "time" column`,
+		"time,type,asset,quantity\nyesterday,buy,BTC,1\n":     `line 2: invalid time "yesterday"`,
+		"time,type,asset,quantity\n2021-01-02,buy,BTC,lots\n": `line 2: invalid quantity "lots"`,
+		"time,type,asset,quantity\n2021-01-02,lend,BTC,1\n":   `line 2: unknown transaction type "lend"`,
+		"time,type,asset,quantity\n2021-01-02,buy,,1\n":       "line 2: missing asset",
+	}
+
+	for csv, want := range errs {
+		if _, err := Parse(strings.NewReader(csv), Generic); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) error = %v, want it to contain %q", csv, err, want)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("time\n"), Format("mtgox")); err == nil || !strings.Contains(err.Error(), `unknown import format "mtgox"`) {
+		t.Errorf("Parse() in an unknown format error = %v", err)
+	}
+}
+
+func TestNormalizeAsset(t *testing.T) {
+	// Kraken prefixes its older assets with X (or Z for fiat) and suffixes staked ones
+	for asset, want := range map[string]string{"XXBT": "BTC", "XBT.M": "BTC", "XETH": "ETH", "ZUSD": "USD", "DOT.S": "DOT", "xdg": "DOGE"} {
+		if got := normalizeAsset(asset, Kraken); got != want {
+			t.Errorf("normalizeAsset(%q, kraken) = %q, want %q", asset, got, want)
+		}
+	}
+
+	if got := normalizeAsset("XETH", Coinbase); got != "XETH" {
+		t.Errorf("normalizeAsset(\"XETH\", coinbase) = %q, want it untouched", got)
+	}
+
+	if got := normalizeAsset("btc", Generic); got != "BTC" {
+		t.Errorf("normalizeAsset(\"btc\", generic) = %q, want BTC", got)
+	}
+}
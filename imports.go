@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/importer"
+)
+
+// importSource prefixes the IDs of activity imported from exchange exports
+const importSource = "import"
+
+// ImportedTransactionsRecord is the data model for a respective row in the 'imported_transactions' table stored in Spanner,
+// holding the exchange activity a user imported alongside the synced transactions
+type ImportedTransactionsRecord struct {
+	UserID        string    `spanner:"user_id"`   // pk
+	ImportID      string    `spanner:"import_id"` // pk, stable across re-imports (see importer.Transaction)
+	Source        string    `spanner:"source"`    // the format it was imported from, e.g. "coinbase"
+	ExternalID    string    `spanner:"external_id"`
+	Type          string    `spanner:"type"`
+	Asset         string    `spanner:"asset"`
+	Quantity      float64   `spanner:"quantity"` // net change in the account's balance of Asset
+	Fee           float64   `spanner:"fee"`      // in Asset
+	Price         float64   `spanner:"price"`
+	PriceCurrency string    `spanner:"price_currency"`
+	TxnTimestamp  time.Time `spanner:"txn_timestamp"`
+	Notes         string    `spanner:"notes"`
+	CreatedAt     time.Time `spanner:"created_at"`
+}
+
+// ImportResponse represents the expected response body to '/v1/users/{user}/imports'
+type ImportResponse struct {
+	Format     importer.Format               `json:"format"`
+	DryRun     bool                          `json:"dry_run"`
+	Imported   []*ImportedTransactionsRecord `json:"imported"`   // what was (or, on a dry run, would be) inserted
+	Duplicates []string                      `json:"duplicates"` // the IDs of rows that were already imported
+}
+
+// ImportHandler returns a closure responsible for parsing the exchange CSV export in the request body
+// and invoking importTransactions() for the user in the request path
+func ImportHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+		query := r.URL.Query()
+
+		format, err := importer.ParseFormat(query.Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dryRun := false
+		if v := query.Get("dry_run"); v != "" {
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "dry_run must be a boolean", http.StatusBadRequest)
+				return
+			}
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		txns, err := importer.Parse(bytes.NewReader(body), format)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse %s export. %v", format, err), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := importTransactions(ctx, s, userID, txns, dryRun)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not import transactions for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		resp.Format = format
+
+		status := http.StatusCreated
+		if dryRun {
+			status = http.StatusOK
+		}
+
+		writeJSON(w, status, resp)
+	})
+}
+
+// spannerReader is implemented by both read-only and read-write Spanner transactions
+type spannerReader interface {
+	rowReader
+	querier
+}
+
+// importTransactions stores the provided transactions for the provided user, skipping the ones already imported.
+// on a dry run nothing is written, but the response is the same.
+func importTransactions(ctx context.Context, s *spanner.Client, userID string, txns []*importer.Transaction, dryRun bool) (*ImportResponse, error) {
+	if dryRun {
+		txn := s.ReadOnlyTransaction()
+		defer txn.Close()
+
+		return planImport(ctx, txn, userID, txns)
+	}
+
+	var resp *ImportResponse
+
+	_, err := readWriteTransaction(ctx, s, "import_transactions", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		var err error
+		if resp, err = planImport(ctx, txn, userID, txns); err != nil {
+			return err
+		}
+
+		mutations := []*spanner.Mutation{}
+		for _, v := range resp.Imported {
+			mut, err := spanner.InsertStruct(importedTransactionsTable, v)
+			if err != nil {
+				return err
+			}
+
+			mutations = append(mutations, mut)
+		}
+
+		return txn.BufferWrite(mutations)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.DryRun = false
+	return resp, nil
+}
+
+// planImport splits the provided transactions into the records to insert and the IDs already imported for the provided user
+// (including duplicates within the same export)
+func planImport(ctx context.Context, txn spannerReader, userID string, txns []*importer.Transaction) (*ImportResponse, error) {
+	if _, err := readUser(ctx, txn, userID); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, v := range txns {
+		ids = append(ids, v.ID)
+	}
+
+	stmt := spanner.NewStatement(`SELECT import_id FROM imported_transactions WHERE user_id = @user_id AND import_id IN UNNEST(@ids)`)
+	stmt.Params["user_id"] = userID
+	stmt.Params["ids"] = ids
+
+	seen := map[string]bool{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var id string
+		if err := row.Column(0, &id); err != nil {
+			return err
+		}
+
+		seen[id] = true
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ImportResponse{
+		DryRun:     true,
+		Imported:   []*ImportedTransactionsRecord{},
+		Duplicates: []string{},
+	}
+
+	now := time.Now()
+	for _, v := range txns {
+		if seen[v.ID] {
+			resp.Duplicates = append(resp.Duplicates, v.ID)
+			continue
+		}
+
+		seen[v.ID] = true
+
+		resp.Imported = append(resp.Imported, &ImportedTransactionsRecord{
+			UserID:        userID,
+			ImportID:      v.ID,
+			Source:        string(v.Format),
+			ExternalID:    v.ExternalID,
+			Type:          v.Type,
+			Asset:         v.Asset,
+			Quantity:      v.Quantity,
+			Fee:           v.Fee,
+			Price:         v.Price,
+			PriceCurrency: v.Currency,
+			TxnTimestamp:  v.Time,
+			Notes:         v.Notes,
+			CreatedAt:     now,
+		})
+	}
+
+	return resp, nil
+}
+
+// readImportedActivity reads the provided user's imported exchange transactions as activity
+func readImportedActivity(ctx context.Context, txn querier, userID string) ([]*activity, error) {
+	stmt := spanner.NewStatement(`
+		SELECT user_id, import_id, source, external_id, type, asset, quantity, fee, price, price_currency, txn_timestamp, notes, created_at
+		FROM imported_transactions
+		WHERE user_id = @user_id
+		ORDER BY txn_timestamp
+	`)
+	stmt.Params["user_id"] = userID
+
+	acts := []*activity{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec ImportedTransactionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		id := fmt.Sprintf("%s:%s", importSource, rec.ImportID)
+		act := &activity{
+			ID:       id,
+			Ref:      id,
+			Wallet:   rec.Source,
+			Asset:    rec.Asset,
+			Time:     rec.TxnTimestamp,
+			Quantity: rec.Quantity,
+			Fee:      rec.Fee,
+			Price:    rec.Price,
+			Currency: rec.PriceCurrency,
+		}
+
+		if act.Currency == defaultCurrency {
+			act.AmountUSD = math.Abs(act.Quantity) * act.Price
+		}
+
+		acts = append(acts, act)
+		return nil
+	})
+
+	return acts, err
+}
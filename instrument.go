@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/metrics"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+var (
+	httpRequests = metrics.NewCounter(
+		"http_requests_total",
+		"HTTP requests served, by route, method and status code.",
+		"route", "method", "status",
+	)
+
+	httpRequestDuration = metrics.NewHistogram(
+		"http_request_duration_seconds",
+		"Latency of the HTTP requests served, by route, method and status code.",
+		metrics.DefaultBuckets,
+		"route", "method", "status",
+	)
+
+	addressSyncDuration = metrics.NewHistogram(
+		"address_sync_duration_seconds",
+		"Time taken to sync an address from the Blockchair API.",
+		metrics.DefaultBuckets,
+	)
+
+	addressSyncNewTxns = metrics.NewCounter(
+		"address_sync_new_transactions_total",
+		"Transactions found by address syncs that we hadn't stored yet.",
+	)
+
+	exchangeSyncDuration = metrics.NewHistogram(
+		"exchange_sync_duration_seconds",
+		"Time taken to sync an exchange account, by exchange.",
+		metrics.DefaultBuckets,
+		"exchange",
+	)
+
+	exchangeSyncNewTxns = metrics.NewCounter(
+		"exchange_sync_new_transactions_total",
+		"Transactions imported by exchange account syncs that we hadn't stored yet, by exchange.",
+		"exchange",
+	)
+
+	spannerTxns = metrics.NewCounter(
+		"spanner_transactions_total",
+		"Spanner read/write transactions, by name and result (committed or failed).",
+		"name", "result",
+	)
+
+	spannerTxnRetries = metrics.NewCounter(
+		"spanner_transaction_retries_total",
+		"Times a Spanner read/write transaction was retried (e.g. after being aborted by a conflicting one), by name.",
+		"name",
+	)
+
+	authFailures = metrics.NewCounter(
+		"auth_failures_total",
+		"Requests rejected by API key authentication or authorization, by reason (missing, invalid, scope or forbidden).",
+		"reason",
+	)
+
+	webhookDeliveries = metrics.NewCounter(
+		"webhook_deliveries_total",
+		"Webhook delivery attempts, by event type and outcome (delivered, retrying or failed).",
+		"event", "outcome",
+	)
+
+	webhookDeliveryDuration = metrics.NewHistogram(
+		"webhook_delivery_duration_seconds",
+		"Time taken by subscribers to answer webhook deliveries, by event type.",
+		metrics.DefaultBuckets,
+		"event",
+	)
+
+	asyncJobs = metrics.NewCounter(
+		"jobs_total",
+		"Asynchronous jobs run to completion, by kind and final status (succeeded, failed or cancelled).",
+		"kind", "status",
+	)
+
+	asyncJobDuration = metrics.NewHistogram(
+		"job_duration_seconds",
+		"Time taken to run an asynchronous job, by kind.",
+		metrics.DefaultBuckets,
+		"kind",
+	)
+
+	transferMatches = metrics.NewCounter(
+		"transfer_matches_total",
+		"Transfers between a user's own wallets matched by transfer detection, by source (user or request).",
+		"source",
+	)
+)
+
+// instrumentRoutes is a middleware tracing each request (joining the caller's trace if it sent a traceparent header)
+// and recording the count & latency of the requests served by each route
+func instrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), fmt.Sprintf("%s %s", r.Method, route),
+			"http.method", r.Method,
+			"http.route", route,
+			"http.target", r.URL.Path,
+			"request_id", logging.RequestID(r.Context()),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+
+		status := strconv.Itoa(rec.status)
+		httpRequests.Inc(route, r.Method, status)
+		httpRequestDuration.ObserveDuration(time.Since(start), route, r.Method, status)
+	})
+}
+
+// statusRecorder records the status code of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets handlers streaming their response flush through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// readWriteTransaction runs the provided function in a read/write transaction like (*spanner.Client).ReadWriteTransaction,
+// tracing the named transaction and recording its result and how often Spanner had to retry it
+func readWriteTransaction(ctx context.Context, s *spanner.Client, name string, f func(context.Context, *spanner.ReadWriteTransaction) error) (time.Time, error) {
+	ctx, span := tracing.Start(ctx, "spanner."+name)
+	defer span.End()
+
+	attempts := 0
+
+	ts, err := s.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		attempts++
+		if attempts > 1 {
+			spannerTxnRetries.Inc(name)
+		}
+
+		return f(ctx, txn)
+	})
+
+	result := "committed"
+	if err != nil {
+		result = "failed"
+	}
+
+	spannerTxns.Inc(name, result)
+
+	span.SetAttributes("attempts", attempts)
+	span.SetError(err)
+
+	return ts, err
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+// the kinds of asynchronous job
+const (
+	jobAddAddress  = "add_address"  // an /add (or POST /v1/addresses), i.e. an initial sync
+	jobSyncAddress = "sync_address" // a /sync (or POST /v1/addresses/{addr}/sync)
+)
+
+// asynchronous job statuses
+const (
+	jobQueued    = "queued"    // waiting for a runner to claim it
+	jobRunning   = "running"   // claimed by the runner whose heartbeat_at keeps moving
+	jobSucceeded = "succeeded" // done, its response is in result
+	jobFailed    = "failed"    // done, the reason why is in error
+	jobCancelled = "cancelled" // cancelled before it could finish
+)
+
+// jobEventFinished is the event ending a job's event stream once it's done, after the events of its sync (see
+// JobEventsHandler)
+const jobEventFinished = "job.finished"
+
+const (
+	// jobConcurrency bounds how many jobs each runner runs at once; they mostly wait on Blockchair's rate limit, so
+	// more of them wouldn't finish any sooner
+	jobConcurrency = 4
+
+	// jobHeartbeat is how often a running job records that it's still alive, and checks whether it's been cancelled
+	jobHeartbeat = 5 * time.Second
+
+	// jobLease is how long a running job can go without a heartbeat before it's presumed abandoned (e.g. by an instance
+	// that was killed) and reclaimed by another runner
+	jobLease = time.Minute
+)
+
+// jobColumns lists the columns read into a JobsRecord
+var jobColumns = []string{
+	"job_id", "kind", "user_id", "address", "status", "batches_done", "batches_total", "error", "result",
+	"cancel_requested", "created_at", "started_at", "heartbeat_at", "finished_at",
+}
+
+// JobsRecord is the data model for a respective row in the 'jobs' table stored in Spanner: an add or sync of an
+// address, run in the background on behalf of a request that didn't wait for it
+type JobsRecord struct {
+	JobID           string           `spanner:"job_id"` // pk
+	Kind            string           `spanner:"kind"`
+	UserID          string           `spanner:"user_id"` // who the job was created for, empty without auth
+	Address         string           `spanner:"address"`
+	Status          string           `spanner:"status"`
+	BatchesDone     int64            `spanner:"batches_done"`  // transaction batches fetched from Blockchair so far
+	BatchesTotal    int64            `spanner:"batches_total"` // 0 until the job knows how many there are
+	Error           string           `spanner:"error"`
+	Result          string           `spanner:"result" json:"-"` // the JSON response the request would have had
+	CancelRequested bool             `spanner:"cancel_requested"`
+	CreatedAt       time.Time        `spanner:"created_at"`
+	StartedAt       spanner.NullTime `spanner:"started_at"`
+	HeartbeatAt     spanner.NullTime `spanner:"heartbeat_at"`
+	FinishedAt      spanner.NullTime `spanner:"finished_at"`
+}
+
+// Finished reports whether the job is done, one way or another
+func (j *JobsRecord) Finished() bool {
+	return j.Status == jobSucceeded || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// cancel cancels the (unfinished) job right away if it's queued, or asks its runner to stop it if it's running
+func (j *JobsRecord) cancel() {
+	switch j.Status {
+	case jobQueued:
+		j.Status = jobCancelled
+		j.FinishedAt = spanner.NullTime{Time: time.Now().UTC(), Valid: true}
+	default:
+		j.CancelRequested = true
+	}
+}
+
+// JobEventsRecord is the data model for a respective row in the 'job_events' table stored in Spanner: an event of a
+// job's sync, recorded for whoever follows the job
+type JobEventsRecord struct {
+	JobID     string    `spanner:"job_id"` // pk
+	Seq       int64     `spanner:"seq"`    // pk, from 1 in the order the job's events happened (across its runs)
+	Type      string    `spanner:"type"`
+	Event     string    `spanner:"event"` // the JSON-encoded SyncEvent
+	CreatedAt time.Time `spanner:"created_at"`
+}
+
+// JobResponse represents the expected response body to '/v1/jobs/{job}', and to the requests made asynchronously
+type JobResponse struct {
+	Job    *JobsRecord     `json:"job"`
+	Result json.RawMessage `json:"result,omitempty"` // once the job has succeeded
+}
+
+// newJobResponse returns the response body describing the provided job
+func newJobResponse(job *JobsRecord) *JobResponse {
+	resp := &JobResponse{Job: job}
+	if len(job.Result) > 0 {
+		resp.Result = json.RawMessage(job.Result)
+	}
+
+	return resp
+}
+
+// wantsAsync reports whether a request asked not to wait for its job, via ?async=true or Prefer: respond-async
+func wantsAsync(r *http.Request) bool {
+	if async, err := strconv.ParseBool(r.URL.Query().Get("async")); err == nil {
+		return async
+	}
+
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startJob queues a job of the provided kind and answers the request with it, pointing at where it can be polled
+func startJob(w http.ResponseWriter, r *http.Request, s *spanner.Client, kind, addr, userID string) {
+	job, err := enqueueJob(r.Context(), s, kind, addr, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not queue job. %v", err), statusFromErr(err))
+		return
+	}
+
+	w.Header().Set("Location", "/v1/jobs/"+job.JobID)
+	writeJSON(w, http.StatusAccepted, newJobResponse(job))
+}
+
+// GetJobHandler returns a closure responsible for reading the job in the request path
+func GetJobHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		jobID := mux.Vars(r)["job"]
+
+		job, err := readJob(ctx, s.Single(), jobID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get job %s. %v", jobID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newJobResponse(job))
+	})
+}
+
+// CancelJobHandler returns a closure responsible for cancelling the job in the request path. A queued job is cancelled
+// right away, while a running one is asked to stop and is cancelled by its runner within jobHeartbeat.
+func CancelJobHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		jobID := mux.Vars(r)["job"]
+
+		var job *JobsRecord
+		_, err := readWriteTransaction(ctx, s, "cancel_job", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			var err error
+			job, err = readJob(ctx, txn, jobID)
+			if err != nil || job.Finished() {
+				return err
+			}
+
+			job.cancel()
+
+			mut, err := spanner.UpdateStruct(jobsTable, job)
+			if err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{mut})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not cancel job %s. %v", jobID, err), statusFromErr(err))
+			return
+		}
+
+		if job.Finished() && job.Status != jobCancelled {
+			http.Error(w, fmt.Sprintf("job %s already %s", jobID, job.Status), http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newJobResponse(job))
+	})
+}
+
+// enqueueJob creates a queued job of the provided kind, for the provided address & user
+func enqueueJob(ctx context.Context, s *spanner.Client, kind, addr, userID string) (*JobsRecord, error) {
+	job, mut, err := newJob(kind, addr, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("queued job", "job_id", job.JobID, "kind", kind, "address", addr)
+
+	return job, nil
+}
+
+// newJob returns a queued job of the provided kind, for the provided address & user, along with the mutation inserting it
+func newJob(kind, addr, userID string) (*JobsRecord, *spanner.Mutation, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	job := &JobsRecord{
+		JobID:     id,
+		Kind:      kind,
+		UserID:    userID,
+		Address:   addr,
+		Status:    jobQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	mut, err := spanner.InsertStruct(jobsTable, job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return job, mut, nil
+}
+
+// cancelAddressJobs returns the mutations cancelling the unfinished jobs of the provided address
+func cancelAddressJobs(ctx context.Context, txn querier, addr string) ([]*spanner.Mutation, error) {
+	stmt := spanner.NewStatement(fmt.Sprintf(`SELECT %s FROM jobs WHERE address = @address AND status IN UNNEST(@statuses)`, strings.Join(jobColumns, ", ")))
+	stmt.Params["address"] = addr
+	stmt.Params["statuses"] = []string{jobQueued, jobRunning}
+
+	mutations := []*spanner.Mutation{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var job JobsRecord
+		if err := row.ToStruct(&job); err != nil {
+			return err
+		}
+
+		job.cancel()
+
+		mut, err := spanner.UpdateStruct(jobsTable, &job)
+		if err != nil {
+			return err
+		}
+
+		mutations = append(mutations, mut)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mutations, nil
+}
+
+// readJob reads the JobsRecord for the provided job ID
+func readJob(ctx context.Context, txn rowReader, jobID string) (*JobsRecord, error) {
+	row, err := txn.ReadRow(ctx, jobsTable, spanner.Key{jobID}, jobColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var job JobsRecord
+	if err := row.ToStruct(&job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// newJobEvent returns the mutation recording the provided event of the job with the provided ID, as its seq-th
+func newJobEvent(jobID string, seq int64, event *SyncEvent) (*spanner.Mutation, error) {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return spanner.InsertOrUpdateStruct(jobEventsTable, &JobEventsRecord{
+		JobID:     jobID,
+		Seq:       seq,
+		Type:      event.Type,
+		Event:     string(raw),
+		CreatedAt: event.At,
+	})
+}
+
+// lastJobEventSeq returns the seq of the last event recorded for the job with the provided ID, 0 if there's none
+func lastJobEventSeq(ctx context.Context, txn querier, jobID string) (int64, error) {
+	stmt := spanner.NewStatement(`SELECT IFNULL(MAX(seq), 0) FROM job_events WHERE job_id = @job_id`)
+	stmt.Params["job_id"] = jobID
+
+	var seq int64
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&seq)
+	})
+
+	return seq, err
+}
+
+// readJobEvents reads the job with the provided ID along with its events recorded after the provided seq, in order,
+// as of the same point in time: once the job has finished, every event of its sync is among them
+func readJobEvents(ctx context.Context, s *spanner.Client, jobID string, after int64) (*JobsRecord, []*JobEventsRecord, error) {
+	txn := s.ReadOnlyTransaction()
+	defer txn.Close()
+
+	job, err := readJob(ctx, txn, jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmt := spanner.NewStatement(`
+		SELECT job_id, seq, type, event, created_at
+		FROM job_events
+		WHERE job_id = @job_id AND seq > @after
+		ORDER BY seq
+	`)
+	stmt.Params["job_id"] = jobID
+	stmt.Params["after"] = after
+
+	events := []*JobEventsRecord{}
+	err = txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var event JobEventsRecord
+		if err := row.ToStruct(&event); err != nil {
+			return err
+		}
+
+		events = append(events, &event)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return job, events, nil
+}
+
+// jobRunner claims & runs the queued jobs, on as many instances as there are running
+type jobRunner struct {
+	s *spanner.Client
+	b *blockchair.Client
+	p prices.Provider
+}
+
+// runJobsEvery claims the jobs waiting to be run each interval of the provided schedule, running up to jobConcurrency
+// of them at a time & recording each run in the schedule's status. It returns once the stop channel is closed, after
+// the jobs it's running have finished, unless the provided context is done.
+func (j *jobRunner) runJobsEvery(ctx context.Context, stop <-chan struct{}, schedule *health.JobStatus) {
+	log := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(schedule.Interval())
+	defer ticker.Stop()
+
+	// a slot is held by each running job, so holding every one of them means none are left
+	slots := make(chan struct{}, jobConcurrency)
+	defer func() {
+		for i := 0; i < jobConcurrency; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		free := jobConcurrency - len(slots)
+		if free == 0 {
+			schedule.Ran(time.Now())
+			continue
+		}
+
+		stmt := spanner.NewStatement(`
+			SELECT job_id
+			FROM jobs
+			WHERE status = @queued OR (status = @running AND heartbeat_at < @stale)
+			ORDER BY created_at
+			LIMIT @limit
+		`)
+		stmt.Params["queued"] = jobQueued
+		stmt.Params["running"] = jobRunning
+		stmt.Params["stale"] = time.Now().Add(-jobLease)
+		stmt.Params["limit"] = free
+
+		ids := []string{}
+		err := j.s.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var id string
+			if err := row.Columns(&id); err != nil {
+				return err
+			}
+
+			ids = append(ids, id)
+			return nil
+		})
+
+		if err != nil {
+			log.Error("could not list jobs to run", "error", err)
+			continue
+		}
+
+		for _, id := range ids {
+			job, err := j.claim(ctx, id)
+			if err != nil {
+				log.Error("could not claim job", "job_id", id, "error", err)
+				continue
+			}
+
+			if job == nil {
+				continue
+			}
+
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				j.run(ctx, job)
+			}()
+		}
+
+		schedule.Ran(time.Now())
+	}
+}
+
+// claim marks the job with the provided ID as running, returning nil unless it's still waiting to be run (i.e. another
+// runner didn't get to it first). An abandoned job that was asked to stop is cancelled rather than claimed.
+func (j *jobRunner) claim(ctx context.Context, jobID string) (*JobsRecord, error) {
+	var claimed *JobsRecord
+
+	_, err := readWriteTransaction(ctx, j.s, "claim_job", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		claimed = nil
+
+		job, err := readJob(ctx, txn, jobID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		abandoned := job.Status == jobRunning && job.HeartbeatAt.Time.Before(now.Add(-jobLease))
+		if job.Status != jobQueued && !abandoned {
+			return nil
+		}
+
+		if job.CancelRequested {
+			job.Status = jobCancelled
+			job.FinishedAt = spanner.NullTime{Time: now, Valid: true}
+		} else {
+			job.Status = jobRunning
+			job.HeartbeatAt = spanner.NullTime{Time: now, Valid: true}
+			if !job.StartedAt.Valid {
+				job.StartedAt = spanner.NullTime{Time: now, Valid: true}
+			}
+
+			claimed = job
+		}
+
+		mut, err := spanner.UpdateStruct(jobsTable, job)
+		if err != nil {
+			return err
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{mut})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+// run runs the provided (claimed) job to completion, recording its progress as it goes and its outcome once it's done.
+// A job interrupted by the provided context being done is left running, for another runner to reclaim once its
+// heartbeat goes stale.
+func (j *jobRunner) run(ctx context.Context, job *JobsRecord) {
+	ctx, span := tracing.Start(ctx, "jobs.run", "job_id", job.JobID, "kind", job.Kind, "address", job.Address)
+	defer span.End()
+
+	log := logging.FromContext(ctx).With("job_id", job.JobID, "kind", job.Kind, "address", job.Address)
+	ctx = logging.NewContext(ctx, log)
+	start := time.Now()
+
+	log.Info("running job")
+
+	// a reclaimed job's events follow the ones recorded by its earlier runs
+	seq, err := lastJobEventSeq(ctx, j.s.Single(), job.JobID)
+	if err != nil {
+		log.Warn("could not read job events, recording them from the start", "error", err)
+	}
+
+	// every event of the job's sync is recorded for whoever follows it, and its progress is the batches of
+	// transactions fetched. events are reported synchronously by the sync, so they're numbered in order.
+	jobCtx, cancel := context.WithCancel(withSyncEvents(ctx, func(event *SyncEvent) {
+		seq++
+		mutations := []*spanner.Mutation{}
+
+		mut, err := newJobEvent(job.JobID, seq, event)
+		if err != nil {
+			log.Warn("could not record job event", "event", event.Type, "error", err)
+		} else {
+			mutations = append(mutations, mut)
+		}
+
+		var done, total int
+		progressed := true
+		switch data := event.Data.(type) {
+		case *SyncStartedEventData:
+			done, total = 0, data.Batches
+		case *BatchEventData:
+			done, total = data.Batch, data.Batches
+		default:
+			progressed = false
+		}
+
+		if progressed {
+			cols := []string{"job_id", "batches_done", "batches_total", "heartbeat_at"}
+			mutations = append(mutations, spanner.Update(jobsTable, cols, []interface{}{job.JobID, int64(done), int64(total), time.Now().UTC()}))
+		}
+
+		if len(mutations) == 0 {
+			return
+		}
+
+		if _, err := j.s.Apply(ctx, mutations); err != nil {
+			log.Warn("could not record job progress", "event", event.Type, "error", err)
+		}
+	}))
+	defer cancel()
+
+	finished := make(chan struct{})
+	cancelled := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		j.watch(jobCtx, job.JobID, finished, cancelled, cancel)
+	}()
+
+	result, err := j.perform(jobCtx, job)
+
+	close(finished)
+	<-watching
+
+	// a job that got to commit its work succeeded, even if it was asked to stop just before it did
+	switch {
+	case err == nil:
+		job.Status = jobSucceeded
+		raw, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			log.Error("could not encode job result", "error", marshalErr)
+		}
+
+		job.Result = string(raw)
+	case isClosed(cancelled):
+		job.Status = jobCancelled
+	case ctx.Err() != nil:
+		log.Warn("job interrupted, leaving it to be reclaimed", "error", err)
+		return
+	default:
+		job.Status = jobFailed
+		job.Error = err.Error()
+	}
+
+	now := time.Now().UTC()
+	cols := []string{"job_id", "status", "error", "result", "heartbeat_at", "finished_at"}
+	mut := spanner.Update(jobsTable, cols, []interface{}{job.JobID, job.Status, job.Error, job.Result, now, now})
+	if _, applyErr := j.s.Apply(ctx, []*spanner.Mutation{mut}); applyErr != nil {
+		log.Error("could not record job outcome", "status", job.Status, "error", applyErr)
+		return
+	}
+
+	span.SetError(err)
+	asyncJobs.Inc(job.Kind, job.Status)
+	asyncJobDuration.ObserveDuration(time.Since(start), job.Kind)
+
+	log.Info("finished job", "status", job.Status, "error", job.Error, "duration_ms", time.Since(start))
+}
+
+// perform does the work of the provided job, returning the response its request would have had. A panic fails the
+// job rather than taking down the server, since jobs run outside of any request.
+func (j *jobRunner) perform(ctx context.Context, job *JobsRecord) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.FromContext(ctx).Error("job panicked", "panic", r, "stack", string(debug.Stack()))
+			result, err = nil, fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	switch job.Kind {
+	case jobAddAddress:
+		address, err := add(ctx, job.Address, job.UserID, j.s, j.b, j.p)
+		return &AddResponse{Address: address}, err
+	case jobSyncAddress:
+		address, err := syncAddress(ctx, j.s, j.b, j.p, job.Address)
+		return &SyncResponse{Address: address}, err
+	default:
+		return nil, fmt.Errorf("unknown kind of job %q", job.Kind)
+	}
+}
+
+// watch keeps the heartbeat of the running job with the provided ID going until the finished channel is closed,
+// closing the cancelled channel & calling cancel if the job is asked to stop in the meantime
+func (j *jobRunner) watch(ctx context.Context, jobID string, finished <-chan struct{}, cancelled chan<- struct{}, cancel context.CancelFunc) {
+	log := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		row, err := j.s.Single().ReadRow(ctx, jobsTable, spanner.Key{jobID}, []string{"cancel_requested"})
+		if err != nil {
+			log.Warn("could not check whether job was cancelled", "error", err)
+			continue
+		}
+
+		var cancelRequested bool
+		if err := row.Columns(&cancelRequested); err != nil {
+			log.Warn("could not check whether job was cancelled", "error", err)
+			continue
+		}
+
+		if cancelRequested {
+			log.Info("cancelling job")
+			close(cancelled)
+			cancel()
+			return
+		}
+
+		mut := spanner.Update(jobsTable, []string{"job_id", "heartbeat_at"}, []interface{}{jobID, time.Now().UTC()})
+		if _, err := j.s.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+			log.Warn("could not record job heartbeat", "error", err)
+		}
+	}
+}
+
+// isClosed reports whether the provided channel has been closed
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/journal"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+const (
+	// the accounts on the other side of a user's wallets
+	feesAccount            = "Expenses:Fees"
+	externalAccount        = "Equity:External"
+	openingBalancesAccount = "Equity:Opening-Balances"
+
+	// dust is half a satoshi: any quantity smaller than that is float rounding
+	dust = 0.5 / satoshisPerBTC
+)
+
+// GetJournalHandler returns a closure responsible for invoking userJournal() for the user in the request path
+// and writing it as a beancount (default) or ledger-cli journal (format=ledger)
+func GetJournalHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+		query := r.URL.Query()
+
+		format, err := journal.ParseFormat(query.Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		currency := defaultCurrency
+		if v := query.Get("currency"); v != "" {
+			currency = strings.ToUpper(v)
+		}
+
+		j, err := userJournal(ctx, s, p, userID, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not build journal for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		if err := j.Write(w, format); err != nil {
+			logging.FromContext(r.Context()).Error("could not write journal", "user_id", userID, "error", err)
+		}
+	})
+}
+
+// userJournal builds a double-entry journal of the provided user's activity: each address is an asset account, fees go
+// to an expense account, and transfers between the user's own wallets (see userTransfers()) are a single entry between
+// both accounts. every address opens with whatever balance its stored transactions don't account for, and is asserted
+// to hold the balance we last synced.
+func userJournal(ctx context.Context, s *spanner.Client, p prices.Provider, userID, currency string) (*journal.Journal, error) {
+	txn := s.ReadOnlyTransaction()
+	defer txn.Close()
+
+	user, err := readUser(ctx, txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := readAddresses(ctx, txn, user.AddressList())
+	if err != nil {
+		return nil, err
+	}
+
+	acts, err := readUserActivity(ctx, txn, user)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers, err := userTransfers(acts)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal.Journal{
+		Title:    fmt.Sprintf("%s (%s)", user.Username, user.UUID),
+		Currency: currency,
+	}
+
+	j.Entries = append(j.Entries, openingEntries(addresses, acts)...)
+	j.Entries = append(j.Entries, activityEntries(acts, transfers)...)
+
+	priced := map[string]bool{}
+	for _, v := range acts {
+		day := fmt.Sprintf("%s/%s", v.Asset, v.Time.UTC().Format("2006-01-02"))
+		if priced[day] {
+			continue
+		}
+
+		price, err := activityPrice(ctx, p, v, currency)
+		if err != nil {
+			return nil, err
+		}
+
+		if price > 0 {
+			priced[day] = true
+			j.Prices = append(j.Prices, &journal.Price{Time: v.Time, Base: v.Asset, Quote: currency, Price: price})
+		}
+	}
+
+	for _, addr := range user.AddressList() {
+		rec, ok := addresses[addr]
+		if !ok || rec.UpdatedAt.IsZero() {
+			continue
+		}
+
+		j.Assertions = append(j.Assertions, &journal.Assertion{
+			Time:      rec.UpdatedAt,
+			Account:   walletAccount(addr),
+			Quantity:  float64(rec.NativeBalance) / satoshisPerBTC,
+			Commodity: btcAsset,
+		})
+	}
+
+	return j, nil
+}
+
+// openingEntries returns an entry per address for the balance it held before its first stored transaction
+// (only its most recent transactions are synced), dated at that transaction
+func openingEntries(addresses map[string]*AddressesRecord, acts []*activity) []*journal.Entry {
+	openings := map[string]*journal.Entry{}
+	balances := map[string]float64{}
+	order := []string{}
+
+	for _, v := range acts {
+		if _, ok := addresses[v.Wallet]; !ok {
+			continue
+		}
+
+		if _, ok := openings[v.Wallet]; !ok {
+			openings[v.Wallet] = &journal.Entry{Time: v.Time, Narration: "Opening balance", Ref: v.Wallet}
+			balances[v.Wallet] = float64(addresses[v.Wallet].NativeBalance) / satoshisPerBTC
+			order = append(order, v.Wallet)
+		}
+
+		balances[v.Wallet] -= v.Quantity
+	}
+
+	entries := []*journal.Entry{}
+	for _, addr := range order {
+		opening := balances[addr]
+		if math.Abs(opening) < dust {
+			continue
+		}
+
+		entry := openings[addr]
+		entry.Postings = []*journal.Posting{
+			{Account: walletAccount(addr), Quantity: opening, Commodity: btcAsset},
+			{Account: openingBalancesAccount, Quantity: -opening, Commodity: btcAsset},
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// activityEntries returns an entry per transaction in the provided activity (in time order), merging the sides of each
+// transfer into one. whatever the user's wallets paid out beyond the fee went to (or came from) outside the portfolio.
+func activityEntries(acts []*activity, transfers map[string]string) []*journal.Entry {
+	transferred := map[string]bool{}
+	for outID, inID := range transfers {
+		transferred[outID] = true
+		transferred[inID] = true
+	}
+
+	// group activity by transaction, pulling the deposit side of a transfer into its withdrawal's group
+	groupOf := map[string]string{}
+	for _, v := range acts {
+		groupOf[v.ID] = v.Ref
+	}
+
+	for outID, inID := range transfers {
+		groupOf[inID] = groupOf[outID]
+	}
+
+	groups := map[string][]*activity{}
+	order := []string{}
+	for _, v := range acts {
+		key := groupOf[v.ID]
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+
+		groups[key] = append(groups[key], v)
+	}
+
+	entries := []*journal.Entry{}
+	for _, key := range order {
+		group := groups[key]
+
+		entry := &journal.Entry{Time: group[0].Time, Ref: key}
+
+		var net, fee float64
+		var transfer bool
+		for _, v := range group {
+			entry.Postings = append(entry.Postings, &journal.Posting{Account: activityAccount(v), Quantity: v.Quantity, Commodity: v.Asset})
+			net += v.Quantity
+			transfer = transfer || transferred[v.ID]
+
+			// the fee is only ours if we paid into the transaction
+			if v.Quantity < 0 && v.Fee > fee {
+				fee = v.Fee
+			}
+		}
+
+		asset := group[0].Asset
+
+		if net < 0 && fee > 0 {
+			fee = math.Min(fee, -net)
+			entry.Postings = append(entry.Postings, &journal.Posting{Account: feesAccount, Quantity: fee, Commodity: asset})
+			net += fee
+		}
+
+		if math.Abs(net) < dust {
+			net = 0
+		}
+
+		if net != 0 {
+			entry.Postings = append(entry.Postings, &journal.Posting{Account: externalAccount, Quantity: -net, Commodity: asset})
+		}
+
+		switch {
+		case transfer:
+			entry.Narration = "Transfer between own wallets"
+			entry.Tags = []string{transferTag}
+		case net > 0:
+			entry.Narration = "Received"
+		case net < 0:
+			entry.Narration = "Sent"
+		default:
+			entry.Narration = "Fee"
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// walletAccount returns the name of the asset account of the provided address
+func walletAccount(addr string) string {
+	return "Assets:Bitcoin:" + journal.Component(addr)
+}
+
+// activityAccount returns the name of the asset account the provided activity happened in: its address' account if it
+// was synced, otherwise one per exchange (e.g. "Assets:Coinbase")
+func activityAccount(a *activity) string {
+	if a.onchain() {
+		return walletAccount(a.Wallet)
+	}
+
+	return "Assets:" + journal.Component(a.Wallet)
+}
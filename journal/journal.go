@@ -0,0 +1,290 @@
+package journal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Format is a plain-text accounting journal format
+type Format string
+
+const (
+	Beancount Format = "beancount"
+	Ledger    Format = "ledger"
+)
+
+// ParseFormat validates the provided format name (defaulting to Beancount)
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "":
+		return Beancount, nil
+	case Beancount, Ledger:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown journal format %q, must be one of: %s, %s", s, Beancount, Ledger)
+	}
+}
+
+// Journal represents a double-entry journal of transactions, balance assertions and prices
+type Journal struct {
+	Title      string
+	Currency   string // the operating (fiat) currency prices are quoted in
+	Entries    []*Entry
+	Assertions []*Assertion
+	Prices     []*Price
+}
+
+// Entry represents a single balanced transaction
+type Entry struct {
+	Time      time.Time
+	Narration string
+	Ref       string // the identifier of what the entry was built from, e.g. a txn hash
+	Tags      []string
+	Postings  []*Posting
+}
+
+// Posting represents one leg of an entry
+type Posting struct {
+	Account   string
+	Quantity  float64 // signed, > 0 debits the account
+	Commodity string
+}
+
+// Assertion represents the balance an account is expected to have as of a point in time
+type Assertion struct {
+	Time      time.Time
+	Account   string
+	Quantity  float64
+	Commodity string
+}
+
+// Price represents the price of one unit of a commodity on a given day
+type Price struct {
+	Time  time.Time
+	Base  string
+	Quote string
+	Price float64
+}
+
+// Component turns the provided string into a valid account name component: anything but letters, digits and dashes
+// is replaced with a dash, and it has to start with an uppercase letter or digit (e.g. "bc1q..." becomes "Bc1q...")
+func Component(s string) string {
+	runes := []rune(s)
+	for i, v := range runes {
+		if !unicode.IsLetter(v) && !unicode.IsDigit(v) && v != '-' {
+			runes[i] = '-'
+		}
+	}
+
+	if len(runes) > 0 && !unicode.IsDigit(runes[0]) {
+		runes[0] = unicode.ToUpper(runes[0])
+	}
+
+	return string(runes)
+}
+
+// directive is anything written to the journal under a date, in the order directives are written on the same date
+type directive struct {
+	time  time.Time
+	order int
+	write func(w io.Writer, f Format) error
+}
+
+// Write writes the journal in the provided format: account declarations first, then prices, entries and assertions
+// in time order (so ledger-cli checks each assertion right after the entries it covers)
+func (j *Journal) Write(w io.Writer, f Format) error {
+	if f != Beancount && f != Ledger {
+		return fmt.Errorf("unknown journal format %q", f)
+	}
+
+	if err := j.writeHeader(w, f); err != nil {
+		return err
+	}
+
+	directives := []*directive{}
+	for _, v := range j.Prices {
+		v := v
+		directives = append(directives, &directive{time: v.Time, order: 0, write: v.write})
+	}
+
+	for _, v := range j.Entries {
+		v := v
+		directives = append(directives, &directive{time: v.Time, order: 1, write: v.write})
+	}
+
+	for _, v := range j.Assertions {
+		v := v
+		directives = append(directives, &directive{time: v.Time, order: 2, write: v.write})
+	}
+
+	sort.SliceStable(directives, func(i, k int) bool {
+		if !directives[i].time.Equal(directives[k].time) {
+			return directives[i].time.Before(directives[k].time)
+		}
+
+		return directives[i].order < directives[k].order
+	})
+
+	for _, v := range directives {
+		if err := v.write(w, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeHeader writes the journal's options and opens every account it uses, as of the first time it's used
+func (j *Journal) writeHeader(w io.Writer, f Format) error {
+	opened := map[string]time.Time{}
+	open := func(account string, at time.Time) {
+		if first, ok := opened[account]; !ok || at.Before(first) {
+			opened[account] = at
+		}
+	}
+
+	commodities := map[string]bool{}
+	for _, v := range j.Entries {
+		for _, p := range v.Postings {
+			open(p.Account, v.Time)
+			commodities[p.Commodity] = true
+		}
+	}
+
+	for _, v := range j.Assertions {
+		open(v.Account, v.Time)
+		commodities[v.Commodity] = true
+	}
+
+	accounts := []string{}
+	for k := range opened {
+		accounts = append(accounts, k)
+	}
+	sort.Strings(accounts)
+
+	if f == Beancount {
+		if len(j.Title) > 0 {
+			fmt.Fprintf(w, "option \"title\" %s\n", strconv.Quote(j.Title))
+		}
+
+		if len(j.Currency) > 0 {
+			fmt.Fprintf(w, "option \"operating_currency\" %s\n", strconv.Quote(j.Currency))
+		}
+
+		fmt.Fprintln(w)
+		for _, v := range accounts {
+			fmt.Fprintf(w, "%s open %s\n", date(opened[v], f), v)
+		}
+
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+
+	if len(j.Title) > 0 {
+		fmt.Fprintf(w, "; %s\n\n", j.Title)
+	}
+
+	names := []string{}
+	for k := range commodities {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, v := range names {
+		fmt.Fprintf(w, "commodity %s\n", v)
+	}
+
+	for _, v := range accounts {
+		fmt.Fprintf(w, "account %s\n", v)
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// write writes the entry, with its ref as metadata (beancount) or a comment (ledger-cli)
+func (e *Entry) write(w io.Writer, f Format) error {
+	if f == Beancount {
+		tags := ""
+		for _, v := range e.Tags {
+			tags += " #" + v
+		}
+
+		fmt.Fprintf(w, "%s * %s%s\n", date(e.Time, f), strconv.Quote(e.Narration), tags)
+		if len(e.Ref) > 0 {
+			fmt.Fprintf(w, "  ref: %s\n", strconv.Quote(e.Ref))
+		}
+	} else {
+		fmt.Fprintf(w, "%s * %s\n", date(e.Time, f), e.Narration)
+		if len(e.Ref) > 0 {
+			fmt.Fprintf(w, "    ; ref: %s\n", e.Ref)
+		}
+
+		if len(e.Tags) > 0 {
+			fmt.Fprintf(w, "    ; :%s:\n", strings.Join(e.Tags, ":"))
+		}
+	}
+
+	for _, v := range e.Postings {
+		fmt.Fprintf(w, "%s%-60s %s %s\n", indent(f), v.Account, quantity(v.Quantity), v.Commodity)
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// write writes the assertion: a balance directive (beancount) or a balance assignment on an empty posting (ledger-cli)
+func (a *Assertion) write(w io.Writer, f Format) error {
+	var err error
+	if f == Beancount {
+		// beancount checks balances at the start of the day, i.e. before that day's entries
+		_, err = fmt.Fprintf(w, "%s balance %s %s %s\n\n", date(a.Time.AddDate(0, 0, 1), f), a.Account, quantity(a.Quantity), a.Commodity)
+	} else {
+		_, err = fmt.Fprintf(w, "%s * Balance assertion\n%s%-60s 0 %s = %s %s\n\n",
+			date(a.Time, f), indent(f), a.Account, a.Commodity, quantity(a.Quantity), a.Commodity)
+	}
+
+	return err
+}
+
+// write writes the price directive
+func (p *Price) write(w io.Writer, f Format) error {
+	price := strconv.FormatFloat(p.Price, 'f', 2, 64)
+
+	var err error
+	if f == Beancount {
+		_, err = fmt.Fprintf(w, "%s price %s %s %s\n\n", date(p.Time, f), p.Base, price, p.Quote)
+	} else {
+		_, err = fmt.Fprintf(w, "P %s %s %s %s\n\n", date(p.Time, f), p.Base, price, p.Quote)
+	}
+
+	return err
+}
+
+// date formats the day of the provided time (in UTC) the way the provided format expects
+func date(t time.Time, f Format) string {
+	if f == Ledger {
+		return t.UTC().Format("2006/01/02")
+	}
+
+	return t.UTC().Format("2006-01-02")
+}
+
+// indent returns the indentation of postings in the provided format
+func indent(f Format) string {
+	if f == Ledger {
+		return "    "
+	}
+
+	return "  "
+}
+
+// quantity formats an amount of a commodity to the satoshi
+func quantity(v float64) string {
+	return strconv.FormatFloat(v, 'f', 8, 64)
+}
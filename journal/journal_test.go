@@ -0,0 +1,106 @@
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// portfolio returns the journal of a deposit, a later sale and the balance each leaves
+func portfolio() *Journal {
+	deposited := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	sold := time.Date(2021, 3, 4, 9, 30, 0, 0, time.UTC)
+
+	return &Journal{
+		Title:    "Test \"portfolio\"",
+		Currency: "USD",
+		Entries: []*Entry{
+			{
+				Time:      deposited,
+				Narration: "Received 0.5 BTC",
+				Ref:       "txn1",
+				Tags:      []string{"onchain"},
+				Postings: []*Posting{
+					{Account: "Assets:Bitcoin:Bc1qtest", Quantity: 0.5, Commodity: "BTC"},
+					{Account: "Income:Unknown", Quantity: -0.5, Commodity: "BTC"},
+				},
+			},
+			{
+				Time:      sold,
+				Narration: "Sold 0.2 BTC",
+				Ref:       "txn2",
+				Tags:      []string{"coinbase", "trade"},
+				Postings: []*Posting{
+					{Account: "Assets:Bitcoin:Bc1qtest", Quantity: -0.2, Commodity: "BTC"},
+					{Account: "Assets:Coinbase:USD", Quantity: 9000, Commodity: "USD"},
+					{Account: "Equity:Trading", Quantity: 0.2, Commodity: "BTC"},
+					{Account: "Equity:Trading", Quantity: -9000, Commodity: "USD"},
+				},
+			},
+		},
+		Assertions: []*Assertion{
+			{Time: deposited, Account: "Assets:Bitcoin:Bc1qtest", Quantity: 0.5, Commodity: "BTC"},
+			{Time: sold, Account: "Assets:Bitcoin:Bc1qtest", Quantity: 0.3, Commodity: "BTC"},
+		},
+		Prices: []*Price{
+			{Time: deposited, Base: "BTC", Quote: "USD", Price: 32000.5},
+			{Time: sold, Base: "BTC", Quote: "USD", Price: 45000},
+		},
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for format, golden := range map[Format]string{
+		Beancount: "portfolio.beancount",
+		Ledger:    "portfolio.ledger",
+	} {
+		want, err := ioutil.ReadFile(filepath.Join("testdata", golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := portfolio().Write(&buf, format); err != nil {
+			t.Fatalf("Write(%s) error = %v", format, err)
+		}
+
+		if buf.String() != string(want) {
+			t.Errorf("Write(%s) =\n%s\nwant testdata/%s:\n%s", format, buf.String(), golden, want)
+		}
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	if err := portfolio().Write(&bytes.Buffer{}, Format("qif")); err == nil {
+		t.Error("Write() in an unknown format returned no error")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": Beancount, "beancount": Beancount, "Ledger": Ledger} {
+		if got, err := ParseFormat(in); got != want || err != nil {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+
+	if _, err := ParseFormat("qif"); err == nil {
+		t.Error("ParseFormat(\"qif\") returned no error")
+	}
+}
+
+func TestComponent(t *testing.T) {
+	// account components must start with a capital letter and hold only letters, digits & dashes
+	for in, want := range map[string]string{
+		"bc1qar0srrr":                        "Bc1qar0srrr",
+		"1BoatSLRHtKNngkdXEeobR76b53LETtpyT": "1BoatSLRHtKNngkdXEeobR76b53LETtpyT",
+		"cold storage":                       "Cold-storage",
+		"my_wallet.1":                        "My-wallet-1",
+		"":                                   "",
+	} {
+		if got := Component(in); got != want {
+			t.Errorf("Component(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the level's name, as written to each line
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel parses a level name, e.g. "debug"
+func ParseLevel(s string) (Level, error) {
+	for _, v := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(s, v.String()) {
+			return v, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q, must be one of: debug, info, warn, error", s)
+}
+
+// Logger writes leveled log lines as JSON objects, one per line, carrying a set of key/value pairs along with each
+// message. It's safe for concurrent use, and loggers derived from it (see With) share its output.
+type Logger struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level Level
+	attrs []interface{} // alternating keys & values
+}
+
+// New returns a logger writing the lines at or above the provided level to the provided writer
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: w, level: level}
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(os.Stderr, LevelInfo)
+)
+
+// Default returns the logger used wherever no other one is provided
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultLogger
+}
+
+// SetDefault replaces the logger returned by Default()
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultLogger = l
+}
+
+// ctxKey is the context key loggers are stored under
+type ctxKey struct{}
+
+// NewContext returns a copy of the provided context carrying the provided logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by the provided context, or Default() if there's none
+func FromContext(ctx context.Context) *Logger {
+	return FromContextOr(ctx, Default())
+}
+
+// FromContextOr returns the logger carried by the provided context, or the provided fallback if there's none
+func FromContextOr(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+
+	return fallback
+}
+
+// With returns a logger adding the provided key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	attrs := make([]interface{}, 0, len(l.attrs)+len(kv))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, kv...)
+
+	return &Logger{mu: l.mu, out: l.out, level: l.level, attrs: attrs}
+}
+
+// Enabled reports whether lines at the provided level are written, e.g. to skip building an expensive payload dump
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a debug line with the provided key/value pairs
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info writes an info line with the provided key/value pairs
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn writes a warning line with the provided key/value pairs
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+// Error writes an error line with the provided key/value pairs
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// log writes a single line: time, level & message first, then the logger's pairs and the provided ones, in order
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	writePair(&b, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(",")
+	writePair(&b, "level", level.String())
+	b.WriteString(",")
+	writePair(&b, "msg", msg)
+
+	pairs := append(append([]interface{}{}, l.attrs...), kv...)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			key = fmt.Sprint(pairs[i])
+		}
+
+		// a trailing key without a value is logged rather than silently dropped
+		var value interface{} = "(missing)"
+		if i+1 < len(pairs) {
+			value = pairs[i+1]
+		}
+
+		b.WriteString(",")
+		writePair(&b, key, value)
+	}
+
+	b.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	io.WriteString(l.out, b.String())
+}
+
+// writePair writes a single "key":value pair, where errors are written as their message and durations in milliseconds
+func writePair(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = float64(v) / float64(time.Millisecond)
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteString(":")
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+
+	b.Write(encoded)
+}
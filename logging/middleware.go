@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader carries the ID of a request, either provided by the caller (e.g. a load balancer) or generated for it
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the length of the request IDs we accept from callers
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key request IDs are stored under
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request the provided context belongs to ("" outside of a request)
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Middleware returns a middleware that assigns each request an ID (echoed in the X-Request-ID response header), makes
+// a logger carrying it available to the handler through the request's context, and logs the request once it's served
+func Middleware(l *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if len(id) == 0 || len(id) > maxRequestIDLength {
+				id = NewRequestID()
+			}
+
+			w.Header().Set(RequestIDHeader, id)
+
+			reqLogger := l.With("request_id", id)
+			ctx := context.WithValue(NewContext(r.Context(), reqLogger), requestIDKey{}, id)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			log := reqLogger.Info
+			if rec.status >= http.StatusInternalServerError {
+				log = reqLogger.Error
+			}
+
+			log("served request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"bytes", rec.bytes,
+				"duration_ms", time.Since(start),
+			)
+		})
+	}
+}
+
+// statusRecorder records the status code & size of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader records the status code before writing it
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+
+	return n, err
+}
+
+// Flush lets handlers streaming their response flush through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
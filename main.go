@@ -3,31 +3,59 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
 	"sort"
 	"time"
 
 	"cloud.google.com/go/spanner"
 	"github.com/gorilla/mux"
 	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/config"
+	"github.com/jf2978/cointracker-eng-assignment/exchanges"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/metrics"
+	"github.com/jf2978/cointracker-eng-assignment/migrations"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+	"github.com/jf2978/cointracker-eng-assignment/secrets"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+	"github.com/jf2978/cointracker-eng-assignment/webhooks"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
 // Server represents a basic web server backed by a Google Spanner as a data store
 type Server struct {
-	context    context.Context
-	router     *mux.Router
-	spanner    *spanner.Client
-	blockchair *blockchair.Client
+	config      *config.Config
+	context     context.Context
+	cancel      context.CancelFunc // cancels context, aborting whatever's still running at the end of a shutdown
+	logger      *logging.Logger
+	router      *mux.Router
+	spanner     *spanner.Client
+	blockchair  *blockchair.Client
+	prices      *prices.Store
+	connectors  map[string]exchanges.Connector
+	credentials *secrets.Box // seals exchange credentials, nil when exchanges.credentials_key isn't configured
+
+	// background jobs & readiness
+	exchangeSync    *health.JobStatus // nil when the exchange sync scheduler is disabled
+	webhookDelivery *health.JobStatus // nil when webhook deliveries aren't sent
+	webhooks        *webhookDispatcher
+	asyncJobs       *health.JobStatus // nil when this instance doesn't run asynchronous jobs
+	jobs            *jobRunner
+	readiness       *health.Checker
 }
 
 // AddRequest represents the expected request body to '/add'
 type AddRequest struct {
 	Address string `json:"address"`
+	UserID  string `json:"user_id,omitempty"` // optionally attaches the address to this user's portfolio
 }
 
 // AddResponse represents the expected response body to '/add'
@@ -53,6 +81,7 @@ type TransactionsRequest struct {
 // TransactionsResponse represents the expected response body to '/transactions'
 type TransactionsResponse struct {
 	Transactions []*TransactionsRecord `json:"transactions"`
+	NextCursor   string                `json:"next_cursor,omitempty"` // empty once the last page has been returned
 }
 
 // SyncRequest represents the expected request body to '/sync'
@@ -77,17 +106,14 @@ type CustomTxn struct {
 	TxnTimestamp time.Time `json:"time"`
 	TxnFlow      string    `json:"flow"` // determines whether the txn is flow "in" or "out" of the wallet specified
 	AmountUSD    float64   `json:"amount"`
+	Asset        string    `json:"asset,omitempty"` // both sides of a transfer move the same asset (empty matches empty)
 }
 
 // UnmarshalJSON implements the Unmarshaler interface and overrides the default behavior in encoding/json
 // in order to accurately convert timestamps to a Go time.Time
 func (c *CustomTxn) UnmarshalJSON(data []byte) error {
-
-	fmt.Print("custom marshaller!")
 	var v map[string]interface{}
 	if err := json.Unmarshal(data, &v); err != nil {
-		fmt.Printf("error%v\n", err)
-
 		return err
 	}
 
@@ -95,6 +121,7 @@ func (c *CustomTxn) UnmarshalJSON(data []byte) error {
 	c.WalletID = v["wallet"].(string)
 	c.TxnFlow = v["flow"].(string)
 	c.AmountUSD = v["amount"].(float64)
+	c.Asset, _ = v["asset"].(string)
 
 	rawTime, err := time.Parse("2006-01-02 15:04:05 UTC", v["time"].(string))
 	if err != nil {
@@ -107,72 +134,280 @@ func (c *CustomTxn) UnmarshalJSON(data []byte) error {
 
 // AddressesRecord is the data model for a respective row in the 'addresses' table stored in Spanner
 type AddressesRecord struct {
-	PublicKey   string    `spanner:"public_key"`
-	Balance     float64   `spanner:"balance"`
-	CreatedAt   time.Time `spanner:"created_at"`
-	UpdatedAt   time.Time `spanner:"updated_at"`
-	LastTxnHash string    `spanner:"last_txn_hash"`
+	PublicKey     string           `spanner:"public_key"`
+	Balance       float64          `spanner:"balance"`        // in USD
+	NativeBalance int64            `spanner:"native_balance"` // in satoshis
+	CreatedAt     time.Time        `spanner:"created_at"`
+	UpdatedAt     time.Time        `spanner:"updated_at"`
+	LastTxnHash   string           `spanner:"last_txn_hash"`
+	ArchivedAt    spanner.NullTime `spanner:"archived_at"` // set while the address is archived (see setArchived)
 }
 
 // TransactionsRecord is the data model for a respective row in the 'transactions' table stored in Spanner
 type TransactionsRecord struct {
-	TxnHash      string    `spanner:"txn_hash"`   // pk
-	PublicKey    string    `spanner:"public_key"` // pk
-	Amount       float64   `spanner:"amount"`
-	Fee          float64   `spanner:"fee"`
-	Tags         string    `spanner:"tags"`
-	TxnTimestamp time.Time `spanner:"txn_timestamp"`
-	CreatedAt    time.Time `spanner:"created_at"`
+	TxnHash       string    `spanner:"txn_hash"`   // pk
+	PublicKey     string    `spanner:"public_key"` // pk
+	Amount        float64   `spanner:"amount"`
+	Fee           float64   `spanner:"fee"`            // in USD
+	NativeFee     int64     `spanner:"native_fee"`     // in satoshis
+	BalanceChange int64     `spanner:"balance_change"` // net effect on this address' balance in satoshis (> 0 is inbound)
+	Price         float64   `spanner:"price"`          // the BTC rate this transaction was valued at (in PriceCurrency)
+	PriceCurrency string    `spanner:"price_currency"` // the fiat currency of Price, e.g. "USD"
+	PriceSource   string    `spanner:"price_source"`   // where Price came from, e.g. "local" (our price history) or "blockchair"
+	Tags          string    `spanner:"tags"`
+	TxnTimestamp  time.Time `spanner:"txn_timestamp"`
+	CreatedAt     time.Time `spanner:"created_at"`
 }
 
 const (
-	// server configuration
-	endpoint = "localhost"
-	port     = "8080"
+	// prices
+	defaultCurrency = "USD"
 
-	// todo: replace with better names & use environment variables in the real world
-	projectID  = "cointracker-test-1234"
-	instanceID = "test-instance"
-	databaseID = "test-db"
+	// blockchairPriceSource marks prices derived from Blockchair's own USD valuation of a transaction
+	blockchairPriceSource = "blockchair"
+
+	// transactionBatchSize is how many transactions the Blockchair API returns per call
+	transactionBatchSize = 10
 
 	// tables
-	addressesTable    = "addresses"
-	transactionsTable = "transactions"
+	addressesTable            = "addresses"
+	transactionsTable         = "transactions"
+	usersTable                = "users"
+	transfersTable            = "transfers"
+	lotSelectionsTable        = "lot_selections"
+	importedTransactionsTable = "imported_transactions"
+	exchangeAccountsTable     = "exchange_accounts"
+	manualTransactionsTable   = "manual_transactions"
+	apiKeysTable              = "api_keys"
+	webhookSubscriptionsTable = "webhook_subscriptions"
+	webhookDeliveriesTable    = "webhook_deliveries"
+	jobsTable                 = "jobs"
+	jobEventsTable            = "job_events"
+	addressNicknamesTable     = "address_nicknames"
 )
 
-// InitServer returns a new Server with some default values
-func InitServer() *Server {
-	ctx := context.Background()
+// InitServer returns a new Server with the provided config, logging through the provided logger
+func InitServer(cfg *config.Config, logger *logging.Logger) *Server {
+	ctx, cancel := context.WithCancel(logging.NewContext(context.Background(), logger))
+
+	spannerClient, err := newSpannerClient(ctx, cfg.Storage.Spanner)
+	if err != nil {
+		logger.Error("could not create spanner client", "error", err)
+		os.Exit(1)
+	}
+
+	if err := checkSchema(ctx, cfg.Storage, spannerClient); err != nil {
+		log := logger
+		if errors.Is(err, migrations.ErrOutdated) {
+			log = logger.With("hint", "run `go run . migrate up`")
+		}
+
+		log.Error("refusing to start against this database", "error", err)
+		os.Exit(1)
+	}
+
+	blockchairClient := newBlockchairClient(ctx, cfg.Provider.Blockchair, logger)
+
+	priceStore, err := newPriceStore(ctx, cfg.Prices.HistoryDir)
+	if err != nil {
+		logger.Error("could not load price history", "dir", cfg.Prices.HistoryDir, "error", err)
+		os.Exit(1)
+	}
 
-	// todo: faciliate later testing by setting spanner emulator env vars here
+	connectors := newConnectors(cfg.Exchanges)
 
-	dbPath := fmt.Sprintf("projects/%s/instances/%s/databases/%s", projectID, instanceID, databaseID)
-	spannerClient, err := spanner.NewClient(ctx, dbPath, option.WithServiceAccountFile("./service-account.json"))
+	credentials, err := newCredentialsBox(cfg.Exchanges)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("could not load exchange credentials key", "error", err)
+		os.Exit(1)
 	}
 
-	blockchairClient := blockchair.NewClient(ctx)
+	var exchangeSync *health.JobStatus
+	if cfg.Scheduler.ExchangeSync.Enabled {
+		exchangeSync = health.NewJobStatus(cfg.Scheduler.ExchangeSync.Interval)
+	}
+
+	var webhookDelivery *health.JobStatus
+	if cfg.Scheduler.WebhookDelivery.Enabled {
+		webhookDelivery = health.NewJobStatus(cfg.Scheduler.WebhookDelivery.Interval)
+	}
+
+	var asyncJobs *health.JobStatus
+	if cfg.Scheduler.Jobs.Enabled {
+		asyncJobs = health.NewJobStatus(cfg.Scheduler.Jobs.Interval)
+	}
+
+	sender := webhooks.NewSender(webhooks.DefaultTimeout, cfg.Webhooks.AllowPrivateURLs)
+	dispatcher := &webhookDispatcher{s: spannerClient, sender: sender}
+	runner := &jobRunner{s: spannerClient, b: blockchairClient, p: priceStore}
+
+	readiness := newReadinessChecker(spannerClient, blockchairClient, exchangeSync, webhookDelivery, asyncJobs)
 
 	r := mux.NewRouter()
-	r.Handle("/add", AddHandler(ctx, spannerClient, blockchairClient))
-	r.Handle("/balance", GetBalanceHandler(ctx, spannerClient, blockchairClient))
-	r.Handle("/transactions", GetTransactionsHandler(ctx, spannerClient, blockchairClient))
-	r.Handle("/sync", SyncHandler(ctx, spannerClient, blockchairClient))
-	r.Handle("/detect-transfer", DetectTransfersHandler(ctx, spannerClient))
+	r.Use(instrumentRoutes)
+	r.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	r.Handle("/healthz", health.LivenessHandler()).Methods(http.MethodGet)
+	r.Handle("/readyz", readiness.ReadinessHandler()).Methods(http.MethodGet)
+
+	auth := &authorizer{s: spannerClient, enabled: cfg.Auth.Enabled}
+	if !auth.enabled {
+		logger.Warn("API key authentication is disabled, every request is let through as an admin")
+	}
+
+	// v1 routes address each BTC address as a resource via its path variable, each requiring an API key with the scope
+	// it needs (and, unless it's an admin key, to belong to the user who owns the resource)
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.Handle("/addresses", auth.require(scopeWrite, nil, AddHandler(spannerClient, blockchairClient, priceStore))).Methods(http.MethodPost)
+	v1.Handle("/addresses/bulk", auth.require(scopeWrite, nil, BulkAddHandler(spannerClient, blockchairClient))).Methods(http.MethodPost)
+	v1.Handle("/addresses/{addr}", auth.require(scopeRead, ownAddress, GetAddressHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/addresses/{addr}", auth.require(scopeAdmin, nil, DeleteAddressHandler(spannerClient))).Methods(http.MethodDelete)
+	v1.Handle("/addresses/{addr}/balance", auth.require(scopeRead, ownAddress, GetAddressBalanceHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/addresses/{addr}/transactions", auth.require(scopeRead, ownAddress, ListTransactionsHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/addresses/{addr}/history", auth.require(scopeRead, ownAddress, GetAddressHistoryHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/addresses/{addr}/sync", auth.require(scopeWrite, ownUnsharedAddress, SyncHandler(spannerClient, blockchairClient, priceStore))).Methods(http.MethodPost)
+	v1.Handle("/addresses/{addr}/archive", auth.require(scopeWrite, ownUnsharedAddress, ArchiveAddressHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/addresses/{addr}/unarchive", auth.require(scopeWrite, ownUnsharedAddress, UnarchiveAddressHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/addresses/{addr}/revalue", auth.require(scopeWrite, ownUnsharedAddress, RevalueHandler(spannerClient, priceStore))).Methods(http.MethodPost)
+	v1.Handle("/detect-transfers", auth.require(scopeRead, nil, DetectTransfersHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/jobs/{job}", auth.require(scopeRead, ownJob, GetJobHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/jobs/{job}/events", auth.require(scopeRead, ownJob, JobEventsHandler(spannerClient, readiness))).Methods(http.MethodGet)
+	v1.Handle("/jobs/{job}/cancel", auth.require(scopeWrite, ownJob, CancelJobHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users", auth.require(scopeAdmin, nil, CreateUserHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}", auth.require(scopeRead, ownUser, GetUserHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/api-keys", auth.require(scopeWrite, ownUser, CreateAPIKeyHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/api-keys", auth.require(scopeRead, ownUser, ListAPIKeysHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/api-keys/{key}", auth.require(scopeWrite, ownUser, DeleteAPIKeyHandler(spannerClient))).Methods(http.MethodDelete)
+	v1.Handle("/users/{user}/webhooks", auth.require(scopeWrite, ownUser, CreateWebhookHandler(spannerClient, sender))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/webhooks", auth.require(scopeRead, ownUser, ListWebhooksHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/webhooks/{webhook}", auth.require(scopeWrite, ownUser, DeleteWebhookHandler(spannerClient))).Methods(http.MethodDelete)
+	v1.Handle("/users/{user}/webhooks/{webhook}/deliveries", auth.require(scopeRead, ownUser, ListWebhookDeliveriesHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/webhooks/{webhook}/ping", auth.require(scopeWrite, ownUser, PingWebhookHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/portfolio", auth.require(scopeRead, ownUser, GetPortfolioHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/history", auth.require(scopeRead, ownUser, GetPortfolioHistoryHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/detect-transfers", auth.require(scopeWrite, ownUser, DetectUserTransfersHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/cost-basis-method", auth.require(scopeWrite, ownUser, SetCostBasisMethodHandler(spannerClient))).Methods(http.MethodPut)
+	v1.Handle("/users/{user}/lot-selections/{disposal}", auth.require(scopeWrite, ownUser, SetLotSelectionHandler(spannerClient))).Methods(http.MethodPut)
+	v1.Handle("/users/{user}/gains", auth.require(scopeRead, ownUser, GetGainsHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/tax-report", auth.require(scopeRead, ownUser, GetTaxReportHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/journal", auth.require(scopeRead, ownUser, GetJournalHandler(spannerClient, priceStore))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/imports", auth.require(scopeWrite, ownUser, ImportHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/manual-transactions", auth.require(scopeWrite, ownUser, CreateManualTransactionHandler(spannerClient))).Methods(http.MethodPost)
+	v1.Handle("/users/{user}/manual-transactions", auth.require(scopeRead, ownUser, ListManualTransactionsHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/manual-transactions/{id}", auth.require(scopeRead, ownUser, GetManualTransactionHandler(spannerClient))).Methods(http.MethodGet)
+	v1.Handle("/users/{user}/manual-transactions/{id}", auth.require(scopeWrite, ownUser, UpdateManualTransactionHandler(spannerClient))).Methods(http.MethodPut)
+	v1.Handle("/users/{user}/manual-transactions/{id}", auth.require(scopeWrite, ownUser, DeleteManualTransactionHandler(spannerClient))).Methods(http.MethodDelete)
+	v1.Handle("/users/{user}/exchanges", auth.require(scopeWrite, ownUser, AddExchangeAccountHandler(spannerClient, connectors, credentials))).Methods(http.MethodPost)
+	v1.Handle("/exchanges/{account}", auth.require(scopeWrite, ownExchangeAccount, DeleteExchangeAccountHandler(spannerClient))).Methods(http.MethodDelete)
+	v1.Handle("/exchanges/{account}/sync", auth.require(scopeWrite, ownExchangeAccount, SyncExchangeAccountHandler(spannerClient, connectors, credentials))).Methods(http.MethodPost)
+	v1.Handle("/prices", auth.require(scopeAdmin, nil, ImportPricesHandler(priceStore))).Methods(http.MethodPost)
+	v1.Handle("/prices/{base}/{quote}", auth.require(scopeRead, nil, GetPriceHandler(priceStore))).Methods(http.MethodGet)
+
+	// deprecated routes, kept as aliases until existing clients have moved over to v1. They name their address in the
+	// body rather than the path, so only admin keys can use the ones reading or writing an address.
+	r.Handle("/add", Deprecated("/v1/addresses", auth.require(scopeAdmin, nil, AddHandler(spannerClient, blockchairClient, priceStore))))
+	r.Handle("/balance", Deprecated("/v1/addresses/{addr}/balance", auth.require(scopeAdmin, nil, GetBalanceHandler(spannerClient, blockchairClient, priceStore))))
+	r.Handle("/transactions", Deprecated("/v1/addresses/{addr}/transactions", auth.require(scopeAdmin, nil, GetTransactionsHandler(spannerClient, blockchairClient, priceStore))))
+	r.Handle("/sync", Deprecated("/v1/addresses/{addr}/sync", auth.require(scopeAdmin, nil, SyncHandler(spannerClient, blockchairClient, priceStore))))
+	r.Handle("/detect-transfer", Deprecated("/v1/detect-transfers", auth.require(scopeRead, nil, DetectTransfersHandler(spannerClient))))
+	r.Handle("/detect-transfers", Deprecated("/v1/detect-transfers", auth.require(scopeRead, nil, DetectTransfersHandler(spannerClient))))
 
 	return &Server{
-		context:    ctx,
-		router:     r,
-		spanner:    spannerClient,
-		blockchair: blockchairClient,
+		config:      cfg,
+		context:     ctx,
+		cancel:      cancel,
+		logger:      logger,
+		router:      r,
+		spanner:     spannerClient,
+		blockchair:  blockchairClient,
+		prices:      priceStore,
+		connectors:  connectors,
+		credentials: credentials,
+
+		exchangeSync:    exchangeSync,
+		webhookDelivery: webhookDelivery,
+		webhooks:        dispatcher,
+		asyncJobs:       asyncJobs,
+		jobs:            runner,
+		readiness:       readiness,
+	}
+}
+
+// newSpannerClient returns a new client for our Spanner database, or for the emulator's if one is configured
+func newSpannerClient(ctx context.Context, cfg config.SpannerConfig) (*spanner.Client, error) {
+	return spanner.NewClient(ctx, cfg.DatabasePath(), spannerOptions(cfg)...)
+}
+
+// spannerOptions returns the options of every Spanner client (including admin ones): authenticated with the configured
+// credentials, unless they're talking to the emulator
+func spannerOptions(cfg config.SpannerConfig) []option.ClientOption {
+	if len(cfg.EmulatorHost) > 0 {
+		return []option.ClientOption{
+			option.WithEndpoint(cfg.EmulatorHost),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+			option.WithoutAuthentication(),
+		}
+	}
+
+	return []option.ClientOption{option.WithCredentialsFile(cfg.CredentialsFile)}
+}
+
+// newBlockchairClient returns a new Blockchair client with the provided config
+func newBlockchairClient(ctx context.Context, cfg config.BlockchairConfig, logger *logging.Logger) *blockchair.Client {
+	return blockchair.NewClient(ctx, &blockchair.Config{
+		BaseURL:       cfg.BaseURL,
+		APIKey:        cfg.APIKey,
+		Timeout:       cfg.Timeout,
+		RateLimit:     cfg.RateLimit,
+		RateLimitWait: cfg.RateLimitWait,
+	}, logger)
+}
+
+// newLogger returns the JSON logger writing to stderr at the configured level
+func newLogger(cfg config.LoggingConfig) *logging.Logger {
+	level, err := logging.ParseLevel(cfg.Level)
+	if err != nil {
+		level = logging.LevelInfo // unreachable once the config is validated
+	}
+
+	return logging.New(os.Stderr, level)
+}
+
+// newTraceExporter returns the configured span exporter: "stdout" or "stderr" write each span as a line of JSON, while
+// "none" drops them
+func newTraceExporter(cfg config.TracingConfig) (tracing.Exporter, error) {
+	switch cfg.Exporter {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return tracing.NewJSONExporter(os.Stdout), nil
+	case "stderr":
+		return tracing.NewJSONExporter(os.Stderr), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, must be one of: none, stdout, stderr", cfg.Exporter)
 	}
 }
 
+// newPriceStore returns a new price store loaded with the price history in the provided directory
+func newPriceStore(ctx context.Context, dir string) (*prices.Store, error) {
+	priceStore := prices.NewStore()
+
+	n, err := priceStore.LoadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("loaded historical prices", "prices", n, "dir", dir)
+
+	return priceStore, nil
+}
+
 // AddHandler returns a closure responsible for validating the incoming request
-// and invoking add() to create a new BTC address
-func AddHandler(ctx context.Context, s *spanner.Client, b *blockchair.Client) http.Handler {
+// and invoking add() to create a new BTC address, or queueing a job to if the request asked not to wait (see wantsAsync).
+// Its sync's progress is streamed if the request asked to follow it (see wantsEventStream).
+func AddHandler(s *spanner.Client, b *blockchair.Client, p prices.Provider) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -185,37 +420,73 @@ func AddHandler(ctx context.Context, s *spanner.Client, b *blockchair.Client) ht
 			return
 		}
 
-		address, err := add(ctx, addReq.Address, s, b)
+		userID, ok := addingUserID(ctx, addReq.UserID)
+		if !ok {
+			http.Error(w, "API key may only add addresses to its own user", http.StatusForbidden)
+			return
+		}
+		addReq.UserID = userID
+
+		if wantsAsync(r) {
+			startJob(w, r, s, jobAddAddress, addReq.Address, addReq.UserID)
+			return
+		}
+
+		if wantsEventStream(r) {
+			streamSync(w, r, s, addReq.UserID, addReq.Address, func(ctx context.Context) (*AddressesRecord, error) {
+				return add(ctx, addReq.Address, addReq.UserID, s, b, p)
+			})
+			return
+		}
+
+		address, err := add(ctx, addReq.Address, addReq.UserID, s, b, p)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), statusFromErr(err))
 			return
 		}
 
 		addrResp := &AddResponse{Address: address}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(addrResp)
+		writeJSON(w, http.StatusOK, addrResp)
 	})
 }
 
-// add adds a BTC wallet if it doesn't already exist and imports its associated transactions
-func add(ctx context.Context, addr string, s *spanner.Client, b *blockchair.Client) (*AddressesRecord, error) {
+// addingUserID returns the user addresses are added for, given the one a request asked for. A non-admin API key
+// defaults to, and may only add addresses to, its own user (it couldn't read them back otherwise); ok is false if it
+// asked for another one.
+func addingUserID(ctx context.Context, requested string) (userID string, ok bool) {
+	key := apiKeyFromContext(ctx)
+	if key == nil || key.HasScope(scopeAdmin) {
+		return requested, true
+	}
+
+	if len(requested) == 0 {
+		return key.UserID, true
+	}
+
+	return requested, requested == key.UserID
+}
+
+// add adds a BTC wallet if it doesn't already exist and imports its associated transactions,
+// attaching it to the provided user's addresses (if any)
+func add(ctx context.Context, addr, userID string, s *spanner.Client, b *blockchair.Client, p prices.Provider) (*AddressesRecord, error) {
 	address := &AddressesRecord{}
 
-	_, err := s.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	_, err := readWriteTransaction(ctx, s, "add_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
 
-		row, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"public_key", "balance", "last_txn_hash", "created_at", "updated_at"})
+		// attaching the address to a user that doesn't exist should fail before we spend any time syncing
+		if len(userID) > 0 {
+			if err := attachAddresses(ctx, txn, userID, addr); err != nil {
+				return err
+			}
+		}
+
+		row, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, addressColumns)
 
 		// this address already exists in the addresses table, we're done
 		if err == nil {
-			var addrRec AddressesRecord
-			if structErr := row.ToStruct(&addrRec); structErr != nil {
-				return structErr
-			}
-
-			address = &addrRec
-			return nil
+			address, err = decodeAddress(row)
+			return err
 		}
 
 		if err != nil && spanner.ErrCode(err) != codes.NotFound {
@@ -223,7 +494,7 @@ func add(ctx context.Context, addr string, s *spanner.Client, b *blockchair.Clie
 		}
 
 		// create this address & immediately sync transactions relevant to this address
-		address, _, err = sync(ctx, txn, b, addr, "")
+		address, _, err = sync(ctx, txn, b, p, addr, "")
 		if err != nil {
 			return err
 		}
@@ -236,8 +507,10 @@ func add(ctx context.Context, addr string, s *spanner.Client, b *blockchair.Clie
 
 // GetBalanceHandler returns a closure responsible for validating the incoming request
 // and invoking balance() to fetch the provided address' balance
-func GetBalanceHandler(ctx context.Context, s *spanner.Client, b *blockchair.Client) http.Handler {
+func GetBalanceHandler(s *spanner.Client, b *blockchair.Client, p prices.Provider) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -250,7 +523,7 @@ func GetBalanceHandler(ctx context.Context, s *spanner.Client, b *blockchair.Cli
 			return
 		}
 
-		b, err := balance(ctx, s, b, balanceReq.Address)
+		b, err := balance(ctx, s, b, p, balanceReq.Address)
 
 		if err != nil {
 			http.Error(w, fmt.Sprintf("could not get balance for address %s\n. %v", balanceReq.Address, err), http.StatusInternalServerError)
@@ -259,18 +532,16 @@ func GetBalanceHandler(ctx context.Context, s *spanner.Client, b *blockchair.Cli
 
 		balanceResp := &BalanceResponse{Balance: b}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(balanceResp)
+		writeJSON(w, http.StatusOK, balanceResp)
 	})
 }
 
 // balance gets the current balance of the give BTC address
 // note: the returned value can be out of date, if we want the most up-to-date balance, we have to call `sync` first
-func balance(ctx context.Context, s *spanner.Client, b *blockchair.Client, addr string) (float64, error) {
+func balance(ctx context.Context, s *spanner.Client, b *blockchair.Client, p prices.Provider, addr string) (float64, error) {
 	var addressRec *AddressesRecord
 
-	_, err := s.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+	_, err := readWriteTransaction(ctx, s, "sync_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
 		row, readErr := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"last_txn_hash"})
 		if readErr != nil {
 			return readErr
@@ -279,7 +550,7 @@ func balance(ctx context.Context, s *spanner.Client, b *blockchair.Client, addr
 		var lastTxnHash string
 		row.ColumnByName("last_txn_hash", &lastTxnHash)
 
-		address, _, syncErr := sync(ctx, txn, b, addr, lastTxnHash)
+		address, _, syncErr := sync(ctx, txn, b, p, addr, lastTxnHash)
 		if syncErr != nil {
 			return syncErr
 		}
@@ -298,8 +569,10 @@ func balance(ctx context.Context, s *spanner.Client, b *blockchair.Client, addr
 
 // GetTransactionsHandler returns a closure responsible for validating the incoming request
 // and invoking transactions() to fetch the provided address' list of all transactions
-func GetTransactionsHandler(ctx context.Context, s *spanner.Client, b *blockchair.Client) http.Handler {
+func GetTransactionsHandler(s *spanner.Client, b *blockchair.Client, p prices.Provider) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -312,153 +585,174 @@ func GetTransactionsHandler(ctx context.Context, s *spanner.Client, b *blockchai
 			return
 		}
 
-		txnsRecs, err := transactions(ctx, txnsReq.Address, s, b)
+		q, err := parseTxnQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// this route returned every transaction before pagination was introduced, which its clients still expect unless
+		// they ask for a page
+		if len(r.URL.Query().Get("limit")) == 0 && q.Cursor == nil {
+			q.Limit = 0
+		}
+
+		txnsRecs, nextCursor, err := transactions(ctx, txnsReq.Address, q, s, b, p)
 
 		if err != nil {
 			http.Error(w, fmt.Sprintf("could not get transactions for address %s\n. %v", txnsReq.Address, err), http.StatusInternalServerError)
 			return
 		}
 
-		txnsResp := &TransactionsResponse{Transactions: txnsRecs}
+		txnsResp := &TransactionsResponse{Transactions: txnsRecs, NextCursor: nextCursor}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(txnsResp)
+		writeJSON(w, http.StatusOK, txnsResp)
 	})
 }
 
-// transactions gets the current transactions associated with the provided BTC address (mapped key-value "txn_hash" -> txn struct)
-// limitations: the first time this is called for an address, historical transactions may take a while to be fetched and
-func transactions(ctx context.Context, addr string, s *spanner.Client, b *blockchair.Client) ([]*TransactionsRecord, error) {
-	var txnsRecs []*TransactionsRecord
-
-	_, err := s.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-
-		// read for transactions associated with this address
-		stmt := spanner.NewStatement(`
-			SELECT t.txn_hash, t.public_key, t.amount, t.fee, t.tags, t.txn_timestamp, a.last_txn_hash
-			FROM transactions t
-			JOIN addresses a USING(public_key)
-			WHERE public_key = @address
-		`)
-		stmt.Params["address"] = addr
-
+// transactions syncs the provided BTC address and then gets the page of its transactions matching the provided query
+// limitations: the first time this is called for an address, historical transactions may take a while to be fetched
+func transactions(ctx context.Context, addr string, q *TxnQuery, s *spanner.Client, b *blockchair.Client, p prices.Provider) ([]*TransactionsRecord, string, error) {
+	_, err := readWriteTransaction(ctx, s, "sync_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		// an address we aren't tracking yet is synced from scratch
 		lastTxnHash := ""
 
-		iter := txn.Query(ctx, stmt)
-		iterErr := iter.Do(func(row *spanner.Row) error {
-
-			type JoinedRecord struct {
-				TxnHash      string    `spanner:"txn_hash"`
-				PublicKey    string    `spanner:"public_key"`
-				Amount       float64   `spanner:"amount"`
-				Fee          float64   `spanner:"fee"`
-				Tags         string    `spanner:"tags`
-				TxnTimestamp time.Time `spanner:"txn_timestamp"`
-				LastTxnHash  string    `spanner:"last_txn_hash"`
-			}
-
-			var rec JoinedRecord
-			row.ToStruct(&rec)
-
-			txnsRecs = append(txnsRecs, &TransactionsRecord{
-				PublicKey:    rec.PublicKey,
-				Amount:       rec.Amount,
-				Fee:          rec.Fee,
-				Tags:         rec.Tags,
-				TxnTimestamp: rec.TxnTimestamp,
-			})
-
-			fmt.Printf("joined struct: %+v\n", rec)
-
-			if len(lastTxnHash) == 0 {
-				lastTxnHash = rec.LastTxnHash
-			}
-
-			return nil
-		})
-
-		if iterErr != nil {
-			return iterErr
+		row, readErr := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"last_txn_hash"})
+		if readErr != nil && spanner.ErrCode(readErr) != codes.NotFound {
+			return readErr
 		}
 
-		fmt.Printf("last txn hash found: %s\n", lastTxnHash)
-
-		_, txns, syncErr := sync(ctx, txn, b, addr, lastTxnHash)
-		if syncErr != nil {
-			return syncErr
+		if readErr == nil {
+			row.ColumnByName("last_txn_hash", &lastTxnHash)
 		}
 
-		txnsRecs = append(txnsRecs, txns...)
-
-		return nil
+		_, _, syncErr := sync(ctx, txn, b, p, addr, lastTxnHash)
+		return syncErr
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return txnsRecs, nil
+	// mutations buffered by sync aren't visible until its transaction commits, so the read happens afterwards
+	return listTransactions(ctx, s, addr, q)
 }
 
 // SyncHandler returns a closure responsible for validating the incoming request
-// and invoking sync() to trigger an update for the provided address (and its transactions)
-func SyncHandler(ctx context.Context, s *spanner.Client, b *blockchair.Client) http.Handler {
+// and invoking syncAddress() to trigger an update for the provided address (and its transactions), or queueing a job to
+// if the request asked not to wait (see wantsAsync). Its progress is streamed if the request asked to follow it (see
+// wantsEventStream).
+func SyncHandler(s *spanner.Client, b *blockchair.Client, p prices.Provider) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		var syncReq SyncRequest
-		if err := json.Unmarshal(body, &syncReq); err != nil {
-			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
-			return
-		}
-
-		addr := syncReq.Address
+		ctx := r.Context()
+
+		// v1 routes carry the address in the path, the deprecated /sync route in the body
+		addr, ok := mux.Vars(r)["addr"]
+		if !ok {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
-		var syncResp *SyncResponse
-		_, err = s.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-			row, readErr := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"last_txn_hash"})
-			if readErr != nil {
-				return readErr
+			var syncReq SyncRequest
+			if err := json.Unmarshal(body, &syncReq); err != nil {
+				http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+				return
 			}
 
-			var lastTxnHash string
-			row.ColumnByName("last_txn_hash", &lastTxnHash)
+			addr = syncReq.Address
+		}
 
-			addressRec, _, syncErr := sync(ctx, txn, b, addr, lastTxnHash)
-			if syncErr != nil {
-				return syncErr
-			}
+		// a job belongs to whoever asked for it, so that they can poll it, and a stream detects their transfers
+		var userID string
+		if key := apiKeyFromContext(ctx); key != nil {
+			userID = key.UserID
+		}
 
-			syncResp = &SyncResponse{
-				Address: addressRec,
+		if wantsAsync(r) {
+			startJob(w, r, s, jobSyncAddress, addr, userID)
+			return
+		}
+
+		if wantsEventStream(r) {
+			// admins (or anyone, without auth) name the user whose transfers to detect
+			if key := apiKeyFromContext(ctx); key == nil || key.HasScope(scopeAdmin) {
+				if v := r.URL.Query().Get("user_id"); len(v) > 0 {
+					userID = v
+				}
 			}
 
-			return nil
-		})
+			streamSync(w, r, s, userID, addr, func(ctx context.Context) (*AddressesRecord, error) {
+				return syncAddress(ctx, s, b, p, addr)
+			})
+			return
+		}
 
+		address, err := syncAddress(ctx, s, b, p, addr)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), statusFromErr(err))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(syncResp)
+		writeJSON(w, http.StatusOK, &SyncResponse{Address: address})
 	})
 }
 
-// sync fetches the latest address & transaction data from the blockchair API
-func sync(ctx context.Context, txn *spanner.ReadWriteTransaction, b *blockchair.Client, addr, lastTxnHash string) (*AddressesRecord, []*TransactionsRecord, error) {
+// syncAddress syncs the provided address from where its last sync left off, failing if it hasn't been added yet
+func syncAddress(ctx context.Context, s *spanner.Client, b *blockchair.Client, p prices.Provider, addr string) (*AddressesRecord, error) {
 	var address *AddressesRecord
-	var transactions []*TransactionsRecord
+	_, err := readWriteTransaction(ctx, s, "sync_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, readErr := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"last_txn_hash"})
+		if readErr != nil {
+			return readErr
+		}
+
+		var lastTxnHash string
+		row.ColumnByName("last_txn_hash", &lastTxnHash)
 
+		addressRec, _, syncErr := sync(ctx, txn, b, p, addr, lastTxnHash)
+		if syncErr != nil {
+			return syncErr
+		}
+
+		address = addressRec
+		return nil
+	})
+
+	return address, err
+}
+
+// sync fetches the latest address & transaction data from the blockchair API
+func sync(ctx context.Context, txn *spanner.ReadWriteTransaction, b *blockchair.Client, p prices.Provider, addr, lastTxnHash string) (address *AddressesRecord, transactions []*TransactionsRecord, err error) {
+	ctx, span := tracing.Start(ctx, "sync.address", "address", addr, "last_txn_hash", lastTxnHash)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	log := logging.FromContext(ctx).With("address", addr)
 	now := time.Now()
 
+	// what we stored as of the last sync, to tell what this one changed (nothing, for an address we're adding)
+	var previousBalance spanner.NullInt64
+	var archivedAt spanner.NullTime
+	row, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"native_balance", "archived_at"})
+	if err != nil && spanner.ErrCode(err) != codes.NotFound {
+		return nil, nil, err
+	}
+
+	existed := err == nil
+	if existed {
+		if err := row.Columns(&previousBalance, &archivedAt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if archivedAt.Valid {
+		return nil, nil, errAddressArchived(addr)
+	}
+
 	// pull the latest transaction data for this address
 	addrStats, err := getAddrStats(ctx, b, addr)
 
@@ -466,6 +760,11 @@ func sync(ctx context.Context, txn *spanner.ReadWriteTransaction, b *blockchair.
 		return nil, nil, err
 	}
 
+	stored, err := readStoredTransactions(ctx, txn, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	txnHashes := addrStats.Txns
 
 	// find the cutoff point and filter out txn hashes that we've already seen/processed if we know it
@@ -475,44 +774,89 @@ func sync(ctx context.Context, txn *spanner.ReadWriteTransaction, b *blockchair.
 				txnHashes = txnHashes[:i]
 				break
 			}
-			fmt.Printf("skipping syncing transaction: %s\n", v)
 		}
 	}
 
-	txns, err := getTransactions(ctx, b, txnHashes)
+	// a reorg can take out the last transaction we saw, leaving nothing to cut off at
+	unseen := []string{}
+	for _, v := range txnHashes {
+		if _, ok := stored[v]; !ok {
+			unseen = append(unseen, v)
+		}
+	}
+	txnHashes = unseen
+
+	reorged := reorgedTransactions(addrStats.Txns, addrStats.Addr.TransactionCount, stored)
+	if len(addrStats.Txns) != addrStats.Addr.TransactionCount && len(addrStats.Txns) < blockchair.TransactionLimit {
+		log.Warn("listed transactions don't add up to the address' total, not checking for reorgs", "listed_txns", len(addrStats.Txns), "total_txns", addrStats.Addr.TransactionCount)
+	}
+
+	log.Debug("syncing address", "last_txn_hash", lastTxnHash, "known_txns", len(addrStats.Txns), "new_txns", len(txnHashes), "reorged_txns", len(reorged))
+	span.SetAttributes("new_txns", len(txnHashes))
+
+	reportSyncEvent(ctx, syncEventStarted, addr, &SyncStartedEventData{
+		Transactions: len(txnHashes),
+		Batches:      (len(txnHashes) + transactionBatchSize - 1) / transactionBatchSize,
+		Reorged:      len(reorged),
+	})
+
+	fetchCtx, fetchSpan := tracing.Start(ctx, "sync.fetch_transactions", "txns", len(txnHashes))
+	txns, err := getTransactions(fetchCtx, b, addr, txnHashes)
+	fetchSpan.SetError(err)
+	fetchSpan.End()
+
 	if err != nil {
 		return nil, nil, err
 	}
 
+	priceCtx, priceSpan := tracing.Start(ctx, "sync.price_transactions", "txns", len(txns))
+
 	// insert the transaction data into our tables
 	mutations := []*spanner.Mutation{}
 	for _, v := range txns {
+		price, source := txnPrice(priceCtx, p, v.Txn)
+
 		rec := &TransactionsRecord{
-			TxnHash:      v.Txn.Hash,
-			PublicKey:    addr,
-			Amount:       v.Txn.AmountUSD,
-			Fee:          v.Txn.FeeUSD,
-			TxnTimestamp: v.Txn.Timestamp,
-			CreatedAt:    now,
+			TxnHash:       v.Txn.Hash,
+			PublicKey:     addr,
+			Amount:        v.Txn.AmountUSD,
+			Fee:           v.Txn.FeeUSD,
+			NativeFee:     v.Txn.Fee,
+			BalanceChange: v.BalanceChange(addr),
+			Price:         price,
+			PriceCurrency: defaultCurrency,
+			PriceSource:   source,
+			TxnTimestamp:  v.Txn.Timestamp,
+			CreatedAt:     now,
 		}
 
 		transactions = append(transactions, rec)
 
 		mut, err := spanner.InsertStruct(transactionsTable, rec)
 		if err != nil {
+			priceSpan.SetError(err)
+			priceSpan.End()
 			return nil, nil, err
 		}
 
 		mutations = append(mutations, mut)
 	}
 
+	priceSpan.End()
+
 	// update the addresses table to match newest data returned by our api (primarily balance + last_txn_hash)
 	address = &AddressesRecord{
-		PublicKey:   addr,
-		Balance:     addrStats.Addr.BalanceUSD,
-		CreatedAt:   now,
-		UpdatedAt:   now,
-		LastTxnHash: addrStats.Txns[0],
+		PublicKey:     addr,
+		Balance:       addrStats.Addr.BalanceUSD,
+		NativeBalance: int64(addrStats.Addr.Balance),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		LastTxnHash:   lastTxnHash,
+	}
+
+	// an address that never transacted has no latest transaction yet
+	if len(addrStats.Txns) > 0 {
+		address.LastTxnHash = addrStats.Txns[0]
 	}
 
 	mut, err := spanner.InsertOrUpdateStruct(addressesTable, address)
@@ -522,17 +866,125 @@ func sync(ctx context.Context, txn *spanner.ReadWriteTransaction, b *blockchair.
 
 	mutations = append(mutations, mut)
 
-	if err := txn.BufferWrite(mutations); err != nil {
+	for _, v := range reorged {
+		log.Warn("transaction was reorged out of the chain, removing it", "txn_hash", v.TxnHash)
+		mutations = append(mutations, spanner.Delete(transactionsTable, spanner.Key{v.TxnHash, addr}))
+	}
+
+	_, writeSpan := tracing.Start(ctx, "sync.buffer_writes", "mutations", len(mutations))
+	err = txn.BufferWrite(mutations)
+	writeSpan.SetError(err)
+	writeSpan.End()
+
+	if err != nil {
 		return nil, nil, err
 	}
 
+	reportSyncEvent(ctx, syncEventTxnsInserted, addr, &TxnsInsertedEventData{Transactions: len(transactions), Reorged: len(reorged)})
+
+	if existed {
+		if err := queueSyncEvents(ctx, txn, address, previousBalance, transactions, reorged); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	addressSyncDuration.ObserveDuration(time.Since(now))
+	addressSyncNewTxns.Add(float64(len(transactions)))
+
+	log.Info("synced address", "new_txns", len(transactions), "native_balance", address.NativeBalance, "duration_ms", time.Since(now))
+
 	return address, transactions, err
 }
 
+// readStoredTransactions reads the transactions we stored for the provided address, keyed by hash
+func readStoredTransactions(ctx context.Context, txn querier, addr string) (map[string]*TransactionsRecord, error) {
+	stmt := spanner.NewStatement(`
+		SELECT txn_hash, public_key, amount, fee, COALESCE(native_fee, 0) AS native_fee, COALESCE(balance_change, 0) AS balance_change,
+			COALESCE(price, 0) AS price, COALESCE(tags, '') AS tags, txn_timestamp, created_at
+		FROM transactions
+		WHERE public_key = @address
+	`)
+	stmt.Params["address"] = addr
+
+	stored := map[string]*TransactionsRecord{}
+
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var rec TransactionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		stored[rec.TxnHash] = &rec
+		return nil
+	})
+
+	return stored, err
+}
+
+// reorgedTransactions returns the stored transactions that were reorged out of the chain, going by the provided
+// (newest first) hashes of an address' latest transactions and its total number of transactions, as of the same
+// response: the list is contiguous, so any stored transaction newer than the oldest one listed (or any at all, if the
+// list holds all of them) that's missing from it is gone. A list that doesn't add up to the total (e.g. a partial
+// response), or that's empty, is taken to say nothing about what's stored.
+func reorgedTransactions(listed []string, total int, stored map[string]*TransactionsRecord) []*TransactionsRecord {
+	expected := total
+	if expected > blockchair.TransactionLimit {
+		expected = blockchair.TransactionLimit
+	}
+
+	if len(listed) == 0 || len(listed) != expected {
+		return []*TransactionsRecord{}
+	}
+
+	isListed := map[string]bool{}
+	var horizon time.Time
+	for _, v := range listed {
+		isListed[v] = true
+
+		if rec, ok := stored[v]; ok && (horizon.IsZero() || rec.TxnTimestamp.Before(horizon)) {
+			horizon = rec.TxnTimestamp
+		}
+	}
+
+	complete := len(listed) == total
+
+	reorged := []*TransactionsRecord{}
+	for hash, rec := range stored {
+		if isListed[hash] {
+			continue
+		}
+
+		if complete || (!horizon.IsZero() && rec.TxnTimestamp.After(horizon)) {
+			reorged = append(reorged, rec)
+		}
+	}
+
+	sort.Slice(reorged, func(i, j int) bool { return reorged[i].TxnTimestamp.After(reorged[j].TxnTimestamp) })
+
+	return reorged
+}
+
+// txnPrice returns the BTC/USD rate to value the provided transaction at (and where it came from): our own price history
+// if it covers the transaction, otherwise the rate Blockchair valued it at
+func txnPrice(ctx context.Context, p prices.Provider, txn *blockchair.Transaction) (float64, string) {
+	quote, err := p.Price(ctx, btcAsset, defaultCurrency, txn.Timestamp)
+	if err == nil {
+		return quote.Price, quote.Source
+	}
+
+	if !errors.Is(err, prices.ErrNoPrice) {
+		logging.FromContext(ctx).Warn("could not price transaction, falling back to blockchair", "txn_hash", txn.Hash, "error", err)
+	}
+
+	return txn.PriceUSD(), blockchairPriceSource
+}
+
 // DetectTransfersHandler returns a closure responsible for validating the incoming request
 // and invoking detectTransfers() to tag transactions that are likely transfers
-func DetectTransfersHandler(ctx context.Context, s *spanner.Client) http.Handler {
+func DetectTransfersHandler(s *spanner.Client) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -545,8 +997,6 @@ func DetectTransfersHandler(ctx context.Context, s *spanner.Client) http.Handler
 			return
 		}
 
-		fmt.Printf("detect trasnfers request %v\n", detectReq)
-
 		txns, err := detectTransfers(detectReq.Txns)
 
 		if err != nil {
@@ -554,17 +1004,16 @@ func DetectTransfersHandler(ctx context.Context, s *spanner.Client) http.Handler
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(txns)
+		transferMatches.Add(float64(len(txns)), "request")
+		logging.FromContext(ctx).Info("detected transfers", "txns", len(detectReq.Txns), "transfers", len(txns))
+
+		writeJSON(w, http.StatusOK, txns)
 	})
 }
 
 // detectTransfers detects the likely transfers between a user's wallets with fuzzy matching based on transaction amounts and corresponding timestamps
 // note this algorithm can be extended to bucket sort based on time ranges (exact timestamp match is probably unrealistic), but the simpler version is implemented here
 func detectTransfers(txns []*CustomTxn) (map[string]string, error) {
-	// todo: (nice to have) group addresses into "user wallets" and save them to the users table
-
 	// brute force -> compare all possible pairs w/ nested iteration. O(1) space, but O(n^2) time (no bueno)
 	// alternative approach (sorting) -> sort transactions by timestamp, for each timestamp/range bucket,
 	// look for out/in pairs s.t. amounts & wallets are equivalent. O(n) space and O(nlogn) time where n = # of transactions
@@ -572,19 +1021,19 @@ func detectTransfers(txns []*CustomTxn) (map[string]string, error) {
 	// sort transactions by timestamp and falling back on: amount (preferring "outflows" first if equal)
 	// SliceStable ensures that equal elements maintain their order in the original list
 	sort.SliceStable(txns, func(i, j int) bool {
-		if txns[i].TxnTimestamp.Before(txns[j].TxnTimestamp) {
-			return true
+		if !txns[i].TxnTimestamp.Equal(txns[j].TxnTimestamp) {
+			return txns[i].TxnTimestamp.Before(txns[j].TxnTimestamp)
 		}
 
-		if txns[i].AmountUSD < txns[j].AmountUSD {
-			return true
+		if txns[i].AmountUSD != txns[j].AmountUSD {
+			return txns[i].AmountUSD < txns[j].AmountUSD
 		}
 
-		if txns[i].TxnTimestamp.Equal(txns[j].TxnTimestamp) && txns[i].AmountUSD == txns[j].AmountUSD {
-			return txns[i].TxnFlow == "out"
+		if txns[i].Asset != txns[j].Asset {
+			return txns[i].Asset < txns[j].Asset
 		}
 
-		return false
+		return txns[i].TxnFlow == directionOut && txns[j].TxnFlow != directionOut
 	})
 
 	result := map[string]string{} // map from withdrawing txn -> deposit txn
@@ -594,13 +1043,12 @@ func detectTransfers(txns []*CustomTxn) (map[string]string, error) {
 
 		if txns[i].TxnTimestamp.Equal(txns[j].TxnTimestamp) &&
 			txns[i].AmountUSD == txns[j].AmountUSD &&
+			txns[i].Asset == txns[j].Asset &&
 			txns[i].TxnFlow != txns[j].TxnFlow &&
 			txns[i].WalletID != txns[j].WalletID {
 
 			result[txns[i].TxnID] = txns[j].TxnID
 
-			fmt.Printf("transfer detected!: %s -> %s", txns[i].TxnID, txns[j].TxnID)
-
 			// skip this pair entirely
 			i++
 			j++
@@ -608,8 +1056,6 @@ func detectTransfers(txns []*CustomTxn) (map[string]string, error) {
 	}
 
 	return result, nil
-
-	// todo: (nice to have) save this detected and add tag to transactions by hash id + this address (composite key)
 }
 
 // getAddrStats gets the AddressStats for the provided address via the Blockchair API
@@ -620,19 +1066,26 @@ func getAddrStats(ctx context.Context, b *blockchair.Client, addr string) (*bloc
 		return nil, err
 	}
 
-	return statsResp.Data[addr], nil
+	// syncing off an empty snapshot would take the address for one with no transactions
+	stats, ok := statsResp.Data[addr]
+	if !ok || stats == nil || stats.Addr == nil {
+		return nil, fmt.Errorf("blockchair returned no stats for address %s", addr)
+	}
+
+	return stats, nil
 }
 
-// getTransactions gets all transaction data for provided txn hashes via the Blockchair API (in batches of 10)
+// getTransactions gets all transaction data for provided txn hashes of the provided address via the Blockchair API (in
+// batches of 10), reporting each batch fetched as a sync event
 // note: the blockchair api limits calls to their /transactions endpoint for up to 10 txn hashes
-// ideally, we'd parallelize these chunks and/or kick off a job instead of blocking execution
-func getTransactions(ctx context.Context, b *blockchair.Client, txnHashes []string) (map[string]*blockchair.TransactionWrapper, error) {
+// ideally, we'd parallelize these chunks
+func getTransactions(ctx context.Context, b *blockchair.Client, addr string, txnHashes []string) (map[string]*blockchair.TransactionWrapper, error) {
 	txns := make(map[string]*blockchair.TransactionWrapper)
 
 	// group the list of all transactions into chunks of 10
 	var batches [][]string
-	for i := 0; i < len(txnHashes); i += 10 {
-		end := i + 10
+	for i := 0; i < len(txnHashes); i += transactionBatchSize {
+		end := i + transactionBatchSize
 
 		if end > len(txnHashes) {
 			end = len(txnHashes)
@@ -641,18 +1094,19 @@ func getTransactions(ctx context.Context, b *blockchair.Client, txnHashes []stri
 		batches = append(batches, txnHashes[i:end])
 	}
 
+	log := logging.FromContext(ctx)
+
 	// for each batch, get the transaction data
-	for _, batch := range batches {
-		fmt.Printf("processing batch: %v ...\n", batch)
+	for i, batch := range batches {
+		log.Debug("processing batch", "batch", i+1, "batches", len(batches), "batch_size", len(batch), "txn_hashes", batch)
 
 		resp, err := b.GetTransactionsByHashes(ctx, batch)
 		if err != nil {
 			return nil, err
 		}
 
-		fmt.Printf("processed batch: %+v ...\n", resp.Data)
-
 		txns = mergeTxnMaps(txns, resp.Data)
+		reportSyncEvent(ctx, syncEventBatchFetched, addr, &BatchEventData{Batch: i + 1, Batches: len(batches), Transactions: len(batch)})
 	}
 
 	return txns, nil
@@ -667,11 +1121,69 @@ func mergeTxnMaps(a, b map[string]*blockchair.TransactionWrapper) map[string]*bl
 	return a
 }
 
+// Deprecated wraps a legacy handler, pointing callers at its v1 successor via the Deprecation and Link response headers
+func Deprecated(successor string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes the provided value as a JSON response body with the given status code
+// note: headers have to be set before calling WriteHeader, otherwise they're silently dropped
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusFromErr maps errors returned by Spanner to the closest matching HTTP status code
+func statusFromErr(err error) int {
+	switch spanner.ErrCode(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
+
 func main() {
-	server := InitServer()
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logging.Default().Error("could not load config", "error", err)
+		os.Exit(2)
+	}
+
+	logger := newLogger(cfg.Logging)
+	logging.SetDefault(logger)
 
-	log.Printf("Listening on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(
-		fmt.Sprintf("%s:%s", endpoint, port), server.router),
-	)
+	exporter, err := newTraceExporter(cfg.Tracing)
+	if err != nil {
+		logger.Warn("not exporting traces", "error", err)
+	}
+
+	tracing.SetExporter(exporter)
+
+	// any arguments left after the flags run one of the administrative commands instead of the server
+	if len(args) > 0 {
+		if err := runCommand(logging.NewContext(context.Background(), logger), cfg, args[0], args[1:]); err != nil {
+			logger.Error("command failed", "command", args[0], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	server := InitServer(cfg, logger)
+
+	if err := server.ListenAndServe(cfg.Server.Addr()); err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+)
+
+func TestReorgedTransactions(t *testing.T) {
+	// a (the oldest) through d (the newest) are stored
+	stored := map[string]*TransactionsRecord{}
+	for i, hash := range []string{"a", "b", "c", "d"} {
+		stored[hash] = &TransactionsRecord{TxnHash: hash, TxnTimestamp: time.Date(2021, 1, 1, i, 0, 0, 0, time.UTC)}
+	}
+
+	reorged := func(listed []string, total int) string {
+		hashes := []string{}
+		for _, v := range reorgedTransactions(listed, total, stored) {
+			hashes = append(hashes, v.TxnHash)
+		}
+		sort.Strings(hashes)
+		return fmt.Sprint(hashes)
+	}
+
+	// a listing of every transaction the provider counts vouches for all of them
+	if got := reorged([]string{"e", "d", "b", "a"}, 4); got != "[c]" {
+		t.Errorf("reorgedTransactions() of a complete listing without c = %s, want [c]", got)
+	}
+
+	if got := reorged([]string{"d", "c", "b"}, 3); got != "[a]" {
+		t.Errorf("reorgedTransactions() of a complete listing without a = %s, want [a]", got)
+	}
+
+	if got := reorged([]string{"e", "d", "c", "b", "a"}, 5); got != "[]" {
+		t.Errorf("reorgedTransactions() of everything = %s, want none", got)
+	}
+
+	// a full page only vouches for what's newer than the oldest stored transaction it lists
+	page := []string{"e", "d", "b"}
+	for i := len(page); i < blockchair.TransactionLimit; i++ {
+		page = append(page, fmt.Sprintf("older%d", i))
+	}
+
+	if got := reorged(page, 60); got != "[c]" {
+		t.Errorf("reorgedTransactions() of a full page without c = %s, want [c]", got)
+	}
+
+	page[2] = "c"
+	if got := reorged(page, 60); got != "[]" {
+		t.Errorf("reorgedTransactions() of a full page listing c & d = %s, want none (a & b are past it)", got)
+	}
+
+	// a listing inconsistent with the count (likely the provider lagging) or an empty one doesn't prove anything
+	inconsistent := map[string]struct {
+		listed []string
+		total  int
+	}{
+		"short of the total":    {[]string{"e", "d"}, 5},
+		"short of a full page":  {[]string{"d", "c"}, 60},
+		"empty despite a total": {[]string{}, 4},
+		"empty":                 {[]string{}, 0},
+	}
+
+	for name, v := range inconsistent {
+		if got := reorged(v.listed, v.total); got != "[]" {
+			t.Errorf("reorgedTransactions() of a listing %s = %s, want none", name, got)
+		}
+	}
+}
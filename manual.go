@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+)
+
+// manualSource prefixes the IDs of activity the user entered by hand, and is the "wallet" it's held in
+const manualSource = "manual"
+
+// manualColumns lists the columns read into a ManualTransactionsRecord
+var manualColumns = []string{
+	"user_id", "manual_id", "asset", "quantity", "fiat_value", "fiat_currency", "txn_timestamp", "counterparty", "notes", "created_at", "updated_at",
+}
+
+// ManualTransactionsRecord is the data model for a respective row in the 'manual_transactions' table stored in Spanner,
+// holding the off-chain activity a user entered by hand (OTC trades, cash purchases, gifts...)
+type ManualTransactionsRecord struct {
+	UserID       string    `spanner:"user_id"`   // pk
+	ManualID     string    `spanner:"manual_id"` // pk
+	Asset        string    `spanner:"asset"`
+	Quantity     float64   `spanner:"quantity"`   // signed (> 0 when the user acquired the asset)
+	FiatValue    float64   `spanner:"fiat_value"` // what the whole quantity was worth at the time, in FiatCurrency
+	FiatCurrency string    `spanner:"fiat_currency"`
+	TxnTimestamp time.Time `spanner:"txn_timestamp"`
+	Counterparty string    `spanner:"counterparty"`
+	Notes        string    `spanner:"notes"`
+	CreatedAt    time.Time `spanner:"created_at"`
+	UpdatedAt    time.Time `spanner:"updated_at"`
+}
+
+// ManualTransactionRequest represents the expected request body to '/v1/users/{user}/manual-transactions'
+type ManualTransactionRequest struct {
+	Asset        string    `json:"asset"`
+	Amount       float64   `json:"amount"` // signed (> 0 when the user acquired the asset)
+	FiatValue    float64   `json:"fiat_value"`
+	Currency     string    `json:"currency"` // of fiat_value, defaults to USD
+	Timestamp    time.Time `json:"timestamp"`
+	Counterparty string    `json:"counterparty"`
+	Notes        string    `json:"notes"`
+}
+
+// ManualTransactionResponse represents the expected response body to '/v1/users/{user}/manual-transactions/{id}'
+type ManualTransactionResponse struct {
+	Transaction *ManualTransactionsRecord `json:"transaction"`
+}
+
+// ManualTransactionsResponse represents the expected response body to '/v1/users/{user}/manual-transactions'
+type ManualTransactionsResponse struct {
+	Transactions []*ManualTransactionsRecord `json:"transactions"`
+}
+
+// parseManualTransactionRequest parses and validates the ManualTransactionRequest in the provided request body
+func parseManualTransactionRequest(r *http.Request) (*ManualTransactionRequest, int, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var manualReq ManualTransactionRequest
+	if err := json.Unmarshal(body, &manualReq); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("provided payload is not valid JSON")
+	}
+
+	manualReq.Asset = strings.ToUpper(manualReq.Asset)
+	manualReq.Currency = strings.ToUpper(manualReq.Currency)
+	if len(manualReq.Currency) == 0 {
+		manualReq.Currency = defaultCurrency
+	}
+
+	switch {
+	case len(manualReq.Asset) == 0:
+		return nil, http.StatusBadRequest, fmt.Errorf("asset is required")
+	case manualReq.Amount == 0:
+		return nil, http.StatusBadRequest, fmt.Errorf("amount is required (negative when the asset left the portfolio)")
+	case manualReq.FiatValue < 0:
+		return nil, http.StatusBadRequest, fmt.Errorf("fiat_value cannot be negative")
+	case manualReq.Timestamp.IsZero():
+		return nil, http.StatusBadRequest, fmt.Errorf("timestamp is required")
+	}
+
+	return &manualReq, http.StatusOK, nil
+}
+
+// CreateManualTransactionHandler returns a closure responsible for validating the incoming request
+// and recording a manual transaction for the user in the request path
+func CreateManualTransactionHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		manualReq, status, err := parseManualTransactionRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		id, err := newUUID()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		rec := newManualTransactionsRecord(userID, id, manualReq)
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+
+		_, err = readWriteTransaction(ctx, s, "create_manual_transaction", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if _, err := readUser(ctx, txn, userID); err != nil {
+				return err
+			}
+
+			mut, err := spanner.InsertStruct(manualTransactionsTable, rec)
+			if err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{mut})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not create manual transaction for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, &ManualTransactionResponse{Transaction: rec})
+	})
+}
+
+// ListManualTransactionsHandler returns a closure responsible for listing the manual transactions of the user in the request path
+func ListManualTransactionsHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		txn := s.ReadOnlyTransaction()
+		defer txn.Close()
+
+		if _, err := readUser(ctx, txn, userID); err != nil {
+			http.Error(w, fmt.Sprintf("could not list manual transactions for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		recs, err := readManualTransactions(ctx, txn, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list manual transactions for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ManualTransactionsResponse{Transactions: recs})
+	})
+}
+
+// GetManualTransactionHandler returns a closure responsible for reading the manual transaction in the request path
+func GetManualTransactionHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		vars := mux.Vars(r)
+
+		rec, err := readManualTransaction(ctx, s.Single(), vars["user"], vars["id"])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get manual transaction %s. %v", vars["id"], err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ManualTransactionResponse{Transaction: rec})
+	})
+}
+
+// UpdateManualTransactionHandler returns a closure responsible for replacing the manual transaction in the request path
+// with the one in the request body
+func UpdateManualTransactionHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		vars := mux.Vars(r)
+
+		manualReq, status, err := parseManualTransactionRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		rec := newManualTransactionsRecord(vars["user"], vars["id"], manualReq)
+		rec.UpdatedAt = time.Now()
+
+		_, err = readWriteTransaction(ctx, s, "update_manual_transaction", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			existing, err := readManualTransaction(ctx, txn, rec.UserID, rec.ManualID)
+			if err != nil {
+				return err
+			}
+
+			rec.CreatedAt = existing.CreatedAt
+
+			mut, err := spanner.UpdateStruct(manualTransactionsTable, rec)
+			if err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{mut})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not update manual transaction %s. %v", rec.ManualID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ManualTransactionResponse{Transaction: rec})
+	})
+}
+
+// DeleteManualTransactionHandler returns a closure responsible for deleting the manual transaction in the request path
+func DeleteManualTransactionHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		vars := mux.Vars(r)
+
+		_, err := readWriteTransaction(ctx, s, "delete_manual_transaction", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if _, err := readManualTransaction(ctx, txn, vars["user"], vars["id"]); err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.Delete(manualTransactionsTable, spanner.Key{vars["user"], vars["id"]}),
+			})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not delete manual transaction %s. %v", vars["id"], err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// newManualTransactionsRecord converts the provided request into a record (without its created & updated times)
+func newManualTransactionsRecord(userID, id string, manualReq *ManualTransactionRequest) *ManualTransactionsRecord {
+	return &ManualTransactionsRecord{
+		UserID:       userID,
+		ManualID:     id,
+		Asset:        manualReq.Asset,
+		Quantity:     manualReq.Amount,
+		FiatValue:    manualReq.FiatValue,
+		FiatCurrency: manualReq.Currency,
+		TxnTimestamp: manualReq.Timestamp.UTC(),
+		Counterparty: manualReq.Counterparty,
+		Notes:        manualReq.Notes,
+	}
+}
+
+// readManualTransaction reads the ManualTransactionsRecord with the provided ID
+func readManualTransaction(ctx context.Context, txn rowReader, userID, id string) (*ManualTransactionsRecord, error) {
+	row, err := txn.ReadRow(ctx, manualTransactionsTable, spanner.Key{userID, id}, manualColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec ManualTransactionsRecord
+	if err := row.ToStruct(&rec); err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+// readManualTransactions reads all of the provided user's manual transactions, in time order
+func readManualTransactions(ctx context.Context, txn querier, userID string) ([]*ManualTransactionsRecord, error) {
+	stmt := spanner.NewStatement(fmt.Sprintf(`
+		SELECT %s
+		FROM manual_transactions
+		WHERE user_id = @user_id
+		ORDER BY txn_timestamp
+	`, strings.Join(manualColumns, ", ")))
+	stmt.Params["user_id"] = userID
+
+	recs := []*ManualTransactionsRecord{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec ManualTransactionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		recs = append(recs, &rec)
+		return nil
+	})
+
+	return recs, err
+}
+
+// activity converts the manual transaction to activity, held in the user's "manual" wallet
+func (m *ManualTransactionsRecord) activity() *activity {
+	id := fmt.Sprintf("%s:%s", manualSource, m.ManualID)
+	act := &activity{
+		ID:       id,
+		Ref:      id,
+		Wallet:   manualSource,
+		Asset:    m.Asset,
+		Time:     m.TxnTimestamp,
+		Quantity: m.Quantity,
+		Price:    m.FiatValue / math.Abs(m.Quantity),
+		Currency: m.FiatCurrency,
+	}
+
+	if act.Currency == defaultCurrency {
+		act.AmountUSD = m.FiatValue
+	}
+
+	return act
+}
+
+// readManualActivity reads the provided user's manual transactions as activity
+func readManualActivity(ctx context.Context, txn querier, userID string) ([]*activity, error) {
+	recs, err := readManualTransactions(ctx, txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	acts := []*activity{}
+	for _, v := range recs {
+		acts = append(acts, v.activity())
+	}
+
+	return acts, nil
+}
@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets (in seconds) used for latencies, spanning fast reads to rate-limited syncs
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Default is the registry the package-level constructors register with, and Handler() serves
+var Default = NewRegistry()
+
+// collector is a metric that can write its samples in the Prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics, written in the order they were registered. It's safe for concurrent use.
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+// NewRegistry returns a new, empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register adds the provided metric to the registry, panicking if its name is taken (which is a programming error)
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every registered metric in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.write(cw)
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// Handler returns a handler serving the registry's metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler returns a handler serving the Default registry's metrics
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// series identifies the samples of a metric sharing the same label values
+type series struct {
+	key    string
+	values []string
+}
+
+// vec holds what every kind of metric has in common: its name, help text and label names
+type vec struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// newSeries returns the series for the provided label values, panicking if their number doesn't match the labels
+func (v *vec) newSeries(values []string) series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	return series{key: strings.Join(values, "\xff"), values: append([]string{}, values...)}
+}
+
+// header writes the HELP & TYPE lines of the metric
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, kind)
+}
+
+// labelPairs formats the provided label values (plus any extra name/value pairs, e.g. a bucket's "le") as {name="value",...}
+func (v *vec) labelPairs(values []string, extra ...string) string {
+	pairs := []string{}
+
+	for i, name := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i])))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing value, partitioned by its labels' values
+type Counter struct {
+	vec
+	mu     sync.Mutex
+	series map[string]series
+	values map[string]float64
+}
+
+// NewCounter registers a new counter with the provided labels
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		vec:    vec{name: name, help: help, labels: labels},
+		series: map[string]series{},
+		values: map[string]float64{},
+	}
+
+	r.register(name, c)
+	return c
+}
+
+// NewCounter registers a new counter with the Default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Inc adds 1 to the series with the provided label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the provided (non-negative) value to the series with the provided label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+
+	s := c.newSeries(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.series[s.key] = s
+	c.values[s.key] += v
+}
+
+// write writes the counter's samples, one per series
+func (c *Counter) write(w io.Writer) {
+	c.header(w, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.series[key].values), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations (e.g. latencies) into cumulative buckets, partitioned by its labels' values
+type Histogram struct {
+	vec
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]series
+	counts  map[string][]uint64 // per bucket, not cumulative
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// NewHistogram registers a new histogram with the provided (ascending) bucket upper bounds and labels
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		vec:     vec{name: name, help: help, labels: labels},
+		buckets: append([]float64{}, buckets...),
+		series:  map[string]series{},
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+
+	sort.Float64s(h.buckets)
+
+	r.register(name, h)
+	return h
+}
+
+// NewHistogram registers a new histogram with the Default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Observe records the provided value in the series with the provided label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.newSeries(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.series[s.key]; !ok {
+		h.series[s.key] = s
+		h.counts[s.key] = make([]uint64, len(h.buckets))
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[s.key][i]++
+	}
+
+	h.sums[s.key] += v
+	h.totals[s.key]++
+}
+
+// ObserveDuration records the provided duration, in seconds
+func (h *Histogram) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+// write writes the histogram's cumulative buckets, sum & count, per series
+func (h *Histogram) write(w io.Writer) {
+	h.header(w, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range sortedKeys(h.series) {
+		values := h.series[key].values
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += h.counts[key][i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", formatFloat(le)), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values), h.totals[key])
+	}
+}
+
+// sortedKeys returns the keys of the provided series in order, so that samples are written in a stable order
+func sortedKeys(m map[string]series) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeLabel escapes a label value as the text format requires
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat formats a sample value as the text format expects
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingWriter counts the bytes written through it, for WriteTo
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+// Write writes to the underlying writer, counting the bytes written
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,244 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table is the table tracking which migrations were applied to a database
+const Table = "schema_migrations"
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// fileName matches the name of a migration's files, e.g. "0002_index_transactions_by_address.up.sql"
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// ErrOutdated is returned by Check when a database is missing migrations
+var ErrOutdated = errors.New("database schema is outdated")
+
+// Migration is a versioned change to the schema, along with the statements reverting it
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Status is whether a migration was applied to a database, and when
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"` // nil if it's pending
+}
+
+// Driver applies migrations to a storage backend, tracking them in its Table
+type Driver interface {
+	// Applied returns when each applied migration was applied, keyed by version (empty before the first is)
+	Applied(ctx context.Context) (map[int]time.Time, error)
+
+	// Apply runs the migration's Up (or Down) statements and records it as applied (or not)
+	Apply(ctx context.Context, m *Migration, up bool) error
+}
+
+// Load returns every migration in the repo, oldest first
+func Load() ([]*Migration, error) {
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %q, must be named <version>_<name>.(up|down).sql", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, match[2])
+		}
+
+		data, err := fs.ReadFile(files, path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			m.Up = splitStatements(string(data))
+		} else {
+			m.Down = splitStatements(string(data))
+		}
+	}
+
+	migrations := []*Migration{}
+	for _, m := range byVersion {
+		if len(m.Up) == 0 || len(m.Down) == 0 {
+			return nil, fmt.Errorf("migration %d (%s) needs both up and down statements", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// splitStatements splits a migration file into its statements, dropping comments and the semicolons separating them
+// (which Spanner doesn't accept)
+func splitStatements(sql string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(sql, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	statements := []string{}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); len(stmt) > 0 {
+			statements = append(statements, stmt)
+		}
+	}
+
+	return statements
+}
+
+// Migrator applies the repo's migrations through a driver
+type Migrator struct {
+	driver     Driver
+	migrations []*Migration
+}
+
+// NewMigrator returns a migrator applying the repo's migrations through the provided driver
+func NewMigrator(driver Driver) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{driver: driver, migrations: migrations}, nil
+}
+
+// Status returns the status of every migration, oldest first
+func (m *Migrator) Status(ctx context.Context) ([]*Status, error) {
+	applied, err := m.driver.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*Status{}
+	for _, migration := range m.migrations {
+		status := &Status{Version: migration.Version, Name: migration.Name}
+		if at, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Up applies up to the provided number of pending migrations (all of them if steps < 1), oldest first, returning the
+// ones it applied
+func (m *Migrator) Up(ctx context.Context, steps int) ([]*Migration, error) {
+	applied, err := m.driver.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []*Migration{}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if steps > 0 && len(done) == steps {
+			break
+		}
+
+		if err := m.driver.Apply(ctx, migration, true); err != nil {
+			return done, fmt.Errorf("could not apply migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Down reverts up to the provided number of applied migrations (1 if steps < 1), newest first, returning the ones it
+// reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	if steps < 1 {
+		steps = 1
+	}
+
+	applied, err := m.driver.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []*Migration{}
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if err := m.driver.Apply(ctx, migration, false); err != nil {
+			return done, fmt.Errorf("could not revert migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Check returns an error wrapping ErrOutdated if any migration is pending, or if the database has one applied that
+// this build doesn't know about (i.e. it was migrated by a newer build)
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.driver.Applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := map[int]bool{}
+	pending := []string{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, fmt.Sprintf("%d (%s)", migration.Version, migration.Name))
+		}
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: pending migrations %s", ErrOutdated, strings.Join(pending, ", "))
+	}
+
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d applied, which this build doesn't know about", version)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	databasepb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+)
+
+// SpannerDriver applies migrations to a Spanner database. DDL can't run in a transaction, so a migration failing
+// partway through leaves whatever statements succeeded applied, without being recorded; fix its leftovers by hand (or
+// make its statements idempotent) before running it again.
+type SpannerDriver struct {
+	client *spanner.Client
+	admin  *database.DatabaseAdminClient
+	path   string // projects/<project>/instances/<instance>/databases/<database>
+}
+
+// NewSpannerDriver returns a driver migrating the database at the provided path, reading through the provided client
+// and changing its schema through the provided admin client
+func NewSpannerDriver(client *spanner.Client, admin *database.DatabaseAdminClient, path string) *SpannerDriver {
+	return &SpannerDriver{client: client, admin: admin, path: path}
+}
+
+// Applied returns when each applied migration was applied, keyed by version
+func (d *SpannerDriver) Applied(ctx context.Context) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+
+	exists, err := d.tableExists(ctx)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	iter := d.client.Single().Query(ctx, spanner.NewStatement(fmt.Sprintf(`SELECT version, applied_at FROM %s`, Table)))
+	err = iter.Do(func(row *spanner.Row) error {
+		var version int64
+		var at time.Time
+		if err := row.Columns(&version, &at); err != nil {
+			return err
+		}
+
+		applied[int(version)] = at
+		return nil
+	})
+
+	return applied, err
+}
+
+// Apply runs the migration's statements, then records (or deletes) its row in the tracking table
+func (d *SpannerDriver) Apply(ctx context.Context, m *Migration, up bool) error {
+	exists, err := d.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		stmt := fmt.Sprintf(`CREATE TABLE %s (version INT64 NOT NULL, name STRING(MAX), applied_at TIMESTAMP) PRIMARY KEY (version)`, Table)
+		if err := d.updateDDL(ctx, []string{stmt}); err != nil {
+			return fmt.Errorf("could not create %s: %v", Table, err)
+		}
+	}
+
+	statements := m.Down
+	if up {
+		statements = m.Up
+	}
+
+	if err := d.updateDDL(ctx, statements); err != nil {
+		return err
+	}
+
+	mutation := spanner.Delete(Table, spanner.Key{int64(m.Version)})
+	if up {
+		mutation = spanner.InsertOrUpdate(Table, []string{"version", "name", "applied_at"}, []interface{}{int64(m.Version), m.Name, time.Now().UTC()})
+	}
+
+	_, err = d.client.Apply(ctx, []*spanner.Mutation{mutation})
+	return err
+}
+
+// updateDDL runs the provided DDL statements, waiting for them to complete
+func (d *SpannerDriver) updateDDL(ctx context.Context, statements []string) error {
+	op, err := d.admin.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   d.path,
+		Statements: statements,
+	})
+	if err != nil {
+		return err
+	}
+
+	return op.Wait(ctx)
+}
+
+// tableExists reports whether the tracking table was created yet
+func (d *SpannerDriver) tableExists(ctx context.Context) (bool, error) {
+	stmt := spanner.NewStatement(`SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = '' AND table_name = @table`)
+	stmt.Params["table"] = Table
+
+	var n int64
+	err := d.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&n)
+	})
+
+	return n > 0, err
+}
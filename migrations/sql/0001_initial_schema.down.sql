@@ -0,0 +1,8 @@
+DROP TABLE manual_transactions;
+DROP TABLE exchange_accounts;
+DROP TABLE imported_transactions;
+DROP TABLE lot_selections;
+DROP TABLE transfers;
+DROP TABLE transactions;
+DROP TABLE addresses;
+DROP TABLE users;
@@ -0,0 +1,85 @@
+-- the tables as they stood before migrations were introduced (see the Tables section of the README)
+
+CREATE TABLE users (
+  uuid STRING(MAX) NOT NULL,
+  username STRING(MAX),
+  addresses STRING(MAX),
+  cost_basis_method STRING(MAX),
+) PRIMARY KEY (uuid);
+
+CREATE TABLE addresses (
+  public_key STRING(MAX) NOT NULL,
+  balance FLOAT64,
+  native_balance INT64,
+  created_at TIMESTAMP,
+  updated_at TIMESTAMP,
+  last_txn_hash STRING(MAX),
+) PRIMARY KEY (public_key);
+
+CREATE TABLE transactions (
+  txn_hash STRING(MAX) NOT NULL,
+  public_key STRING(MAX) NOT NULL,
+  txn_timestamp TIMESTAMP,
+  amount FLOAT64,
+  fee FLOAT64,
+  native_fee INT64,
+  balance_change INT64,
+  price FLOAT64,
+  price_currency STRING(MAX),
+  price_source STRING(MAX),
+  created_at TIMESTAMP,
+  tags STRING(MAX),
+) PRIMARY KEY (txn_hash, public_key);
+
+CREATE TABLE transfers (
+  out_id STRING(MAX) NOT NULL,
+  in_id STRING(MAX),
+  user_id STRING(MAX),
+  detected_at TIMESTAMP,
+) PRIMARY KEY (out_id);
+
+CREATE TABLE lot_selections (
+  user_id STRING(MAX) NOT NULL,
+  disposal_id STRING(MAX) NOT NULL,
+  lot_ids STRING(MAX),
+) PRIMARY KEY (user_id, disposal_id);
+
+CREATE TABLE imported_transactions (
+  user_id STRING(MAX) NOT NULL,
+  import_id STRING(MAX) NOT NULL,
+  source STRING(MAX),
+  external_id STRING(MAX),
+  type STRING(MAX),
+  asset STRING(MAX),
+  quantity FLOAT64,
+  fee FLOAT64,
+  price FLOAT64,
+  price_currency STRING(MAX),
+  txn_timestamp TIMESTAMP,
+  notes STRING(MAX),
+  created_at TIMESTAMP,
+) PRIMARY KEY (user_id, import_id);
+
+CREATE TABLE exchange_accounts (
+  account_id STRING(MAX) NOT NULL,
+  user_id STRING(MAX),
+  exchange STRING(MAX),
+  api_key STRING(MAX),
+  api_secret STRING(MAX),
+  created_at TIMESTAMP,
+  last_synced_at TIMESTAMP,
+) PRIMARY KEY (account_id);
+
+CREATE TABLE manual_transactions (
+  user_id STRING(MAX) NOT NULL,
+  manual_id STRING(MAX) NOT NULL,
+  asset STRING(MAX),
+  quantity FLOAT64,
+  fiat_value FLOAT64,
+  fiat_currency STRING(MAX),
+  txn_timestamp TIMESTAMP,
+  counterparty STRING(MAX),
+  notes STRING(MAX),
+  created_at TIMESTAMP,
+  updated_at TIMESTAMP,
+) PRIMARY KEY (user_id, manual_id);
@@ -0,0 +1 @@
+DROP INDEX transactions_by_public_key;
@@ -0,0 +1,3 @@
+-- every per-address read of transactions (balances, histories, listings) filters on public_key, which isn't the
+-- leading key column, and most order by time
+CREATE INDEX transactions_by_public_key ON transactions (public_key, txn_timestamp);
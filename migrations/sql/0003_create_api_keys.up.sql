@@ -0,0 +1,11 @@
+CREATE TABLE api_keys (
+  key_id STRING(MAX) NOT NULL,
+  user_id STRING(MAX),
+  name STRING(MAX),
+  key_hash STRING(MAX),
+  scopes STRING(MAX),
+  created_at TIMESTAMP,
+) PRIMARY KEY (key_id);
+
+-- listing a user's keys
+CREATE INDEX api_keys_by_user_id ON api_keys (user_id);
@@ -0,0 +1,4 @@
+DROP INDEX webhook_deliveries_by_next_attempt;
+DROP TABLE webhook_deliveries;
+DROP INDEX webhook_subscriptions_by_user_id;
+DROP TABLE webhook_subscriptions;
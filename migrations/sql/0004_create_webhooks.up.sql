@@ -0,0 +1,33 @@
+CREATE TABLE webhook_subscriptions (
+  subscription_id STRING(MAX) NOT NULL,
+  user_id STRING(MAX),
+  address STRING(MAX),
+  url STRING(MAX),
+  secret STRING(MAX),
+  event_types STRING(MAX),
+  created_at TIMESTAMP,
+) PRIMARY KEY (subscription_id);
+
+-- listing a user's subscriptions, and finding the ones an event goes to
+CREATE INDEX webhook_subscriptions_by_user_id ON webhook_subscriptions (user_id);
+
+-- the delivery log, which goes with its subscription
+CREATE TABLE webhook_deliveries (
+  subscription_id STRING(MAX) NOT NULL,
+  delivery_id STRING(MAX) NOT NULL,
+  event_id STRING(MAX),
+  event_type STRING(MAX),
+  payload STRING(MAX),
+  status STRING(MAX),
+  attempts INT64,
+  next_attempt_at TIMESTAMP,
+  last_attempt_at TIMESTAMP,
+  last_status_code INT64,
+  last_error STRING(MAX),
+  created_at TIMESTAMP,
+  delivered_at TIMESTAMP,
+) PRIMARY KEY (subscription_id, delivery_id),
+  INTERLEAVE IN PARENT webhook_subscriptions ON DELETE CASCADE;
+
+-- the dispatcher's queue of deliveries due for an attempt
+CREATE INDEX webhook_deliveries_by_next_attempt ON webhook_deliveries (status, next_attempt_at);
@@ -0,0 +1,2 @@
+DROP INDEX jobs_by_status;
+DROP TABLE jobs;
@@ -0,0 +1,19 @@
+CREATE TABLE jobs (
+  job_id STRING(MAX) NOT NULL,
+  kind STRING(MAX),
+  user_id STRING(MAX),
+  address STRING(MAX),
+  status STRING(MAX),
+  batches_done INT64,
+  batches_total INT64,
+  error STRING(MAX),
+  result STRING(MAX),
+  cancel_requested BOOL,
+  created_at TIMESTAMP,
+  started_at TIMESTAMP,
+  heartbeat_at TIMESTAMP,
+  finished_at TIMESTAMP,
+) PRIMARY KEY (job_id);
+
+-- the runner's queue of jobs to claim
+CREATE INDEX jobs_by_status ON jobs (status, created_at);
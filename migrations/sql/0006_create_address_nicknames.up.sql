@@ -0,0 +1,7 @@
+-- what users call their addresses, e.g. "cold storage". Not interleaved in users, whose key column is named uuid.
+CREATE TABLE address_nicknames (
+  user_id STRING(MAX) NOT NULL,
+  public_key STRING(MAX) NOT NULL,
+  nickname STRING(MAX),
+  updated_at TIMESTAMP,
+) PRIMARY KEY (user_id, public_key);
@@ -0,0 +1 @@
+ALTER TABLE addresses DROP COLUMN archived_at;
@@ -0,0 +1,2 @@
+-- archived addresses are no longer synced or counted in portfolios, but keep their transactions for gains & tax reports
+ALTER TABLE addresses ADD COLUMN archived_at TIMESTAMP;
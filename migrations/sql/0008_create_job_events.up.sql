@@ -0,0 +1,9 @@
+-- the events of each job's sync, in the order they happened, for whoever follows the job (see JobEventsHandler)
+CREATE TABLE job_events (
+  job_id STRING(MAX) NOT NULL,
+  seq INT64 NOT NULL,
+  type STRING(MAX),
+  event STRING(MAX),
+  created_at TIMESTAMP,
+) PRIMARY KEY (job_id, seq),
+  INTERLEAVE IN PARENT jobs ON DELETE CASCADE;
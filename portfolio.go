@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+const (
+	// every address we track today lives on the bitcoin blockchain
+	bitcoinChain = "bitcoin"
+	btcAsset     = "BTC"
+
+	satoshisPerBTC = 1e8
+
+	// staleAfter is how long after its last sync an address' stored balance is considered out of date
+	staleAfter = time.Hour
+)
+
+// PortfolioResponse represents the expected response body to '/v1/users/{user}/portfolio'
+type PortfolioResponse struct {
+	UserID      string            `json:"user_id"`
+	FiatBalance float64           `json:"fiat_balance"` // in USD, across all assets
+	Stale       bool              `json:"stale"`        // whether any address in the portfolio is stale
+	Assets      []*AssetBalance   `json:"assets"`
+	Addresses   []*AddressBalance `json:"addresses"`
+	OffChain    []*AssetBalance   `json:"off_chain"` // what the user's manual transactions add up to, per asset (included in Assets)
+}
+
+// AssetBalance represents the portfolio's holdings of a single asset, totalled across its addresses
+type AssetBalance struct {
+	Asset         string  `json:"asset"`
+	Chain         string  `json:"chain"`
+	NativeBalance float64 `json:"native_balance"`
+	FiatBalance   float64 `json:"fiat_balance"`
+
+	// flows in and out of the portfolio, where transfers between the user's own addresses only count their net effect (i.e. fees)
+	Received          float64 `json:"received"`
+	Sent              float64 `json:"sent"`
+	InternalTransfers int     `json:"internal_transfers"`
+}
+
+// AddressBalance represents a single address' contribution to the portfolio
+type AddressBalance struct {
+	Address       string    `json:"address"`
+	Asset         string    `json:"asset"`
+	Chain         string    `json:"chain"`
+	NativeBalance float64   `json:"native_balance"`
+	FiatBalance   float64   `json:"fiat_balance"`
+	Received      float64   `json:"received"`
+	Sent          float64   `json:"sent"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Stale         bool      `json:"stale"` // not synced within the last hour (or never synced at all)
+}
+
+// GetPortfolioHandler returns a closure responsible for invoking portfolio() for the user in the request path
+func GetPortfolioHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		portfolioResp, err := portfolio(ctx, s, p, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get portfolio for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, portfolioResp)
+	})
+}
+
+// portfolio totals the stored balances of all the provided user's (unarchived) addresses and manual transactions, broken down per address
+// and per asset. off-chain holdings are valued at the current price.
+// note: like balance(), this doesn't sync; stale addresses are flagged instead
+func portfolio(ctx context.Context, s *spanner.Client, p prices.Provider, userID string) (*PortfolioResponse, error) {
+	// read everything from the same snapshot so balances and flows agree with each other
+	txn := s.ReadOnlyTransaction()
+	defer txn.Close()
+
+	user, err := readUser(ctx, txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := readAddresses(ctx, txn, user.AddressList())
+	if err != nil {
+		return nil, err
+	}
+
+	// archived addresses keep their transactions for gains & tax reports, but they're no longer part of the portfolio
+	addrs := unarchivedAddresses(user.AddressList(), addresses)
+
+	txnsRecs, err := readBalanceChanges(ctx, txn, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	manual, err := readManualTransactions(ctx, txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	offChain, err := offChainBalances(ctx, p, manual)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PortfolioResponse{
+		UserID:    userID,
+		Assets:    []*AssetBalance{},
+		Addresses: []*AddressBalance{},
+		OffChain:  offChain,
+	}
+
+	// one entry per address, even if it's listed on the user more than once
+	byAddr := map[string]*AddressBalance{}
+	for _, addr := range addrs {
+		if _, ok := byAddr[addr]; ok {
+			continue
+		}
+
+		addrBalance := &AddressBalance{Address: addr, Asset: btcAsset, Chain: bitcoinChain, Stale: true}
+
+		if rec, ok := addresses[addr]; ok {
+			addrBalance.NativeBalance = float64(rec.NativeBalance) / satoshisPerBTC
+			addrBalance.FiatBalance = rec.Balance
+			addrBalance.UpdatedAt = rec.UpdatedAt
+			addrBalance.Stale = time.Since(rec.UpdatedAt) > staleAfter
+		}
+
+		byAddr[addr] = addrBalance
+		resp.Addresses = append(resp.Addresses, addrBalance)
+	}
+
+	btc := &AssetBalance{Asset: btcAsset, Chain: bitcoinChain}
+
+	for _, v := range resp.Addresses {
+		btc.NativeBalance += v.NativeBalance
+		btc.FiatBalance += v.FiatBalance
+		resp.Stale = resp.Stale || v.Stale
+	}
+
+	// per address, every transaction counts; across the portfolio, a transaction touching several of the
+	// user's addresses is a self-transfer and only its net effect counts (otherwise it'd be both sent and received)
+	netByHash := map[string]int64{}
+	addrsByHash := map[string]int{}
+	for _, v := range txnsRecs {
+		if v.BalanceChange > 0 {
+			byAddr[v.PublicKey].Received += float64(v.BalanceChange) / satoshisPerBTC
+		} else {
+			byAddr[v.PublicKey].Sent += float64(-v.BalanceChange) / satoshisPerBTC
+		}
+
+		netByHash[v.TxnHash] += v.BalanceChange
+		addrsByHash[v.TxnHash]++
+	}
+
+	for hash, net := range netByHash {
+		if addrsByHash[hash] > 1 {
+			btc.InternalTransfers++
+		}
+
+		if net > 0 {
+			btc.Received += float64(net) / satoshisPerBTC
+		} else {
+			btc.Sent += float64(-net) / satoshisPerBTC
+		}
+	}
+
+	resp.Assets = append(resp.Assets, btc)
+
+	for _, v := range offChain {
+		total := btc
+		if v.Asset != btcAsset {
+			total = &AssetBalance{Asset: v.Asset}
+			resp.Assets = append(resp.Assets, total)
+		}
+
+		total.NativeBalance += v.NativeBalance
+		total.FiatBalance += v.FiatBalance
+		total.Received += v.Received
+		total.Sent += v.Sent
+	}
+
+	for _, v := range resp.Assets {
+		resp.FiatBalance += v.FiatBalance
+	}
+
+	sort.Slice(resp.Addresses, func(i, j int) bool {
+		return resp.Addresses[i].Address < resp.Addresses[j].Address
+	})
+
+	return resp, nil
+}
+
+// offChainBalances totals the provided manual transactions per asset (in the order each asset first appears),
+// valuing each at its current price in USD (0 if we don't have one)
+func offChainBalances(ctx context.Context, p prices.Provider, recs []*ManualTransactionsRecord) ([]*AssetBalance, error) {
+	balances := []*AssetBalance{}
+	byAsset := map[string]*AssetBalance{}
+
+	for _, v := range recs {
+		balance, ok := byAsset[v.Asset]
+		if !ok {
+			balance = &AssetBalance{Asset: v.Asset}
+			byAsset[v.Asset] = balance
+			balances = append(balances, balance)
+		}
+
+		balance.NativeBalance += v.Quantity
+		if v.Quantity > 0 {
+			balance.Received += v.Quantity
+		} else {
+			balance.Sent -= v.Quantity
+		}
+	}
+
+	now := time.Now()
+	for _, v := range balances {
+		price, err := activityPrice(ctx, p, &activity{Asset: v.Asset, Time: now}, defaultCurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		v.FiatBalance = v.NativeBalance * price
+	}
+
+	return balances, nil
+}
+
+// readAddresses reads the AddressesRecords we're tracking out of the provided addresses, keyed by public key
+func readAddresses(ctx context.Context, txn *spanner.ReadOnlyTransaction, addrs []string) (map[string]*AddressesRecord, error) {
+	keys := []spanner.Key{}
+	for _, v := range addrs {
+		keys = append(keys, spanner.Key{v})
+	}
+
+	addresses := map[string]*AddressesRecord{}
+
+	iter := txn.Read(ctx, addressesTable, spanner.KeySetFromKeys(keys...), addressColumns)
+	err := iter.Do(func(row *spanner.Row) error {
+		rec, err := decodeAddress(row)
+		if err != nil {
+			return err
+		}
+
+		addresses[rec.PublicKey] = rec
+		return nil
+	})
+
+	return addresses, err
+}
+
+// readBalanceChanges reads the hash, address and balance change of every stored transaction for the provided addresses
+func readBalanceChanges(ctx context.Context, txn *spanner.ReadOnlyTransaction, addrs []string) ([]*TransactionsRecord, error) {
+	stmt := spanner.NewStatement(`
+		SELECT txn_hash, public_key, COALESCE(balance_change, 0) AS balance_change
+		FROM transactions
+		WHERE public_key IN UNNEST(@addresses)
+	`)
+	stmt.Params["addresses"] = addrs
+
+	txnsRecs := []*TransactionsRecord{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec TransactionsRecord
+		if err := row.ToStructLenient(&rec); err != nil {
+			return err
+		}
+
+		txnsRecs = append(txnsRecs, &rec)
+		return nil
+	})
+
+	return txnsRecs, err
+}
@@ -0,0 +1,230 @@
+package prices
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// granularities of the prices we store, each valid for its period after the price's timestamp
+	Hourly = "hourly"
+	Daily  = "daily"
+
+	// Source is reported on every quote served from a Store
+	Source = "local"
+)
+
+// ErrNoPrice is returned when a provider has no price covering the requested time
+var ErrNoPrice = errors.New("no price available")
+
+// Provider represents anything that can price an asset (e.g. BTC) in a fiat currency (e.g. USD) at a point in time
+type Provider interface {
+	Price(ctx context.Context, base, quote string, at time.Time) (*Quote, error)
+}
+
+// Quote represents a single historical price
+type Quote struct {
+	Base        string    `json:"base"`
+	Quote       string    `json:"quote"`
+	Time        time.Time `json:"time"` // the start of the period this price covers
+	Granularity string    `json:"granularity"`
+	Price       float64   `json:"price"`
+	Source      string    `json:"source"`
+}
+
+// period returns how long after its timestamp a price with the provided granularity is valid for
+func period(granularity string) time.Duration {
+	if granularity == Hourly {
+		return time.Hour
+	}
+
+	return 24 * time.Hour
+}
+
+// Store is an in-memory history of daily and hourly prices, safe for concurrent use
+// note: hourly prices are preferred over daily ones whenever both cover the requested time
+type Store struct {
+	mu     sync.RWMutex
+	series map[string][]*Quote // keyed by "BASE/QUOTE/granularity", sorted by time
+}
+
+// NewStore constructs an empty price Store
+func NewStore() *Store {
+	return &Store{
+		series: map[string][]*Quote{},
+	}
+}
+
+// seriesKey returns the key the series for the provided pair & granularity is stored under
+func seriesKey(base, quote, granularity string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.ToUpper(base), strings.ToUpper(quote), granularity)
+}
+
+// Add adds the provided quotes to the store, replacing any existing price for the same pair, granularity and time
+func (s *Store) Add(quotes ...*Quote) error {
+	for _, v := range quotes {
+		if v.Granularity != Hourly && v.Granularity != Daily {
+			return fmt.Errorf("unsupported granularity %q, must be one of: %s, %s", v.Granularity, Hourly, Daily)
+		}
+
+		if v.Price <= 0 {
+			return fmt.Errorf("invalid %s/%s price %v at %s", v.Base, v.Quote, v.Price, v.Time)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range quotes {
+		q := *v
+		q.Base, q.Quote, q.Source = strings.ToUpper(q.Base), strings.ToUpper(q.Quote), Source
+		q.Time = q.Time.UTC()
+
+		key := seriesKey(q.Base, q.Quote, q.Granularity)
+		series := s.series[key]
+
+		i := sort.Search(len(series), func(i int) bool { return !series[i].Time.Before(q.Time) })
+		if i < len(series) && series[i].Time.Equal(q.Time) {
+			series[i] = &q
+			continue
+		}
+
+		series = append(series, nil)
+		copy(series[i+1:], series[i:])
+		series[i] = &q
+
+		s.series[key] = series
+	}
+
+	return nil
+}
+
+// Price implements Provider, returning the hourly (or failing that, daily) price covering the provided time
+func (s *Store) Price(ctx context.Context, base, quote string, at time.Time) (*Quote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, granularity := range []string{Hourly, Daily} {
+		series := s.series[seriesKey(base, quote, granularity)]
+
+		// the latest price at or before the requested time, as long as its period still covers it
+		i := sort.Search(len(series), func(i int) bool { return series[i].Time.After(at) }) - 1
+		if i >= 0 && at.Sub(series[i].Time) < period(granularity) {
+			q := *series[i]
+			return &q, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w for %s/%s at %s", ErrNoPrice, strings.ToUpper(base), strings.ToUpper(quote), at.UTC().Format(time.RFC3339))
+}
+
+// LoadCSV parses prices from the provided CSV and adds them to the store, returning how many were added.
+// The CSV needs a header row with (in any order) the columns: time, base, quote, granularity & price,
+// where time is either an RFC 3339 timestamp or a date (YYYY-MM-DD) in UTC
+func (s *Store) LoadCSV(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("could not read the CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, v := range header {
+		columns[strings.ToLower(strings.TrimSpace(v))] = i
+	}
+
+	for _, v := range []string{"time", "base", "quote", "granularity", "price"} {
+		if _, ok := columns[v]; !ok {
+			return 0, fmt.Errorf("the CSV header is missing the %q column", v)
+		}
+	}
+
+	quotes := []*Quote{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		at, err := parseTime(record[columns["time"]])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		price, err := strconv.ParseFloat(record[columns["price"]], 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid price %q", line, record[columns["price"]])
+		}
+
+		quotes = append(quotes, &Quote{
+			Base:        record[columns["base"]],
+			Quote:       record[columns["quote"]],
+			Time:        at,
+			Granularity: strings.ToLower(record[columns["granularity"]]),
+			Price:       price,
+		})
+	}
+
+	if err := s.Add(quotes...); err != nil {
+		return 0, err
+	}
+
+	return len(quotes), nil
+}
+
+// LoadDir loads every .csv file in the provided directory into the store (see LoadCSV), returning how many prices were added.
+// A directory that doesn't exist simply has no prices in it.
+func (s *Store) LoadDir(dir string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return total, err
+		}
+
+		n, err := s.LoadCSV(f)
+		f.Close()
+
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", path, err)
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// parseTime parses the timestamps accepted in price CSVs
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, must be an RFC 3339 timestamp or a YYYY-MM-DD date", v)
+}
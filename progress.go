@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/blockchair"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+)
+
+// the types of sync event, named as the Server-Sent Events they're streamed as
+const (
+	syncEventStarted          = "sync.started"          // the sync knows how many transactions it has to fetch
+	syncEventBatchFetched     = "batch.fetched"         // a batch of transactions was fetched from Blockchair
+	syncEventRateLimitWait    = "rate_limit.wait"       // Blockchair rate limited us, the sync is waiting it out
+	syncEventRateLimitResumed = "rate_limit.resumed"    // the wait is over
+	syncEventTxnsInserted     = "transactions.inserted" // the fetched transactions were written, pending the commit
+	syncEventTransfer         = "transfer.detected"     // transfer detection linked a new transfer
+	syncEventFinished         = "sync.finished"         // the sync committed
+	syncEventFailed           = "sync.failed"           // the sync failed, committing nothing
+)
+
+// SyncEvent is a step of a sync, reported as it happens to whoever is following it (see withSyncEvents). A sync that's
+// retried (e.g. after its Spanner transaction was aborted) starts over, reporting its steps again.
+type SyncEvent struct {
+	Type    string      `json:"type"`
+	At      time.Time   `json:"at"`
+	Address string      `json:"address,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// SyncStartedEventData is the data of sync.started events
+type SyncStartedEventData struct {
+	Transactions int `json:"transactions"` // the new transactions to fetch
+	Batches      int `json:"batches"`      // the batches they're fetched in
+	Reorged      int `json:"reorged"`      // the stored transactions to remove
+}
+
+// BatchEventData is the data of batch.fetched events
+type BatchEventData struct {
+	Batch        int `json:"batch"` // 1-indexed
+	Batches      int `json:"batches"`
+	Transactions int `json:"transactions"` // in this batch
+}
+
+// RateLimitWaitEventData is the data of rate_limit.wait events
+type RateLimitWaitEventData struct {
+	Until time.Time `json:"until"`   // when the wait is expected to end
+	Wait  float64   `json:"wait_ms"` // how long that is from now
+}
+
+// RateLimitResumedEventData is the data of rate_limit.resumed events
+type RateLimitResumedEventData struct {
+	Waited float64 `json:"waited_ms"`
+}
+
+// TxnsInsertedEventData is the data of transactions.inserted events
+type TxnsInsertedEventData struct {
+	Transactions int `json:"transactions"`
+	Reorged      int `json:"reorged"`
+}
+
+// SyncFailedEventData is the data of sync.failed events
+type SyncFailedEventData struct {
+	Error string `json:"error"`
+}
+
+const (
+	// streamWriteTimeout bounds each write of an event stream, in place of the server's writeTimeout
+	streamWriteTimeout = 30 * time.Second
+
+	// jobEventsPoll is how often a job's event stream checks for events recorded since the last ones it sent
+	jobEventsPoll = time.Second
+
+	// jobEventsKeepAlive is how long a job's event stream can go without an event before it sends a comment, so
+	// proxies don't take it for a dead connection
+	jobEventsKeepAlive = 15 * time.Second
+)
+
+// syncEventsContextKey is the context key of the function sync events are reported to
+type syncEventsContextKey struct{}
+
+// withSyncEvents returns a copy of the provided context reporting the events of the syncs run with it (including
+// Blockchair's rate limit waits) to the provided function
+func withSyncEvents(ctx context.Context, f func(*SyncEvent)) context.Context {
+	ctx = context.WithValue(ctx, syncEventsContextKey{}, f)
+
+	return blockchair.WithRateLimitHooks(ctx, &blockchair.RateLimitHooks{
+		Started: func(until time.Time) {
+			now := time.Now().UTC()
+			f(&SyncEvent{Type: syncEventRateLimitWait, At: now, Data: &RateLimitWaitEventData{Until: until.UTC(), Wait: milliseconds(until.Sub(now))}})
+		},
+		Ended: func(waited time.Duration, err error) {
+			if err == nil {
+				f(&SyncEvent{Type: syncEventRateLimitResumed, At: time.Now().UTC(), Data: &RateLimitResumedEventData{Waited: milliseconds(waited)}})
+			}
+		},
+	})
+}
+
+// reportSyncEvent reports an event of the sync of the provided address, if anyone's following it
+func reportSyncEvent(ctx context.Context, eventType, addr string, data interface{}) {
+	if f, ok := ctx.Value(syncEventsContextKey{}).(func(*SyncEvent)); ok {
+		f(&SyncEvent{Type: eventType, At: time.Now().UTC(), Address: addr, Data: data})
+	}
+}
+
+// wantsEventStream reports whether a request asked to follow its sync as Server-Sent Events, via Accept:
+// text/event-stream
+func wantsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.HasPrefix(strings.TrimSpace(accept), "text/event-stream") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamSync answers the request with a stream of the events of the provided sync as it runs, ending with either
+// sync.finished or sync.failed. If the request asked to (with ?detect_transfers=true), the provided user's transfers
+// are detected once the sync has committed, streaming the new ones found.
+func streamSync(w http.ResponseWriter, r *http.Request, s *spanner.Client, userID, addr string, run func(ctx context.Context) (*AddressesRecord, error)) {
+	flusher, ok := startEventStream(r.Context(), w)
+	if !ok {
+		http.Error(w, "could not stream the sync's events", http.StatusInternalServerError)
+		return
+	}
+
+	log := logging.FromContext(r.Context())
+
+	// events are reported synchronously by the sync, so they're written in order by this one goroutine
+	var id int64
+	ctx := withSyncEvents(r.Context(), func(event *SyncEvent) {
+		id++
+		if err := writeEvent(r.Context(), w, id, event); err != nil {
+			log.Debug("could not stream sync event", "event", event.Type, "error", err)
+			return
+		}
+
+		flusher.Flush()
+	})
+
+	address, err := run(ctx)
+	if err != nil {
+		reportSyncEvent(ctx, syncEventFailed, addr, &SyncFailedEventData{Error: err.Error()})
+		return
+	}
+
+	if detect, _ := strconv.ParseBool(r.URL.Query().Get("detect_transfers")); detect && len(userID) > 0 {
+		if _, err := detectUserTransfers(ctx, s, userID); err != nil {
+			// the sync itself committed, so it's still reported as finished
+			log.Warn("could not detect transfers after sync", "user_id", userID, "error", err)
+		}
+	}
+
+	reportSyncEvent(ctx, syncEventFinished, addr, &SyncResponse{Address: address})
+}
+
+// JobEventsHandler returns a closure responsible for streaming the events of the job in the request path as
+// Server-Sent Events: the events its sync reported so far, then each one as it's recorded, ending with job.finished
+// once the job is done. A stream resumes after the event named by its Last-Event-ID header, so EventSource picks up
+// where it left off when it reconnects; reconnecting after job.finished answers with a 204, which stops it.
+func JobEventsHandler(s *spanner.Client, readiness *health.Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logging.FromContext(ctx)
+
+		jobID := mux.Vars(r)["job"]
+
+		var after int64
+		if v := r.Header.Get("Last-Event-ID"); len(v) > 0 {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id < 0 {
+				http.Error(w, "Last-Event-ID must be the id of an event of the job's stream", http.StatusBadRequest)
+				return
+			}
+			after = id
+		}
+
+		job, events, err := readJobEvents(ctx, s, jobID, after)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get events of job %s. %v", jobID, err), statusFromErr(err))
+			return
+		}
+
+		// job.finished follows the job's last event, so a client past it has seen the whole stream
+		if job.Finished() && len(events) == 0 && after > 0 {
+			last, err := lastJobEventSeq(ctx, s.Single(), jobID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not get events of job %s. %v", jobID, err), statusFromErr(err))
+				return
+			}
+
+			if after > last {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		flusher, ok := startEventStream(ctx, w)
+		if !ok {
+			http.Error(w, "could not stream the job's events", http.StatusInternalServerError)
+			return
+		}
+
+		ticker := time.NewTicker(jobEventsPoll)
+		defer ticker.Stop()
+
+		quietSince := time.Now()
+		for {
+			for _, v := range events {
+				if err := writeRawEvent(ctx, w, v.Seq, v.Type, []byte(v.Event)); err != nil {
+					log.Debug("could not stream job event", "event", v.Type, "error", err)
+					return
+				}
+
+				after = v.Seq
+			}
+
+			if job.Finished() {
+				event := &SyncEvent{Type: jobEventFinished, At: job.FinishedAt.Time, Address: job.Address, Data: newJobResponse(job)}
+				if err := writeEvent(ctx, w, after+1, event); err != nil {
+					log.Debug("could not stream job event", "event", event.Type, "error", err)
+				}
+
+				flusher.Flush()
+				return
+			}
+
+			// e.g. while the job waits out Blockchair's rate limit, a comment keeps proxies from closing the stream
+			switch {
+			case len(events) > 0:
+				quietSince = time.Now()
+			case time.Since(quietSince) >= jobEventsKeepAlive:
+				extendWriteDeadline(ctx)
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+
+				quietSince = time.Now()
+			}
+
+			flusher.Flush()
+
+			// the client reconnects to another instance, resuming after the last event it got
+			if readiness.ShuttingDown() {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			job, events, err = readJobEvents(ctx, s, jobID, after)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn("could not read job events", "job_id", jobID, "error", err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// startEventStream starts answering the request with a stream of Server-Sent Events, returning the flusher to send
+// each one with (false if the response can't be streamed, in which case nothing was written)
+func startEventStream(ctx context.Context, w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // or proxies like nginx hold the events back
+	extendWriteDeadline(ctx)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return flusher, true
+}
+
+// connContextKey is the context key of the connection a request came in on
+type connContextKey struct{}
+
+// withConn returns a copy of the provided context carrying the provided connection, as the server's ConnContext, so
+// that event streams can move its write deadline
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// extendWriteDeadline gives the next write to the stream answering the request of the provided context
+// streamWriteTimeout. A stream lasts as long as what it follows, which can be longer than the server's writeTimeout
+// (set on the connection for each request, bounding its whole response), so its deadline moves with each write. The
+// server resets the deadline for the connection's next request.
+func extendWriteDeadline(ctx context.Context) {
+	conn, ok := ctx.Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		logging.FromContext(ctx).Debug("could not extend stream write deadline", "error", err)
+	}
+}
+
+// writeEvent writes the provided event in the Server-Sent Events format
+func writeEvent(ctx context.Context, w http.ResponseWriter, id int64, event *SyncEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return writeRawEvent(ctx, w, id, event.Type, data)
+}
+
+// writeRawEvent writes an event of the provided type, with the provided (JSON-encoded) data, in the Server-Sent Events
+// format
+func writeRawEvent(ctx context.Context, w http.ResponseWriter, id int64, eventType string, data []byte) error {
+	extendWriteDeadline(ctx)
+
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, eventType, data)
+	return err
+}
+
+// milliseconds returns the provided duration in (fractional) milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
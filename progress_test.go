@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+)
+
+func TestEventStreamOutlivesWriteTimeout(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := startEventStream(r.Context(), w)
+		if !ok {
+			t.Error("startEventStream() could not stream")
+			return
+		}
+
+		for i := int64(1); i <= 3; i++ {
+			time.Sleep(150 * time.Millisecond)
+
+			if err := writeRawEvent(r.Context(), w, i, "batch.fetched", []byte(`{}`)); err != nil {
+				t.Errorf("writeRawEvent(%d) error = %v", i, err)
+				return
+			}
+
+			flusher.Flush()
+		}
+	})
+
+	// configured like the server (see ListenAndServe), through the same middleware as every route
+	srv := httptest.NewUnstartedServer(logging.Middleware(logging.New(ioutil.Discard, logging.LevelInfo))(instrumentRoutes(handler)))
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Config.ConnContext = withConn
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the stream failed after %q: %v", body, err)
+	}
+
+	if got := strings.Count(string(body), "event: batch.fetched"); got != 3 {
+		t.Errorf("stream had %d events, want 3:\n%s", got, body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"github.com/jf2978/cointracker-eng-assignment/config"
+	"github.com/jf2978/cointracker-eng-assignment/migrations"
+)
+
+// newMigrator returns a migrator for the configured storage backend, along with a func closing its clients. Only a
+// migrator that can change the schema (e.g. for the migrate command) needs an admin client; checking it doesn't.
+func newMigrator(ctx context.Context, cfg config.StorageConfig, admin bool) (*migrations.Migrator, func(), error) {
+	switch cfg.Backend {
+	case "spanner":
+		client, err := newSpannerClient(ctx, cfg.Spanner)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var adminClient *database.DatabaseAdminClient
+		if admin {
+			adminClient, err = database.NewDatabaseAdminClient(ctx, spannerOptions(cfg.Spanner)...)
+			if err != nil {
+				client.Close()
+				return nil, nil, err
+			}
+		}
+
+		closeClients := func() {
+			client.Close()
+			if adminClient != nil {
+				adminClient.Close()
+			}
+		}
+
+		migrator, err := migrations.NewMigrator(migrations.NewSpannerDriver(client, adminClient, cfg.Spanner.DatabasePath()))
+		if err != nil {
+			closeClients()
+			return nil, nil, err
+		}
+
+		return migrator, closeClients, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported storage backend %q", cfg.Backend)
+	}
+}
+
+// checkSchema returns an error (wrapping migrations.ErrOutdated if it's behind) unless the Spanner database the
+// provided client reads from has every migration applied, and nothing more
+func checkSchema(ctx context.Context, cfg config.StorageConfig, s *spanner.Client) error {
+	migrator, err := migrations.NewMigrator(migrations.NewSpannerDriver(s, nil, cfg.Spanner.DatabasePath()))
+	if err != nil {
+		return err
+	}
+
+	return migrator.Check(ctx)
+}
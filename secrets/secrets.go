@@ -0,0 +1,99 @@
+// Package secrets seals values we have to be able to read back (unlike our own API keys, which are only ever hashed),
+// e.g. the API credentials of connected exchange accounts, with AES-256-GCM under a configured key.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size of a key, in bytes
+const KeySize = 32
+
+// sealedPrefix marks sealed values (and the version of their format), telling them apart from ones stored before they
+// were sealed
+const sealedPrefix = "sealed:v1:"
+
+// the errors returned by Box
+var (
+	ErrInvalidKey = fmt.Errorf("key must be %d bytes, base64-encoded", KeySize)
+	ErrNotSealed  = errors.New("value is not sealed")
+	ErrTampered   = errors.New("sealed value is corrupt, or was sealed under another key or context")
+)
+
+// Box seals & opens values under a single key. It's safe for concurrent use.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a base64-encoded key (e.g. generated with `openssl rand -base64 32`)
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// New returns a new Box sealing values under the provided key
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts the provided value, bound to the provided context (e.g. the ID of the row it's stored in, so it can't
+// be copied to another one): it can only be opened with the same context
+func (b *Box) Seal(value, context string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(value), []byte(context))
+
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed with the provided context
+func (b *Box) Open(sealed, context string) (string, error) {
+	if !IsSealed(sealed) {
+		return "", ErrNotSealed
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", ErrTampered
+	}
+
+	nonce, ciphertext := raw[:b.aead.NonceSize()], raw[b.aead.NonceSize():]
+	value, err := b.aead.Open(nil, nonce, ciphertext, []byte(context))
+	if err != nil {
+		return "", ErrTampered
+	}
+
+	return string(value), nil
+}
+
+// IsSealed reports whether the provided value was sealed, rather than stored as is
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
@@ -0,0 +1,81 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		encoded string
+		wantErr bool
+	}{
+		{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, KeySize)), false},
+		{" " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, KeySize)) + "\n", false},
+		{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)), true},
+		{"not base64!", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseKey(tt.encoded); (err != nil) != tt.wantErr {
+			t.Errorf("ParseKey(%q) = %v, want error: %v", tt.encoded, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	box, err := New(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := New(bytes.Repeat([]byte{2}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("api-secret", "account-1:api_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsSealed(sealed) {
+		t.Fatalf("IsSealed(%q) = false, want true", sealed)
+	}
+
+	if again, _ := box.Seal("api-secret", "account-1:api_secret"); again == sealed {
+		t.Errorf("sealing the same value twice returned the same output %q", sealed)
+	}
+
+	tests := []struct {
+		name    string
+		box     *Box
+		sealed  string
+		context string
+		want    string
+		wantErr error
+	}{
+		{"same key & context", box, sealed, "account-1:api_secret", "api-secret", nil},
+		{"other context", box, sealed, "account-2:api_secret", "", ErrTampered},
+		{"other key", other, sealed, "account-1:api_secret", "", ErrTampered},
+		{"truncated", box, sealed[:len(sealed)-4], "account-1:api_secret", "", ErrTampered},
+		{"not base64", box, sealedPrefix + "!!", "account-1:api_secret", "", ErrTampered},
+		{"plaintext", box, "api-secret", "account-1:api_secret", "", ErrNotSealed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.box.Open(tt.sealed, tt.context)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Open() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("Open() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
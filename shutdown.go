@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+)
+
+const (
+	// http server timeouts; writes get the longest since a sync can wait out Blockchair's rate limit (see
+	// blockchair.DefaultRateLimitWait) before it responds. event streams move their deadline with each event instead
+	// (see extendWriteDeadline), since they last as long as what they follow.
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 3 * time.Minute
+	idleTimeout       = 2 * time.Minute
+
+	// shutdownDelay is how long we keep serving after a SIGTERM while reporting unready, so that load balancers stop
+	// routing requests to us before we stop accepting them
+	shutdownDelay = 5 * time.Second
+
+	// shutdownTimeout bounds how long we wait for in-flight requests and background jobs to finish before cancelling them
+	shutdownTimeout = 30 * time.Second
+)
+
+// ListenAndServe serves the server's routes on the provided address alongside its background jobs, until it's sent a
+// SIGTERM or SIGINT. It then drains in-flight requests and background jobs before returning, cancelling whatever is
+// still running after shutdownTimeout.
+func (server *Server) ListenAndServe(addr string) error {
+	log := server.logger
+
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           logging.Middleware(server.logger)(server.router),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+
+		// every request's context derives from the server's, so that cancelling it aborts whatever didn't drain
+		BaseContext: func(net.Listener) context.Context { return server.context },
+
+		// event streams move the write deadline of their connection (see extendWriteDeadline)
+		ConnContext: withConn,
+	}
+
+	stop := make(chan struct{})
+	jobsDone := make(chan struct{})
+
+	go func() {
+		defer close(jobsDone)
+
+		deliveryDone := make(chan struct{})
+		go func() {
+			defer close(deliveryDone)
+
+			if server.webhookDelivery != nil {
+				server.webhooks.deliverWebhooksEvery(server.context, stop, server.webhookDelivery)
+			}
+		}()
+
+		runnerDone := make(chan struct{})
+		go func() {
+			defer close(runnerDone)
+
+			if server.asyncJobs != nil {
+				server.jobs.runJobsEvery(server.context, stop, server.asyncJobs)
+			}
+		}()
+
+		if server.exchangeSync != nil {
+			syncExchangeAccountsEvery(server.context, stop, server.spanner, server.connectors, server.credentials, server.exchangeSync)
+		}
+
+		<-deliveryDone
+		<-runnerDone
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Info("listening", "addr", addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		close(stop)
+		server.cancel()
+		<-jobsDone
+		return err
+	case sig = <-signals:
+	}
+
+	log.Info("shutting down", "signal", sig.String())
+	server.readiness.MarkShuttingDown()
+
+	// an interrupt is someone at a terminal rather than an orchestrator, so there's no load balancer to wait for
+	if sig == syscall.SIGTERM {
+		time.Sleep(shutdownDelay)
+	}
+
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Warn("could not drain in-flight requests, closing their connections", "error", err)
+		httpServer.Close()
+	}
+
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		log.Warn("could not drain background jobs, cancelling them", "error", ctx.Err())
+	}
+
+	// cancels whatever's left, e.g. a sync that outlived its connection
+	server.cancel()
+	server.spanner.Close()
+
+	log.Info("shut down")
+
+	return nil
+}
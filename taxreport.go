@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+	"github.com/jf2978/cointracker-eng-assignment/taxreport"
+)
+
+// GetTaxReportHandler returns a closure responsible for invoking taxReport() for the user in the request path,
+// returning either the full report as JSON (default) or just its Form 8949-style CSV (format=csv)
+func GetTaxReportHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+		query := r.URL.Query()
+
+		year, err := strconv.Atoi(query.Get("year"))
+		if err != nil {
+			http.Error(w, "year is required and must be an integer", http.StatusBadRequest)
+			return
+		}
+
+		currency := defaultCurrency
+		if v := query.Get("currency"); v != "" {
+			currency = strings.ToUpper(v)
+		}
+
+		format := query.Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "format must be one of: json, csv", http.StatusBadRequest)
+			return
+		}
+
+		report, err := taxReport(ctx, s, p, userID, year, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not build tax report for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		if format != "csv" {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"form-8949-%d.csv\"", year))
+		w.WriteHeader(http.StatusOK)
+
+		if err := report.WriteCSV(w); err != nil {
+			logging.FromContext(r.Context()).Error("could not write tax report", "user_id", userID, "error", err)
+		}
+	})
+}
+
+// taxReport builds the Form 8949-style report of the provided user's disposals in the provided tax year
+func taxReport(ctx context.Context, s *spanner.Client, p prices.Provider, userID string, year int, currency string) (*taxreport.Report, error) {
+	_, result, err := computeGains(ctx, s, p, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return taxreport.New(year, currency, result.Realized), nil
+}
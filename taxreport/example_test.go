@@ -0,0 +1,38 @@
+package taxreport_test
+
+import (
+	"os"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/gains"
+	"github.com/jf2978/cointracker-eng-assignment/taxreport"
+)
+
+func Example() {
+	bought := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	result, err := gains.Compute([]*gains.Event{
+		{ID: "buy1", Asset: "BTC", Time: bought, Quantity: 1, Price: 5000},
+		{ID: "buy2", Asset: "BTC", Time: bought.AddDate(0, 6, 0), Quantity: 1, Price: 10000},
+		{ID: "sell", Asset: "BTC", Time: bought.AddDate(1, 1, 0), Quantity: -1.25, Price: 60000},
+		{ID: "spend", Asset: "BTC", Time: bought.AddDate(1, 3, 0), Quantity: -0.5, Price: 55000},
+	}, gains.FIFO, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	report := taxreport.New(2021, "USD", result.Realized)
+
+	report.WriteCSV(os.Stdout)
+	report.WriteSummary(os.Stdout)
+
+	// Output:
+	// description,date acquired,date sold,proceeds,cost basis,gain or loss,term
+	// 0.25 BTC,09/15/2020,04/15/2021,15000.00,2500.00,12500.00,short
+	// 0.5 BTC,09/15/2020,06/15/2021,27500.00,5000.00,22500.00,short
+	// 1 BTC,03/15/2020,04/15/2021,60000.00,5000.00,55000.00,long
+	// 2021 tax year (USD)
+	//   short-term: 2 disposals, proceeds 42500.00, cost basis 7500.00, gain 35000.00
+	//   long-term: 1 disposals, proceeds 60000.00, cost basis 5000.00, gain 55000.00
+	// no transactions are missing price or cost basis data
+}
@@ -0,0 +1,185 @@
+package taxreport
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/gains"
+)
+
+const (
+	// holding periods
+	ShortTerm = "short"
+	LongTerm  = "long"
+
+	// dateFormat is the date format used on Form 8949
+	dateFormat = "01/02/2006"
+)
+
+// Report represents a Form 8949-style report of the disposals made in a single tax year
+type Report struct {
+	Year     int        `json:"year"`
+	Currency string     `json:"currency"`
+	Rows     []*Row     `json:"rows"`
+	Summary  []*Summary `json:"summary"`
+	Missing  []*Missing `json:"missing"` // transactions whose rows are unreliable for lack of data
+}
+
+// Row represents a single line of the report, i.e. (part of) a disposal matched against a single lot
+type Row struct {
+	EventID     string    `json:"event_id"`
+	Description string    `json:"description"`
+	Acquired    time.Time `json:"acquired"`
+	Sold        time.Time `json:"sold"`
+	Proceeds    float64   `json:"proceeds"`
+	CostBasis   float64   `json:"cost_basis"`
+	Gain        float64   `json:"gain"`
+	Term        string    `json:"term"` // "short" or "long"
+}
+
+// Summary represents the totals of the report for a single holding period
+type Summary struct {
+	Term      string  `json:"term"`
+	Count     int     `json:"count"`
+	Proceeds  float64 `json:"proceeds"`
+	CostBasis float64 `json:"cost_basis"`
+	Gain      float64 `json:"gain"`
+}
+
+// Missing represents a transaction in the report we lack the price or cost basis data to report accurately
+type Missing struct {
+	EventID      string `json:"event_id"`
+	MissingPrice bool   `json:"missing_price"`
+	MissingBasis bool   `json:"missing_basis"`
+}
+
+// New builds the report of the provided realizations disposed of in the provided year
+func New(year int, currency string, realized []*gains.Realization) *Report {
+	report := &Report{
+		Year:     year,
+		Currency: currency,
+		Rows:     []*Row{},
+		Summary: []*Summary{
+			{Term: ShortTerm},
+			{Term: LongTerm},
+		},
+		Missing: []*Missing{},
+	}
+
+	missing := map[string]*Missing{}
+
+	for _, v := range realized {
+		if v.Disposed.Year() != year {
+			continue
+		}
+
+		row := &Row{
+			EventID:     v.EventID,
+			Description: fmt.Sprintf("%s %s", strconv.FormatFloat(v.Quantity, 'f', -1, 64), v.Asset),
+			Acquired:    v.Acquired,
+			Sold:        v.Disposed,
+			Proceeds:    v.Proceeds,
+			CostBasis:   v.CostBasis,
+			Gain:        v.Gain,
+			Term:        ShortTerm,
+		}
+
+		summary := report.Summary[0]
+		if v.LongTerm {
+			row.Term = LongTerm
+			summary = report.Summary[1]
+		}
+
+		summary.Count++
+		summary.Proceeds += row.Proceeds
+		summary.CostBasis += row.CostBasis
+		summary.Gain += row.Gain
+
+		report.Rows = append(report.Rows, row)
+
+		if v.MissingPrice || v.MissingBasis {
+			m, ok := missing[v.EventID]
+			if !ok {
+				m = &Missing{EventID: v.EventID}
+				missing[v.EventID] = m
+				report.Missing = append(report.Missing, m)
+			}
+
+			m.MissingPrice = m.MissingPrice || v.MissingPrice
+			m.MissingBasis = m.MissingBasis || v.MissingBasis
+		}
+	}
+
+	// Form 8949 lists short-term disposals (Part I) before long-term ones (Part II)
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		if report.Rows[i].Term != report.Rows[j].Term {
+			return report.Rows[i].Term == ShortTerm
+		}
+
+		return report.Rows[i].Sold.Before(report.Rows[j].Sold)
+	})
+
+	return report
+}
+
+// WriteCSV writes the rows of the report as a Form 8949-style CSV
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+
+	header := []string{"description", "date acquired", "date sold", "proceeds", "cost basis", "gain or loss", "term"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, v := range r.Rows {
+		record := []string{
+			v.Description,
+			v.Acquired.UTC().Format(dateFormat),
+			v.Sold.UTC().Format(dateFormat),
+			money(v.Proceeds),
+			money(v.CostBasis),
+			money(v.Gain),
+			v.Term,
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteSummary writes a plain-text summary of the report's totals per holding period, and of the data it's missing
+func (r *Report) WriteSummary(w io.Writer) error {
+	fmt.Fprintf(w, "%d tax year (%s)\n", r.Year, r.Currency)
+
+	for _, v := range r.Summary {
+		fmt.Fprintf(w, "  %s-term: %d disposals, proceeds %s, cost basis %s, gain %s\n",
+			v.Term, v.Count, money(v.Proceeds), money(v.CostBasis), money(v.Gain))
+	}
+
+	if len(r.Missing) == 0 {
+		_, err := fmt.Fprintln(w, "no transactions are missing price or cost basis data")
+		return err
+	}
+
+	fmt.Fprintf(w, "%d transactions are missing data:\n", len(r.Missing))
+	for _, v := range r.Missing {
+		if _, err := fmt.Fprintf(w, "  %s (missing price: %t, missing basis: %t)\n", v.EventID, v.MissingPrice, v.MissingBasis); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// money formats an amount of fiat to the cent
+func money(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
@@ -0,0 +1,77 @@
+package taxreport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/gains"
+)
+
+// report returns the report of something bought at the provided time and sold at the other
+func report(t *testing.T, bought, sold time.Time) *Report {
+	t.Helper()
+
+	result, err := gains.Compute([]*gains.Event{
+		{ID: "buy", Asset: "BTC", Time: bought, Quantity: 1, Price: 100},
+		{ID: "sell", Asset: "BTC", Time: sold, Quantity: -1, Price: 200},
+	}, gains.FIFO, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(sold.Year(), "USD", result.Realized)
+}
+
+func TestHoldingPeriod(t *testing.T) {
+	bought := time.Date(2020, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	terms := map[time.Time]string{
+		bought.AddDate(0, 6, 0):                      ShortTerm,
+		bought.AddDate(1, 0, 0):                      ShortTerm, // the anniversary
+		bought.AddDate(1, 0, 0).Add(time.Hour):       ShortTerm, // a year and an hour, still on the anniversary
+		bought.AddDate(1, 0, 1):                      LongTerm,
+		bought.AddDate(1, 0, 1).Add(-10 * time.Hour): LongTerm, // midnight after the anniversary
+	}
+
+	for sold, want := range terms {
+		rows := report(t, bought, sold).Rows
+		if len(rows) != 1 || rows[0].Term != want {
+			t.Errorf("sold at %s: rows %+v, want one %s-term", sold, rows, want)
+		}
+	}
+}
+
+func TestNewLeavesOutOtherYears(t *testing.T) {
+	bought := time.Date(2020, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	result, err := gains.Compute([]*gains.Event{
+		{ID: "buy", Asset: "BTC", Time: bought, Quantity: 1, Price: 100},
+		{ID: "sell", Asset: "BTC", Time: bought.AddDate(0, 6, 0), Quantity: -1, Price: 200},
+	}, gains.FIFO, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := New(2021, "USD", result.Realized); len(r.Rows) != 0 {
+		t.Errorf("New() for 2021 rows = %+v, want none from 2020", r.Rows)
+	}
+}
+
+func TestNewListsMissingDataOncePerTransaction(t *testing.T) {
+	disposed := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	r := New(2021, "USD", []*gains.Realization{
+		{EventID: "a", Asset: "BTC", Disposed: disposed, Quantity: 0.25, Proceeds: 10, Gain: 10, MissingBasis: true},
+		{EventID: "a", Asset: "BTC", Disposed: disposed, Quantity: 0.1, Proceeds: 4, Gain: 4, MissingBasis: true, MissingPrice: true},
+		{EventID: "b", Asset: "BTC", Disposed: disposed, Quantity: 0.5, Proceeds: 20, CostBasis: 5, Gain: 15},
+		{EventID: "c", Asset: "BTC", Disposed: disposed.AddDate(-1, 0, 0), Quantity: 0.5, MissingPrice: true},
+	})
+
+	if len(r.Missing) != 1 {
+		t.Fatalf("New() missing = %+v, want a alone", r.Missing)
+	}
+
+	if m := r.Missing[0]; m.EventID != "a" || !m.MissingBasis || !m.MissingPrice {
+		t.Errorf("New() missing = %+v, want a missing both its basis & price", m)
+	}
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// SpanData is the snapshot of an ended span handed to exporters
+type SpanData struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"` // empty for the root span of a trace
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Exporter ships ended spans somewhere they can be looked at, e.g. stdout or a tracing backend.
+// Export is called synchronously as each span ends, so implementations shipping spans over the network should buffer.
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+// noopExporter drops every span, which is the default until SetExporter is called
+type noopExporter struct{}
+
+// Export drops the span
+func (noopExporter) Export(*SpanData) {}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter = noopExporter{}
+)
+
+// SetExporter sets the exporter every sampled span is handed to once it ends (nil drops them)
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	if e == nil {
+		e = noopExporter{}
+	}
+
+	exporter = e
+}
+
+// currentExporter returns the exporter set by SetExporter
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return exporter
+}
+
+// JSONExporter writes each span as a JSON object on its own line, e.g. to stdout when running locally
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns an exporter writing spans to the provided writer
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// Export writes the span
+func (e *JSONExporter) Export(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.enc.Encode(span)
+}
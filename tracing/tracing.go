@@ -0,0 +1,266 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of a request, see https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace, i.e. every span of a request across services
+type TraceID [16]byte
+
+// String returns the trace ID as lowercase hex
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a single span within a trace
+type SpanID [8]byte
+
+// String returns the span ID as lowercase hex
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that's propagated to its children, including across services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool // whether the trace's spans should be exported
+}
+
+// IsValid reports whether both IDs are set (the spec forbids all-zero IDs)
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value, e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// future versions may append fields, but must keep these first four as they are
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) || !isLowerHex(version) {
+		return sc, fmt.Errorf("unsupported traceparent version in %q", s)
+	}
+
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 || !isLowerHex(traceID+spanID+flags) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	hex.Decode(sc.TraceID[:], []byte(traceID))
+	hex.Decode(sc.SpanID[:], []byte(spanID))
+
+	var f [1]byte
+	hex.Decode(f[:], []byte(flags))
+	sc.Sampled = f[0]&1 == 1
+
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	return sc, nil
+}
+
+// isLowerHex reports whether the string only holds lowercase hex digits, as the spec requires
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Span times a single operation, e.g. a handler or a call to a provider, along with some attributes describing it.
+// Every method is a no-op on a nil span.
+type Span struct {
+	mu      sync.Mutex
+	name    string
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+	attrs   map[string]interface{}
+	err     string
+	ended   bool
+}
+
+// spanKey is the context key the current span is stored under
+type spanKey struct{}
+
+// remoteKey is the context key the span context of a caller (see Extract) is stored under
+type remoteKey struct{}
+
+// Start starts a span as a child of the span in the provided context (or of the remote caller's span, see Extract),
+// starting a new trace if there's neither. The returned context carries the new span.
+func Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	span := &Span{name: name, start: time.Now(), attrs: map[string]interface{}{}}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parent = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+
+	rand.Read(span.context.SpanID[:])
+	span.SetAttributes(kv...)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span carried by the provided context, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns a copy of the provided context carrying the provided span, so that the spans started from
+// it are its children
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Extract returns a copy of the provided context carrying the caller's span context from the provided headers (if
+// any), so that the spans started from it join the caller's trace
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span in the provided context (if any), so that
+// the callee can join its trace
+func Inject(ctx context.Context, h http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set(TraceparentHeader, span.context.Traceparent())
+	}
+}
+
+// Context returns the span's context
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.context
+}
+
+// SetName renames the span, e.g. once a handler's route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.name = name
+}
+
+// SetAttributes adds the provided key/value pairs to the span's attributes
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+}
+
+// SetError marks the span as failed with the provided error (a nil error is ignored)
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// End ends the span, exporting it if its trace is sampled. Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	end := time.Now()
+
+	attrs := make(map[string]interface{}, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+
+	data := &SpanData{
+		Name:       s.name,
+		TraceID:    s.context.TraceID.String(),
+		SpanID:     s.context.SpanID.String(),
+		Start:      s.start,
+		End:        end,
+		DurationMS: float64(end.Sub(s.start)) / float64(time.Millisecond),
+		Attributes: attrs,
+		Error:      s.err,
+	}
+
+	if s.parent != (SpanID{}) {
+		data.ParentID = s.parent.String()
+	}
+
+	sampled := s.context.Sampled
+	s.mu.Unlock()
+
+	if sampled {
+		currentExporter().Export(data)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+const (
+	defaultTxnPageSize = 50
+	maxTxnPageSize     = 500
+
+	// sort keys
+	sortByTimestamp = "timestamp"
+	sortByAmount    = "amount"
+
+	// directions a transaction can flow relative to an address
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// sortColumns maps each supported sort key to the column it orders by
+var sortColumns = map[string]string{
+	sortByTimestamp: "txn_timestamp",
+	sortByAmount:    "amount",
+}
+
+// TxnQuery represents the pagination, filtering and sorting options for listing an address' transactions,
+// parsed from the query parameters: cursor, limit, from, to, min_amount, max_amount, direction, tag, sort & order
+type TxnQuery struct {
+	Cursor    *TxnCursor
+	Limit     int       // 0 for every matching transaction, in a single page (see GetTransactionsHandler)
+	From      time.Time // inclusive
+	To        time.Time // exclusive
+	MinAmount *float64  // in USD
+	MaxAmount *float64  // in USD
+	Direction string    // "in" or "out" relative to the address
+	Tag       string
+	Sort      string // "timestamp" or "amount"
+	Desc      bool
+}
+
+// TxnCursor represents the position of the last transaction returned in a page, encoded as an opaque string for clients.
+// It also records the ordering & filters of the query it was handed out for, as it points nowhere meaningful in another.
+type TxnCursor struct {
+	Sort         string    `json:"s"`
+	Desc         bool      `json:"d,omitempty"`
+	Filters      string    `json:"f"` // see TxnQuery.filtersHash
+	TxnTimestamp time.Time `json:"t"`
+	Amount       float64   `json:"a,omitempty"`
+	TxnHash      string    `json:"h"`
+}
+
+// Encode returns the opaque string representation of this cursor handed out to clients
+func (c *TxnCursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeTxnCursor parses a cursor previously returned by TxnCursor.Encode
+func decodeTxnCursor(encoded string) (*TxnCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var c TxnCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &c, nil
+}
+
+// parseTxnQuery parses and validates the TxnQuery options from the provided query parameters,
+// defaulting to the newest transactions first in pages of 50
+func parseTxnQuery(values url.Values) (*TxnQuery, error) {
+	q := &TxnQuery{
+		Limit: defaultTxnPageSize,
+		Sort:  sortByTimestamp,
+		Desc:  true,
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTxnPageSize {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %d", maxTxnPageSize)
+		}
+		q.Limit = limit
+	}
+
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := values.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+			}
+			*dst = t
+		}
+	}
+
+	for param, dst := range map[string]**float64{"min_amount": &q.MinAmount, "max_amount": &q.MaxAmount} {
+		if v := values.Get(param); v != "" {
+			amount, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", param)
+			}
+			*dst = &amount
+		}
+	}
+
+	switch q.Direction = values.Get("direction"); q.Direction {
+	case "", directionIn, directionOut:
+	default:
+		return nil, fmt.Errorf("direction must be one of: %s, %s", directionIn, directionOut)
+	}
+
+	q.Tag = values.Get("tag")
+
+	if v := values.Get("sort"); v != "" {
+		if _, ok := sortColumns[v]; !ok {
+			return nil, fmt.Errorf("sort must be one of: %s, %s", sortByTimestamp, sortByAmount)
+		}
+		q.Sort = v
+	}
+
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return nil, fmt.Errorf("order must be one of: asc, desc")
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeTxnCursor(v)
+		if err != nil {
+			return nil, err
+		}
+
+		// a cursor only points somewhere meaningful in the ordering & filters it was handed out for
+		switch {
+		case cursor.Sort != q.Sort:
+			return nil, fmt.Errorf("cursor was issued for sort=%s", cursor.Sort)
+		case cursor.Desc != q.Desc:
+			return nil, fmt.Errorf("cursor was issued for order=%s", sortOrder(cursor.Desc))
+		case cursor.Filters != q.filtersHash():
+			return nil, fmt.Errorf("cursor was issued for other filters (from, to, min_amount, max_amount, direction & tag must stay the same)")
+		}
+		q.Cursor = cursor
+	}
+
+	return q, nil
+}
+
+// filtersHash returns a digest of the filters of this TxnQuery, so a cursor can tell whether it's used with the ones it
+// was handed out for without carrying them all
+func (q *TxnQuery) filtersHash() string {
+	amount := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	filters := []string{timestamp(q.From), timestamp(q.To), amount(q.MinAmount), amount(q.MaxAmount), q.Direction, q.Tag}
+
+	sum := sha256.Sum256([]byte(strings.Join(filters, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sortOrder returns the value of the order query parameter for the provided direction
+func sortOrder(desc bool) string {
+	if desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// statement builds the query selecting the page of the provided address' transactions described by this TxnQuery
+// note: we select one more row than the limit so we know whether there's a next page
+func (q *TxnQuery) statement(addr string) spanner.Statement {
+	column := sortColumns[q.Sort]
+
+	order, cmp := "ASC", ">"
+	if q.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	conditions := []string{"public_key = @address"}
+	params := map[string]interface{}{
+		"address": addr,
+	}
+
+	limit := ""
+	if q.Limit > 0 {
+		limit = "LIMIT @limit"
+		params["limit"] = int64(q.Limit + 1)
+	}
+
+	if !q.From.IsZero() {
+		conditions = append(conditions, "txn_timestamp >= @from")
+		params["from"] = q.From
+	}
+
+	if !q.To.IsZero() {
+		conditions = append(conditions, "txn_timestamp < @to")
+		params["to"] = q.To
+	}
+
+	if q.MinAmount != nil {
+		conditions = append(conditions, "amount >= @min_amount")
+		params["min_amount"] = *q.MinAmount
+	}
+
+	if q.MaxAmount != nil {
+		conditions = append(conditions, "amount <= @max_amount")
+		params["max_amount"] = *q.MaxAmount
+	}
+
+	switch q.Direction {
+	case directionIn:
+		conditions = append(conditions, "balance_change > 0")
+	case directionOut:
+		conditions = append(conditions, "balance_change < 0")
+	}
+
+	if q.Tag != "" {
+		conditions = append(conditions, "@tag IN UNNEST(SPLIT(tags, ','))")
+		params["tag"] = q.Tag
+	}
+
+	// keyset pagination: continue strictly after the (sort value, txn hash) of the last row returned
+	if q.Cursor != nil {
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s @cursor_value OR (%[1]s = @cursor_value AND txn_hash %[2]s @cursor_hash))", column, cmp))
+		params["cursor_hash"] = q.Cursor.TxnHash
+
+		if q.Sort == sortByAmount {
+			params["cursor_value"] = q.Cursor.Amount
+		} else {
+			params["cursor_value"] = q.Cursor.TxnTimestamp
+		}
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT txn_hash, public_key, amount, fee, COALESCE(native_fee, 0) AS native_fee, COALESCE(balance_change, 0) AS balance_change,
+			COALESCE(price, 0) AS price, COALESCE(tags, '') AS tags, txn_timestamp, created_at
+		FROM transactions
+		WHERE %s
+		ORDER BY %s %s, txn_hash %s
+		%s
+	`, strings.Join(conditions, " AND "), column, order, order, limit)
+
+	return spanner.Statement{SQL: sql, Params: params}
+}
+
+// listTransactions reads the page of stored transactions for the provided address matching the provided query without syncing it,
+// returning the cursor for the next page (empty if this is the last one)
+func listTransactions(ctx context.Context, s *spanner.Client, addr string, q *TxnQuery) ([]*TransactionsRecord, string, error) {
+	ctx, span := tracing.Start(ctx, "spanner.list_transactions", "address", addr, "limit", q.Limit)
+	defer span.End()
+
+	// make sure we 404 on addresses we aren't tracking rather than returning an empty list
+	if _, err := readAddress(ctx, s, addr); err != nil {
+		return nil, "", err
+	}
+
+	txnsRecs := []*TransactionsRecord{}
+
+	iter := s.Single().Query(ctx, q.statement(addr))
+	err := iter.Do(func(row *spanner.Row) error {
+		var rec TransactionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		txnsRecs = append(txnsRecs, &rec)
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if q.Limit == 0 || len(txnsRecs) <= q.Limit {
+		return txnsRecs, "", nil
+	}
+
+	txnsRecs = txnsRecs[:q.Limit]
+	last := txnsRecs[len(txnsRecs)-1]
+
+	next := &TxnCursor{Sort: q.Sort, Desc: q.Desc, Filters: q.filtersHash(), TxnHash: last.TxnHash}
+	if q.Sort == sortByAmount {
+		next.Amount = last.Amount
+	} else {
+		next.TxnTimestamp = last.TxnTimestamp
+	}
+
+	return txnsRecs, next.Encode(), nil
+}
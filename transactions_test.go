@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTxnQuery(t *testing.T) {
+	amount := 10.5
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		want    *TxnQuery
+		wantErr string
+	}{
+		{
+			name:  "defaults",
+			query: "",
+			want:  &TxnQuery{Limit: defaultTxnPageSize, Sort: sortByTimestamp, Desc: true},
+		},
+		{
+			name:  "every option",
+			query: "limit=10&from=2021-01-01T00:00:00Z&min_amount=10.5&direction=in&tag=rent&sort=amount&order=asc",
+			want:  &TxnQuery{Limit: 10, From: from, MinAmount: &amount, Direction: directionIn, Tag: "rent", Sort: sortByAmount},
+		},
+		{name: "limit too high", query: "limit=501", wantErr: "limit must be an integer between 1 and 500"},
+		{name: "limit not a number", query: "limit=ten", wantErr: "limit must be an integer"},
+		{name: "invalid from", query: "from=2021-01-01", wantErr: "from must be an RFC 3339 timestamp"},
+		{name: "invalid amount", query: "max_amount=lots", wantErr: "max_amount must be a number"},
+		{name: "invalid direction", query: "direction=sideways", wantErr: "direction must be one of"},
+		{name: "invalid sort", query: "sort=fee", wantErr: "sort must be one of"},
+		{name: "invalid order", query: "order=random", wantErr: "order must be one of"},
+		{name: "invalid cursor", query: "cursor=not-a-cursor", wantErr: "invalid cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+
+			got, err := parseTxnQuery(values)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseTxnQuery(%q) error = %v, want it to contain %q", tt.query, err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseTxnQuery(%q) error = %v", tt.query, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTxnQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTxnCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		issued  string // the query the cursor was handed out for
+		next    string // the query it's then used with
+		wantErr string
+	}{
+		{name: "same query", issued: "sort=amount", next: "sort=amount"},
+		{name: "another page size", issued: "limit=10", next: "limit=20"},
+		{name: "same filters spelled differently", issued: "min_amount=10&from=2021-01-01T00:00:00Z", next: "min_amount=10.0&from=2021-01-01T01:00:00%2B01:00"},
+		{name: "another sort", issued: "sort=amount", next: "sort=timestamp", wantErr: "cursor was issued for sort=amount"},
+		{name: "another order", issued: "order=asc", next: "order=desc", wantErr: "cursor was issued for order=asc"},
+		{name: "a filter added", issued: "direction=in", next: "direction=in&tag=rent", wantErr: "cursor was issued for other filters"},
+		{name: "a filter changed", issued: "from=2021-01-01T00:00:00Z", next: "from=2021-02-01T00:00:00Z", wantErr: "cursor was issued for other filters"},
+		{name: "a filter removed", issued: "max_amount=100", next: "", wantErr: "cursor was issued for other filters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued, _ := url.ParseQuery(tt.issued)
+			q, err := parseTxnQuery(issued)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cursor := &TxnCursor{
+				Sort:         q.Sort,
+				Desc:         q.Desc,
+				Filters:      q.filtersHash(),
+				TxnTimestamp: time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC),
+				Amount:       123.45,
+				TxnHash:      "abc123",
+			}
+
+			next, _ := url.ParseQuery(tt.next)
+			next.Set("cursor", cursor.Encode())
+
+			got, err := parseTxnQuery(next)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseTxnQuery() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseTxnQuery() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got.Cursor, cursor) {
+				t.Errorf("decoded cursor = %+v, want %+v", got.Cursor, cursor)
+			}
+		})
+	}
+}
+
+func TestTxnQueryStatementLimit(t *testing.T) {
+	page := (&TxnQuery{Limit: 10, Sort: sortByTimestamp, Desc: true}).statement("bc1qa")
+	if !strings.Contains(page.SQL, "LIMIT @limit") || page.Params["limit"] != int64(11) {
+		t.Errorf("a page of 10 should select 11 rows, got %q with %v", page.SQL, page.Params)
+	}
+
+	// the deprecated /transactions route's full history
+	all := (&TxnQuery{Sort: sortByTimestamp, Desc: true}).statement("bc1qa")
+	if strings.Contains(all.SQL, "LIMIT") {
+		t.Errorf("a query without a limit should select every row, got %q", all.SQL)
+	}
+	if _, ok := all.Params["limit"]; ok {
+		t.Errorf("a query without a limit shouldn't have a limit param, got %v", all.Params)
+	}
+}
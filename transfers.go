@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/webhooks"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// transferTag is added to the tags of transactions that are (one side of) a transfer between a user's own wallets
+	transferTag = "transfer"
+
+	// transferWindow is how long after a withdrawal from (or to) an exchange its deposit can arrive, e.g. while the
+	// exchange waits for confirmations
+	transferWindow = 6 * time.Hour
+
+	// transferSlippage is the share of such a withdrawal that can go missing in transit beyond its recorded fee
+	// (e.g. a network fee the exchange doesn't report)
+	transferSlippage = 0.01
+)
+
+// TransfersRecord is the data model for a respective row in the 'transfers' table stored in Spanner,
+// linking the two sides of a transfer between a user's own wallets
+type TransfersRecord struct {
+	OutID      string    `spanner:"out_id"` // pk, the activity ID of the withdrawing side
+	InID       string    `spanner:"in_id"`  // the activity ID of the depositing side
+	UserID     string    `spanner:"user_id"`
+	DetectedAt time.Time `spanner:"detected_at"`
+}
+
+// DetectUserTransfersHandler returns a closure responsible for invoking detectUserTransfers() for the user in the request path
+func DetectUserTransfersHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID := mux.Vars(r)["user"]
+
+		transfers, err := detectUserTransfers(ctx, s, userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not detect transfers for user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, transfers)
+	})
+}
+
+// userTransfers runs detectTransfers() over the provided activity, then matchOffchainTransfers() over whatever it left
+// unmatched, returning a map from withdrawing -> depositing activity IDs
+func userTransfers(acts []*activity) (map[string]string, error) {
+	txns := []*CustomTxn{}
+	for _, v := range acts {
+		// detectTransfers() pairs sides on their USD value, which imported & manual activity priced in another currency
+		// (or not at all) doesn't have
+		if v.AmountUSD == 0 {
+			continue
+		}
+
+		txns = append(txns, v.customTxn())
+	}
+
+	transfers, err := detectTransfers(txns)
+	if err != nil {
+		return nil, err
+	}
+
+	matchOffchainTransfers(acts, transfers)
+
+	return transfers, nil
+}
+
+// matchOffchainTransfers adds the transfers to or from an exchange among the provided (time-ordered) activity to the
+// provided transfers. unlike on-chain transfers, both sides are recorded separately & at different times, so a withdrawal
+// is matched with the first deposit of the same asset into another wallet within transferWindow that's worth what was
+// withdrawn net of fees.
+func matchOffchainTransfers(acts []*activity, transfers map[string]string) {
+	matched := map[string]bool{}
+	for outID, inID := range transfers {
+		matched[outID] = true
+		matched[inID] = true
+	}
+
+	for _, out := range acts {
+		if out.Quantity >= 0 || matched[out.ID] {
+			continue
+		}
+
+		withdrawn := -out.Quantity
+		expected := withdrawn - out.Fee
+
+		for _, in := range acts {
+			if in.Quantity <= 0 || matched[in.ID] || in.Wallet == out.Wallet || in.Asset != out.Asset {
+				continue
+			}
+
+			// transfers between addresses are already matched on-chain
+			if in.onchain() && out.onchain() {
+				continue
+			}
+
+			if in.Time.Before(out.Time) || in.Time.Sub(out.Time) > transferWindow {
+				continue
+			}
+
+			if in.Quantity > withdrawn+dust || in.Quantity < expected*(1-transferSlippage) {
+				continue
+			}
+
+			transfers[out.ID] = in.ID
+			matched[out.ID] = true
+			matched[in.ID] = true
+			break
+		}
+	}
+}
+
+// detectUserTransfers detects the transfers between the provided user's wallets from their stored activity,
+// saving the links between both sides and tagging the transactions involved. Links saved by an earlier detection that
+// no longer holds (e.g. since a reorg, or a manual transaction was edited) are deleted, and their sides untagged.
+func detectUserTransfers(ctx context.Context, s *spanner.Client, userID string) (map[string]string, error) {
+	var transfers map[string]string
+	var detected []*TransferEventData
+
+	_, err := readWriteTransaction(ctx, s, "detect_transfers", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		detected = nil
+
+		user, err := readUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		acts, err := readUserActivity(ctx, txn, user)
+		if err != nil {
+			return err
+		}
+
+		transfers, err = userTransfers(acts)
+		if err != nil {
+			return err
+		}
+
+		saved, err := readUserTransfers(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		mutations := []*spanner.Mutation{}
+
+		for outID, inID := range transfers {
+			if saved[outID] != inID {
+				if err := queueTransferEvent(ctx, txn, userID, outID, inID); err != nil {
+					return err
+				}
+
+				detected = append(detected, &TransferEventData{OutID: outID, InID: inID})
+			}
+
+			mut, err := spanner.InsertOrUpdateStruct(transfersTable, &TransfersRecord{
+				OutID:      outID,
+				InID:       inID,
+				UserID:     userID,
+				DetectedAt: now,
+			})
+			if err != nil {
+				return err
+			}
+
+			mutations = append(mutations, mut)
+
+			for _, id := range []string{outID, inID} {
+				mut, err := tagActivity(ctx, txn, id, transferTag)
+				if err != nil {
+					return err
+				}
+
+				if mut != nil {
+					mutations = append(mutations, mut)
+				}
+			}
+		}
+
+		unlinked, untagged := staleTransfers(saved, transfers)
+		for _, outID := range unlinked {
+			mutations = append(mutations, spanner.Delete(transfersTable, spanner.Key{outID}))
+		}
+
+		// another user's transfer can still have the same side (e.g. both added the address)
+		stillLinked, err := linkedElsewhere(ctx, txn, userID, untagged)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range untagged {
+			if stillLinked[id] {
+				continue
+			}
+
+			mut, err := untagActivity(ctx, txn, id, transferTag)
+			if err != nil {
+				return err
+			}
+
+			if mut != nil {
+				mutations = append(mutations, mut)
+			}
+		}
+
+		return txn.BufferWrite(mutations)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	transferMatches.Add(float64(len(transfers)), "user")
+	logging.FromContext(ctx).Info("detected transfers", "user_id", userID, "transfers", len(transfers))
+
+	// only once they're saved, since a retried transaction detects them all over again
+	for _, transfer := range detected {
+		reportSyncEvent(ctx, syncEventTransfer, "", transfer)
+	}
+
+	return transfers, nil
+}
+
+// readUserTransfers reads the transfers saved for the provided user, as a map from withdrawing -> depositing activity IDs
+func readUserTransfers(ctx context.Context, txn querier, userID string) (map[string]string, error) {
+	stmt := spanner.NewStatement(`SELECT out_id, in_id FROM transfers WHERE user_id = @user_id`)
+	stmt.Params["user_id"] = userID
+
+	transfers := map[string]string{}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var outID, inID string
+		if err := row.Columns(&outID, &inID); err != nil {
+			return err
+		}
+
+		transfers[outID] = inID
+		return nil
+	})
+
+	return transfers, err
+}
+
+// staleTransfers compares the transfers saved for a user with the ones just detected, returning the withdrawing sides of
+// the saved links to delete (relinked ones are overwritten instead) and the activity IDs that are no longer a side of
+// any transfer, whose tag goes with them
+func staleTransfers(saved, detected map[string]string) (unlinked []string, untagged []string) {
+	linked := map[string]bool{}
+	for outID, inID := range detected {
+		linked[outID] = true
+		linked[inID] = true
+	}
+
+	unlinked, untagged = []string{}, []string{}
+	for outID, inID := range saved {
+		if detected[outID] == inID {
+			continue
+		}
+
+		if _, ok := detected[outID]; !ok {
+			unlinked = append(unlinked, outID)
+		}
+
+		for _, id := range []string{outID, inID} {
+			if !linked[id] {
+				untagged = append(untagged, id)
+				linked[id] = true // only once
+			}
+		}
+	}
+
+	sort.Strings(unlinked)
+	sort.Strings(untagged)
+
+	return unlinked, untagged
+}
+
+// linkedElsewhere reports which of the provided activity IDs are a side of a transfer saved for a user other than the
+// provided one
+func linkedElsewhere(ctx context.Context, txn querier, userID string, ids []string) (map[string]bool, error) {
+	linked := map[string]bool{}
+	if len(ids) == 0 {
+		return linked, nil
+	}
+
+	stmt := spanner.NewStatement(`SELECT out_id, in_id FROM transfers WHERE user_id != @user_id AND (out_id IN UNNEST(@ids) OR in_id IN UNNEST(@ids))`)
+	stmt.Params["user_id"] = userID
+	stmt.Params["ids"] = ids
+
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var outID, inID string
+		if err := row.Columns(&outID, &inID); err != nil {
+			return err
+		}
+
+		linked[outID] = true
+		linked[inID] = true
+		return nil
+	})
+
+	return linked, err
+}
+
+// queueTransferEvent queues the transfer.detected event of a newly detected transfer, for the user's subscriptions to
+// all of their addresses or to the address of either side
+func queueTransferEvent(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, outID, inID string) error {
+	addrs := []string{}
+	for _, id := range []string{outID, inID} {
+		if _, addr, ok := parseOnchainActivityID(id); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	event, err := newWebhookEvent(webhooks.EventTransferDetected, "", &TransferEventData{OutID: outID, InID: inID})
+	if err != nil {
+		return err
+	}
+
+	return enqueueWebhookEvent(ctx, txn, event, userID, addrs)
+}
+
+// tagActivity returns the mutation adding the provided tag to the transaction behind the provided activity ID
+// (nil if it's already tagged, or isn't an on-chain transaction)
+func tagActivity(ctx context.Context, txn *spanner.ReadWriteTransaction, id, tag string) (*spanner.Mutation, error) {
+	txnHash, addr, ok := parseOnchainActivityID(id)
+	if !ok {
+		return nil, nil
+	}
+
+	row, err := txn.ReadRow(ctx, transactionsTable, spanner.Key{txnHash, addr}, []string{"tags"})
+	if err != nil {
+		return nil, err
+	}
+
+	var tags spanner.NullString
+	if err := row.Column(0, &tags); err != nil {
+		return nil, err
+	}
+
+	tagList := []string{}
+	for _, v := range strings.Split(tags.StringVal, ",") {
+		if v == tag {
+			return nil, nil
+		}
+
+		if len(v) > 0 {
+			tagList = append(tagList, v)
+		}
+	}
+
+	return spanner.Update(transactionsTable,
+		[]string{"txn_hash", "public_key", "tags"},
+		[]interface{}{txnHash, addr, strings.Join(append(tagList, tag), ",")},
+	), nil
+}
+
+// untagActivity returns the mutation removing the provided tag from the transaction behind the provided activity ID
+// (nil if it isn't tagged, or isn't an on-chain transaction we still have)
+func untagActivity(ctx context.Context, txn *spanner.ReadWriteTransaction, id, tag string) (*spanner.Mutation, error) {
+	txnHash, addr, ok := parseOnchainActivityID(id)
+	if !ok {
+		return nil, nil
+	}
+
+	row, err := txn.ReadRow(ctx, transactionsTable, spanner.Key{txnHash, addr}, []string{"tags"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tags spanner.NullString
+	if err := row.Column(0, &tags); err != nil {
+		return nil, err
+	}
+
+	tagged := false
+	tagList := []string{}
+	for _, v := range strings.Split(tags.StringVal, ",") {
+		if v == tag {
+			tagged = true
+			continue
+		}
+
+		if len(v) > 0 {
+			tagList = append(tagList, v)
+		}
+	}
+
+	if !tagged {
+		return nil, nil
+	}
+
+	return spanner.Update(transactionsTable,
+		[]string{"txn_hash", "public_key", "tags"},
+		[]interface{}{txnHash, addr, strings.Join(tagList, ",")},
+	), nil
+}
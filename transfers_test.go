@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchOffchainTransfers(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// a 1 BTC withdrawal from Kraken (paying a 0.0005 fee) & the on-chain deposit it should match, changed by each scenario
+	match := func(change func(deposit *activity)) map[string]string {
+		withdrawal := &activity{ID: "import:kraken:w1", Wallet: "kraken", Asset: "BTC", Time: start, Quantity: -1.0005, Fee: 0.0005}
+		deposit := &activity{ID: "onchain:t1:bc1qa", Wallet: "bc1qa", Asset: "BTC", Time: start.Add(30 * time.Minute), Quantity: 1}
+		change(deposit)
+
+		acts := []*activity{withdrawal, deposit}
+		if deposit.Time.Before(withdrawal.Time) {
+			acts = []*activity{deposit, withdrawal}
+		}
+
+		transfers := map[string]string{}
+		matchOffchainTransfers(acts, transfers)
+		return transfers
+	}
+
+	matched := map[string]func(*activity){
+		"as withdrawn":                     func(*activity) {},
+		"short of the fee within slippage": func(d *activity) { d.Quantity = 0.995 },
+	}
+
+	for name, change := range matched {
+		if got := match(change); !reflect.DeepEqual(got, map[string]string{"import:kraken:w1": "onchain:t1:bc1qa"}) {
+			t.Errorf("deposit %s: matchOffchainTransfers() = %v, want it matched", name, got)
+		}
+	}
+
+	unmatched := map[string]func(*activity){
+		"too small":             func(d *activity) { d.Quantity = 0.9 },
+		"larger than withdrawn": func(d *activity) { d.Quantity = 1.1 },
+		"after the window":      func(d *activity) { d.Time = start.Add(7 * time.Hour) },
+		"before the withdrawal": func(d *activity) { d.Time = start.Add(-30 * time.Minute) },
+		"of another asset":      func(d *activity) { d.Asset = "ETH" },
+		"into the same wallet":  func(d *activity) { d.ID, d.Wallet = "import:kraken:d1", "kraken" },
+	}
+
+	for name, change := range unmatched {
+		if got := match(change); len(got) > 0 {
+			t.Errorf("deposit %s: matchOffchainTransfers() = %v, want no match", name, got)
+		}
+	}
+}
+
+func TestMatchOffchainTransfersLeavesOnchainPairs(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	withdrawal := &activity{ID: "import:kraken:w1", Wallet: "kraken", Asset: "BTC", Time: start, Quantity: -1.0005, Fee: 0.0005}
+	sent := &activity{ID: "onchain:t0:bc1qz", Wallet: "bc1qz", Asset: "BTC", Time: start.Add(20 * time.Minute), Quantity: -1}
+	first := &activity{ID: "onchain:t1:bc1qa", Wallet: "bc1qa", Asset: "BTC", Time: start.Add(30 * time.Minute), Quantity: 1}
+	second := &activity{ID: "onchain:t2:bc1qb", Wallet: "bc1qb", Asset: "BTC", Time: start.Add(40 * time.Minute), Quantity: 1}
+
+	// both sides on-chain are left to detectTransfers
+	transfers := map[string]string{}
+	matchOffchainTransfers([]*activity{sent, first}, transfers)
+	if len(transfers) > 0 {
+		t.Errorf("matchOffchainTransfers() of an on-chain pair = %v, want none", transfers)
+	}
+
+	// a deposit detectTransfers already matched isn't matched again, & the withdrawal goes to the next one
+	transfers = map[string]string{sent.ID: first.ID}
+	matchOffchainTransfers([]*activity{withdrawal, sent, first, second}, transfers)
+	if want := map[string]string{sent.ID: first.ID, withdrawal.ID: second.ID}; !reflect.DeepEqual(transfers, want) {
+		t.Errorf("matchOffchainTransfers() = %v, want %v", transfers, want)
+	}
+
+	// otherwise the first matching deposit wins
+	transfers = map[string]string{}
+	matchOffchainTransfers([]*activity{withdrawal, first, second}, transfers)
+	if want := map[string]string{withdrawal.ID: first.ID}; !reflect.DeepEqual(transfers, want) {
+		t.Errorf("matchOffchainTransfers() = %v, want %v", transfers, want)
+	}
+}
+
+func TestUserTransfers(t *testing.T) {
+	at := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		acts []*activity
+		want map[string]string
+	}{
+		{
+			name: "same asset & value across wallets",
+			acts: []*activity{
+				{ID: "onchain:t1:bc1qa", Wallet: "bc1qa", Asset: "BTC", Time: at, Quantity: -1, AmountUSD: 30000},
+				{ID: "onchain:t1:bc1qb", Wallet: "bc1qb", Asset: "BTC", Time: at, Quantity: 1, AmountUSD: 30000},
+			},
+			want: map[string]string{"onchain:t1:bc1qa": "onchain:t1:bc1qb"},
+		},
+		{
+			name: "same value in two assets",
+			acts: []*activity{
+				{ID: "import:kraken:w1", Wallet: "kraken", Asset: "ETH", Time: at, Quantity: -10, AmountUSD: 30000},
+				{ID: "manual:m1", Wallet: "ledger", Asset: "BTC", Time: at, Quantity: 1, AmountUSD: 30000},
+			},
+			want: map[string]string{},
+		},
+		{
+			// e.g. a Kraken withdrawal priced in EUR and a receipt entered by hand without a value
+			name: "unpriced in two assets",
+			acts: []*activity{
+				{ID: "import:kraken:w1", Wallet: "kraken", Asset: "ETH", Time: at, Quantity: -10, Price: 1500, Currency: "EUR"},
+				{ID: "manual:m1", Wallet: "ledger", Asset: "BTC", Time: at, Quantity: 1},
+			},
+			want: map[string]string{},
+		},
+		{
+			name: "unpriced in the same asset",
+			acts: []*activity{
+				{ID: "manual:m1", Wallet: "ledger", Asset: "BTC", Time: at, Quantity: -1},
+				{ID: "manual:m2", Wallet: "trezor", Asset: "BTC", Time: at, Quantity: 2},
+			},
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userTransfers(tt.acts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userTransfers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleTransfers(t *testing.T) {
+	saved := map[string]string{
+		"onchain:t1:bc1qa": "onchain:t1:bc1qb", // still detected
+		"onchain:t2:bc1qa": "onchain:t2:bc1qc", // reorged away
+		"import:kraken:w1": "manual:m1",        // the manual receipt was edited, the withdrawal now matches another one
+	}
+
+	detected := map[string]string{
+		"onchain:t1:bc1qa": "onchain:t1:bc1qb",
+		"import:kraken:w1": "onchain:t3:bc1qc",
+	}
+
+	unlinked, untagged := staleTransfers(saved, detected)
+
+	if want := []string{"onchain:t2:bc1qa"}; !reflect.DeepEqual(unlinked, want) {
+		t.Errorf("staleTransfers() unlinked = %v, want %v", unlinked, want)
+	}
+
+	if want := []string{"manual:m1", "onchain:t2:bc1qa", "onchain:t2:bc1qc"}; !reflect.DeepEqual(untagged, want) {
+		t.Errorf("staleTransfers() untagged = %v, want %v", untagged, want)
+	}
+
+	// nothing saved is stale when it's all detected again
+	unlinked, untagged = staleTransfers(detected, detected)
+	if len(unlinked) > 0 || len(untagged) > 0 {
+		t.Errorf("staleTransfers() of the same transfers = %v, %v, want none", unlinked, untagged)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/gains"
+)
+
+// usersColumns lists the columns read into a UsersRecord, in the order readUser() decodes them
+var usersColumns = []string{"uuid", "username", "addresses", "cost_basis_method"}
+
+// UsersRecord is the data model for a respective row in the 'users' table stored in Spanner
+type UsersRecord struct {
+	UUID            string `spanner:"uuid"` // pk
+	Username        string `spanner:"username"`
+	Addresses       string `spanner:"addresses"`         // comma-delimited list of public keys
+	CostBasisMethod string `spanner:"cost_basis_method"` // how disposals consume lots, e.g. "fifo" (see gains.Method); empty means FIFO
+}
+
+// AddressList returns the user's addresses as a slice (skipping empty entries)
+func (u *UsersRecord) AddressList() []string {
+	addrs := []string{}
+	for _, v := range strings.Split(u.Addresses, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			addrs = append(addrs, v)
+		}
+	}
+
+	return addrs
+}
+
+// HasAddress reports whether the provided address belongs to this user
+func (u *UsersRecord) HasAddress(addr string) bool {
+	for _, v := range u.AddressList() {
+		if v == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateUserRequest represents the expected request body to '/v1/users'
+type CreateUserRequest struct {
+	Username string `json:"username"`
+}
+
+// UserResponse represents the expected response body to '/v1/users'
+type UserResponse struct {
+	User      *UsersRecord      `json:"user"`
+	Nicknames map[string]string `json:"nicknames,omitempty"` // the user's nicknames for their addresses, keyed by public key
+}
+
+// CreateUserHandler returns a closure responsible for validating the incoming request
+// and invoking createUser() to create a new user
+func CreateUserHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var userReq CreateUserRequest
+		if err := json.Unmarshal(body, &userReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if len(userReq.Username) == 0 {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		user, err := createUser(ctx, s, userReq.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, &UserResponse{User: user})
+	})
+}
+
+// GetUserHandler returns a closure responsible for reading the user in the request path
+func GetUserHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		user, err := readUser(ctx, s.Single(), userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		nicknames, err := readAddressNicknames(ctx, s.Single(), userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get nicknames of user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &UserResponse{User: user, Nicknames: nicknames})
+	})
+}
+
+// createUser creates a new user (with no addresses) under a randomly generated uuid
+func createUser(ctx context.Context, s *spanner.Client, username string) (*UsersRecord, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &UsersRecord{UUID: id, Username: username, CostBasisMethod: string(gains.FIFO)}
+
+	mut, err := spanner.InsertStruct(usersTable, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// rowReader is implemented by both read-only and read-write Spanner transactions
+type rowReader interface {
+	ReadRow(ctx context.Context, table string, key spanner.Key, columns []string) (*spanner.Row, error)
+}
+
+// readUser reads the UsersRecord for the provided uuid
+func readUser(ctx context.Context, txn rowReader, userID string) (*UsersRecord, error) {
+	row, err := txn.ReadRow(ctx, usersTable, spanner.Key{userID}, usersColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	// every column but the key is nullable, e.g. cost_basis_method is NULL for users created before it was introduced
+	var username, addresses, method spanner.NullString
+
+	user := UsersRecord{}
+	if err := row.Columns(&user.UUID, &username, &addresses, &method); err != nil {
+		return nil, err
+	}
+
+	user.Username, user.Addresses, user.CostBasisMethod = username.StringVal, addresses.StringVal, method.StringVal
+
+	return &user, nil
+}
+
+// attachAddresses appends the provided addresses to the user's list of addresses (skipping the ones already there).
+// They have to be attached all at once, since a transaction doesn't read back the writes it buffered.
+func attachAddresses(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, addrs ...string) error {
+	user, err := readUser(ctx, txn, userID)
+	if err != nil {
+		return err
+	}
+
+	list := user.AddressList()
+	for _, addr := range addrs {
+		if !user.HasAddress(addr) {
+			list = append(list, addr)
+		}
+	}
+
+	if len(list) == len(user.AddressList()) {
+		return nil
+	}
+
+	user.Addresses = strings.Join(list, ",")
+
+	return txn.BufferWrite([]*spanner.Mutation{
+		spanner.Update(usersTable, []string{"uuid", "addresses"}, []interface{}{user.UUID, user.Addresses}),
+	})
+}
+
+// addressUserIDs returns the IDs of the users with the provided address on their address list
+func addressUserIDs(ctx context.Context, txn querier, addr string) ([]string, error) {
+	stmt := spanner.NewStatement(`
+		SELECT uuid FROM users
+		WHERE EXISTS (SELECT 1 FROM UNNEST(SPLIT(addresses, ',')) AS a WHERE TRIM(a) = @address)`)
+	stmt.Params["address"] = addr
+
+	userIDs := []string{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var userID string
+		if err := row.Column(0, &userID); err != nil {
+			return err
+		}
+
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+// detachAddress returns the mutations removing the provided address from the address list of every user it's on
+func detachAddress(ctx context.Context, txn querier, addr string) ([]*spanner.Mutation, error) {
+	stmt := spanner.NewStatement(`
+		SELECT uuid, addresses FROM users
+		WHERE EXISTS (SELECT 1 FROM UNNEST(SPLIT(addresses, ',')) AS a WHERE TRIM(a) = @address)`)
+	stmt.Params["address"] = addr
+
+	mutations := []*spanner.Mutation{}
+
+	iter := txn.Query(ctx, stmt)
+	err := iter.Do(func(row *spanner.Row) error {
+		var user UsersRecord
+		if err := row.Columns(&user.UUID, &user.Addresses); err != nil {
+			return err
+		}
+
+		list := []string{}
+		for _, v := range user.AddressList() {
+			if v != addr {
+				list = append(list, v)
+			}
+		}
+
+		mutations = append(mutations, spanner.Update(usersTable, []string{"uuid", "addresses"}, []interface{}{user.UUID, strings.Join(list, ",")}))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mutations, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
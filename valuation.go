@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/prices"
+)
+
+// ImportPricesResponse represents the expected response body to '/v1/prices'
+type ImportPricesResponse struct {
+	Added int `json:"added"`
+}
+
+// RevalueResponse represents the expected response body to '/v1/addresses/{addr}/revalue'
+type RevalueResponse struct {
+	Currency string   `json:"currency"`
+	Revalued int      `json:"revalued"`
+	Missing  []string `json:"missing"` // hashes of the transactions we had no price for (left as they were)
+}
+
+// ImportPricesHandler returns a closure responsible for loading the CSV request body into the price store (see prices.Store.LoadCSV)
+func ImportPricesHandler(store *prices.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := store.LoadCSV(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not import prices. %v", err), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ImportPricesResponse{Added: n})
+	})
+}
+
+// GetPriceHandler returns a closure responsible for looking up the price of the pair in the request path at the requested time (default: now)
+func GetPriceHandler(p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		vars := mux.Vars(r)
+
+		at := time.Now()
+		if v := r.URL.Query().Get("at"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "at must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			at = t
+		}
+
+		quote, err := p.Price(ctx, vars["base"], vars["quote"], at)
+		if errors.Is(err, prices.ErrNoPrice) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, quote)
+	})
+}
+
+// RevalueHandler returns a closure responsible for invoking revalue() for the address in the request path
+func RevalueHandler(s *spanner.Client, p prices.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		addr := mux.Vars(r)["addr"]
+
+		currency := defaultCurrency
+		if v := r.URL.Query().Get("currency"); v != "" {
+			currency = strings.ToUpper(v)
+		}
+
+		revalueResp, err := revalue(ctx, s, p, addr, currency)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not revalue address %s. %v", addr, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, revalueResp)
+	})
+}
+
+// revalue recomputes the price every stored transaction of the provided address is valued at from our price history,
+// e.g. after importing better price data or to keep the books in another currency
+func revalue(ctx context.Context, s *spanner.Client, p prices.Provider, addr, currency string) (*RevalueResponse, error) {
+	var revalueResp *RevalueResponse
+
+	_, err := readWriteTransaction(ctx, s, "revalue_address", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		revalueResp = &RevalueResponse{Currency: currency, Missing: []string{}}
+
+		if _, err := txn.ReadRow(ctx, addressesTable, spanner.Key{addr}, []string{"public_key"}); err != nil {
+			return err
+		}
+
+		stmt := spanner.NewStatement(`SELECT txn_hash, txn_timestamp FROM transactions WHERE public_key = @address`)
+		stmt.Params["address"] = addr
+
+		mutations := []*spanner.Mutation{}
+
+		iter := txn.Query(ctx, stmt)
+		err := iter.Do(func(row *spanner.Row) error {
+			var txnHash string
+			var txnTimestamp time.Time
+			if err := row.Columns(&txnHash, &txnTimestamp); err != nil {
+				return err
+			}
+
+			quote, err := p.Price(ctx, btcAsset, currency, txnTimestamp)
+			if errors.Is(err, prices.ErrNoPrice) {
+				revalueResp.Missing = append(revalueResp.Missing, txnHash)
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			mutations = append(mutations, spanner.Update(transactionsTable,
+				[]string{"txn_hash", "public_key", "price", "price_currency", "price_source"},
+				[]interface{}{txnHash, addr, quote.Price, currency, quote.Source},
+			))
+			revalueResp.Revalued++
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return txn.BufferWrite(mutations)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return revalueResp, nil
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/gorilla/mux"
+	"github.com/jf2978/cointracker-eng-assignment/health"
+	"github.com/jf2978/cointracker-eng-assignment/logging"
+	"github.com/jf2978/cointracker-eng-assignment/webhooks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// webhook delivery statuses
+const (
+	deliveryPending   = "pending"   // due for (another) attempt at next_attempt_at
+	deliveryDelivered = "delivered" // accepted by the subscriber
+	deliveryFailed    = "failed"    // given up on after webhooks.MaxAttempts
+)
+
+const (
+	// webhookSecretPrefix starts every subscription's signing secret
+	webhookSecretPrefix = "whsec_"
+
+	// webhookBatchSize bounds how many due deliveries each run of the dispatcher sends
+	webhookBatchSize = 100
+
+	// webhookLease is how long a delivery being sent is held back from other dispatchers (e.g. on another instance),
+	// comfortably longer than a subscriber has to answer
+	webhookLease = 2 * webhooks.DefaultTimeout
+
+	// the default and maximum page size of the delivery log
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// the columns read into a WebhookSubscriptionsRecord & a WebhookDeliveriesRecord
+var (
+	webhookColumns  = []string{"subscription_id", "user_id", "address", "url", "secret", "event_types", "created_at"}
+	deliveryColumns = []string{
+		"subscription_id", "delivery_id", "event_id", "event_type", "payload", "status", "attempts", "next_attempt_at",
+		"last_attempt_at", "last_status_code", "last_error", "created_at", "delivered_at",
+	}
+)
+
+// WebhookSubscriptionsRecord is the data model for a respective row in the 'webhook_subscriptions' table stored in
+// Spanner: a URL the events of a user's addresses (or of one of them) are delivered to
+type WebhookSubscriptionsRecord struct {
+	SubscriptionID string             `spanner:"subscription_id"` // pk
+	UserID         string             `spanner:"user_id"`
+	Address        spanner.NullString `spanner:"address"` // null for every one of the user's addresses
+	URL            string             `spanner:"url"`
+	Secret         string             `spanner:"secret" json:"-"` // signs every delivery, returned once on creation
+	EventTypes     string             `spanner:"event_types"`     // comma-delimited, empty for all of them
+	CreatedAt      time.Time          `spanner:"created_at"`
+}
+
+// Wants reports whether the subscription is for the provided type of event
+func (w *WebhookSubscriptionsRecord) Wants(eventType string) bool {
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+
+	for _, v := range strings.Split(w.EventTypes, ",") {
+		if v == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookDeliveriesRecord is the data model for a respective row in the 'webhook_deliveries' table stored in Spanner,
+// logging the delivery of an event to a subscription (and its attempts so far)
+type WebhookDeliveriesRecord struct {
+	SubscriptionID string             `spanner:"subscription_id"` // pk
+	DeliveryID     string             `spanner:"delivery_id"`     // pk
+	EventID        string             `spanner:"event_id"`
+	EventType      string             `spanner:"event_type"`
+	Payload        string             `spanner:"payload" json:"-"` // the JSON-encoded webhooks.Event, sent as is on every attempt
+	Status         string             `spanner:"status"`           // pending, delivered or failed
+	Attempts       int64              `spanner:"attempts"`
+	NextAttemptAt  spanner.NullTime   `spanner:"next_attempt_at"`
+	LastAttemptAt  spanner.NullTime   `spanner:"last_attempt_at"`
+	LastStatusCode spanner.NullInt64  `spanner:"last_status_code"` // null if the last attempt got no response
+	LastError      spanner.NullString `spanner:"last_error"`
+	CreatedAt      time.Time          `spanner:"created_at"`
+	DeliveredAt    spanner.NullTime   `spanner:"delivered_at"`
+}
+
+// CreateWebhookRequest represents the expected request body to '/v1/users/{user}/webhooks'
+type CreateWebhookRequest struct {
+	URL        string   `json:"url"`
+	Address    string   `json:"address,omitempty"`     // only this one of the user's addresses, rather than all of them
+	EventTypes []string `json:"event_types,omitempty"` // defaults to every type
+}
+
+// CreateWebhookResponse represents the expected response body to '/v1/users/{user}/webhooks'
+type CreateWebhookResponse struct {
+	Webhook *WebhookSubscriptionsRecord `json:"webhook"`
+	Secret  string                      `json:"secret"` // the only time the signing secret is ever returned
+}
+
+// ListWebhooksResponse represents the expected response body to GET '/v1/users/{user}/webhooks'
+type ListWebhooksResponse struct {
+	Webhooks []*WebhookSubscriptionsRecord `json:"webhooks"`
+}
+
+// DeliveriesResponse represents the expected response body to '/v1/users/{user}/webhooks/{webhook}/deliveries'
+type DeliveriesResponse struct {
+	Deliveries []*WebhookDeliveriesRecord `json:"deliveries"`
+}
+
+// CreateWebhookHandler returns a closure responsible for validating the incoming request
+// and creating a webhook subscription for the user in the request path
+func CreateWebhookHandler(s *spanner.Client, sender *webhooks.Sender) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var webhookReq CreateWebhookRequest
+		if err := json.Unmarshal(body, &webhookReq); err != nil {
+			http.Error(w, "provided payload is not valid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := sender.CheckURL(ctx, webhookReq.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, v := range webhookReq.EventTypes {
+			if !webhooks.IsEventType(v) {
+				http.Error(w, fmt.Sprintf("unknown event type %q, must be one of: %s", v, strings.Join(webhooks.EventTypes, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, err := readUser(ctx, s.Single(), userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		if len(webhookReq.Address) > 0 && !user.HasAddress(webhookReq.Address) {
+			http.Error(w, fmt.Sprintf("address %s does not belong to user %s", webhookReq.Address, userID), http.StatusBadRequest)
+			return
+		}
+
+		webhook, secret, err := createWebhook(ctx, s, userID, &webhookReq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not create webhook. %v", err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, &CreateWebhookResponse{Webhook: webhook, Secret: secret})
+	})
+}
+
+// ListWebhooksHandler returns a closure responsible for listing the webhook subscriptions of the user in the request path
+func ListWebhooksHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID := mux.Vars(r)["user"]
+
+		stmt := spanner.NewStatement(fmt.Sprintf(`SELECT %s FROM webhook_subscriptions WHERE user_id = @user_id ORDER BY created_at`, strings.Join(webhookColumns, ", ")))
+		stmt.Params["user_id"] = userID
+
+		webhookRecs, err := queryWebhooks(ctx, s.Single(), stmt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list webhooks of user %s. %v", userID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &ListWebhooksResponse{Webhooks: webhookRecs})
+	})
+}
+
+// DeleteWebhookHandler returns a closure responsible for removing the webhook subscription in the request path (and
+// its delivery log)
+func DeleteWebhookHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, webhookID := mux.Vars(r)["user"], mux.Vars(r)["webhook"]
+
+		_, err := readWriteTransaction(ctx, s, "delete_webhook", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			if _, err := readUserWebhook(ctx, txn, userID, webhookID); err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{spanner.Delete(webhookSubscriptionsTable, spanner.Key{webhookID})})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not delete webhook %s. %v", webhookID, err), statusFromErr(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ListWebhookDeliveriesHandler returns a closure responsible for listing the delivery log of the webhook subscription
+// in the request path, newest first (optionally only those with a 'status', up to 'limit' of them)
+func ListWebhookDeliveriesHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, webhookID := mux.Vars(r)["user"], mux.Vars(r)["webhook"]
+
+		limit := defaultDeliveriesLimit
+		if v := r.URL.Query().Get("limit"); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDeliveriesLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxDeliveriesLimit), http.StatusBadRequest)
+				return
+			}
+
+			limit = n
+		}
+
+		conditions := []string{"subscription_id = @subscription_id"}
+		params := map[string]interface{}{"subscription_id": webhookID, "limit": limit}
+
+		if v := r.URL.Query().Get("status"); len(v) > 0 {
+			if v != deliveryPending && v != deliveryDelivered && v != deliveryFailed {
+				http.Error(w, fmt.Sprintf("status must be one of: %s, %s, %s", deliveryPending, deliveryDelivered, deliveryFailed), http.StatusBadRequest)
+				return
+			}
+
+			conditions = append(conditions, "status = @status")
+			params["status"] = v
+		}
+
+		txn := s.ReadOnlyTransaction()
+		defer txn.Close()
+
+		if _, err := readUserWebhook(ctx, txn, userID, webhookID); err != nil {
+			http.Error(w, fmt.Sprintf("could not get webhook %s. %v", webhookID, err), statusFromErr(err))
+			return
+		}
+
+		stmt := spanner.Statement{
+			SQL: fmt.Sprintf(`SELECT %s FROM webhook_deliveries WHERE %s ORDER BY created_at DESC LIMIT @limit`,
+				strings.Join(deliveryColumns, ", "), strings.Join(conditions, " AND ")),
+			Params: params,
+		}
+
+		deliveries := []*WebhookDeliveriesRecord{}
+		err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var rec WebhookDeliveriesRecord
+			if err := row.ToStruct(&rec); err != nil {
+				return err
+			}
+
+			deliveries = append(deliveries, &rec)
+			return nil
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list deliveries of webhook %s. %v", webhookID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &DeliveriesResponse{Deliveries: deliveries})
+	})
+}
+
+// PingWebhookHandler returns a closure responsible for queueing a ping event to the webhook subscription in the
+// request path, to test it
+func PingWebhookHandler(s *spanner.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, webhookID := mux.Vars(r)["user"], mux.Vars(r)["webhook"]
+
+		var delivery *WebhookDeliveriesRecord
+		_, err := readWriteTransaction(ctx, s, "ping_webhook", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			webhook, err := readUserWebhook(ctx, txn, userID, webhookID)
+			if err != nil {
+				return err
+			}
+
+			event, err := newWebhookEvent(webhooks.EventPing, "", map[string]string{"webhook_id": webhook.SubscriptionID})
+			if err != nil {
+				return err
+			}
+
+			delivery, err = newDelivery(webhook, event, time.Now())
+			if err != nil {
+				return err
+			}
+
+			mut, err := spanner.InsertStruct(webhookDeliveriesTable, delivery)
+			if err != nil {
+				return err
+			}
+
+			return txn.BufferWrite([]*spanner.Mutation{mut})
+		})
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not ping webhook %s. %v", webhookID, err), statusFromErr(err))
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, delivery)
+	})
+}
+
+// createWebhook creates a webhook subscription for the provided user, returning it along with its signing secret
+func createWebhook(ctx context.Context, s *spanner.Client, userID string, webhookReq *CreateWebhookRequest) (*WebhookSubscriptionsRecord, string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	webhook := &WebhookSubscriptionsRecord{
+		SubscriptionID: id,
+		UserID:         userID,
+		Address:        spanner.NullString{StringVal: webhookReq.Address, Valid: len(webhookReq.Address) > 0},
+		URL:            webhookReq.URL,
+		Secret:         webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(secret),
+		EventTypes:     strings.Join(webhookReq.EventTypes, ","),
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	mut, err := spanner.InsertStruct(webhookSubscriptionsTable, webhook)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := s.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		return nil, "", err
+	}
+
+	return webhook, webhook.Secret, nil
+}
+
+// readUserWebhook reads the provided user's webhook subscription with the provided ID, as if it didn't exist if it's
+// another user's
+func readUserWebhook(ctx context.Context, txn rowReader, userID, webhookID string) (*WebhookSubscriptionsRecord, error) {
+	row, err := txn.ReadRow(ctx, webhookSubscriptionsTable, spanner.Key{webhookID}, webhookColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhook WebhookSubscriptionsRecord
+	if err := row.ToStruct(&webhook); err != nil {
+		return nil, err
+	}
+
+	if webhook.UserID != userID {
+		return nil, status.Errorf(codes.NotFound, "webhook %s not found", webhookID)
+	}
+
+	return &webhook, nil
+}
+
+// queryWebhooks reads the webhook subscriptions returned by the provided statement
+func queryWebhooks(ctx context.Context, txn querier, stmt spanner.Statement) ([]*WebhookSubscriptionsRecord, error) {
+	webhookRecs := []*WebhookSubscriptionsRecord{}
+
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var rec WebhookSubscriptionsRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		webhookRecs = append(webhookRecs, &rec)
+		return nil
+	})
+
+	return webhookRecs, err
+}
+
+// newWebhookEvent returns a new event of the provided type about the provided address (if any), carrying the provided data
+func newWebhookEvent(eventType, addr string, data interface{}) (*webhooks.Event, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhooks.Event{ID: id, Type: eventType, CreatedAt: time.Now().UTC(), Address: addr, Data: data}, nil
+}
+
+// newDelivery returns the pending delivery of the provided event to the provided subscription, due at the provided time
+func newDelivery(webhook *WebhookSubscriptionsRecord, event *webhooks.Event, at time.Time) (*WebhookDeliveriesRecord, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	// each subscriber sees the event as their own user's
+	e := *event
+	e.UserID = webhook.UserID
+
+	payload, err := json.Marshal(&e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookDeliveriesRecord{
+		SubscriptionID: webhook.SubscriptionID,
+		DeliveryID:     id,
+		EventID:        event.ID,
+		EventType:      event.Type,
+		Payload:        string(payload),
+		Status:         deliveryPending,
+		NextAttemptAt:  spanner.NullTime{Time: at, Valid: true},
+		CreatedAt:      at,
+	}, nil
+}
+
+// enqueueWebhookEvent buffers a pending delivery of the provided event to every subscription it matches, as part of the
+// provided transaction (so that it's only ever sent if whatever it announces was committed). Events of a user (e.g. a
+// transfer) go to their subscriptions for all of their addresses or for one of the provided ones, while events of an
+// address go to every user with the address.
+func enqueueWebhookEvent(ctx context.Context, txn *spanner.ReadWriteTransaction, event *webhooks.Event, userID string, addrs []string) error {
+	var stmt spanner.Statement
+	if len(userID) > 0 {
+		stmt = spanner.NewStatement(fmt.Sprintf(`
+			SELECT %s
+			FROM webhook_subscriptions
+			WHERE user_id = @user_id AND (address IS NULL OR address IN UNNEST(@addresses))
+		`, strings.Join(webhookColumns, ", ")))
+		stmt.Params["user_id"] = userID
+	} else {
+		stmt = spanner.NewStatement(fmt.Sprintf(`
+			SELECT %s
+			FROM webhook_subscriptions
+			WHERE address IN UNNEST(@addresses)
+				OR (address IS NULL AND user_id IN (
+					SELECT uuid FROM users WHERE EXISTS (SELECT 1 FROM UNNEST(SPLIT(addresses, ',')) AS a WHERE TRIM(a) IN UNNEST(@addresses))
+				))
+		`, strings.Join(webhookColumns, ", ")))
+	}
+	stmt.Params["addresses"] = addrs
+
+	webhookRecs, err := queryWebhooks(ctx, txn, stmt)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	mutations := []*spanner.Mutation{}
+
+	for _, webhook := range webhookRecs {
+		if !webhook.Wants(event.Type) {
+			continue
+		}
+
+		delivery, err := newDelivery(webhook, event, now)
+		if err != nil {
+			return err
+		}
+
+		mut, err := spanner.InsertStruct(webhookDeliveriesTable, delivery)
+		if err != nil {
+			return err
+		}
+
+		mutations = append(mutations, mut)
+	}
+
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	logging.FromContext(ctx).Debug("queued webhook deliveries", "event", event.Type, "event_id", event.ID, "deliveries", len(mutations))
+
+	return txn.BufferWrite(mutations)
+}
+
+// TransactionsEventData is the data of transactions.new and transactions.reorged events
+type TransactionsEventData struct {
+	Transactions []*TransactionsRecord `json:"transactions"`
+}
+
+// BalanceEventData is the data of balance.changed events
+type BalanceEventData struct {
+	PreviousNativeBalance int64   `json:"previous_native_balance"` // in satoshis
+	NativeBalance         int64   `json:"native_balance"`          // in satoshis
+	Balance               float64 `json:"balance"`                 // in USD
+}
+
+// TransferEventData is the data of transfer.detected events
+type TransferEventData struct {
+	OutID string `json:"out_id"` // the activity ID of the withdrawing side
+	InID  string `json:"in_id"`  // the activity ID of the depositing side
+}
+
+// queueSyncEvents queues the events of an address sync: the transactions it stored, the change to the address'
+// balance and the transactions it found reorged out (whichever happened)
+func queueSyncEvents(ctx context.Context, txn *spanner.ReadWriteTransaction, address *AddressesRecord, previousBalance spanner.NullInt64, added, reorged []*TransactionsRecord) error {
+	addrs := []string{address.PublicKey}
+	events := []*webhooks.Event{}
+
+	queue := func(eventType string, data interface{}) error {
+		event, err := newWebhookEvent(eventType, address.PublicKey, data)
+		if err != nil {
+			return err
+		}
+
+		events = append(events, event)
+		return nil
+	}
+
+	if len(added) > 0 {
+		if err := queue(webhooks.EventTransactionsNew, &TransactionsEventData{Transactions: added}); err != nil {
+			return err
+		}
+	}
+
+	if previousBalance.Int64 != address.NativeBalance {
+		data := &BalanceEventData{PreviousNativeBalance: previousBalance.Int64, NativeBalance: address.NativeBalance, Balance: address.Balance}
+		if err := queue(webhooks.EventBalanceChanged, data); err != nil {
+			return err
+		}
+	}
+
+	if len(reorged) > 0 {
+		if err := queue(webhooks.EventTransactionsReorged, &TransactionsEventData{Transactions: reorged}); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range events {
+		if err := enqueueWebhookEvent(ctx, txn, event, "", addrs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// webhookDispatcher sends the deliveries queued by enqueueWebhookEvent, retrying the failed ones with backoff
+type webhookDispatcher struct {
+	s      *spanner.Client
+	sender *webhooks.Sender
+}
+
+// deliverWebhooksEvery sends the deliveries that are due each interval of the provided job, recording each run in the
+// job's status. It returns once the stop channel is closed, finishing the delivery it's sending (if any) first, unless
+// the provided context is done.
+func (d *webhookDispatcher) deliverWebhooksEvery(ctx context.Context, stop <-chan struct{}, job *health.JobStatus) {
+	log := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(job.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stmt := spanner.NewStatement(`
+			SELECT subscription_id, delivery_id
+			FROM webhook_deliveries
+			WHERE status = @status AND next_attempt_at <= CURRENT_TIMESTAMP()
+			ORDER BY next_attempt_at
+			LIMIT @limit
+		`)
+		stmt.Params["status"] = deliveryPending
+		stmt.Params["limit"] = webhookBatchSize
+
+		keys := []spanner.Key{}
+		err := d.s.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var subscriptionID, deliveryID string
+			if err := row.Columns(&subscriptionID, &deliveryID); err != nil {
+				return err
+			}
+
+			keys = append(keys, spanner.Key{subscriptionID, deliveryID})
+			return nil
+		})
+
+		if err != nil {
+			log.Error("could not list webhook deliveries to send", "error", err)
+			continue
+		}
+
+		for i, key := range keys {
+			select {
+			case <-stop:
+				log.Info("stopped sending webhook deliveries", "remaining", len(keys)-i)
+				return
+			default:
+			}
+
+			if err := d.deliver(ctx, key); err != nil {
+				log.Error("could not send webhook delivery", "subscription_id", key[0], "delivery_id", key[1], "error", err)
+			}
+		}
+
+		job.Ran(time.Now())
+	}
+}
+
+// deliver makes an attempt at the delivery with the provided key, unless another dispatcher got to it first,
+// recording its outcome in the delivery log
+func (d *webhookDispatcher) deliver(ctx context.Context, key spanner.Key) error {
+	var webhook *WebhookSubscriptionsRecord
+	var delivery *WebhookDeliveriesRecord
+
+	// claim the delivery by pushing its next attempt back, so that nothing else sends it while we do
+	_, err := readWriteTransaction(ctx, d.s, "claim_webhook_delivery", func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		webhook, delivery = nil, nil
+
+		row, err := txn.ReadRow(ctx, webhookDeliveriesTable, key, deliveryColumns)
+		if err != nil {
+			return err
+		}
+
+		var rec WebhookDeliveriesRecord
+		if err := row.ToStruct(&rec); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if rec.Status != deliveryPending || rec.NextAttemptAt.Time.After(now) {
+			return nil
+		}
+
+		row, err = txn.ReadRow(ctx, webhookSubscriptionsTable, spanner.Key{rec.SubscriptionID}, webhookColumns)
+		if err != nil {
+			return err
+		}
+
+		var sub WebhookSubscriptionsRecord
+		if err := row.ToStruct(&sub); err != nil {
+			return err
+		}
+
+		webhook, delivery = &sub, &rec
+
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update(webhookDeliveriesTable, []string{"subscription_id", "delivery_id", "next_attempt_at"}, []interface{}{rec.SubscriptionID, rec.DeliveryID, now.Add(webhookLease)}),
+		})
+	})
+
+	if err != nil || delivery == nil {
+		return err
+	}
+
+	result, sendErr := d.sender.Send(ctx, webhook.URL, webhook.Secret, delivery.DeliveryID, delivery.EventType, []byte(delivery.Payload))
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = spanner.NullTime{Time: now, Valid: true}
+	delivery.LastStatusCode = spanner.NullInt64{Int64: int64(result.StatusCode), Valid: result.StatusCode != 0}
+	delivery.LastError = spanner.NullString{}
+
+	outcome := deliveryDelivered
+	switch {
+	case sendErr == nil:
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = spanner.NullTime{Time: now, Valid: true}
+		delivery.NextAttemptAt = spanner.NullTime{}
+	case delivery.Attempts >= webhooks.MaxAttempts:
+		outcome = deliveryFailed
+		delivery.Status = deliveryFailed
+		delivery.LastError = spanner.NullString{StringVal: sendErr.Error(), Valid: true}
+		delivery.NextAttemptAt = spanner.NullTime{}
+	default:
+		outcome = "retrying"
+		delivery.LastError = spanner.NullString{StringVal: sendErr.Error(), Valid: true}
+		delivery.NextAttemptAt = spanner.NullTime{Time: now.Add(webhooks.Backoff(int(delivery.Attempts))), Valid: true}
+	}
+
+	webhookDeliveries.Inc(delivery.EventType, outcome)
+	webhookDeliveryDuration.ObserveDuration(result.Duration, delivery.EventType)
+
+	logging.FromContext(ctx).Info("sent webhook delivery",
+		"subscription_id", delivery.SubscriptionID,
+		"delivery_id", delivery.DeliveryID,
+		"event", delivery.EventType,
+		"attempt", delivery.Attempts,
+		"status_code", result.StatusCode,
+		"outcome", outcome,
+		"duration_ms", result.Duration,
+	)
+
+	mut, err := spanner.UpdateStruct(webhookDeliveriesTable, delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.s.Apply(ctx, []*spanner.Mutation{mut})
+	return err
+}
@@ -0,0 +1,90 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Delivery is a delivery received by a Receiver
+type Delivery struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Event      *Event    `json:"event"`
+}
+
+// Receiver is a local subscriber for testing subscriptions: it verifies the signature of each delivery it's posted and
+// keeps the ones it accepts, optionally failing a share of them to exercise retries. It's safe for concurrent use.
+type Receiver struct {
+	secret   string
+	failRate float64
+	onEvent  func(*Delivery)
+
+	mu         sync.RWMutex
+	deliveries []*Delivery
+}
+
+// NewReceiver returns a new Receiver verifying deliveries with the provided secret, answering the provided share of
+// them (between 0 and 1) with a 503, and calling onEvent (if not nil) with each one it accepts
+func NewReceiver(secret string, failRate float64, onEvent func(*Delivery)) *Receiver {
+	return &Receiver{secret: secret, failRate: failRate, onEvent: onEvent}
+}
+
+// Deliveries returns the deliveries accepted so far, oldest first
+func (r *Receiver) Deliveries() []*Delivery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*Delivery{}, r.deliveries...)
+}
+
+// ServeHTTP accepts POSTed deliveries, and lists the accepted ones on a GET
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Deliveries())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := Verify(r.secret, req.Header.Get(SignatureHeader), body, DefaultTolerance); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if r.failRate > 0 && rand.Float64() < r.failRate {
+		http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "delivery is not a valid event", http.StatusBadRequest)
+		return
+	}
+
+	delivery := &Delivery{ID: req.Header.Get(DeliveryHeader), ReceivedAt: time.Now().UTC(), Event: &event}
+
+	r.mu.Lock()
+	r.deliveries = append(r.deliveries, delivery)
+	r.mu.Unlock()
+
+	if r.onEvent != nil {
+		r.onEvent(delivery)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for subscriber URLs that resolve to an address that isn't publicly routable, e.g. a
+// loopback, private network, link-local or cloud metadata (169.254.169.254) one
+var ErrPrivateAddress = errors.New("url resolves to an address that isn't publicly routable")
+
+// the non-public ranges the standard library doesn't have a check for
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved, including broadcast
+	"64:ff9b::/96",  // NAT64, which can reach any IPv4 address
+)
+
+// IsPublicIP reports whether the provided IP is publicly routable, i.e. safe for a subscriber to resolve to
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, v := range reservedNets {
+		if v.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckURL validates a subscriber URL: it has to be an absolute http(s) URL and, unless allowPrivate is set (e.g. to
+// test against a local Receiver), every address its host resolves to has to be publicly routable
+func CheckURL(ctx context.Context, rawURL string, allowPrivate bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+
+	if allowPrivate {
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve url host %s: %w", u.Hostname(), err)
+	}
+
+	for _, v := range ips {
+		if !IsPublicIP(v.IP) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, v.IP)
+		}
+	}
+
+	return nil
+}
+
+// publicOnly is a net.Dialer control function refusing to connect to addresses that aren't publicly routable. It
+// checks the address actually dialed, so a subscriber's DNS changing after CheckURL (or a redirect) can't get around it.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); !IsPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+
+	return nil
+}
+
+// mustParseCIDRs parses the provided CIDRs, panicking if any is invalid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, v := range cidrs {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
@@ -0,0 +1,82 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fd00:ec2::254", false},   // AWS' IPv6 metadata
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		wantErr      bool
+		wantPrivate  bool
+	}{
+		{"http://127.0.0.1:8082", false, true, true},
+		{"http://169.254.169.254/latest/meta-data", false, true, true},
+		{"http://[::1]/hook", false, true, true},
+		{"http://127.0.0.1:8082", true, false, false},
+		{"ftp://example.com", false, true, false},
+		{"/relative", true, true, false},
+	}
+
+	for _, tt := range tests {
+		err := CheckURL(context.Background(), tt.url, tt.allowPrivate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckURL(%s, %v) = %v, want error: %v", tt.url, tt.allowPrivate, err, tt.wantErr)
+		}
+
+		if errors.Is(err, ErrPrivateAddress) != tt.wantPrivate {
+			t.Errorf("CheckURL(%s, %v) = %v, want ErrPrivateAddress: %v", tt.url, tt.allowPrivate, err, tt.wantPrivate)
+		}
+	}
+}
+
+func TestSenderRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if _, err := NewSender(time.Second, false).Send(context.Background(), srv.URL, "secret", "d1", EventPing, []byte("{}")); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("Send to %s = %v, want ErrPrivateAddress", srv.URL, err)
+	}
+
+	if _, err := NewSender(time.Second, true).Send(context.Background(), srv.URL, "secret", "d2", EventPing, []byte("{}")); err != nil {
+		t.Errorf("Send to %s allowing private addresses = %v, want nil", srv.URL, err)
+	}
+}
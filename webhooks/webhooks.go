@@ -0,0 +1,242 @@
+// Package webhooks signs & delivers events to the URLs subscribed to them, and verifies their signatures on the
+// receiving end (see Receiver).
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jf2978/cointracker-eng-assignment/tracing"
+)
+
+// the types of event delivered to subscribers
+const (
+	EventTransactionsNew     = "transactions.new"     // a sync stored new transactions of an address
+	EventBalanceChanged      = "balance.changed"      // a sync changed an address' balance
+	EventTransferDetected    = "transfer.detected"    // transfer detection linked a new transfer between a user's wallets
+	EventTransactionsReorged = "transactions.reorged" // a sync found stored transactions were reorged out of the chain
+	EventPing                = "ping"                 // sent on demand, to test a subscription
+)
+
+// EventTypes lists every type of event that can be subscribed to
+var EventTypes = []string{EventTransactionsNew, EventBalanceChanged, EventTransferDetected, EventTransactionsReorged, EventPing}
+
+// the headers of every delivery
+const (
+	SignatureHeader = "X-Cointracker-Signature" // t=<unix timestamp>,v1=<hex-encoded HMAC-SHA256 of "<t>.<body>">
+	EventHeader     = "X-Cointracker-Event"     // the event's type
+	DeliveryHeader  = "X-Cointracker-Delivery"  // the delivery's ID, the same across its attempts
+)
+
+const (
+	// DefaultTimeout bounds how long a subscriber has to answer a delivery
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultTolerance is how old a delivery's signature can be before Verify rejects it (against replays)
+	DefaultTolerance = 5 * time.Minute
+
+	// MaxAttempts is how many times a delivery is attempted before it's given up on
+	MaxAttempts = 8
+
+	// the delay before the second attempt, doubling with each one after it up to maxBackoff (i.e. about 20 minutes
+	// across all of them)
+	baseBackoff = 10 * time.Second
+	maxBackoff  = 15 * time.Minute
+
+	// maxResponseBody is how much of a subscriber's response is kept in the delivery log
+	maxResponseBody = 1024
+)
+
+// the errors returned by Verify
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("signature doesn't match")
+	ErrExpiredSignature = errors.New("signature is too old")
+)
+
+// Event is the body of every delivery
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	UserID    string      `json:"user_id,omitempty"`
+	Address   string      `json:"address,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// IsEventType reports whether the provided string is one of EventTypes
+func IsEventType(v string) bool {
+	for _, t := range EventTypes {
+		if t == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Backoff returns how long to wait after the provided (1-indexed) attempt failed before attempting again
+func Backoff(attempt int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxBackoff {
+		return maxBackoff
+	}
+
+	return d
+}
+
+// Sign returns the signature header of the provided body, signed with the provided secret at the provided time
+func Sign(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac(secret, t, body))
+}
+
+// Verify checks the provided signature header against the provided body & secret, rejecting signatures older than
+// the provided tolerance (unless it's 0)
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	if len(header) == 0 {
+		return ErrMissingSignature
+	}
+
+	var t string
+	signatures := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			if sig, err := hex.DecodeString(kv[1]); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrMissingSignature
+	}
+
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return ErrExpiredSignature
+	}
+
+	expected := mac(secret, t, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// mac returns the HMAC-SHA256 of "<t>.<body>" keyed by the provided secret
+func mac(secret, t string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Result is the outcome of a single delivery attempt
+type Result struct {
+	StatusCode int           // 0 if no response was received
+	Body       string        // the start of the response body
+	Duration   time.Duration // how long the subscriber took to answer
+}
+
+// OK reports whether the subscriber accepted the delivery, i.e. answered with a 2xx
+func (r *Result) OK() bool {
+	return r.StatusCode >= 200 && r.StatusCode <= 299
+}
+
+// Sender posts signed deliveries to subscribers
+type Sender struct {
+	client       *http.Client
+	allowPrivate bool
+}
+
+// NewSender returns a new Sender, giving subscribers the provided timeout to answer. Unless allowPrivate is set (e.g.
+// to test against a local Receiver), it refuses to connect to addresses that aren't publicly routable (see CheckURL).
+func NewSender(timeout time.Duration, allowPrivate bool) *Sender {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = publicOnly
+	}
+
+	// no proxy, since the address checked would be the proxy's rather than the subscriber's
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &Sender{client: &http.Client{Timeout: timeout, Transport: transport}, allowPrivate: allowPrivate}
+}
+
+// CheckURL validates a subscriber URL the Sender is to deliver to (see CheckURL)
+func (s *Sender) CheckURL(ctx context.Context, rawURL string) error {
+	return CheckURL(ctx, rawURL, s.allowPrivate)
+}
+
+// Send posts the provided (JSON-encoded) event to the provided URL, signed with the provided secret, returning an
+// error unless the subscriber answered with a 2xx. The result describes whatever response was received either way.
+func (s *Sender) Send(ctx context.Context, url, secret, deliveryID, eventType string, body []byte) (result *Result, err error) {
+	ctx, span := tracing.Start(ctx, "webhooks.send", "event", eventType, "delivery_id", deliveryID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &Result{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cointracker-webhooks")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), body))
+	tracing.Inject(ctx, req.Header)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &Result{Duration: time.Since(start)}, err
+	}
+	defer resp.Body.Close()
+
+	raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	result = &Result{StatusCode: resp.StatusCode, Body: string(raw), Duration: time.Since(start)}
+	span.SetAttributes("status", resp.StatusCode)
+
+	if !result.OK() {
+		return result, fmt.Errorf("subscriber answered %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return result, nil
+}
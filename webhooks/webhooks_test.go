@@ -0,0 +1,100 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// the same vector subscribers can check their own verification against
+	got := Sign("whsec_test", time.Unix(1600000000, 0), []byte(`{"id":"evt_1"}`))
+	want := "t=1600000000,v1=82ecd22cd24413c7080aa1dea2190d4fd696e35a65768c823133e93b6bf823ab"
+
+	if got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Now()
+	signed := Sign("whsec_test", now, body)
+
+	if err := Verify("whsec_test", signed, body, DefaultTolerance); err != nil {
+		t.Errorf("Verify() of a fresh signature = %v", err)
+	}
+
+	if err := Verify("whsec_test", signed, []byte(`{"id":"evt_2"}`), DefaultTolerance); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() of a tampered body = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	// while a secret is rotated, deliveries carry a signature with each and either one verifies
+	rotated := Sign("whsec_other", now, body) + "," + strings.Split(signed, ",")[1]
+	if err := Verify("whsec_test", rotated, body, DefaultTolerance); err != nil {
+		t.Errorf("Verify() among rotated secrets = %v", err)
+	}
+
+	if err := Verify("whsec_test", Sign("whsec_other", now, body), body, DefaultTolerance); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with another secret = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	for _, header := range []string{"", "v1=00", "t=1600000000", "t=soon,v1=00"} {
+		if err := Verify("whsec_test", header, body, DefaultTolerance); !errors.Is(err, ErrMissingSignature) {
+			t.Errorf("Verify(%q) = %v, want %v", header, err, ErrMissingSignature)
+		}
+	}
+
+	old := Sign("whsec_test", now.Add(-time.Hour), body)
+	if err := Verify("whsec_test", old, body, DefaultTolerance); !errors.Is(err, ErrExpiredSignature) {
+		t.Errorf("Verify() of an hour old signature = %v, want %v", err, ErrExpiredSignature)
+	}
+
+	if err := Verify("whsec_test", old, body, 0); err != nil {
+		t.Errorf("Verify() of an hour old signature without a tolerance = %v", err)
+	}
+}
+
+func TestSendToReceiver(t *testing.T) {
+	receiver := NewReceiver("whsec_test", 0, nil)
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	sender := NewSender(time.Second, true)
+	body := []byte(`{"id":"evt_1","type":"ping","created_at":"2021-01-01T00:00:00Z","data":{}}`)
+
+	result, err := sender.Send(context.Background(), srv.URL, "whsec_test", "dlv_1", EventPing, body)
+	if err != nil || !result.OK() {
+		t.Fatalf("Send() = %+v, %v", result, err)
+	}
+
+	deliveries := receiver.Deliveries()
+	if len(deliveries) != 1 || deliveries[0].ID != "dlv_1" || deliveries[0].Event.ID != "evt_1" {
+		t.Errorf("Receiver.Deliveries() = %+v, want evt_1 delivered as dlv_1", deliveries)
+	}
+
+	// the receiver turns away deliveries signed with a stale secret
+	result, err = sender.Send(context.Background(), srv.URL, "whsec_old", "dlv_2", EventPing, body)
+	if err == nil || result.StatusCode != 401 {
+		t.Errorf("Send() with the wrong secret = %+v, %v, want a 401", result, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	// doubling from 10 seconds...
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 7: 640 * time.Second} {
+		if got := Backoff(attempt); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	// ...up to maxBackoff
+	for _, attempt := range []int{8, 20} {
+		if got := Backoff(attempt); got != maxBackoff {
+			t.Errorf("Backoff(%d) = %v, want %v", attempt, got, maxBackoff)
+		}
+	}
+}